@@ -2,15 +2,20 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"flag"
 	"log"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/joho/godotenv"
+	amqp "github.com/rabbitmq/amqp091-go"
 	"github.com/tnqbao/gau-upload-service/consumer/topic"
 	"github.com/tnqbao/gau-upload-service/shared/config"
 	"github.com/tnqbao/gau-upload-service/shared/infra"
+	"github.com/tnqbao/gau-upload-service/shared/repository"
 )
 
 const (
@@ -18,6 +23,10 @@ const (
 	ChunkCompleteQueue = "upload.chunk_complete"
 	ConsumerTag        = "gau-upload-consumer"
 
+	// ImageVariantsQueue receives upload.created events from the HTTP service to generate image variants
+	ImageVariantsQueue       = "upload.image_variants"
+	ImageVariantsConsumerTag = "gau-upload-image-variants"
+
 	// Exchange and routing keys
 	UploadExchange             = "upload.exchange"
 	ChunkCompleteRoutingKey    = "upload.chunk_complete"
@@ -32,6 +41,19 @@ func main() {
 
 	// Initialize configuration
 	cfg := config.NewConfig()
+
+	// Subcommands run once and exit instead of starting the consumer
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "reconcile":
+			runReconcile(cfg, os.Args[2:])
+			return
+		case "migrate-schema":
+			runMigrateSchema(cfg)
+			return
+		}
+	}
+
 	log.Printf("Consumer service starting with config: %+v", cfg.EnvConfig.Environment)
 
 	// Initialize infrastructure for consumer (requires RabbitMQ)
@@ -63,8 +85,20 @@ func main() {
 		log.Fatalf("Failed to bind compose_completed queue: %v", err)
 	}
 
+	// Declare and bind image_variants queue
+	if err := inf.RabbitMQ.DeclareQueue(ImageVariantsQueue, true, false); err != nil {
+		log.Fatalf("Failed to declare image_variants queue: %v", err)
+	}
+	if err := inf.RabbitMQ.BindQueue(ImageVariantsQueue, UploadExchange, repository.UploadCreatedRoutingKey); err != nil {
+		log.Fatalf("Failed to bind image_variants queue: %v", err)
+	}
+
 	// Create chunk complete handler
-	handler := topic.NewChunkCompleteHandler(inf)
+	// The consumer only writes Parquet metadata: the bolt backend is locked by the HTTP service,
+	// and buckets without a usage counter yet count as empty until it writes to them
+	metadata, usage := repository.NewConsumerMetadata(cfg, inf)
+	handler := topic.NewChunkCompleteHandler(inf, cfg.Policy, metadata, usage)
+	variantHandler := topic.NewImageVariantHandler(inf, cfg.EnvConfig.Limit.ImageMaxSize)
 
 	// Start consuming chunk_complete messages
 	msgs, err := inf.RabbitMQ.Consume(ChunkCompleteQueue, ConsumerTag)
@@ -72,10 +106,28 @@ func main() {
 		log.Fatalf("Failed to start consuming: %v", err)
 	}
 
+	variantMsgs, err := inf.RabbitMQ.Consume(ImageVariantsQueue, ImageVariantsConsumerTag)
+	if err != nil {
+		log.Fatalf("Failed to start consuming image variants: %v", err)
+	}
+
 	// Setup graceful shutdown
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	go consumeImageVariants(ctx, variantMsgs, variantHandler)
+
+	// Periodically compact Parquet metadata delta segments, which only the parquet backend writes
+	if interval := cfg.EnvConfig.Metadata.CompactionInterval; interval > 0 && cfg.EnvConfig.Metadata.Backend == "parquet" {
+		go runMetadataCompaction(ctx, inf.ParquetService, interval)
+	}
+
+	// Periodically delete abandoned uploads and expired records from the pending bucket
+	if interval := cfg.EnvConfig.Upload.PendingSweepInterval; interval > 0 {
+		sweeper := repository.NewPendingSweeper(inf.MinioClient, cfg.EnvConfig.Upload.PendingIdleTTL)
+		go runPendingSweep(ctx, sweeper, interval)
+	}
+
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 
@@ -121,3 +173,133 @@ func main() {
 	cancel()
 	log.Println("Consumer service stopped gracefully")
 }
+
+// consumeImageVariants generates the image variants of upload.created events until ctx is cancelled
+func consumeImageVariants(ctx context.Context, msgs <-chan amqp.Delivery, handler *topic.ImageVariantHandler) {
+	log.Printf("Consumer started. Listening for upload.created messages on queue: %s", ImageVariantsQueue)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg, ok := <-msgs:
+			if !ok {
+				log.Println("Image variants message channel closed")
+				return
+			}
+
+			if err := handler.HandleUploadCreated(ctx, msg.Body); err != nil {
+				log.Printf("Error processing upload.created message: %v", err)
+				// Requeue once for transient failures; after that, uploading the content again
+				// republishes the event for any variant still missing
+				if nackErr := msg.Nack(false, !msg.Redelivered); nackErr != nil {
+					log.Printf("Failed to nack message: %v", nackErr)
+				}
+				continue
+			}
+
+			if err := msg.Ack(false); err != nil {
+				log.Printf("Failed to ack message: %v", err)
+			}
+		}
+	}
+}
+
+// runMetadataCompaction merges Parquet metadata delta segments on a fixed interval until ctx is cancelled
+// Running it on several consumer replicas is safe; base segments are replaced with conditional writes
+func runMetadataCompaction(ctx context.Context, parquetService *infra.ParquetService, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	log.Printf("Metadata compaction scheduled every %v", interval)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			result, err := parquetService.Compact(ctx)
+			if err != nil {
+				log.Printf("Metadata compaction failed: %v", err)
+				continue
+			}
+			log.Printf("Metadata compaction completed: %d partitions, %d deltas merged, %d rows",
+				result.Partitions, result.DeltasMerged, result.Rows)
+		}
+	}
+}
+
+// runPendingSweep cleans the pending bucket on a fixed interval until ctx is cancelled
+// Running it on several consumer replicas is safe; only objects past their TTL are deleted
+func runPendingSweep(ctx context.Context, sweeper *repository.PendingSweeper, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	log.Printf("Pending bucket sweep scheduled every %v", interval)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			result, err := sweeper.Sweep(ctx)
+			if err != nil {
+				log.Printf("Pending bucket sweep failed: %v", err)
+			}
+			if len(result.Deleted) > 0 {
+				log.Printf("Pending bucket sweep deleted: %v", result.Deleted)
+			}
+		}
+	}
+}
+
+// runReconcile implements `consumer reconcile [-bucket name] [-dry-run]`
+// It prints progress while scanning and the JSON report on stdout when done
+func runReconcile(cfg *config.Config, args []string) {
+	flags := flag.NewFlagSet("reconcile", flag.ExitOnError)
+	bucket := flags.String("bucket", "", "only reconcile this bucket (default: every bucket)")
+	dryRun := flags.Bool("dry-run", false, "report changes without applying them")
+	_ = flags.Parse(args)
+
+	// The bolt database is held by the HTTP service, which reconciles it through its admin endpoint
+	if cfg.EnvConfig.Metadata.Backend == "bolt" {
+		log.Fatalf("Reconciliation of the bolt metadata backend must run through POST /admin/metadata/reconcile")
+	}
+
+	// RabbitMQ is not needed to reconcile
+	inf := infra.InitInfra(cfg)
+	repo := repository.NewRepository(cfg, inf)
+
+	reconciler := repository.NewReconciler(inf.MinioClient, repo.Metadata, repo.Blobs)
+	report, err := reconciler.Reconcile(context.Background(), repository.ReconcileOptions{
+		Bucket: *bucket,
+		DryRun: *dryRun,
+		Progress: func(progress repository.ReconcileProgress) {
+			log.Printf("[%s] %s %d/%d", progress.Bucket, progress.Phase, progress.Done, progress.Total)
+		},
+	})
+	if report != nil {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		_ = encoder.Encode(report)
+	}
+	if err != nil {
+		log.Fatalf("Reconciliation failed: %v", err)
+	}
+	log.Printf("Reconciliation completed: %d pruned, %d backfilled, %d blobs collected, %d errors (dry run: %t)",
+		len(report.Pruned), len(report.Backfilled), len(report.Collected), len(report.Errors), *dryRun)
+}
+
+// runMigrateSchema implements `consumer migrate-schema`, rewriting Parquet metadata to the latest schema
+func runMigrateSchema(cfg *config.Config) {
+	if cfg.EnvConfig.Metadata.Backend != "parquet" {
+		log.Fatalf("Schema migration only applies to the parquet metadata backend, not %s", cfg.EnvConfig.Metadata.Backend)
+	}
+
+	// RabbitMQ is not needed to migrate
+	inf := infra.InitInfra(cfg)
+
+	result, err := inf.ParquetService.MigrateSchema(context.Background())
+	if err != nil {
+		log.Fatalf("Schema migration failed: %v", err)
+	}
+	log.Printf("Schema migration to version %d completed: %d of %d segments rewritten, %d rows (legacy migrated: %t)",
+		infra.CurrentSchemaVersion, result.Rewritten, result.Segments, result.Rows, result.LegacyMigrated)
+}
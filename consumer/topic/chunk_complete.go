@@ -8,12 +8,14 @@ import (
 	"fmt"
 	"io"
 	"log"
-	"path/filepath"
 	"sort"
 	"strings"
 	"time"
 
+	"github.com/tnqbao/gau-upload-service/shared/config"
 	"github.com/tnqbao/gau-upload-service/shared/infra"
+	"github.com/tnqbao/gau-upload-service/shared/repository"
+	"github.com/tnqbao/gau-upload-service/shared/utils"
 )
 
 // ChunkCompleteMessage is received from cloud-orchestrator when all chunks are uploaded
@@ -31,6 +33,8 @@ type ChunkCompleteMessage struct {
 	TotalChunks  int               `json:"total_chunks"`
 	TargetBucket string            `json:"target_bucket"`
 	TargetPath   string            `json:"target_path"`
+	NameTemplate string            `json:"name_template"` // optional, overrides the target bucket's template
+	OnConflict   string            `json:"on_conflict"`   // optional, what to do when the final path holds other content, overwrite by default
 	Metadata     map[string]string `json:"metadata"`
 	Timestamp    int64             `json:"timestamp"`
 }
@@ -46,6 +50,7 @@ type ComposeCompletedMessage struct {
 	ContentType string `json:"content_type"`
 	FileName    string `json:"file_name"`
 	CustomPath  string `json:"custom_path"`
+	Skipped     bool   `json:"skipped"` // on_conflict=skip kept the file already at file_path
 	Success     bool   `json:"success"`
 	Error       string `json:"error"`
 	Timestamp   int64  `json:"timestamp"`
@@ -53,14 +58,37 @@ type ComposeCompletedMessage struct {
 
 // ChunkCompleteHandler handles chunk_complete messages from cloud-orchestrator
 type ChunkCompleteHandler struct {
-	infra *infra.Infra
+	infra    *infra.Infra
+	policy   *config.UploadPolicy
+	metadata infra.MetadataStore // records composed files and their usage; nil leaves them to reconciliation
+	usage    *repository.UsageStore
+	claims   *repository.ClaimStore
+	blobs    *repository.BlobStore // stores composed files like HTTP uploads; nil without metadata
 }
 
-// NewChunkCompleteHandler creates a new chunk complete handler
-func NewChunkCompleteHandler(infra *infra.Infra) *ChunkCompleteHandler {
-	return &ChunkCompleteHandler{
-		infra: infra,
+// composeResult describes a composed upload once stored
+type composeResult struct {
+	hash    string
+	size    int64
+	path    string
+	skipped bool // on_conflict=skip kept the file already at path
+}
+
+// NewChunkCompleteHandler creates a new chunk complete handler; policy provides the name
+// templates and quotas of target buckets, checked against usage
+func NewChunkCompleteHandler(infra *infra.Infra, policy *config.UploadPolicy, metadata infra.MetadataStore, usage *repository.UsageStore) *ChunkCompleteHandler {
+	claims := repository.NewClaimStore(infra.MinioClient)
+	handler := &ChunkCompleteHandler{
+		infra:    infra,
+		policy:   policy,
+		metadata: metadata,
+		usage:    usage,
+		claims:   claims,
 	}
+	if metadata != nil {
+		handler.blobs = repository.NewBlobStore(infra.MinioClient, metadata, claims)
+	}
+	return handler
 }
 
 // HandleChunkComplete processes a chunk_complete message
@@ -82,15 +110,15 @@ func (h *ChunkCompleteHandler) HandleChunkComplete(ctx context.Context, body []b
 		msg.UploadID, msg.FileName, msg.TotalChunks, msg.TargetBucket, msg.TargetPath)
 
 	// Process compose and get result
-	fileHash, fileSize, err := h.composeAndUpload(ctx, &msg)
+	result, err := h.composeAndUpload(ctx, &msg)
 
 	// Prepare response message
 	response := ComposeCompletedMessage{
 		UploadID:    msg.UploadID,
 		BucketID:    msg.BucketID,
 		UserID:      msg.UserID,
-		FileHash:    fileHash,
-		FileSize:    fileSize,
+		FileHash:    result.hash,
+		FileSize:    result.size,
 		ContentType: msg.ContentType,
 		FileName:    msg.FileName,
 		CustomPath:  msg.CustomPath,
@@ -102,15 +130,10 @@ func (h *ChunkCompleteHandler) HandleChunkComplete(ctx context.Context, body []b
 		response.Error = err.Error()
 		log.Printf("[ChunkComplete] Failed to compose upload %s: %v", msg.UploadID, err)
 	} else {
-		// Construct final file path using original filename (no hash)
-		fileName := msg.FileName
-		if msg.CustomPath != "" {
-			response.FilePath = fmt.Sprintf("%s/%s", msg.CustomPath, fileName)
-		} else {
-			response.FilePath = fileName
-		}
+		response.FilePath = result.path
+		response.Skipped = result.skipped
 		log.Printf("[ChunkComplete] Successfully composed upload %s -> %s (hash: %s, size: %d)",
-			msg.UploadID, response.FilePath, fileHash, fileSize)
+			msg.UploadID, response.FilePath, result.hash, result.size)
 	}
 
 	// Publish compose_completed message back to cloud-orchestrator
@@ -125,12 +148,28 @@ func (h *ChunkCompleteHandler) HandleChunkComplete(ctx context.Context, body []b
 }
 
 // composeAndUpload streams chunks, calculates hash, and uploads to target bucket
-func (h *ChunkCompleteHandler) composeAndUpload(ctx context.Context, msg *ChunkCompleteMessage) (string, int64, error) {
+func (h *ChunkCompleteHandler) composeAndUpload(ctx context.Context, msg *ChunkCompleteMessage) (composeResult, error) {
+	onConflict, err := repository.ParseOnConflict(msg.OnConflict)
+	if err != nil {
+		return composeResult{}, err
+	}
+
+	// Only compose files that fit in the quotas of the target bucket and the user
+	if h.policy != nil && h.usage != nil {
+		if err := h.usage.Check(ctx, h.policy, repository.UsageChange{Next: infra.FileMetadata{
+			BucketName: msg.TargetBucket,
+			FileSize:   msg.FileSize,
+			UserID:     msg.UserID,
+		}}); err != nil {
+			return composeResult{}, err
+		}
+	}
+
 	// 1. List all chunks from pending bucket
 	chunkPrefix := msg.TempPrefix // e.g., "{upload_id}/"
 	allObjects, err := h.infra.MinioClient.ListObjectsFromBucket(ctx, msg.TempBucket, chunkPrefix)
 	if err != nil {
-		return "", 0, fmt.Errorf("failed to list chunks: %w", err)
+		return composeResult{}, fmt.Errorf("failed to list chunks: %w", err)
 	}
 
 	// Filter out folder markers and non-chunk files
@@ -151,11 +190,11 @@ func (h *ChunkCompleteHandler) composeAndUpload(ctx context.Context, msg *ChunkC
 	}
 
 	if len(chunks) == 0 {
-		return "", 0, fmt.Errorf("no chunks found in %s/%s", msg.TempBucket, chunkPrefix)
+		return composeResult{}, fmt.Errorf("no chunks found in %s/%s", msg.TempBucket, chunkPrefix)
 	}
 
 	if len(chunks) != msg.TotalChunks {
-		return "", 0, fmt.Errorf("chunk count mismatch: expected %d, found %d (total objects: %d)", msg.TotalChunks, len(chunks), len(allObjects))
+		return composeResult{}, fmt.Errorf("chunk count mismatch: expected %d, found %d (total objects: %d)", msg.TotalChunks, len(chunks), len(allObjects))
 	}
 
 	// 2. Sort chunks by name (chunk_00000.part, chunk_00001.part, ...)
@@ -205,10 +244,7 @@ func (h *ChunkCompleteHandler) composeAndUpload(ctx context.Context, msg *ChunkC
 	}()
 
 	// 4. Determine final file path
-	ext := filepath.Ext(msg.FileName)
-	if ext == "" {
-		ext = ".bin"
-	}
+	ext := utils.FileExtension(msg.FileName, msg.ContentType)
 
 	// We need to upload while streaming, but we don't have the hash yet
 	// So we'll upload to a temp location first, then rename after we have the hash
@@ -216,7 +252,7 @@ func (h *ChunkCompleteHandler) composeAndUpload(ctx context.Context, msg *ChunkC
 
 	// 5. Upload composed stream to target bucket
 	// Use the reader from pipe
-	metadata := map[string]string{
+	objectMetadata := map[string]string{
 		"original-name": msg.FileName,
 		"content-type":  msg.ContentType,
 		"upload-id":     msg.UploadID,
@@ -231,10 +267,10 @@ func (h *ChunkCompleteHandler) composeAndUpload(ctx context.Context, msg *ChunkC
 		pipeReader,
 		msg.FileSize, // Expected size
 		msg.ContentType,
-		metadata,
+		objectMetadata,
 	); err != nil {
 		pipeReader.Close()
-		return "", 0, fmt.Errorf("failed to upload composed file: %w", err)
+		return composeResult{}, fmt.Errorf("failed to upload composed file: %w", err)
 	}
 
 	// Wait for streaming goroutine to finish and get result
@@ -242,7 +278,7 @@ func (h *ChunkCompleteHandler) composeAndUpload(ctx context.Context, msg *ChunkC
 	if result.err != nil {
 		// Cleanup temp file
 		_ = h.infra.MinioClient.DeleteObject(ctx, msg.TargetBucket, tempUploadKey)
-		return "", 0, result.err
+		return composeResult{}, result.err
 	}
 
 	totalSize := result.totalSize
@@ -251,25 +287,30 @@ func (h *ChunkCompleteHandler) composeAndUpload(ctx context.Context, msg *ChunkC
 	fileHash := hex.EncodeToString(hasher.Sum(nil))
 	log.Printf("[ChunkComplete] Calculated hash: %s (total size: %d)", fileHash, totalSize)
 
-	// 7. Rename/copy temp file to final location with original filename (no hash)
-	fileName := msg.FileName
-	var finalPath string
-	if msg.CustomPath != "" {
-		finalPath = fmt.Sprintf("%s/%s", msg.CustomPath, fileName)
-	} else {
-		finalPath = fileName
-	}
-
-	// Copy from temp to final location
-	log.Printf("[ChunkComplete] Moving composed file to final location: %s/%s", msg.TargetBucket, finalPath)
-	if err := h.infra.MinioClient.CopyObject(ctx, msg.TargetBucket, tempUploadKey, msg.TargetBucket, finalPath); err != nil {
-		// Cleanup temp file
+	// 7. Move temp file to final location, named by template or with the original filename
+	finalPath, err := h.finalPath(msg, fileHash)
+	if err != nil {
 		_ = h.infra.MinioClient.DeleteObject(ctx, msg.TargetBucket, tempUploadKey)
-		return "", 0, fmt.Errorf("failed to move to final location: %w", err)
+		return composeResult{}, err
 	}
 
+	objectMetadata["file-hash"] = fileHash
+	stored := composeResult{hash: fileHash, size: totalSize}
+	stored.path, stored.skipped, err = h.store(ctx, msg, onConflict, tempUploadKey, finalPath, infra.FileMetadata{
+		FileHash:     fileHash,
+		BucketName:   msg.TargetBucket,
+		OriginalName: msg.FileName,
+		ContentType:  msg.ContentType,
+		FileSize:     totalSize,
+		UploadedAt:   time.Now(),
+		UserID:       msg.UserID,
+	}, objectMetadata)
+
 	// Delete temp file
 	_ = h.infra.MinioClient.DeleteObject(ctx, msg.TargetBucket, tempUploadKey)
+	if err != nil {
+		return composeResult{}, err
+	}
 
 	// 8. Cleanup chunks from pending bucket (async)
 	go func() {
@@ -282,7 +323,93 @@ func (h *ChunkCompleteHandler) composeAndUpload(ctx context.Context, msg *ChunkC
 		log.Printf("[ChunkComplete] Cleaned up %d chunks from %s/%s", len(chunks), msg.TempBucket, chunkPrefix)
 	}()
 
-	return fileHash, totalSize, nil
+	return stored, nil
+}
+
+// store moves the composed file at tempKey to finalPath, or to the path on_conflict picks. With a
+// metadata store, the path becomes a reference to the blob of its content like HTTP uploads, which
+// counts it against the quotas and releases the content the path referenced before. Without one,
+// the file is copied to the path and reconciliation records it. It returns the path holding the
+// file and whether on_conflict=skip kept the file already there.
+func (h *ChunkCompleteHandler) store(ctx context.Context, msg *ChunkCompleteMessage, onConflict, tempKey, finalPath string, meta infra.FileMetadata, objectMetadata map[string]string) (string, bool, error) {
+	if onConflict != repository.ConflictOverwrite {
+		path, claim, existing, err := h.claims.ClaimUploadPath(ctx, h.metadata, msg.TargetBucket, finalPath, onConflict, meta.FileHash)
+		if err != nil {
+			return "", false, err
+		}
+		if existing != nil {
+			log.Printf("[ChunkComplete] Kept existing file at %s/%s (on_conflict=skip)", msg.TargetBucket, path)
+			return path, true, nil
+		}
+		defer claim.Release(ctx)
+		finalPath = path
+	}
+
+	log.Printf("[ChunkComplete] Moving composed file to final location: %s/%s", msg.TargetBucket, finalPath)
+	if h.blobs == nil {
+		if err := h.infra.MinioClient.CopyObject(ctx, msg.TargetBucket, tempKey, msg.TargetBucket, finalPath); err != nil {
+			return "", false, fmt.Errorf("failed to move to final location: %w", err)
+		}
+		return finalPath, false, nil
+	}
+
+	meta.FilePath = finalPath
+	ref, err := h.blobs.PrepareCopy(ctx, meta, msg.TargetBucket, tempKey, objectMetadata)
+	if err != nil {
+		return "", false, fmt.Errorf("failed to move to final location: %w", err)
+	}
+	if err := h.blobs.Commit(ctx, []*repository.PendingReference{ref}); err != nil {
+		return "", false, fmt.Errorf("failed to record metadata: %w", err)
+	}
+	return finalPath, false, nil
+}
+
+// finalPath returns where a composed upload is stored inside its custom path: named by the name
+// template of the message or of the target bucket, like HTTP uploads, by hash when the target
+// bucket forces it, or with the original filename
+func (h *ChunkCompleteHandler) finalPath(msg *ChunkCompleteMessage, fileHash string) (string, error) {
+	fileName := msg.FileName
+	ext := utils.FileExtension(msg.FileName, msg.ContentType)
+
+	var policy config.BucketPolicy
+	if h.policy != nil {
+		policy = h.policy.For(msg.TargetBucket)
+	}
+	template := msg.NameTemplate
+	if template == "" {
+		template = policy.NameTemplate
+	}
+
+	switch {
+	case template != "":
+		if err := utils.ValidateNameTemplate(template); err != nil {
+			return "", fmt.Errorf("invalid name_template: %w", err)
+		}
+		if err := utils.CheckHashNaming(template, policy.HashNaming()); err != nil {
+			return "", fmt.Errorf("bucket %s names files by hash: %w", msg.TargetBucket, err)
+		}
+		fileName = utils.RenderNameTemplate(template, utils.NameTemplateValues{
+			Hash:         fileHash,
+			OriginalName: msg.FileName,
+			Ext:          ext,
+			Time:         time.Now(),
+		})
+		if fileName == "" {
+			return "", fmt.Errorf("name_template %q produced an empty name", template)
+		}
+	case policy.HashNaming():
+		fileName = fileHash + ext
+	}
+
+	finalPath := fileName
+	if msg.CustomPath != "" {
+		finalPath = fmt.Sprintf("%s/%s", msg.CustomPath, fileName)
+	}
+	// Blobs and variants are shared content that only the blob store writes
+	if repository.IsReservedKey(strings.TrimLeft(finalPath, "/")) {
+		return "", fmt.Errorf("path %s is inside _blobs/ or _variants/, which are reserved", finalPath)
+	}
+	return finalPath, nil
 }
 
 // publishComposeCompleted sends compose_completed message to cloud-orchestrator
@@ -0,0 +1,127 @@
+package topic
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"log"
+	"time"
+
+	"github.com/tnqbao/gau-upload-service/shared/infra"
+	"github.com/tnqbao/gau-upload-service/shared/repository"
+	"github.com/tnqbao/gau-upload-service/shared/utils"
+)
+
+// maxVariantSourcePixels bounds the decoded size of a source image (about 200MB as RGBA)
+const maxVariantSourcePixels = 50_000_000
+
+// ImageVariantHandler generates the image variants announced by upload.created events
+type ImageVariantHandler struct {
+	infra        *infra.Infra
+	maxImageSize int64
+}
+
+// NewImageVariantHandler creates a new image variant handler; larger images are skipped
+func NewImageVariantHandler(infra *infra.Infra, maxImageSize int64) *ImageVariantHandler {
+	return &ImageVariantHandler{
+		infra:        infra,
+		maxImageSize: maxImageSize,
+	}
+}
+
+// HandleUploadCreated processes an upload.created message
+// 1. Skip uploads without variants and variants that already exist
+// 2. Download and decode the source blob
+// 3. Resize to fit each variant box and upload it next to the other variants of the hash
+func (h *ImageVariantHandler) HandleUploadCreated(ctx context.Context, body []byte) error {
+	startTime := time.Now()
+
+	var event repository.UploadCreatedEvent
+	if err := json.Unmarshal(body, &event); err != nil {
+		return fmt.Errorf("failed to parse upload.created message: %w", err)
+	}
+	if len(event.Variants) == 0 {
+		return nil
+	}
+	if event.Bucket == "" || event.BlobKey == "" {
+		return fmt.Errorf("invalid message: bucket and blob_key are required")
+	}
+	if !utils.IsResizableImage(event.ContentType) || event.FileSize > h.maxImageSize {
+		log.Printf("[ImageVariants] Skipping %s/%s: %s of %d bytes is not resizable", event.Bucket, event.FilePath, event.ContentType, event.FileSize)
+		return nil
+	}
+
+	// Content shared by several paths only needs its variants once
+	var missing []repository.UploadVariant
+	for _, variant := range event.Variants {
+		exists, err := h.infra.MinioClient.ObjectExists(ctx, event.Bucket, variant.Key)
+		if err != nil {
+			return fmt.Errorf("failed to check variant %s: %w", variant.Key, err)
+		}
+		if !exists {
+			missing = append(missing, variant)
+		}
+	}
+	if len(missing) == 0 {
+		log.Printf("[ImageVariants] Variants of %s already exist", event.FileHash)
+		return nil
+	}
+
+	data, _, err := h.infra.MinioClient.GetObjectFromBucket(ctx, event.Bucket, event.BlobKey)
+	if err != nil {
+		if infra.IsNotFound(err) {
+			// The content was deleted before its variants were generated
+			log.Printf("[ImageVariants] Source %s/%s no longer exists", event.Bucket, event.BlobKey)
+			return nil
+		}
+		return fmt.Errorf("failed to download source image: %w", err)
+	}
+
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		log.Printf("[ImageVariants] Skipping %s: cannot decode image: %v", event.BlobKey, err)
+		return nil
+	}
+	if config.Width*config.Height > maxVariantSourcePixels {
+		log.Printf("[ImageVariants] Skipping %s: %dx%d is too large", event.BlobKey, config.Width, config.Height)
+		return nil
+	}
+	source, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		log.Printf("[ImageVariants] Skipping %s: cannot decode image: %v", event.BlobKey, err)
+		return nil
+	}
+
+	for _, variant := range missing {
+		width, height := utils.FitSize(config.Width, config.Height, variant.Size, variant.Size)
+		resized := utils.ResizeImage(source, width, height)
+
+		var buffer bytes.Buffer
+		if err := utils.EncodeImage(&buffer, resized, variant.Format, utils.DefaultImageQuality); err != nil {
+			return fmt.Errorf("failed to encode variant %s: %w", variant.Key, err)
+		}
+
+		metadata := map[string]string{
+			"file-hash": event.FileHash,
+			"variant":   fmt.Sprintf("%dx%d", width, height),
+		}
+		if err := h.infra.MinioClient.PutObjectWithMetadata(ctx, event.Bucket, variant.Key, buffer.Bytes(), utils.ImageContentType(variant.Format), metadata); err != nil {
+			return fmt.Errorf("failed to upload variant %s: %w", variant.Key, err)
+		}
+		log.Printf("[ImageVariants] Stored %s/%s (%dx%d, %d bytes)", event.Bucket, variant.Key, width, height, buffer.Len())
+	}
+
+	// The last reference may have been removed meanwhile, taking the existing variants with it
+	if exists, err := h.infra.MinioClient.ObjectExists(ctx, event.Bucket, event.BlobKey); err == nil && !exists {
+		for _, variant := range missing {
+			_ = h.infra.MinioClient.DeleteObjectFromBucket(ctx, event.Bucket, variant.Key)
+		}
+		log.Printf("[ImageVariants] Source %s/%s was deleted while generating variants", event.Bucket, event.BlobKey)
+		return nil
+	}
+
+	log.Printf("[ImageVariants] Generated %d variants of %s in %v", len(missing), event.FileHash, time.Since(startTime))
+	return nil
+}
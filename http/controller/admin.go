@@ -0,0 +1,167 @@
+package controller
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tnqbao/gau-upload-service/shared/infra"
+	"github.com/tnqbao/gau-upload-service/shared/repository"
+	"github.com/tnqbao/gau-upload-service/shared/utils"
+)
+
+// CompactMetadata merges Parquet metadata delta segments into base segments on demand
+func (ctrl *Controller) CompactMetadata(c *gin.Context) {
+	ctx := c.Request.Context()
+	ctrl.Provider.LoggerProvider.InfoWithContextf(ctx, "[Compact Metadata] Compaction requested")
+	if !ctrl.requireParquetMetadata(c, "[Compact Metadata]") {
+		return
+	}
+
+	result, err := ctrl.Infrastructure.ParquetService.Compact(ctx)
+	if err != nil {
+		ctrl.Provider.LoggerProvider.ErrorWithContextf(ctx, err, "[Compact Metadata] Compaction failed")
+		utils.JSON500(c, "Failed to compact metadata: "+err.Error())
+		return
+	}
+
+	ctrl.Provider.LoggerProvider.InfoWithContextf(ctx, "[Compact Metadata] Merged %d deltas across %d partitions", result.DeltasMerged, result.Partitions)
+	utils.JSON200(c, gin.H{
+		"partitions":      result.Partitions,
+		"deltas_merged":   result.DeltasMerged,
+		"rows":            result.Rows,
+		"legacy_migrated": result.LegacyMigrated,
+		"message":         "Metadata compacted successfully",
+	})
+}
+
+// MigrateMetadataSchema rewrites stored Parquet metadata segments to the latest schema version
+func (ctrl *Controller) MigrateMetadataSchema(c *gin.Context) {
+	ctx := c.Request.Context()
+	ctrl.Provider.LoggerProvider.InfoWithContextf(ctx, "[Migrate Metadata] Schema migration requested")
+	if !ctrl.requireParquetMetadata(c, "[Migrate Metadata]") {
+		return
+	}
+
+	result, err := ctrl.Infrastructure.ParquetService.MigrateSchema(ctx)
+	if err != nil {
+		ctrl.Provider.LoggerProvider.ErrorWithContextf(ctx, err, "[Migrate Metadata] Schema migration failed")
+		utils.JSON500(c, "Failed to migrate metadata schema: "+err.Error())
+		return
+	}
+
+	ctrl.Provider.LoggerProvider.InfoWithContextf(ctx, "[Migrate Metadata] Rewrote %d of %d segments", result.Rewritten, result.Segments)
+	utils.JSON200(c, gin.H{
+		"schema_version":  infra.CurrentSchemaVersion,
+		"segments":        result.Segments,
+		"rewritten":       result.Rewritten,
+		"rows":            result.Rows,
+		"legacy_migrated": result.LegacyMigrated,
+		"message":         "Metadata schema migrated successfully",
+	})
+}
+
+// requireParquetMetadata answers 409 when metadata isn't kept in Parquet segments, which only
+// exist with the parquet backend
+func (ctrl *Controller) requireParquetMetadata(c *gin.Context, section string) bool {
+	if backend := ctrl.Config.EnvConfig.Metadata.Backend; backend != "parquet" {
+		ctrl.Provider.LoggerProvider.WarningWithContextf(c.Request.Context(), "%s Rejected: metadata backend is %s", section, backend)
+		utils.JSON409(c, "Metadata is stored by the "+backend+" backend, not in Parquet segments")
+		return false
+	}
+	return true
+}
+
+// reconcileJobKind identifies reconciliation runs in the job store
+const reconcileJobKind = "reconcile"
+
+// ReconcileMetadata prunes metadata entries whose object is gone and backfills entries for
+// objects stored without metadata. Pass dry_run=true to only get the report.
+// A run may re-hash every object, so it runs in the background: the response carries the id
+// of the job, whose progress and report GetReconcileJob returns.
+func (ctrl *Controller) ReconcileMetadata(c *gin.Context) {
+	ctx := c.Request.Context()
+	bucketName := strings.TrimSpace(c.Query("bucket"))
+	dryRun, _ := strconv.ParseBool(c.DefaultQuery("dry_run", "false"))
+	ctrl.Provider.LoggerProvider.InfoWithContextf(ctx, "[Reconcile Metadata] Reconciliation requested - Bucket: %q, DryRun: %t", bucketName, dryRun)
+
+	job, err := ctrl.Repository.Jobs.Start(ctx, reconcileJobKind)
+	if err != nil {
+		ctrl.Provider.LoggerProvider.ErrorWithContextf(ctx, err, "[Reconcile Metadata] Failed to start reconciliation job")
+		utils.JSON500(c, "Failed to start reconciliation: "+err.Error())
+		return
+	}
+
+	go ctrl.runReconcileJob(context.WithoutCancel(ctx), job, repository.ReconcileOptions{
+		Bucket: bucketName,
+		DryRun: dryRun,
+	})
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"job_id":  job.ID,
+		"status":  job.Status,
+		"message": "Reconciliation started",
+	})
+}
+
+// runReconcileJob runs a reconciliation and records its progress and report in the job store
+func (ctrl *Controller) runReconcileJob(ctx context.Context, job *repository.Job, opts repository.ReconcileOptions) {
+	opts.Progress = func(progress repository.ReconcileProgress) {
+		ctrl.Provider.LoggerProvider.InfoWithContextf(ctx, "[Reconcile Metadata] %s %s: %d/%d", progress.Bucket, progress.Phase, progress.Done, progress.Total)
+		if err := ctrl.Repository.Jobs.Progress(ctx, job, progress); err != nil {
+			ctrl.Provider.LoggerProvider.WarningWithContextf(ctx, "[Reconcile Metadata] Failed to record progress of job %s: %v", job.ID, err)
+		}
+	}
+
+	reconciler := repository.NewReconciler(ctrl.Infrastructure.MinioClient, ctrl.Repository.Metadata, ctrl.Repository.Blobs)
+	report, err := reconciler.Reconcile(ctx, opts)
+	if err != nil {
+		ctrl.Provider.LoggerProvider.ErrorWithContextf(ctx, err, "[Reconcile Metadata] Reconciliation job %s failed", job.ID)
+	} else {
+		ctrl.Provider.LoggerProvider.InfoWithContextf(ctx, "[Reconcile Metadata] Job %s pruned %d entries, backfilled %d entries, collected %d blobs, %d errors", job.ID, len(report.Pruned), len(report.Backfilled), len(report.Collected), len(report.Errors))
+	}
+
+	if err := ctrl.Repository.Jobs.Finish(ctx, job, report, err); err != nil {
+		ctrl.Provider.LoggerProvider.ErrorWithContextf(ctx, err, "[Reconcile Metadata] Failed to record result of job %s", job.ID)
+	}
+}
+
+// GetReconcileJob reports the progress of a reconciliation job, and its report once it finished
+func (ctrl *Controller) GetReconcileJob(c *gin.Context) {
+	ctx := c.Request.Context()
+	id := c.Param("id")
+
+	job, err := ctrl.Repository.Jobs.Get(ctx, id)
+	if err != nil {
+		ctrl.Provider.LoggerProvider.ErrorWithContextf(ctx, err, "[Reconcile Metadata] Failed to read job %s", id)
+		utils.JSON500(c, "Failed to read reconciliation job: "+err.Error())
+		return
+	}
+	if job == nil || job.Kind != reconcileJobKind {
+		utils.JSON404(c, "Reconciliation job not found")
+		return
+	}
+	utils.JSON200(c, gin.H{"job": job})
+}
+
+// RecalculateUsage recounts the usage counters of every bucket and user from the metadata store
+func (ctrl *Controller) RecalculateUsage(c *gin.Context) {
+	ctx := c.Request.Context()
+	ctrl.Provider.LoggerProvider.InfoWithContextf(ctx, "[Recalculate Usage] Recalculation requested")
+
+	result, err := ctrl.Repository.Usage.Recalculate(ctx)
+	if err != nil {
+		ctrl.Provider.LoggerProvider.ErrorWithContextf(ctx, err, "[Recalculate Usage] Recalculation failed")
+		utils.JSON500(c, "Failed to recalculate usage: "+err.Error())
+		return
+	}
+
+	ctrl.Provider.LoggerProvider.InfoWithContextf(ctx, "[Recalculate Usage] Recounted %d buckets and %d users", len(result.Buckets), result.Users)
+	utils.JSON200(c, gin.H{
+		"buckets": result.Buckets,
+		"users":   result.Users,
+		"message": "Usage recalculated successfully",
+	})
+}
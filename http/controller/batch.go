@@ -0,0 +1,270 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tnqbao/gau-upload-service/shared/repository"
+	"github.com/tnqbao/gau-upload-service/shared/utils"
+)
+
+// batchFile is one file of a batch upload with its effective options
+type batchFile struct {
+	index      int
+	header     *multipart.FileHeader
+	customPath string
+	isHash     bool
+	userID     string
+}
+
+// batchResult is the outcome of one file of a batch upload
+type batchResult struct {
+	prepared *preparedUpload
+	err      error
+}
+
+// batchPaths hands out target paths so two files of a batch can't overwrite each other
+type batchPaths struct {
+	mu     sync.Mutex
+	hashes map[string]string
+}
+
+// claim reserves path for hash; the same content may claim a path twice
+func (bp *batchPaths) claim(path, hash string) bool {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+
+	if claimed, ok := bp.hashes[path]; ok {
+		return claimed == hash
+	}
+	bp.hashes[path] = hash
+	return true
+}
+
+// UploadFiles stores every files[] part of a multipart form. bucket, path and is_hash apply to all
+// files; path[] and is_hash[] override them per file, in the order of files[]. Files are processed
+// concurrently and their metadata is recorded with a single write.
+func (ctrl *Controller) UploadFiles(c *gin.Context) {
+	ctx := c.Request.Context()
+	ctrl.Provider.LoggerProvider.InfoWithContextf(ctx, "[Batch Upload] Upload request received")
+
+	form, err := c.MultipartForm()
+	if err != nil {
+		utils.JSON400(c, "Failed to parse multipart form: "+err.Error())
+		return
+	}
+	defer form.RemoveAll()
+
+	headers := form.File["files[]"]
+	if len(headers) == 0 {
+		utils.JSON400(c, "files[] is required")
+		return
+	}
+	if maxFiles := ctrl.Config.EnvConfig.Limit.BatchMaxFiles; len(headers) > maxFiles {
+		utils.JSON400(c, fmt.Sprintf("A batch can contain at most %d files", maxFiles))
+		return
+	}
+
+	bucketName := strings.TrimSpace(c.PostForm("bucket"))
+	if bucketName == "" {
+		ctrl.Provider.LoggerProvider.WarningWithContextf(ctx, "[Batch Upload] bucket is required")
+		utils.JSON400(c, "bucket parameter is required")
+		return
+	}
+
+	files, err := batchFiles(c, headers)
+	if err != nil {
+		utils.JSON400(c, err.Error())
+		return
+	}
+
+	// Store content with bounded concurrency; references are committed together afterwards
+	results := make([]batchResult, len(files))
+	paths := &batchPaths{hashes: make(map[string]string)}
+	semaphore := make(chan struct{}, ctrl.Config.EnvConfig.Limit.BatchConcurrency)
+	var wg sync.WaitGroup
+	for i, file := range files {
+		wg.Add(1)
+		semaphore <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+			prepared, err := ctrl.prepareBatchFile(ctx, bucketName, file, paths)
+			results[i] = batchResult{prepared: prepared, err: err}
+		}()
+	}
+	wg.Wait()
+
+	var refs []*repository.PendingReference
+	for _, result := range results {
+		if result.err == nil && result.prepared.ref != nil {
+			refs = append(refs, result.prepared.ref)
+		}
+	}
+	defer func() {
+		for _, result := range results {
+			if result.prepared != nil {
+				result.prepared.claim.Release(ctx)
+			}
+		}
+	}()
+
+	// Each file fits in the quotas on its own; the files stored together must fit too. Their
+	// content is already uploaded by now, so a rejected batch discards the blobs it added.
+	var changes []repository.UsageChange
+	for _, result := range results {
+		if result.err == nil && result.prepared.ref != nil {
+			changes = append(changes, result.prepared.usage)
+		}
+	}
+	if err := ctrl.Repository.Usage.Check(ctx, ctrl.Config.Policy, changes...); err != nil {
+		ctrl.Provider.LoggerProvider.WarningWithContextf(ctx, "[Batch Upload] Rejected batch: %v", err)
+		ctrl.Repository.Blobs.Discard(ctx, refs)
+		refs = nil
+		for i, result := range results {
+			if result.err == nil && result.prepared.ref != nil {
+				results[i].err = err
+			}
+		}
+	}
+	for _, result := range results {
+		if result.err == nil && result.prepared.ref != nil {
+			ctrl.publishUploadCreated(ctx, result.prepared)
+		}
+	}
+	if err := ctrl.Repository.Blobs.Commit(ctx, refs); err != nil {
+		ctrl.Provider.LoggerProvider.ErrorWithContextf(ctx, err, "[Batch Upload] Failed to record metadata")
+		for i, result := range results {
+			if result.err == nil && result.prepared.ref != nil {
+				results[i].err = fmt.Errorf("failed to upload file: %w", err)
+			}
+		}
+	}
+
+	uploaded, failed := 0, 0
+	entries := make([]gin.H, 0, len(results))
+	for i, result := range results {
+		entry := gin.H{
+			"index":    files[i].index,
+			"filename": files[i].header.Filename,
+		}
+		if result.err != nil {
+			failed++
+			entry["success"] = false
+			entry["error"] = result.err.Error()
+		} else {
+			uploaded++
+			entry["success"] = true
+			for key, value := range ctrl.uploadResponse(ctx, result.prepared) {
+				entry[key] = value
+			}
+		}
+		entries = append(entries, entry)
+	}
+
+	ctrl.Provider.LoggerProvider.InfoWithContextf(ctx, "[Batch Upload] Stored %d of %d files in bucket %s", uploaded, len(files), bucketName)
+	utils.JSON200(c, gin.H{
+		"bucket":   bucketName,
+		"total":    len(files),
+		"uploaded": uploaded,
+		"failed":   failed,
+		"results":  entries,
+	})
+}
+
+// prepareBatchFile stages, hashes and stores the content of one file without recording its reference
+func (ctrl *Controller) prepareBatchFile(ctx context.Context, bucket string, file batchFile, paths *batchPaths) (*preparedUpload, error) {
+	if maxSize := ctrl.maxUploadSize(bucket); file.header.Size > maxSize {
+		return nil, fmt.Errorf("file size exceeds %d bytes limit", maxSize)
+	}
+
+	src, err := file.header.Open()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+	tempFile, fileHash, size, err := ctrl.stageToTempFile(src)
+	src.Close()
+	if err != nil {
+		return nil, err
+	}
+	defer removeTempFile(tempFile)
+
+	upload := stagedUpload{
+		Bucket:       bucket,
+		CustomPath:   file.customPath,
+		IsHash:       file.isHash,
+		OriginalName: file.header.Filename,
+		ContentType:  file.header.Header.Get("Content-Type"),
+		Hash:         fileHash,
+		Size:         size,
+		Content:      tempFile,
+		UserID:       file.userID,
+	}
+	if upload.ContentType, err = ctrl.detectContentType(ctx, &upload); err != nil {
+		return nil, err
+	}
+	// Forced hash naming and stripped image metadata change the path claimed below
+	if err := ctrl.applyUploadPolicy(ctx, &upload); err != nil {
+		return nil, err
+	}
+	if !paths.claim(uploadPath(upload), upload.Hash) {
+		return nil, errors.New("another file in this batch is stored at the same path")
+	}
+
+	prepared, err := ctrl.prepareUpload(ctx, upload)
+	if err != nil {
+		ctrl.Provider.LoggerProvider.ErrorWithContextf(ctx, err, "[Batch Upload] Failed to store file %d (%s)", file.index, file.header.Filename)
+		return nil, err
+	}
+	return prepared, nil
+}
+
+// batchFiles applies the shared user_id and the shared and per-file path/is_hash fields to each
+// uploaded file
+func batchFiles(c *gin.Context, headers []*multipart.FileHeader) ([]batchFile, error) {
+	sharedPath, err := normalizeCustomPath(c.PostForm("path"))
+	if err != nil {
+		return nil, err
+	}
+	sharedIsHash := c.PostForm("is_hash")
+	userID := strings.TrimSpace(c.PostForm("user_id"))
+
+	paths := c.PostFormArray("path[]")
+	isHashes := c.PostFormArray("is_hash[]")
+	if len(paths) > 0 && len(paths) != len(headers) {
+		return nil, fmt.Errorf("path[] has %d values for %d files", len(paths), len(headers))
+	}
+	if len(isHashes) > 0 && len(isHashes) != len(headers) {
+		return nil, fmt.Errorf("is_hash[] has %d values for %d files", len(isHashes), len(headers))
+	}
+
+	files := make([]batchFile, 0, len(headers))
+	for i, header := range headers {
+		if header.Filename, err = normalizeFileName(header.Filename); err != nil {
+			return nil, fmt.Errorf("file %d: %w", i, err)
+		}
+		file := batchFile{
+			index:      i,
+			header:     header,
+			customPath: sharedPath,
+			isHash:     parseIsHash(sharedIsHash),
+			userID:     userID,
+		}
+		// An empty per-file value falls back to the shared one
+		if len(paths) > 0 && strings.TrimSpace(paths[i]) != "" {
+			if file.customPath, err = normalizeCustomPath(paths[i]); err != nil {
+				return nil, fmt.Errorf("file %d: %w", i, err)
+			}
+		}
+		if len(isHashes) > 0 && strings.TrimSpace(isHashes[i]) != "" {
+			file.isHash = parseIsHash(isHashes[i])
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
@@ -0,0 +1,188 @@
+package controller
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// checksumMismatchCode identifies uploads rejected because their content doesn't match a client checksum
+const checksumMismatchCode = "CHECKSUM_MISMATCH"
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// checksumField is a checksum a client can send, as a header or a form field
+type checksumField struct {
+	algorithm string // also the object metadata key suffix, e.g. checksum-sha256
+	header    string
+	form      string
+	size      int // digest length in bytes
+}
+
+var checksumFields = []checksumField{
+	{algorithm: "sha256", header: "X-Checksum-SHA256", form: "checksum_sha256", size: 32},
+	{algorithm: "md5", header: "Content-MD5", form: "content_md5", size: md5.Size},
+	{algorithm: "crc32c", header: "X-Checksum-CRC32C", form: "checksum_crc32c", size: 4},
+}
+
+// expectedChecksums holds the digests a client declared for the content it sends, by algorithm
+type expectedChecksums map[string][]byte
+
+// checksumMismatchError reports content whose digest differs from the declared one
+type checksumMismatchError struct {
+	algorithm string
+	expected  string
+	actual    string
+}
+
+func (e *checksumMismatchError) Error() string {
+	return fmt.Sprintf("%s checksum mismatch: expected %s, computed %s", e.algorithm, e.expected, e.actual)
+}
+
+// parseChecksums reads the declared checksums from headers and, when fromForm is set, form fields.
+// Values may be hex or base64 encoded.
+func parseChecksums(c *gin.Context, fromForm bool) (expectedChecksums, error) {
+	if fromForm {
+		return parseChecksumValues(c, c.PostForm)
+	}
+	return parseChecksumValues(c, nil)
+}
+
+// parseChecksumValues is parseChecksums with form fields read through form, nil for headers only
+func parseChecksumValues(c *gin.Context, form func(string) string) (expectedChecksums, error) {
+	expected := make(expectedChecksums)
+	for _, field := range checksumFields {
+		value := strings.TrimSpace(c.GetHeader(field.header))
+		if value == "" && form != nil {
+			value = strings.TrimSpace(form(field.form))
+		}
+		if value == "" {
+			continue
+		}
+
+		digest, ok := decodeDigest(value, field.size)
+		if !ok {
+			return nil, fmt.Errorf("invalid %s checksum: expected %d bytes as hex or base64", field.algorithm, field.size)
+		}
+		expected[field.algorithm] = digest
+	}
+	return expected, nil
+}
+
+// verifier returns a writer computing every declared digest other than SHA-256, which is always
+// computed while staging
+func (e expectedChecksums) verifier() *checksumVerifier {
+	v := &checksumVerifier{expected: e, hashes: make(map[string]hash.Hash)}
+	if _, ok := e["md5"]; ok {
+		v.hashes["md5"] = md5.New()
+	}
+	if _, ok := e["crc32c"]; ok {
+		v.hashes["crc32c"] = crc32.New(crc32cTable)
+	}
+	return v
+}
+
+// streamVerifier returns a verifier computing every digest, for content read before the declared
+// checksums are known; set expected before calling verify
+func streamVerifier() *checksumVerifier {
+	return &checksumVerifier{
+		expected: make(expectedChecksums),
+		hashes: map[string]hash.Hash{
+			"md5":    md5.New(),
+			"crc32c": crc32.New(crc32cTable),
+		},
+	}
+}
+
+// checksumVerifier computes digests of the content written to it
+type checksumVerifier struct {
+	expected expectedChecksums
+	hashes   map[string]hash.Hash
+}
+
+func (v *checksumVerifier) Write(p []byte) (int, error) {
+	for _, h := range v.hashes {
+		h.Write(p)
+	}
+	return len(p), nil
+}
+
+// wrap tees src into the verifier
+func (v *checksumVerifier) wrap(src io.Reader) io.Reader {
+	if len(v.hashes) == 0 {
+		return src
+	}
+	return io.TeeReader(src, v)
+}
+
+// verify compares the declared digests with the computed ones; fileHash is the hex SHA-256.
+// It returns the verified checksums as object metadata.
+func (v *checksumVerifier) verify(fileHash string) (map[string]string, *checksumMismatchError) {
+	computed := make(map[string][]byte, len(v.expected))
+	for algorithm, h := range v.hashes {
+		computed[algorithm] = h.Sum(nil)
+	}
+	if _, ok := v.expected["sha256"]; ok {
+		computed["sha256"], _ = hex.DecodeString(fileHash)
+	}
+
+	verified := make(map[string]string, len(v.expected))
+	for _, field := range checksumFields {
+		expected, ok := v.expected[field.algorithm]
+		if !ok {
+			continue
+		}
+		actual := computed[field.algorithm]
+		if string(actual) != string(expected) {
+			return nil, &checksumMismatchError{
+				algorithm: field.algorithm,
+				expected:  formatDigest(field.algorithm, expected),
+				actual:    formatDigest(field.algorithm, actual),
+			}
+		}
+		verified["checksum-"+field.algorithm] = formatDigest(field.algorithm, actual)
+	}
+	return verified, nil
+}
+
+// writeChecksumMismatch answers an upload whose content doesn't match the declared checksum
+func writeChecksumMismatch(c *gin.Context, err *checksumMismatchError) {
+	c.JSON(http.StatusBadRequest, gin.H{
+		"error":      err.Error(),
+		"error_code": checksumMismatchCode,
+		"algorithm":  err.algorithm,
+		"expected":   err.expected,
+		"actual":     err.actual,
+		"status":     http.StatusBadRequest,
+	})
+}
+
+// decodeDigest accepts a digest of size bytes as hex or standard base64
+func decodeDigest(value string, size int) ([]byte, bool) {
+	if len(value) == hex.EncodedLen(size) {
+		if digest, err := hex.DecodeString(value); err == nil {
+			return digest, true
+		}
+	}
+	if digest, err := base64.StdEncoding.DecodeString(value); err == nil && len(digest) == size {
+		return digest, true
+	}
+	return nil, false
+}
+
+// formatDigest renders a digest the way it is usually exchanged: hex for SHA-256 (like file
+// hashes), base64 for MD5 and CRC32C (like Content-MD5 and S3 checksum headers)
+func formatDigest(algorithm string, digest []byte) string {
+	if algorithm == "sha256" {
+		return hex.EncodeToString(digest)
+	}
+	return base64.StdEncoding.EncodeToString(digest)
+}
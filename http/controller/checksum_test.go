@@ -0,0 +1,153 @@
+package controller
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"hash/crc32"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	testContent   = []byte("hello world")
+	testSHA256    = sha256.Sum256(testContent)
+	testMD5       = md5.Sum(testContent)
+	testCRC32C    = binary.BigEndian.AppendUint32(nil, crc32.Checksum(testContent, crc32cTable))
+	testSHA256Hex = hex.EncodeToString(testSHA256[:])
+	testMD5Base64 = base64.StdEncoding.EncodeToString(testMD5[:])
+)
+
+// newChecksumContext returns a context for a form POST with the given headers and form fields
+func newChecksumContext(headers map[string]string, form url.Values) *gin.Context {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodPost, "/", strings.NewReader(form.Encode()))
+	c.Request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for name, value := range headers {
+		c.Request.Header.Set(name, value)
+	}
+	return c
+}
+
+func TestParseChecksums(t *testing.T) {
+	tests := []struct {
+		name     string
+		headers  map[string]string
+		form     url.Values
+		fromForm bool
+		want     map[string][]byte
+		wantErr  bool
+	}{
+		{
+			name: "none",
+			want: map[string][]byte{},
+		},
+		{
+			name:    "sha256 as hex",
+			headers: map[string]string{"X-Checksum-SHA256": testSHA256Hex},
+			want:    map[string][]byte{"sha256": testSHA256[:]},
+		},
+		{
+			name:    "sha256 as base64",
+			headers: map[string]string{"X-Checksum-SHA256": base64.StdEncoding.EncodeToString(testSHA256[:])},
+			want:    map[string][]byte{"sha256": testSHA256[:]},
+		},
+		{
+			name: "every algorithm",
+			headers: map[string]string{
+				"Content-MD5":       testMD5Base64,
+				"X-Checksum-CRC32C": " " + hex.EncodeToString(testCRC32C) + " ",
+			},
+			want: map[string][]byte{"md5": testMD5[:], "crc32c": testCRC32C},
+		},
+		{
+			name:     "form fields",
+			form:     url.Values{"content_md5": {testMD5Base64}},
+			fromForm: true,
+			want:     map[string][]byte{"md5": testMD5[:]},
+		},
+		{
+			name: "form fields ignored for raw bodies",
+			form: url.Values{"content_md5": {testMD5Base64}},
+			want: map[string][]byte{},
+		},
+		{
+			name:     "header wins over the form",
+			headers:  map[string]string{"X-Checksum-SHA256": testSHA256Hex},
+			form:     url.Values{"checksum_sha256": {strings.Repeat("0", 64)}},
+			fromForm: true,
+			want:     map[string][]byte{"sha256": testSHA256[:]},
+		},
+		{
+			name:    "wrong length",
+			headers: map[string]string{"Content-MD5": testSHA256Hex},
+			wantErr: true,
+		},
+		{
+			name:    "not encoded",
+			headers: map[string]string{"X-Checksum-CRC32C": "zzzzzzzz"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		c := newChecksumContext(tt.headers, tt.form)
+		got, err := parseChecksums(c, tt.fromForm)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: err = %v, want an error: %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: parsed %v, want %v", tt.name, got, tt.want)
+			continue
+		}
+		for algorithm, digest := range tt.want {
+			if string(got[algorithm]) != string(digest) {
+				t.Errorf("%s: %s = %x, want %x", tt.name, algorithm, got[algorithm], digest)
+			}
+		}
+	}
+}
+
+func TestChecksumVerifier(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected expectedChecksums
+		wantErr  string // algorithm of the mismatch, "" when every checksum matches
+	}{
+		{"nothing declared", expectedChecksums{}, ""},
+		{"all match", expectedChecksums{"sha256": testSHA256[:], "md5": testMD5[:], "crc32c": testCRC32C}, ""},
+		{"sha256 mismatch", expectedChecksums{"sha256": make([]byte, 32), "md5": testMD5[:]}, "sha256"},
+		{"crc32c mismatch", expectedChecksums{"crc32c": {0, 0, 0, 0}}, "crc32c"},
+	}
+	for _, tt := range tests {
+		verifier := tt.expected.verifier()
+		if _, err := verifier.Write(testContent); err != nil {
+			t.Fatal(err)
+		}
+
+		verified, mismatch := verifier.verify(testSHA256Hex)
+		if tt.wantErr != "" {
+			if mismatch == nil || mismatch.algorithm != tt.wantErr {
+				t.Errorf("%s: mismatch %v, want one on %s", tt.name, mismatch, tt.wantErr)
+			}
+			continue
+		}
+		if mismatch != nil {
+			t.Errorf("%s: unexpected %v", tt.name, mismatch)
+			continue
+		}
+		if len(verified) != len(tt.expected) {
+			t.Errorf("%s: verified %v, want every declared checksum", tt.name, verified)
+		}
+		if _, ok := tt.expected["md5"]; ok && verified["checksum-md5"] != testMD5Base64 {
+			t.Errorf("%s: checksum-md5 = %q, want %q", tt.name, verified["checksum-md5"], testMD5Base64)
+		}
+	}
+}
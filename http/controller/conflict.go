@@ -0,0 +1,15 @@
+package controller
+
+import (
+	"context"
+
+	"github.com/tnqbao/gau-upload-service/shared/repository"
+)
+
+// pathConflictCode identifies uploads refused because their path is taken
+const pathConflictCode = "PATH_CONFLICT"
+
+// claimUploadPath applies upload.OnConflict to fullPath, see ClaimStore.ClaimUploadPath
+func (ctrl *Controller) claimUploadPath(ctx context.Context, upload stagedUpload, fullPath string) (string, *repository.PathClaim, *repository.ExistingFile, error) {
+	return ctrl.Repository.Claims.ClaimUploadPath(ctx, ctrl.Repository.Metadata, upload.Bucket, fullPath, upload.OnConflict, upload.Hash)
+}
@@ -1,26 +1,29 @@
 package controller
 
 import (
-	"crypto/sha256"
-	"encoding/hex"
 	"fmt"
-	"io"
 	"net/http"
-	"os"
-	"path/filepath"
+	"path"
+	"sort"
+	"strconv"
 	"strings"
-	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/tnqbao/gau-upload-service/shared/infra"
+	"github.com/tnqbao/gau-upload-service/shared/repository"
 	"github.com/tnqbao/gau-upload-service/shared/utils"
 )
 
-// UploadFile handles generic file upload with deduplication using Parquet
+// UploadFile handles generic file upload with deduplication using the metadata store
 func (ctrl *Controller) UploadFile(c *gin.Context) {
 	ctx := c.Request.Context()
 	ctrl.Provider.LoggerProvider.InfoWithContextf(ctx, "[Upload File] Upload request received")
 
+	if ctrl.disklessUpload(c) {
+		ctrl.uploadFileDiskless(c)
+		return
+	}
+
 	// Get file from multipart form
 	fileHeader, err := c.FormFile("file")
 	if err != nil {
@@ -28,6 +31,10 @@ func (ctrl *Controller) UploadFile(c *gin.Context) {
 		utils.JSON400(c, "Failed to get file: "+err.Error())
 		return
 	}
+	if fileHeader.Filename, err = normalizeFileName(fileHeader.Filename); err != nil {
+		utils.JSON400(c, "Invalid filename: filename cannot contain '..'")
+		return
+	}
 
 	// Get bucket name from form data
 	bucketName := strings.TrimSpace(c.PostForm("bucket"))
@@ -38,33 +45,31 @@ func (ctrl *Controller) UploadFile(c *gin.Context) {
 	}
 
 	// Optional: Get custom file path/folder (supports nested paths like abc/def)
-	customPath := strings.TrimSpace(c.PostForm("path"))
-	if customPath != "" {
-		// Clean and normalize path: remove leading/trailing slashes, replace backslashes
-		customPath = strings.Trim(customPath, "/\\")
-		customPath = strings.ReplaceAll(customPath, "\\", "/")
-
-		// Remove any double slashes
-		for strings.Contains(customPath, "//") {
-			customPath = strings.ReplaceAll(customPath, "//", "/")
-		}
-
-		// Validate path doesn't contain dangerous characters
-		if strings.Contains(customPath, "..") {
-			ctrl.Provider.LoggerProvider.WarningWithContextf(ctx, "[Upload File] Invalid path contains ..")
-			utils.JSON400(c, "Invalid path: path cannot contain '..'")
-			return
-		}
+	customPath, err := normalizeCustomPath(c.PostForm("path"))
+	if err != nil {
+		ctrl.Provider.LoggerProvider.WarningWithContextf(ctx, "[Upload File] Invalid path: %v", err)
+		utils.JSON400(c, invalidPathMessage(err))
+		return
 	}
 
 	// Optional: Get is_hash parameter (defaults to true for backward compatibility)
-	isHashStr := strings.ToLower(strings.TrimSpace(c.PostForm("is_hash")))
-	isHash := true // default is true
-	if isHashStr == "false" || isHashStr == "0" {
-		isHash = false
+	isHash := parseIsHash(c.PostForm("is_hash"))
+
+	// Optional: what to do when a non-hash upload targets an existing file (defaults to overwrite)
+	onConflict, err := repository.ParseOnConflict(c.PostForm("on_conflict"))
+	if err != nil {
+		utils.JSON400(c, err.Error())
+		return
+	}
+
+	// Optional: name the file from placeholders such as {hash:2}/{hash}{ext} instead of is_hash
+	nameTemplate, err := parseNameTemplate(c.PostForm("name_template"))
+	if err != nil {
+		utils.JSON400(c, err.Error())
+		return
 	}
 
-	maxUploadSize := ctrl.Config.EnvConfig.Limit.FileMaxSize
+	maxUploadSize := ctrl.maxUploadSize(bucketName)
 
 	if fileHeader.Size > maxUploadSize {
 		ctrl.Provider.LoggerProvider.WarningWithContextf(ctx, "[Upload File] File size exceeds limit: %d bytes", fileHeader.Size)
@@ -72,6 +77,13 @@ func (ctrl *Controller) UploadFile(c *gin.Context) {
 		return
 	}
 
+	// Optional: checksums the client computed for the file
+	expected, err := parseChecksums(c, true)
+	if err != nil {
+		utils.JSON400(c, err.Error())
+		return
+	}
+
 	// Open uploaded file stream
 	srcFile, err := fileHeader.Open()
 	if err != nil {
@@ -81,182 +93,72 @@ func (ctrl *Controller) UploadFile(c *gin.Context) {
 	}
 	defer srcFile.Close()
 
-	// Create a temporary file to store the content while hashing
-	tempDir := ctrl.Config.EnvConfig.ChunkConfig.TempDir
-	if tempDir == "" {
-		tempDir = os.TempDir()
-	}
-	// Ensure temp dir exists
-	if err := os.MkdirAll(tempDir, 0755); err != nil {
-		ctrl.Provider.LoggerProvider.ErrorWithContextf(ctx, err, "[Upload File] Failed to create temp dir")
-		utils.JSON500(c, "Failed to create temp dir: "+err.Error())
-		return
-	}
-
-	tempFile, err := os.CreateTemp(tempDir, "upload-*")
+	// Stream the content to a temporary file while hashing it
+	verifier := expected.verifier()
+	tempFile, fileHash, _, err := ctrl.stageToTempFile(verifier.wrap(srcFile))
 	if err != nil {
-		ctrl.Provider.LoggerProvider.ErrorWithContextf(ctx, err, "[Upload File] Failed to create temp file")
-		utils.JSON500(c, "Failed to create temp file: "+err.Error())
-		return
-	}
-	defer func() {
-		tempFile.Close()
-		os.Remove(tempFile.Name()) // Clean up temp file
-	}()
-
-	// Create hasher
-	hasher := sha256.New()
-
-	// Stream from source to both temp file and hasher
-	writer := io.MultiWriter(tempFile, hasher)
-
-	// Copy data
-	if _, err := io.Copy(writer, srcFile); err != nil {
 		ctrl.Provider.LoggerProvider.ErrorWithContextf(ctx, err, "[Upload File] Failed to stream file to temp storage")
 		utils.JSON500(c, "Failed to stream file: "+err.Error())
 		return
 	}
+	defer removeTempFile(tempFile)
 
-	// Calculate SHA-256 hash
-	fileHash := hex.EncodeToString(hasher.Sum(nil))
-
-	// Detect content type
-	contentType := fileHeader.Header.Get("Content-Type")
-	if contentType == "" {
-		// If content type is missing, we need to detect it.
-		// We can read the first 512 bytes from the temp file.
-		if _, err := tempFile.Seek(0, 0); err != nil {
-			ctrl.Provider.LoggerProvider.ErrorWithContextf(ctx, err, "[Upload File] Failed to seek temp file")
-			utils.JSON500(c, "Failed to seek file: "+err.Error())
-			return
-		}
-		buffer := make([]byte, 512)
-		n, _ := tempFile.Read(buffer)
-		contentType = http.DetectContentType(buffer[:n])
-	}
-
-	// Get file extension
-	ext := filepath.Ext(fileHeader.Filename)
-	if ext == "" {
-		ext = getExtensionFromContentType(contentType)
-	}
-
-	// Construct file name based on is_hash parameter
-	var fileName string
-	if isHash {
-		// Use hash as filename
-		fileName = fileHash + ext
-	} else {
-		// Use original filename directly (preserve spaces and Unicode characters)
-		fileName = fileHeader.Filename
-	}
-
-	// Construct file path with proper directory structure
-	var fullPath string
-	if customPath != "" {
-		// Path will be: path/filename (e.g., "abc/def/file.jpg" or "abc/def/abc123.jpg")
-		fullPath = fmt.Sprintf("%s/%s", customPath, fileName)
-		ctrl.Provider.LoggerProvider.InfoWithContextf(ctx, "[Upload File] Upload to path: %s", fullPath)
-	} else {
-		// No path specified, save to root: filename
-		fullPath = fileName
-		ctrl.Provider.LoggerProvider.InfoWithContextf(ctx, "[Upload File] Upload to root: %s", fullPath)
-	}
-
-	// If custom path provided, ensure folders exist in MinIO FIRST
-	// Skip for "pending" bucket as it only stores temporary chunks
-	if customPath != "" && bucketName != "pending" {
-		// ... existing folder creation logic ...
-		segments := strings.Split(customPath, "/")
-		for i := 0; i < len(segments); i++ {
-			folder := strings.Join(segments[:i+1], "/")
-			if err := ctrl.Infrastructure.MinioClient.CreateFolderIfNotExist(ctx, bucketName, folder); err != nil {
-				// Don't fail hard on folder creation if it might exist
-				ctrl.Provider.LoggerProvider.WarningWithContextf(ctx, "[Upload File] Warning: Failed to create folder %s: %v", folder, err)
-			}
-		}
-	}
-
-	// Check if file already exists by hash in metadata using Parquet
-	existingFile, exists, err := ctrl.Infrastructure.ParquetService.CheckFileByHash(ctx, bucketName, fileHash)
-	if err != nil {
-		ctrl.Provider.LoggerProvider.ErrorWithContextf(ctx, err, "[Upload File] Failed to check file existence")
-		utils.JSON500(c, "Failed to check file existence: "+err.Error())
+	// Corrupted transfers are rejected before anything reaches the bucket
+	checksums, mismatch := verifier.verify(fileHash)
+	if mismatch != nil {
+		ctrl.Provider.LoggerProvider.WarningWithContextf(ctx, "[Upload File] Rejected upload: %v", mismatch)
+		writeChecksumMismatch(c, mismatch)
 		return
 	}
 
-	if exists {
-		// File with same hash exists, but check if it's at a different path
-		if existingFile == fullPath {
-			// Same file at same path - true duplicate
-			ctrl.Provider.LoggerProvider.InfoWithContextf(ctx, "[Upload File] File already exists at exact path: %s (hash: %s)", existingFile, fileHash)
-			utils.JSON200(c, gin.H{
-				"file_path":    existingFile,
-				"file_hash":    fileHash,
-				"message":      "File already exists (deduplicated)",
-				"bucket":       bucketName,
-				"content_type": contentType,
-				"size":         fileHeader.Size,
-				"duplicated":   true,
-			})
-			return
-		} else {
-			// Same content but different path - create a copy/reference
-			ctrl.Provider.LoggerProvider.InfoWithContextf(ctx, "[Upload File] File with same hash exists at %s, but creating copy at new path: %s", existingFile, fullPath)
-			// Continue to upload the file at the new path
-		}
+	// The content now lives in the temp file; release the multipart source and its spool files
+	srcFile.Close()
+	if c.Request.MultipartForm != nil {
+		_ = c.Request.MultipartForm.RemoveAll()
 	}
 
-	// Prepare to upload from temp file
-	// Reset temp file pointer to beginning
-	if _, err := tempFile.Seek(0, 0); err != nil {
-		ctrl.Provider.LoggerProvider.ErrorWithContextf(ctx, err, "[Upload File] Failed to seek temp file for upload")
-		utils.JSON500(c, "Failed to prepare file for upload: "+err.Error())
-		return
-	}
+	stripMetadata := parseStripMetadata(c.PostForm("strip_metadata"))
 
-	// Upload file stream with metadata to MinIO
-	metadata := map[string]string{
-		"file-hash":     fileHash,
-		"original-name": fileHeader.Filename,
-		"content-type":  contentType,
-	}
+	// Optional: the user the file counts against for quotas
+	userID := strings.TrimSpace(c.PostForm("user_id"))
 
-	// Use Stream upload
-	if err := ctrl.Infrastructure.MinioClient.PutObjectStreamWithMetadata(ctx, bucketName, fullPath, tempFile, fileHeader.Size, contentType, metadata); err != nil {
-		ctrl.Provider.LoggerProvider.ErrorWithContextf(ctx, err, "[Upload File] Failed to upload file to MinIO")
-		utils.JSON500(c, "Failed to upload file: "+err.Error())
+	// A retry with the same Idempotency-Key gets the first response instead of storing again
+	idempotent, proceed := ctrl.beginIdempotentRequest(c, idempotencyFingerprint(
+		http.MethodPost, "file", bucketName, customPath, strconv.FormatBool(isHash), onConflict,
+		nameTemplate, strconv.FormatBool(stripMetadata), userID, fileHeader.Filename, fileHash,
+	))
+	if !proceed {
 		return
 	}
-
-	// Add metadata to Parquet for fast lookup
-	fileMetadata := infra.FileMetadata{
-		FileHash:     fileHash,
-		FilePath:     fullPath,
-		BucketName:   bucketName,
-		OriginalName: fileHeader.Filename,
-		ContentType:  contentType,
-		FileSize:     fileHeader.Size,
-		UploadedAt:   time.Now(),
-	}
-	if err := ctrl.Infrastructure.ParquetService.AddFileMetadata(ctx, fileMetadata); err != nil {
-		ctrl.Provider.LoggerProvider.ErrorWithContextf(ctx, err, "[Upload File] Failed to save metadata to Parquet")
-		// Don't fail the request, just log the error
+	defer idempotent.finish(c)
+
+	response, err := ctrl.storeUpload(ctx, stagedUpload{
+		Bucket:        bucketName,
+		CustomPath:    customPath,
+		IsHash:        isHash,
+		OriginalName:  fileHeader.Filename,
+		ContentType:   fileHeader.Header.Get("Content-Type"),
+		Hash:          fileHash,
+		Size:          fileHeader.Size,
+		Content:       tempFile,
+		Checksums:     checksums,
+		StripMetadata: stripMetadata,
+		OnConflict:    onConflict,
+		NameTemplate:  nameTemplate,
+		UserID:        userID,
+	})
+	if err != nil {
+		ctrl.Provider.LoggerProvider.ErrorWithContextf(ctx, err, "[Upload File] Failed to store file")
+		writeStoreError(c, err)
+		return
 	}
 
-	ctrl.Provider.LoggerProvider.InfoWithContextf(ctx, "[Upload File] File uploaded successfully: %s (hash: %s)", fullPath, fileHash)
-	utils.JSON200(c, gin.H{
-		"file_path":    fullPath,
-		"file_hash":    fileHash,
-		"message":      "File uploaded successfully",
-		"bucket":       bucketName,
-		"content_type": contentType,
-		"size":         fileHeader.Size,
-		"duplicated":   exists && existingFile != fullPath, // True if file content was duplicated but saved at new path
-	})
+	utils.JSON200(c, response)
 }
 
-// GetFile retrieves a file from MinIO
+// GetFile streams a file from MinIO with support for Range requests, including multiple ranges,
+// and for If-None-Match/If-Modified-Since revalidation. Images can be resized and re-encoded with
+// the width, height, fit, quality and format query parameters.
 func (ctrl *Controller) GetFile(c *gin.Context) {
 	ctx := c.Request.Context()
 	filePath := c.Query("file_path")
@@ -276,18 +178,71 @@ func (ctrl *Controller) GetFile(c *gin.Context) {
 		return
 	}
 
-	data, contentType, err := ctrl.Infrastructure.MinioClient.GetObjectFromBucket(ctx, bucketName, filePath)
+	// Optional: resize or re-encode images on the fly
+	transform, err := parseImageTransform(c)
+	if err != nil {
+		utils.JSON400(c, err.Error())
+		return
+	}
+
+	// The path may reference a content-addressed blob
+	objectKey, err := ctrl.Repository.Blobs.Resolve(ctx, bucketName, filePath)
+	if err != nil {
+		ctrl.Provider.LoggerProvider.ErrorWithContextf(ctx, err, "[Get File] Failed to resolve file path")
+		utils.JSON500(c, "Failed to resolve file: "+err.Error())
+		return
+	}
+
+	if transform != nil {
+		ctrl.serveTransformed(c, bucketName, filePath, objectKey, transform)
+		return
+	}
+
+	info, err := ctrl.Infrastructure.MinioClient.StatObject(ctx, bucketName, objectKey)
 	if err != nil {
+		if infra.IsNotFound(err) {
+			ctrl.Provider.LoggerProvider.WarningWithContextf(ctx, "[Get File] File not found - Bucket: %s, Path: %s", bucketName, filePath)
+			utils.JSON404(c, "File not found: "+err.Error())
+			return
+		}
 		ctrl.Provider.LoggerProvider.ErrorWithContextf(ctx, err, "[Get File] Failed to get file from MinIO - Bucket: %s, Path: %s, Error: %v", bucketName, filePath, err)
-		utils.JSON404(c, "File not found: "+err.Error())
+		utils.JSON500(c, "Failed to get file: "+err.Error())
 		return
 	}
 
-	ctrl.Provider.LoggerProvider.InfoWithContextf(ctx, "[Get File] File retrieved successfully - Bucket: %s, Path: %s, ContentType: %s, Size: %d bytes", bucketName, filePath, contentType, len(data))
-	c.Data(http.StatusOK, contentType, data)
+	// Only the requested ranges are read from storage, while they are written to the client
+	content := ctrl.Infrastructure.MinioClient.NewObjectReader(ctx, bucketName, info)
+	content.ExpectRanges(c.GetHeader("Range"))
+	defer content.Close()
+
+	contentType := info.ContentType
+	if contentType == "" {
+		// Sniffing would read the head of the object once more
+		contentType = "application/octet-stream"
+	}
+	c.Header("Content-Type", contentType)
+	if info.ETag != "" {
+		c.Header("ETag", quotedETag(info.ETag))
+	}
+	c.Header("Accept-Ranges", "bytes")
+
+	// ServeContent answers conditional requests with 304 or 412 and ranges with 206 or 416, and
+	// sets Last-Modified and Content-Length
+	http.ServeContent(c.Writer, c.Request, path.Base(filePath), info.LastModified, content)
+
+	ctrl.Provider.LoggerProvider.InfoWithContextf(ctx, "[Get File] File served - Bucket: %s, Path: %s, ContentType: %s, Status: %d, Sent: %d of %d bytes",
+		bucketName, filePath, contentType, c.Writer.Status(), max(c.Writer.Size(), 0), info.Size)
 }
 
-// DeleteFile deletes a file from MinIO and removes metadata from Parquet
+// quotedETag returns an ETag as an HTTP entity tag; some S3 backends omit the quotes
+func quotedETag(etag string) string {
+	if strings.HasPrefix(etag, `"`) || strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+	return `"` + etag + `"`
+}
+
+// DeleteFile deletes a file from MinIO and removes its metadata entry
 func (ctrl *Controller) DeleteFile(c *gin.Context) {
 	ctx := c.Request.Context()
 	filePath := c.Query("file_path")
@@ -305,24 +260,45 @@ func (ctrl *Controller) DeleteFile(c *gin.Context) {
 		return
 	}
 
-	// Delete file from MinIO
-	if err := ctrl.Infrastructure.MinioClient.DeleteObjectFromBucket(ctx, bucketName, filePath); err != nil {
-		ctrl.Provider.LoggerProvider.ErrorWithContextf(ctx, err, "[Delete File] Failed to delete file from MinIO")
+	// Blobs and variants are shared by every path referencing their content: they are only
+	// deleted once no reference is left
+	if repository.IsReservedKey(strings.TrimLeft(filePath, "/")) {
+		ctrl.Provider.LoggerProvider.WarningWithContextf(ctx, "[Delete File] Refused to delete reserved key: %s", filePath)
+		utils.JSON400(c, "Invalid file_path: _blobs/ and _variants/ are reserved")
+		return
+	}
+
+	// A retry with the same Idempotency-Key gets the first response instead of deleting again
+	idempotent, proceed := ctrl.beginIdempotentRequest(c, idempotencyFingerprint(http.MethodDelete, "file", bucketName, filePath))
+	if !proceed {
+		return
+	}
+	defer idempotent.finish(c)
+
+	// Remove the reference; the content is deleted once no other path references it
+	removed, contentDeleted, err := ctrl.Repository.Blobs.RemoveReference(ctx, bucketName, filePath)
+	if err != nil {
+		ctrl.Provider.LoggerProvider.ErrorWithContextf(ctx, err, "[Delete File] Failed to remove file reference")
 		utils.JSON500(c, "Failed to delete file: "+err.Error())
 		return
 	}
 
-	// Remove metadata from Parquet
-	if err := ctrl.Infrastructure.ParquetService.RemoveFileMetadata(ctx, bucketName, filePath); err != nil {
-		ctrl.Provider.LoggerProvider.ErrorWithContextf(ctx, err, "[Delete File] Failed to remove metadata from Parquet")
-		// Don't fail the request, just log the error
+	// Files without metadata are stored directly at their path
+	if !removed {
+		if err := ctrl.Infrastructure.MinioClient.DeleteObjectFromBucket(ctx, bucketName, filePath); err != nil {
+			ctrl.Provider.LoggerProvider.ErrorWithContextf(ctx, err, "[Delete File] Failed to delete file from MinIO")
+			utils.JSON500(c, "Failed to delete file: "+err.Error())
+			return
+		}
+		contentDeleted = true
 	}
 
-	ctrl.Provider.LoggerProvider.InfoWithContextf(ctx, "[Delete File] File deleted successfully: %s", filePath)
+	ctrl.Provider.LoggerProvider.InfoWithContextf(ctx, "[Delete File] File deleted successfully: %s (content deleted: %t)", filePath, contentDeleted)
 	utils.JSON200(c, gin.H{
-		"file_path": filePath,
-		"bucket":    bucketName,
-		"message":   "File deleted successfully",
+		"file_path":       filePath,
+		"bucket":          bucketName,
+		"message":         "File deleted successfully",
+		"content_deleted": contentDeleted,
 	})
 }
 
@@ -338,13 +314,39 @@ func (ctrl *Controller) ListFiles(c *gin.Context) {
 		return
 	}
 
-	files, err := ctrl.Infrastructure.MinioClient.ListObjectsFromBucket(ctx, bucketName, prefix)
+	objects, err := ctrl.Infrastructure.MinioClient.ListObjectsFromBucket(ctx, bucketName, prefix)
 	if err != nil {
 		ctrl.Provider.LoggerProvider.ErrorWithContextf(ctx, err, "[List Files] Failed to list files from MinIO")
 		utils.JSON500(c, "Failed to list files: "+err.Error())
 		return
 	}
 
+	// Blob-backed files only exist as references in the metadata store
+	references, err := ctrl.Repository.Metadata.ListFiles(ctx, bucketName, prefix)
+	if err != nil {
+		ctrl.Provider.LoggerProvider.ErrorWithContextf(ctx, err, "[List Files] Failed to list file references")
+		utils.JSON500(c, "Failed to list files: "+err.Error())
+		return
+	}
+
+	seen := make(map[string]bool)
+	files := make([]string, 0, len(objects)+len(references))
+	for _, key := range objects {
+		if repository.IsBlobKey(key) || repository.IsVariantKey(key) || seen[key] {
+			continue
+		}
+		seen[key] = true
+		files = append(files, key)
+	}
+	for _, ref := range references {
+		if seen[ref.FilePath] {
+			continue
+		}
+		seen[ref.FilePath] = true
+		files = append(files, ref.FilePath)
+	}
+	sort.Strings(files)
+
 	ctrl.Provider.LoggerProvider.InfoWithContextf(ctx, "[List Files] Listed %d files with prefix: %s in bucket: %s", len(files), prefix, bucketName)
 	utils.JSON200(c, gin.H{
 		"files":  files,
@@ -353,35 +355,3 @@ func (ctrl *Controller) ListFiles(c *gin.Context) {
 		"prefix": prefix,
 	})
 }
-
-// Helper function to get extension from content type
-func getExtensionFromContentType(contentType string) string {
-	switch contentType {
-	case "image/jpeg", "image/jpg":
-		return ".jpg"
-	case "image/png":
-		return ".png"
-	case "image/gif":
-		return ".gif"
-	case "image/webp":
-		return ".webp"
-	case "image/svg+xml":
-		return ".svg"
-	case "application/pdf":
-		return ".pdf"
-	case "application/zip":
-		return ".zip"
-	case "application/json":
-		return ".json"
-	case "text/plain":
-		return ".txt"
-	case "text/html":
-		return ".html"
-	case "video/mp4":
-		return ".mp4"
-	case "audio/mpeg":
-		return ".mp3"
-	default:
-		return ".bin"
-	}
-}
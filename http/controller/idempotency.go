@@ -0,0 +1,124 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tnqbao/gau-upload-service/shared/utils"
+)
+
+const (
+	// idempotencyKeyHeader carries the client's key for safely retrying a request
+	idempotencyKeyHeader = "Idempotency-Key"
+	// idempotencyKeyMaxLength bounds the keys clients can choose
+	idempotencyKeyMaxLength = 255
+
+	idempotencyKeyReusedCode     = "IDEMPOTENCY_KEY_REUSED"
+	idempotencyKeyInProgressCode = "IDEMPOTENCY_KEY_IN_PROGRESS"
+)
+
+// responseRecorder keeps a copy of the body written to the client
+type responseRecorder struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *responseRecorder) Write(data []byte) (int, error) {
+	w.body.Write(data)
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *responseRecorder) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+// idempotentRequest is a request running under an Idempotency-Key, whose response is recorded
+type idempotentRequest struct {
+	ctrl     *Controller
+	key      string
+	etag     string
+	recorder *responseRecorder
+}
+
+// idempotencyFingerprint identifies the payload of a request from its significant parts
+func idempotencyFingerprint(parts ...string) string {
+	sum := sha256.Sum256([]byte(strings.Join(parts, "\x00")))
+	return hex.EncodeToString(sum[:])
+}
+
+// beginIdempotentRequest applies the Idempotency-Key header of a request whose payload has the
+// given fingerprint. It reports whether the handler should go on: false means the request was
+// answered, with the stored response of the key or an error. The returned request, nil without
+// a key, must be finished once the handler wrote its response.
+func (ctrl *Controller) beginIdempotentRequest(c *gin.Context, fingerprint string) (*idempotentRequest, bool) {
+	key := strings.TrimSpace(c.GetHeader(idempotencyKeyHeader))
+	if key == "" {
+		return nil, true
+	}
+	ctx := c.Request.Context()
+	if len(key) > idempotencyKeyMaxLength {
+		utils.JSON400(c, "Idempotency-Key must be at most 255 characters")
+		return nil, false
+	}
+
+	record, etag, err := ctrl.Repository.Idempotency.Begin(ctx, key, fingerprint)
+	if err != nil {
+		ctrl.Provider.LoggerProvider.ErrorWithContextf(ctx, err, "[Idempotency] Failed to reserve key")
+		utils.JSON500(c, "Failed to check idempotency key: "+err.Error())
+		return nil, false
+	}
+
+	if record != nil {
+		switch {
+		case record.Fingerprint != fingerprint:
+			ctrl.Provider.LoggerProvider.WarningWithContextf(ctx, "[Idempotency] Key reused with a different payload")
+			c.JSON(http.StatusUnprocessableEntity, gin.H{
+				"error":      "Idempotency-Key was already used with a different request",
+				"error_code": idempotencyKeyReusedCode,
+				"status":     http.StatusUnprocessableEntity,
+			})
+		case !record.Completed:
+			utils.JSON409(c, "A request with this Idempotency-Key is still in progress", gin.H{
+				"error_code": idempotencyKeyInProgressCode,
+			})
+		default:
+			ctrl.Provider.LoggerProvider.InfoWithContextf(ctx, "[Idempotency] Replaying stored response (status %d)", record.Status)
+			c.Header("Idempotent-Replayed", "true")
+			c.Data(record.Status, record.ContentType, record.Body)
+		}
+		return nil, false
+	}
+
+	recorder := &responseRecorder{ResponseWriter: c.Writer}
+	c.Writer = recorder
+	return &idempotentRequest{ctrl: ctrl, key: key, etag: etag, recorder: recorder}, true
+}
+
+// finish stores the response written by the handler for replays. Server errors are not stored:
+// the key is released so the client can retry.
+func (r *idempotentRequest) finish(c *gin.Context) {
+	if r == nil {
+		return
+	}
+	// The response is out; keep recording it even if the client went away
+	ctx := context.WithoutCancel(c.Request.Context())
+
+	status := r.recorder.Status()
+	if !r.recorder.Written() || status >= http.StatusInternalServerError {
+		if err := r.ctrl.Repository.Idempotency.Release(ctx, r.key); err != nil {
+			r.ctrl.Provider.LoggerProvider.WarningWithContextf(ctx, "[Idempotency] Failed to release key: %v", err)
+		}
+		return
+	}
+
+	contentType := r.recorder.Header().Get("Content-Type")
+	if err := r.ctrl.Repository.Idempotency.Complete(ctx, r.key, r.etag, status, contentType, r.recorder.body.Bytes()); err != nil {
+		r.ctrl.Provider.LoggerProvider.WarningWithContextf(ctx, "[Idempotency] Failed to store response: %v", err)
+	}
+}
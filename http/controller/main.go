@@ -12,6 +12,9 @@ type Controller struct {
 	Infrastructure *infra.Infra
 	Config         *config.Config
 	Provider       *provider.Provider
+
+	// transforms bounds the image transforms running at once, each holding a decoded image in memory
+	transforms chan struct{}
 }
 
 func NewController(cfg *config.Config, repo *repository.Repository, infra *infra.Infra) *Controller {
@@ -21,5 +24,6 @@ func NewController(cfg *config.Config, repo *repository.Repository, infra *infra
 		Infrastructure: infra,
 		Config:         cfg,
 		Provider:       provide,
+		transforms:     make(chan struct{}, cfg.EnvConfig.Limit.TransformConcurrency),
 	}
 }
@@ -0,0 +1,277 @@
+package controller
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tnqbao/gau-upload-service/shared/infra"
+	"github.com/tnqbao/gau-upload-service/shared/utils"
+)
+
+// sha256HexPattern matches a hex encoded SHA-256 digest
+var sha256HexPattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// GetFileStatistics returns file counts per bucket and per content type and the total stored bytes
+// Use format=csv to download the statistics as CSV
+func (ctrl *Controller) GetFileStatistics(c *gin.Context) {
+	ctx := c.Request.Context()
+	ctrl.Provider.LoggerProvider.InfoWithContextf(ctx, "[File Statistics] Request received")
+
+	stats, err := ctrl.Repository.Metadata.GetStatistics(ctx)
+	if err != nil {
+		ctrl.Provider.LoggerProvider.ErrorWithContextf(ctx, err, "[File Statistics] Failed to compute statistics")
+		utils.JSON500(c, "Failed to get statistics: "+err.Error())
+		return
+	}
+
+	byBucket, _ := stats["by_bucket"].(map[string]int)
+	byType, _ := stats["by_type"].(map[string]int)
+	totalFiles, _ := stats["total_files"].(int)
+	totalSize, _ := stats["total_size"].(int64)
+
+	if wantsCSV(c) {
+		rows := [][]string{
+			{"total", "files", strconv.Itoa(totalFiles)},
+			{"total", "bytes", strconv.FormatInt(totalSize, 10)},
+		}
+		rows = append(rows, countRows("bucket", byBucket)...)
+		rows = append(rows, countRows("content_type", byType)...)
+		writeCSV(c, "file-statistics.csv", []string{"dimension", "key", "value"}, rows)
+		return
+	}
+
+	utils.JSON200(c, gin.H{
+		"total_files": totalFiles,
+		"total_bytes": totalSize,
+		"by_bucket":   byBucket,
+		"by_type":     byType,
+	})
+}
+
+// SearchFilesByHash returns every location of a SHA-256 hash across buckets
+// Use format=csv to download the locations as CSV
+func (ctrl *Controller) SearchFilesByHash(c *gin.Context) {
+	ctx := c.Request.Context()
+	hash := strings.ToLower(strings.TrimSpace(c.Param("hash")))
+	ctrl.Provider.LoggerProvider.InfoWithContextf(ctx, "[Search By Hash] Request received - Hash: %s", hash)
+
+	if !sha256HexPattern.MatchString(hash) {
+		ctrl.Provider.LoggerProvider.WarningWithContextf(ctx, "[Search By Hash] Invalid hash: %s", hash)
+		utils.JSON400(c, "hash must be a hex encoded SHA-256 digest")
+		return
+	}
+
+	files, err := ctrl.Repository.Metadata.SearchByHash(ctx, hash)
+	if err != nil {
+		ctrl.Provider.LoggerProvider.ErrorWithContextf(ctx, err, "[Search By Hash] Failed to search metadata")
+		utils.JSON500(c, "Failed to search by hash: "+err.Error())
+		return
+	}
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].BucketName != files[j].BucketName {
+			return files[i].BucketName < files[j].BucketName
+		}
+		return files[i].FilePath < files[j].FilePath
+	})
+
+	if wantsCSV(c) {
+		rows := make([][]string, 0, len(files))
+		for _, file := range files {
+			rows = append(rows, []string{
+				file.BucketName,
+				file.FilePath,
+				file.FileHash,
+				file.OriginalName,
+				file.ContentType,
+				strconv.FormatInt(file.FileSize, 10),
+				file.UploadedAt.UTC().Format(time.RFC3339),
+			})
+		}
+		header := []string{"bucket", "file_path", "file_hash", "original_name", "content_type", "size", "uploaded_at"}
+		writeCSV(c, fmt.Sprintf("hash-%s.csv", hash[:12]), header, rows)
+		return
+	}
+
+	locations := make([]gin.H, 0, len(files))
+	for _, file := range files {
+		locations = append(locations, fileMetadataJSON(file))
+	}
+
+	ctrl.Provider.LoggerProvider.InfoWithContextf(ctx, "[Search By Hash] Found %d locations for hash: %s", len(files), hash)
+	utils.JSON200(c, gin.H{
+		"file_hash": hash,
+		"files":     locations,
+		"count":     len(locations),
+	})
+}
+
+const (
+	defaultSearchLimit = 100
+	maxSearchLimit     = 1000
+)
+
+// SearchFiles finds files by content type, size range, upload window, bucket, path prefix and
+// original-name substring, with sorting and cursor pagination
+func (ctrl *Controller) SearchFiles(c *gin.Context) {
+	ctx := c.Request.Context()
+	ctrl.Provider.LoggerProvider.InfoWithContextf(ctx, "[Search Files] Request received - Query: %s", c.Request.URL.RawQuery)
+
+	query, err := parseFileQuery(c)
+	if err != nil {
+		ctrl.Provider.LoggerProvider.WarningWithContextf(ctx, "[Search Files] Invalid query: %v", err)
+		utils.JSON400(c, err.Error())
+		return
+	}
+
+	result, err := ctrl.Repository.Metadata.QueryFiles(ctx, query)
+	if err != nil {
+		if errors.Is(err, infra.ErrInvalidCursor) {
+			utils.JSON400(c, "Invalid cursor: it must come from a previous search with the same sort and order")
+			return
+		}
+		ctrl.Provider.LoggerProvider.ErrorWithContextf(ctx, err, "[Search Files] Failed to query metadata")
+		utils.JSON500(c, "Failed to search files: "+err.Error())
+		return
+	}
+
+	files := make([]gin.H, 0, len(result.Files))
+	for _, file := range result.Files {
+		files = append(files, fileMetadataJSON(file))
+	}
+
+	ctrl.Provider.LoggerProvider.InfoWithContextf(ctx, "[Search Files] Returning %d files", len(files))
+	utils.JSON200(c, gin.H{
+		"files":       files,
+		"count":       len(files),
+		"next_cursor": result.NextCursor,
+	})
+}
+
+// parseFileQuery reads the search filters from the query string
+func parseFileQuery(c *gin.Context) (infra.FileQuery, error) {
+	query := infra.FileQuery{
+		Bucket:       strings.TrimSpace(c.Query("bucket")),
+		PathPrefix:   strings.TrimLeft(c.Query("prefix"), "/"),
+		ContentType:  strings.TrimSpace(c.Query("content_type")),
+		NameContains: c.Query("name"),
+		SortBy:       c.DefaultQuery("sort", infra.SortByUploadedAt),
+		Cursor:       c.Query("cursor"),
+		Limit:        defaultSearchLimit,
+	}
+
+	switch query.SortBy {
+	case infra.SortByUploadedAt, infra.SortBySize, infra.SortByPath, infra.SortByName:
+	default:
+		return query, fmt.Errorf("sort must be one of uploaded_at, size, path, name")
+	}
+
+	switch strings.ToLower(c.DefaultQuery("order", "desc")) {
+	case "desc":
+		query.Descending = true
+	case "asc":
+	default:
+		return query, fmt.Errorf("order must be asc or desc")
+	}
+
+	var err error
+	if query.MinSize, err = parseInt64Param(c, "min_size"); err != nil {
+		return query, err
+	}
+	if query.MaxSize, err = parseInt64Param(c, "max_size"); err != nil {
+		return query, err
+	}
+	if query.UploadedAfter, err = parseTimeParam(c, "uploaded_after"); err != nil {
+		return query, err
+	}
+	if query.UploadedBefore, err = parseTimeParam(c, "uploaded_before"); err != nil {
+		return query, err
+	}
+
+	if limit := c.Query("limit"); limit != "" {
+		query.Limit, err = strconv.Atoi(limit)
+		if err != nil || query.Limit < 1 || query.Limit > maxSearchLimit {
+			return query, fmt.Errorf("limit must be between 1 and %d", maxSearchLimit)
+		}
+	}
+	return query, nil
+}
+
+func parseInt64Param(c *gin.Context, name string) (int64, error) {
+	value := c.Query(name)
+	if value == "" {
+		return 0, nil
+	}
+	parsed, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || parsed < 0 {
+		return 0, fmt.Errorf("%s must be a non-negative integer", name)
+	}
+	return parsed, nil
+}
+
+func parseTimeParam(c *gin.Context, name string) (time.Time, error) {
+	value := c.Query(name)
+	if value == "" {
+		return time.Time{}, nil
+	}
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%s must be an RFC 3339 timestamp", name)
+	}
+	return parsed, nil
+}
+
+// fileMetadataJSON is the JSON representation of a metadata entry
+func fileMetadataJSON(meta infra.FileMetadata) gin.H {
+	entry := gin.H{
+		"bucket":        meta.BucketName,
+		"file_path":     meta.FilePath,
+		"file_hash":     meta.FileHash,
+		"original_name": meta.OriginalName,
+		"content_type":  meta.ContentType,
+		"size":          meta.FileSize,
+		"uploaded_at":   meta.UploadedAt.UTC().Format(time.RFC3339),
+	}
+	if names := meta.VariantNames(); len(names) > 0 {
+		entry["variants"] = variantsJSON(meta.FileHash, names)
+	}
+	return entry
+}
+
+// wantsCSV reports whether the client asked for CSV output with format=csv
+func wantsCSV(c *gin.Context) bool {
+	return strings.EqualFold(c.Query("format"), "csv")
+}
+
+// writeCSV sends rows as a CSV attachment
+func writeCSV(c *gin.Context, filename string, header []string, rows [][]string) {
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	c.Status(http.StatusOK)
+
+	writer := csv.NewWriter(c.Writer)
+	_ = writer.Write(header)
+	_ = writer.WriteAll(rows)
+}
+
+// countRows flattens a count map into sorted CSV rows
+func countRows(dimension string, counts map[string]int) [][]string {
+	keys := make([]string, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	rows := make([][]string, 0, len(keys))
+	for _, key := range keys {
+		rows = append(rows, []string{dimension, key, strconv.Itoa(counts[key])})
+	}
+	return rows
+}
@@ -0,0 +1,419 @@
+package controller
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tnqbao/gau-upload-service/shared/infra"
+	"github.com/tnqbao/gau-upload-service/shared/repository"
+	"github.com/tnqbao/gau-upload-service/shared/utils"
+)
+
+// maxMultipartParts is the S3 limit on parts per multipart upload
+const maxMultipartParts = 10000
+
+// completeMultipartRequest optionally selects the parts to assemble; all uploaded parts are used when empty
+type completeMultipartRequest struct {
+	Parts []struct {
+		PartNumber int32  `json:"part_number"`
+		ETag       string `json:"etag"`
+	} `json:"parts"`
+}
+
+// InitiateMultipartUpload starts a multipart upload session. It takes the same form fields as
+// UploadFile (bucket, path, is_hash, on_conflict, name_template, strip_metadata, user_id) plus
+// filename and content_type describing the file.
+func (ctrl *Controller) InitiateMultipartUpload(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	bucketName := strings.TrimSpace(c.PostForm("bucket"))
+	if bucketName == "" {
+		ctrl.Provider.LoggerProvider.WarningWithContextf(ctx, "[Multipart Upload] bucket is required")
+		utils.JSON400(c, "bucket parameter is required")
+		return
+	}
+
+	customPath, err := normalizeCustomPath(c.PostForm("path"))
+	if err != nil {
+		utils.JSON400(c, invalidPathMessage(err))
+		return
+	}
+
+	isHash := parseIsHash(c.PostForm("is_hash"))
+	filename, err := normalizeFileName(c.PostForm("filename"))
+	if err != nil {
+		utils.JSON400(c, "Invalid filename: filename cannot contain '..'")
+		return
+	}
+	if !isHash && filename == "" {
+		utils.JSON400(c, "filename is required when is_hash is false")
+		return
+	}
+
+	// The remaining options are kept with the session and applied on completion
+	onConflict, err := repository.ParseOnConflict(c.PostForm("on_conflict"))
+	if err != nil {
+		utils.JSON400(c, err.Error())
+		return
+	}
+	nameTemplate, err := parseNameTemplate(c.PostForm("name_template"))
+	if err != nil {
+		utils.JSON400(c, err.Error())
+		return
+	}
+
+	session, err := ctrl.Repository.Multipart.Create(ctx, repository.MultipartSession{
+		Bucket:        bucketName,
+		CustomPath:    customPath,
+		IsHash:        isHash,
+		OriginalName:  filename,
+		ContentType:   strings.TrimSpace(c.PostForm("content_type")),
+		UserID:        strings.TrimSpace(c.PostForm("user_id")),
+		OnConflict:    onConflict,
+		NameTemplate:  nameTemplate,
+		StripMetadata: parseStripMetadata(c.PostForm("strip_metadata")),
+	})
+	if err != nil {
+		ctrl.Provider.LoggerProvider.ErrorWithContextf(ctx, err, "[Multipart Upload] Failed to initiate upload")
+		utils.JSON500(c, "Failed to initiate multipart upload: "+err.Error())
+		return
+	}
+
+	ctrl.Provider.LoggerProvider.InfoWithContextf(ctx, "[Multipart Upload] Initiated session %s for bucket %s", session.ID, bucketName)
+	utils.JSON200(c, gin.H{
+		"upload_id":     session.ID,
+		"bucket":        session.Bucket,
+		"max_part_size": ctrl.Config.EnvConfig.ChunkConfig.MaxChunkSize,
+		"max_parts":     maxMultipartParts,
+		"max_size":      ctrl.Config.EnvConfig.Limit.ResumableMaxSize,
+	})
+}
+
+// UploadMultipartPart stores the request body as one part. Every part except the last must be at
+// least 5MB. Checksum headers (X-Checksum-SHA256, Content-MD5, X-Checksum-CRC32C) are verified
+// against the received data.
+func (ctrl *Controller) UploadMultipartPart(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	partNumber, err := strconv.Atoi(c.Param("part_number"))
+	if err != nil || partNumber < 1 || partNumber > maxMultipartParts {
+		utils.JSON400(c, fmt.Sprintf("part_number must be between 1 and %d", maxMultipartParts))
+		return
+	}
+
+	session, ok := ctrl.loadMultipartSession(c)
+	if !ok {
+		return
+	}
+
+	expected, err := parseChecksums(c, false)
+	if err != nil {
+		utils.JSON400(c, err.Error())
+		return
+	}
+
+	// Spool the part while hashing it; one extra byte detects an oversized part
+	maxPartSize := ctrl.Config.EnvConfig.ChunkConfig.MaxChunkSize
+	verifier := expected.verifier()
+	tempFile, partHash, size, err := ctrl.stageToTempFile(verifier.wrap(io.LimitReader(c.Request.Body, maxPartSize+1)))
+	if err != nil {
+		ctrl.Provider.LoggerProvider.ErrorWithContextf(ctx, err, "[Multipart Upload] Failed to read part %d of %s", partNumber, session.ID)
+		utils.JSON500(c, "Failed to read part: "+err.Error())
+		return
+	}
+	defer removeTempFile(tempFile)
+
+	if size > maxPartSize {
+		utils.JSON400(c, fmt.Sprintf("Part size exceeds %d bytes limit", maxPartSize))
+		return
+	}
+	if size == 0 {
+		utils.JSON400(c, "Part is empty")
+		return
+	}
+	if _, mismatch := verifier.verify(partHash); mismatch != nil {
+		ctrl.Provider.LoggerProvider.WarningWithContextf(ctx, "[Multipart Upload] Rejected part %d of %s: %v", partNumber, session.ID, mismatch)
+		writeChecksumMismatch(c, mismatch)
+		return
+	}
+
+	if _, err := tempFile.Seek(0, io.SeekStart); err != nil {
+		utils.JSON500(c, "Failed to read part: "+err.Error())
+		return
+	}
+
+	// The storage re-verifies the checksum, so a part corrupted in transit is rejected
+	checksum, _ := hex.DecodeString(partHash)
+	etag, err := ctrl.Infrastructure.MinioClient.UploadPart(ctx, repository.PendingBucket, session.Key, session.UploadID,
+		int32(partNumber), tempFile, size, base64.StdEncoding.EncodeToString(checksum))
+	if err != nil {
+		if infra.IsNotFound(err) {
+			utils.JSON404(c, "Multipart upload not found")
+			return
+		}
+		ctrl.Provider.LoggerProvider.ErrorWithContextf(ctx, err, "[Multipart Upload] Failed to upload part %d of %s", partNumber, session.ID)
+		utils.JSON500(c, "Failed to upload part: "+err.Error())
+		return
+	}
+
+	ctrl.Provider.LoggerProvider.InfoWithContextf(ctx, "[Multipart Upload] Stored part %d of %s (%d bytes)", partNumber, session.ID, size)
+	utils.JSON200(c, gin.H{
+		"upload_id":       session.ID,
+		"part_number":     partNumber,
+		"etag":            etag,
+		"size":            size,
+		"checksum_sha256": partHash,
+	})
+}
+
+// ListMultipartParts returns the parts uploaded so far with their checksums
+func (ctrl *Controller) ListMultipartParts(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	session, ok := ctrl.loadMultipartSession(c)
+	if !ok {
+		return
+	}
+
+	parts, err := ctrl.Repository.Multipart.Parts(ctx, session)
+	if err != nil {
+		if errors.Is(err, repository.ErrMultipartNotFound) {
+			utils.JSON404(c, "Multipart upload not found")
+			return
+		}
+		ctrl.Provider.LoggerProvider.ErrorWithContextf(ctx, err, "[Multipart Upload] Failed to list parts of %s", session.ID)
+		utils.JSON500(c, "Failed to list parts: "+err.Error())
+		return
+	}
+
+	totalSize := int64(0)
+	results := make([]gin.H, 0, len(parts))
+	for _, part := range parts {
+		totalSize += part.Size
+		results = append(results, multipartPartJSON(part))
+	}
+
+	utils.JSON200(c, gin.H{
+		"upload_id":  session.ID,
+		"bucket":     session.Bucket,
+		"parts":      results,
+		"count":      len(results),
+		"total_size": totalSize,
+	})
+}
+
+// CompleteMultipartUpload assembles the parts, then hashes, deduplicates and registers the file
+// like UploadFile. A JSON body {"parts": [{"part_number", "etag"}]} limits assembly to those parts,
+// and checksum headers are verified against the assembled file.
+func (ctrl *Controller) CompleteMultipartUpload(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	// Optional: checksums of the whole file
+	expected, err := parseChecksums(c, false)
+	if err != nil {
+		utils.JSON400(c, err.Error())
+		return
+	}
+
+	var request completeMultipartRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&request); err != nil && !errors.Is(err, io.EOF) {
+			utils.JSON400(c, "Invalid request body: "+err.Error())
+			return
+		}
+	}
+
+	session, ok := ctrl.loadMultipartSession(c)
+	if !ok {
+		return
+	}
+
+	assembled := false
+	parts, err := ctrl.Repository.Multipart.Parts(ctx, session)
+	if errors.Is(err, repository.ErrMultipartNotFound) {
+		// A previous completion assembled the object but failed to store it
+		assembled, err = ctrl.Infrastructure.MinioClient.ObjectExists(ctx, repository.PendingBucket, session.Key)
+		if err == nil && !assembled {
+			utils.JSON404(c, "Multipart upload not found")
+			return
+		}
+	}
+	if err != nil {
+		ctrl.Provider.LoggerProvider.ErrorWithContextf(ctx, err, "[Multipart Upload] Failed to list parts of %s", session.ID)
+		utils.JSON500(c, "Failed to list parts: "+err.Error())
+		return
+	}
+
+	if !assembled {
+		selected, err := selectMultipartParts(parts, request)
+		if err != nil {
+			utils.JSON400(c, err.Error())
+			return
+		}
+
+		totalSize := int64(0)
+		for _, part := range selected {
+			totalSize += part.Size
+		}
+		if maxSize := ctrl.Config.EnvConfig.Limit.ResumableMaxSize; totalSize > maxSize {
+			utils.JSON400(c, fmt.Sprintf("File size exceeds %d bytes limit", maxSize))
+			return
+		}
+
+		if err := ctrl.Repository.Multipart.Assemble(ctx, session, selected); err != nil {
+			if errors.Is(err, repository.ErrMultipartNotFound) {
+				utils.JSON404(c, "Multipart upload not found")
+				return
+			}
+			if infra.IsBadRequest(err) {
+				// Parts below the 5MB minimum, for example
+				utils.JSON400(c, "Failed to complete multipart upload: "+err.Error())
+				return
+			}
+			ctrl.Provider.LoggerProvider.ErrorWithContextf(ctx, err, "[Multipart Upload] Failed to assemble %s", session.ID)
+			utils.JSON500(c, "Failed to complete multipart upload: "+err.Error())
+			return
+		}
+	}
+
+	// The assembled object is hashed as it streams by and copied server-side, never staged on disk
+	verifier := expected.verifier()
+	fileHash, size, head, err := ctrl.hashStagedObject(ctx, session.Key, verifier)
+	if err != nil {
+		ctrl.Provider.LoggerProvider.ErrorWithContextf(ctx, err, "[Multipart Upload] Failed to hash assembled object of %s", session.ID)
+		utils.JSON500(c, "Failed to read assembled file: "+err.Error())
+		return
+	}
+	sniffedType := http.DetectContentType(head)
+
+	checksums, mismatch := verifier.verify(fileHash)
+	if mismatch != nil {
+		ctrl.Provider.LoggerProvider.WarningWithContextf(ctx, "[Multipart Upload] Rejected session %s: %v", session.ID, mismatch)
+		writeChecksumMismatch(c, mismatch)
+		return
+	}
+
+	response, err := ctrl.storeUpload(ctx, stagedUpload{
+		Bucket:        session.Bucket,
+		CustomPath:    session.CustomPath,
+		IsHash:        session.IsHash,
+		OriginalName:  session.OriginalName,
+		ContentType:   session.ContentType,
+		SniffedType:   sniffedType,
+		Hash:          fileHash,
+		Size:          size,
+		StagedKey:     session.Key,
+		Checksums:     checksums,
+		StripMetadata: session.StripMetadata,
+		OnConflict:    session.OnConflict,
+		NameTemplate:  session.NameTemplate,
+		UserID:        session.UserID,
+	})
+	if err != nil {
+		ctrl.Provider.LoggerProvider.ErrorWithContextf(ctx, err, "[Multipart Upload] Failed to store %s", session.ID)
+		writeStoreError(c, err)
+		return
+	}
+
+	if err := ctrl.Repository.Multipart.Finish(ctx, session); err != nil {
+		ctrl.Provider.LoggerProvider.WarningWithContextf(ctx, "[Multipart Upload] Failed to clean up session %s: %v", session.ID, err)
+	}
+
+	ctrl.Provider.LoggerProvider.InfoWithContextf(ctx, "[Multipart Upload] Completed session %s", session.ID)
+	utils.JSON200(c, response)
+}
+
+// AbortMultipartUpload discards a session and its uploaded parts
+func (ctrl *Controller) AbortMultipartUpload(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	session, ok := ctrl.loadMultipartSession(c)
+	if !ok {
+		return
+	}
+
+	if err := ctrl.Repository.Multipart.Abort(ctx, session); err != nil {
+		ctrl.Provider.LoggerProvider.ErrorWithContextf(ctx, err, "[Multipart Upload] Failed to abort %s", session.ID)
+		utils.JSON500(c, "Failed to abort multipart upload: "+err.Error())
+		return
+	}
+
+	ctrl.Provider.LoggerProvider.InfoWithContextf(ctx, "[Multipart Upload] Aborted session %s", session.ID)
+	utils.JSON200(c, gin.H{
+		"upload_id": session.ID,
+		"message":   "Multipart upload aborted",
+	})
+}
+
+// loadMultipartSession loads the session named by the route and writes the error response when it fails
+func (ctrl *Controller) loadMultipartSession(c *gin.Context) (*repository.MultipartSession, bool) {
+	id := c.Param("id")
+	session, err := ctrl.Repository.Multipart.Get(c.Request.Context(), id)
+	if err != nil {
+		if errors.Is(err, repository.ErrMultipartNotFound) {
+			utils.JSON404(c, "Multipart upload not found")
+			return nil, false
+		}
+		ctrl.Provider.LoggerProvider.ErrorWithContextf(c.Request.Context(), err, "[Multipart Upload] Failed to load session %s", id)
+		utils.JSON500(c, "Failed to load multipart upload: "+err.Error())
+		return nil, false
+	}
+	return session, true
+}
+
+// selectMultipartParts returns the uploaded parts named by the request, or all of them
+func selectMultipartParts(uploaded []infra.MultipartPart, request completeMultipartRequest) ([]infra.MultipartPart, error) {
+	if len(uploaded) == 0 {
+		return nil, errors.New("no parts have been uploaded")
+	}
+	if len(request.Parts) == 0 {
+		return uploaded, nil
+	}
+
+	byNumber := make(map[int32]infra.MultipartPart, len(uploaded))
+	for _, part := range uploaded {
+		byNumber[part.PartNumber] = part
+	}
+
+	selected := make([]infra.MultipartPart, 0, len(request.Parts))
+	previous := int32(0)
+	for _, requested := range request.Parts {
+		if requested.PartNumber <= previous {
+			return nil, errors.New("parts must be listed in ascending part_number order")
+		}
+		previous = requested.PartNumber
+
+		part, ok := byNumber[requested.PartNumber]
+		if !ok {
+			return nil, fmt.Errorf("part %d has not been uploaded", requested.PartNumber)
+		}
+		if requested.ETag != "" && strings.Trim(requested.ETag, `"`) != strings.Trim(part.ETag, `"`) {
+			return nil, fmt.Errorf("part %d etag does not match the uploaded part", requested.PartNumber)
+		}
+		selected = append(selected, part)
+	}
+	return selected, nil
+}
+
+// multipartPartJSON formats a part, reporting its checksum as hex like file hashes
+func multipartPartJSON(part infra.MultipartPart) gin.H {
+	checksum := ""
+	if raw, err := base64.StdEncoding.DecodeString(part.ChecksumSHA256); err == nil && len(raw) == sha256.Size {
+		checksum = hex.EncodeToString(raw)
+	}
+	return gin.H{
+		"part_number":     part.PartNumber,
+		"etag":            part.ETag,
+		"size":            part.Size,
+		"checksum_sha256": checksum,
+		"last_modified":   part.LastModified,
+	}
+}
@@ -0,0 +1,142 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tnqbao/gau-upload-service/shared/config"
+	"github.com/tnqbao/gau-upload-service/shared/repository"
+	"github.com/tnqbao/gau-upload-service/shared/utils"
+)
+
+// policyViolationCode identifies uploads rejected by the policy of their bucket
+const policyViolationCode = "POLICY_VIOLATION"
+
+// policyViolation is an upload refused by its bucket policy, answered with status
+type policyViolation struct {
+	status  int
+	message string
+}
+
+func (e *policyViolation) Error() string {
+	return e.message
+}
+
+// maxUploadSize returns the largest file UploadFile accepts for a bucket
+func (ctrl *Controller) maxUploadSize(bucket string) int64 {
+	return ctrl.Config.Policy.For(bucket).MaxSize(ctrl.Config.EnvConfig.Limit.FileMaxSize)
+}
+
+// applyUploadPolicy checks a staged file against the policy of its bucket, applies forced hash
+// naming, strips image metadata, which changes upload.Hash, and renders the name template.
+// upload.ContentType must already be detected.
+func (ctrl *Controller) applyUploadPolicy(ctx context.Context, upload *stagedUpload) error {
+	policy := ctrl.Config.Policy.For(upload.Bucket)
+
+	if policy.MaxSizeMB > 0 && !utils.IsFileSizeAllowed(upload.Size, policy.MaxSizeMB) {
+		return &policyViolation{
+			status:  http.StatusRequestEntityTooLarge,
+			message: fmt.Sprintf("File size exceeds %d MB limit of bucket %s", policy.MaxSizeMB, upload.Bucket),
+		}
+	}
+
+	// The declared type is chosen by the client, so the type sniffed from the content must pass too
+	if len(policy.DeniedTypes) > 0 || len(policy.AllowedTypes) > 0 {
+		sniffed, err := ctrl.sniffContentType(ctx, upload)
+		if err != nil {
+			return err
+		}
+		if err := checkContentType(policy, upload.Bucket, "Content type", upload.ContentType, false); err != nil {
+			return err
+		}
+		if err := checkContentType(policy, upload.Bucket, "Detected content type", sniffed, true); err != nil {
+			return err
+		}
+	}
+
+	if !policy.CreatesBucket() {
+		exists, err := ctrl.Infrastructure.MinioClient.BucketExists(ctx, upload.Bucket)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return &policyViolation{
+				status:  http.StatusNotFound,
+				message: fmt.Sprintf("Bucket %s does not exist", upload.Bucket),
+			}
+		}
+	}
+
+	if policy.HashNaming() {
+		upload.IsHash = true
+	}
+	if policy.StripsMetadata() {
+		upload.StripMetadata = true
+	}
+	if upload.StripMetadata {
+		if err := ctrl.stripImageMetadata(ctx, upload); err != nil {
+			return err
+		}
+	}
+	return applyNameTemplate(upload, policy)
+}
+
+// checkContentType checks a content type against the denied and allowed types of a bucket.
+// A sniffed type that only says the content is text or binary can't contradict the allowed types.
+func checkContentType(policy config.BucketPolicy, bucket, label, contentType string, sniffed bool) error {
+	// Parameters such as charset don't take part in the match
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = strings.ToLower(strings.TrimSpace(contentType))
+	}
+
+	denied := len(policy.DeniedTypes) > 0 && utils.CheckFileType(mediaType, policy.DeniedTypes)
+	generic := sniffed && (mediaType == "application/octet-stream" || mediaType == "text/plain")
+	if denied || (!generic && len(policy.AllowedTypes) > 0 && !utils.CheckFileType(mediaType, policy.AllowedTypes)) {
+		return &policyViolation{
+			status:  http.StatusUnsupportedMediaType,
+			message: fmt.Sprintf("%s %s is not allowed in bucket %s", label, mediaType, bucket),
+		}
+	}
+	return nil
+}
+
+// writeStoreError answers an upload that could not be stored: policy violations keep their 4xx
+// status, path conflicts are 409, exceeded quotas 507 and anything else is a server error
+func writeStoreError(c *gin.Context, err error) {
+	var conflict *repository.PathConflict
+	if errors.As(err, &conflict) {
+		details := gin.H{
+			"error_code": pathConflictCode,
+			"file_path":  conflict.FilePath,
+		}
+		if conflict.Existing != nil {
+			details["existing_hash"] = conflict.Existing.Hash
+			details["existing_size"] = conflict.Existing.Size
+		}
+		utils.JSON409(c, conflict.Error(), details)
+		return
+	}
+
+	var exceeded *repository.QuotaExceededError
+	if errors.As(err, &exceeded) {
+		writeQuotaExceeded(c, exceeded)
+		return
+	}
+
+	var violation *policyViolation
+	if errors.As(err, &violation) {
+		c.JSON(violation.status, gin.H{
+			"error":      violation.message,
+			"error_code": policyViolationCode,
+			"status":     violation.status,
+		})
+		return
+	}
+	utils.JSON500(c, "Failed to store file: "+err.Error())
+}
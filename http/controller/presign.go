@@ -0,0 +1,298 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tnqbao/gau-upload-service/shared/repository"
+	"github.com/tnqbao/gau-upload-service/shared/utils"
+)
+
+const (
+	defaultPresignExpiry = 15 * time.Minute
+	// maxPresignExpiry is the longest validity S3 accepts for a presigned URL
+	maxPresignExpiry = 7 * 24 * time.Hour
+)
+
+// CreatePresignedUpload returns a presigned PUT URL for uploading a file straight to storage.
+// It takes the UploadFile form fields (bucket, path, is_hash, on_conflict, name_template,
+// strip_metadata, user_id) plus filename, content_type, size (exact byte count, required so the
+// storage enforces it) and expires_in (seconds). Call FinalizePresignedUpload afterwards.
+func (ctrl *Controller) CreatePresignedUpload(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	bucketName := strings.TrimSpace(c.PostForm("bucket"))
+	if bucketName == "" {
+		ctrl.Provider.LoggerProvider.WarningWithContextf(ctx, "[Presigned Upload] bucket is required")
+		utils.JSON400(c, "bucket parameter is required")
+		return
+	}
+
+	customPath, err := normalizeCustomPath(c.PostForm("path"))
+	if err != nil {
+		utils.JSON400(c, invalidPathMessage(err))
+		return
+	}
+
+	isHash := parseIsHash(c.PostForm("is_hash"))
+	filename, err := normalizeFileName(c.PostForm("filename"))
+	if err != nil {
+		utils.JSON400(c, "Invalid filename: filename cannot contain '..'")
+		return
+	}
+	if !isHash && filename == "" {
+		utils.JSON400(c, "filename is required when is_hash is false")
+		return
+	}
+
+	contentType := strings.TrimSpace(c.PostForm("content_type"))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	// A presigned PUT can't carry a size range, so the exact length is signed into the URL
+	maxSize := ctrl.Config.EnvConfig.Limit.ResumableMaxSize
+	value := strings.TrimSpace(c.PostForm("size"))
+	if value == "" {
+		utils.JSON400(c, "size parameter is required")
+		return
+	}
+	size, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || size < 1 {
+		utils.JSON400(c, "size must be a positive integer")
+		return
+	}
+	if size > maxSize {
+		utils.JSON400(c, fmt.Sprintf("File size exceeds %d bytes limit", maxSize))
+		return
+	}
+
+	expiry, err := parsePresignExpiry(c.PostForm("expires_in"))
+	if err != nil {
+		utils.JSON400(c, err.Error())
+		return
+	}
+
+	// The remaining options are kept with the session and applied at finalize
+	onConflict, err := repository.ParseOnConflict(c.PostForm("on_conflict"))
+	if err != nil {
+		utils.JSON400(c, err.Error())
+		return
+	}
+	nameTemplate, err := parseNameTemplate(c.PostForm("name_template"))
+	if err != nil {
+		utils.JSON400(c, err.Error())
+		return
+	}
+
+	upload, request, err := ctrl.Repository.Direct.Create(ctx, repository.DirectUpload{
+		Bucket:        bucketName,
+		CustomPath:    customPath,
+		IsHash:        isHash,
+		OriginalName:  filename,
+		ContentType:   contentType,
+		Size:          size,
+		UserID:        strings.TrimSpace(c.PostForm("user_id")),
+		OnConflict:    onConflict,
+		NameTemplate:  nameTemplate,
+		StripMetadata: parseStripMetadata(c.PostForm("strip_metadata")),
+	}, expiry)
+	if err != nil {
+		ctrl.Provider.LoggerProvider.ErrorWithContextf(ctx, err, "[Presigned Upload] Failed to presign upload")
+		utils.JSON500(c, "Failed to create presigned upload: "+err.Error())
+		return
+	}
+
+	headers := make(map[string]string, len(request.Headers))
+	for name := range request.Headers {
+		headers[name] = request.Headers.Get(name)
+	}
+
+	ctrl.Provider.LoggerProvider.InfoWithContextf(ctx, "[Presigned Upload] Created direct upload %s for bucket %s", upload.ID, bucketName)
+	utils.JSON200(c, gin.H{
+		"upload_id":  upload.ID,
+		"url":        request.URL,
+		"method":     request.Method,
+		"headers":    headers,
+		"expires_at": upload.ExpiresAt,
+		"max_size":   maxSize,
+	})
+}
+
+// FinalizePresignedUpload hashes a directly uploaded file, verifies any client checksums, then
+// stores and registers it like UploadFile
+func (ctrl *Controller) FinalizePresignedUpload(c *gin.Context) {
+	ctx := c.Request.Context()
+	id := c.Param("id")
+
+	// Optional: checksums the client computed for the file
+	expected, err := parseChecksums(c, true)
+	if err != nil {
+		utils.JSON400(c, err.Error())
+		return
+	}
+
+	upload, err := ctrl.Repository.Direct.Get(ctx, id)
+	if err != nil {
+		if errors.Is(err, repository.ErrDirectUploadNotFound) {
+			utils.JSON404(c, "Direct upload not found")
+			return
+		}
+		ctrl.Provider.LoggerProvider.ErrorWithContextf(ctx, err, "[Presigned Upload] Failed to load direct upload %s", id)
+		utils.JSON500(c, "Failed to load direct upload: "+err.Error())
+		return
+	}
+	if upload.Expired(time.Now()) {
+		if err := ctrl.Repository.Direct.Delete(ctx, upload); err != nil {
+			ctrl.Provider.LoggerProvider.WarningWithContextf(ctx, "[Presigned Upload] Failed to discard expired direct upload %s: %v", id, err)
+		}
+		utils.JSON404(c, "Direct upload has expired")
+		return
+	}
+
+	info, err := ctrl.Repository.Direct.Stat(ctx, upload)
+	if err != nil {
+		if errors.Is(err, repository.ErrDirectUploadNotFound) {
+			utils.JSON400(c, "File has not been uploaded yet")
+			return
+		}
+		ctrl.Provider.LoggerProvider.ErrorWithContextf(ctx, err, "[Presigned Upload] Failed to check direct upload %s", id)
+		utils.JSON500(c, "Failed to check uploaded file: "+err.Error())
+		return
+	}
+
+	if maxSize := ctrl.Config.EnvConfig.Limit.ResumableMaxSize; info.Size > maxSize {
+		ctrl.Provider.LoggerProvider.WarningWithContextf(ctx, "[Presigned Upload] Direct upload %s exceeds limit: %d bytes", id, info.Size)
+		if err := ctrl.Repository.Direct.Delete(ctx, upload); err != nil {
+			ctrl.Provider.LoggerProvider.WarningWithContextf(ctx, "[Presigned Upload] Failed to discard direct upload %s: %v", id, err)
+		}
+		utils.JSON400(c, fmt.Sprintf("File size exceeds %d bytes limit", maxSize))
+		return
+	}
+
+	// The uploaded object is hashed as it streams by and copied server-side, never staged on disk
+	verifier := expected.verifier()
+	fileHash, size, head, err := ctrl.hashStagedObject(ctx, upload.Key, verifier)
+	if err != nil {
+		ctrl.Provider.LoggerProvider.ErrorWithContextf(ctx, err, "[Presigned Upload] Failed to hash direct upload %s", id)
+		utils.JSON500(c, "Failed to read uploaded file: "+err.Error())
+		return
+	}
+
+	// A mismatching upload stays staged, so the client can upload it again and retry
+	checksums, mismatch := verifier.verify(fileHash)
+	if mismatch != nil {
+		ctrl.Provider.LoggerProvider.WarningWithContextf(ctx, "[Presigned Upload] Rejected direct upload %s: %v", id, mismatch)
+		writeChecksumMismatch(c, mismatch)
+		return
+	}
+
+	response, err := ctrl.storeUpload(ctx, stagedUpload{
+		Bucket:        upload.Bucket,
+		CustomPath:    upload.CustomPath,
+		IsHash:        upload.IsHash,
+		OriginalName:  upload.OriginalName,
+		ContentType:   upload.ContentType,
+		Hash:          fileHash,
+		SniffedType:   http.DetectContentType(head),
+		Size:          size,
+		StagedKey:     upload.Key,
+		Checksums:     checksums,
+		StripMetadata: upload.StripMetadata,
+		OnConflict:    upload.OnConflict,
+		NameTemplate:  upload.NameTemplate,
+		UserID:        upload.UserID,
+	})
+	if err != nil {
+		ctrl.Provider.LoggerProvider.ErrorWithContextf(ctx, err, "[Presigned Upload] Failed to store direct upload %s", id)
+		writeStoreError(c, err)
+		return
+	}
+
+	if err := ctrl.Repository.Direct.Delete(ctx, upload); err != nil {
+		ctrl.Provider.LoggerProvider.WarningWithContextf(ctx, "[Presigned Upload] Failed to clean up direct upload %s: %v", id, err)
+	}
+
+	ctrl.Provider.LoggerProvider.InfoWithContextf(ctx, "[Presigned Upload] Finalized direct upload %s", id)
+	utils.JSON200(c, response)
+}
+
+// CreatePresignedDownload returns a presigned GET URL so a file can be downloaded straight from storage
+func (ctrl *Controller) CreatePresignedDownload(c *gin.Context) {
+	ctx := c.Request.Context()
+	filePath := c.Query("file_path")
+	bucketName := c.Query("bucket")
+
+	if filePath == "" {
+		utils.JSON400(c, "file_path is required")
+		return
+	}
+	if bucketName == "" {
+		utils.JSON400(c, "bucket parameter is required")
+		return
+	}
+
+	expiry, err := parsePresignExpiry(c.Query("expires_in"))
+	if err != nil {
+		utils.JSON400(c, err.Error())
+		return
+	}
+
+	// The path may reference a content-addressed blob
+	objectKey, err := ctrl.Repository.Blobs.Resolve(ctx, bucketName, filePath)
+	if err != nil {
+		ctrl.Provider.LoggerProvider.ErrorWithContextf(ctx, err, "[Presigned Download] Failed to resolve file path")
+		utils.JSON500(c, "Failed to resolve file: "+err.Error())
+		return
+	}
+
+	exists, err := ctrl.Infrastructure.MinioClient.ObjectExists(ctx, bucketName, objectKey)
+	if err != nil {
+		utils.JSON500(c, "Failed to check file: "+err.Error())
+		return
+	}
+	if !exists {
+		utils.JSON404(c, "File not found")
+		return
+	}
+
+	// Blobs are shared by every path, so the response headers come from this path's entry
+	contentType, filename := "", ""
+	if meta, found, err := ctrl.Repository.Metadata.GetFileByPath(ctx, bucketName, filePath); err == nil && found {
+		contentType, filename = meta.ContentType, meta.OriginalName
+	}
+
+	request, err := ctrl.Infrastructure.MinioClient.PresignGetObject(ctx, bucketName, objectKey, contentType, filename, expiry)
+	if err != nil {
+		ctrl.Provider.LoggerProvider.ErrorWithContextf(ctx, err, "[Presigned Download] Failed to presign download")
+		utils.JSON500(c, "Failed to create presigned download: "+err.Error())
+		return
+	}
+
+	utils.JSON200(c, gin.H{
+		"url":        request.URL,
+		"method":     request.Method,
+		"bucket":     bucketName,
+		"file_path":  filePath,
+		"expires_at": time.Now().Add(expiry),
+	})
+}
+
+// parsePresignExpiry reads an expires_in value in seconds
+func parsePresignExpiry(value string) (time.Duration, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return defaultPresignExpiry, nil
+	}
+
+	seconds, err := strconv.Atoi(value)
+	if err != nil || seconds < 1 || time.Duration(seconds)*time.Second > maxPresignExpiry {
+		return 0, fmt.Errorf("expires_in must be between 1 and %d seconds", int(maxPresignExpiry.Seconds()))
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
@@ -0,0 +1,104 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/tnqbao/gau-upload-service/shared/repository"
+	"github.com/tnqbao/gau-upload-service/shared/utils"
+)
+
+// maxSanitizeSourcePixels bounds the decoded size of an image rotated to apply its orientation
+const maxSanitizeSourcePixels = 50_000_000
+
+// parseStripMetadata reads a strip_metadata value, which is opt-in
+func parseStripMetadata(value string) bool {
+	value = strings.ToLower(strings.TrimSpace(value))
+	return value == "true" || value == "1"
+}
+
+// stripImageMetadata removes EXIF/XMP metadata from JPEG and PNG content and applies the EXIF
+// orientation to the pixels. The staged content is rewritten in place and hashed again, so
+// deduplication works on the sanitized bytes; client checksums describe the original and are
+// dropped. Other content types are left alone; content declared as JPEG or PNG that isn't one, or
+// whose structure can't be followed, is refused rather than stored with its metadata.
+func (ctrl *Controller) stripImageMetadata(ctx context.Context, upload *stagedUpload) error {
+	if upload.Sanitized {
+		return nil
+	}
+	upload.Sanitized = true
+
+	mediaType, _, err := mime.ParseMediaType(upload.ContentType)
+	if err != nil || (mediaType != "image/jpeg" && mediaType != "image/png") {
+		return nil
+	}
+
+	// Check the magic bytes before reading the whole content into memory
+	head, err := ctrl.readHead(ctx, upload, 8)
+	if err != nil {
+		return err
+	}
+	if !utils.IsSanitizableImage(head) {
+		return &policyViolation{
+			status:  http.StatusBadRequest,
+			message: "Content declared as " + mediaType + " is not a JPEG or PNG image",
+		}
+	}
+
+	var data []byte
+	if upload.Content != nil {
+		if _, err := upload.Content.Seek(0, io.SeekStart); err != nil {
+			return fmt.Errorf("failed to read file: %w", err)
+		}
+		if data, err = io.ReadAll(upload.Content); err != nil {
+			return fmt.Errorf("failed to read file: %w", err)
+		}
+	} else {
+		if data, _, err = ctrl.Infrastructure.MinioClient.GetObjectFromBucket(ctx, repository.PendingBucket, upload.StagedKey); err != nil {
+			return fmt.Errorf("failed to read staged file: %w", err)
+		}
+	}
+
+	sanitized, changed, err := utils.SanitizeImage(data, maxSanitizeSourcePixels)
+	if errors.Is(err, utils.ErrImageTooLarge) {
+		return &policyViolation{
+			status:  http.StatusRequestEntityTooLarge,
+			message: "Image is too large to normalize its orientation",
+		}
+	}
+	if err != nil {
+		return &policyViolation{
+			status:  http.StatusBadRequest,
+			message: "Failed to sanitize image: " + err.Error(),
+		}
+	}
+	if !changed {
+		return nil
+	}
+
+	if upload.Content != nil {
+		if err := upload.Content.Truncate(0); err != nil {
+			return fmt.Errorf("failed to rewrite file: %w", err)
+		}
+		if _, err := upload.Content.WriteAt(sanitized, 0); err != nil {
+			return fmt.Errorf("failed to rewrite file: %w", err)
+		}
+	} else if err := ctrl.Repository.Streams.Replace(ctx, upload.StagedKey, bytes.NewReader(sanitized), upload.ContentType); err != nil {
+		return fmt.Errorf("failed to rewrite staged file: %w", err)
+	}
+
+	sum := sha256.Sum256(sanitized)
+	ctrl.Provider.LoggerProvider.InfoWithContextf(ctx, "[Upload File] Stripped image metadata from %s: %d -> %d bytes", upload.OriginalName, upload.Size, len(sanitized))
+	upload.Hash = hex.EncodeToString(sum[:])
+	upload.Size = int64(len(sanitized))
+	upload.Checksums = nil
+	return nil
+}
@@ -0,0 +1,540 @@
+package controller
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tnqbao/gau-upload-service/shared/config"
+	"github.com/tnqbao/gau-upload-service/shared/infra"
+	"github.com/tnqbao/gau-upload-service/shared/repository"
+	"github.com/tnqbao/gau-upload-service/shared/utils"
+)
+
+// errInvalidPath rejects upload folders that could escape their parent
+var errInvalidPath = errors.New("invalid path: path cannot contain '..'")
+
+// errReservedPath rejects upload folders inside the areas holding shared content
+var errReservedPath = errors.New("invalid path: _blobs/ and _variants/ are reserved")
+
+// errInvalidFileName rejects client file names that are not a plain name
+var errInvalidFileName = errors.New("invalid filename: filename cannot contain '..'")
+
+// stagedUpload is hashed content waiting in a local temp file, or a staging object, to be stored
+// under its final path
+type stagedUpload struct {
+	Bucket        string
+	CustomPath    string // already normalized by normalizeCustomPath
+	IsHash        bool
+	OriginalName  string
+	ContentType   string // detected from the content when empty
+	Hash          string
+	Size          int64
+	Content       *os.File
+	StagedKey     string            // staging object in the pending bucket holding the content when Content is nil
+	Checksums     map[string]string // client checksums verified against the content, stored as object metadata
+	StripMetadata bool              // EXIF/XMP are removed from JPEG and PNG content before it is stored
+	Sanitized     bool              // the content was already checked by stripImageMetadata
+	SniffedType   string            // detected from the first 512 bytes; sniffed on demand when empty
+	OnConflict    string            // what a non-hash upload does when its path is taken, overwrite when empty
+	NameTemplate  string            // names the file instead of IsHash; the bucket's template when empty
+	FileName      string            // rendered by applyNameTemplate
+	UserID        string            // user the file counts against for quotas, from the user_id field
+}
+
+// normalizeCustomPath cleans an upload folder: no leading/trailing slashes, forward slashes only,
+// no empty segments. Paths containing ".." or inside the reserved blob and variant areas are rejected.
+func normalizeCustomPath(customPath string) (string, error) {
+	customPath = strings.TrimSpace(customPath)
+	if customPath == "" {
+		return "", nil
+	}
+
+	// Clean and normalize path: remove leading/trailing slashes, replace backslashes
+	customPath = strings.Trim(customPath, "/\\")
+	customPath = strings.ReplaceAll(customPath, "\\", "/")
+
+	// Remove any double slashes
+	for strings.Contains(customPath, "//") {
+		customPath = strings.ReplaceAll(customPath, "//", "/")
+	}
+
+	// Validate path doesn't contain dangerous characters
+	if strings.Contains(customPath, "..") {
+		return "", errInvalidPath
+	}
+	if repository.IsReservedKey(customPath + "/") {
+		return "", errReservedPath
+	}
+	return customPath, nil
+}
+
+// invalidPathMessage answers a path rejected by normalizeCustomPath
+func invalidPathMessage(err error) string {
+	message := err.Error()
+	return strings.ToUpper(message[:1]) + message[1:]
+}
+
+// normalizeFileName keeps only the last element of a client file name, so a name can't add
+// folders to the stored path. Names containing ".." are rejected; an empty name stays empty.
+func normalizeFileName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", nil
+	}
+
+	name = path.Base(strings.ReplaceAll(name, "\\", "/"))
+	if name == "/" || name == "." || strings.Contains(name, "..") {
+		return "", errInvalidFileName
+	}
+	return name, nil
+}
+
+// parseIsHash reads an is_hash value, which defaults to true for backward compatibility
+func parseIsHash(value string) bool {
+	value = strings.ToLower(strings.TrimSpace(value))
+	return value != "false" && value != "0"
+}
+
+// parseNameTemplate reads a name_template value; empty keeps the bucket's template or is_hash
+func parseNameTemplate(value string) (string, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return "", nil
+	}
+	if err := utils.ValidateNameTemplate(value); err != nil {
+		return "", err
+	}
+	return value, nil
+}
+
+// stageToTempFile copies src into a new temp file while hashing it with SHA-256.
+// The caller must close and remove the returned file.
+func (ctrl *Controller) stageToTempFile(src io.Reader) (*os.File, string, int64, error) {
+	tempFile, err := ctrl.createTempFile()
+	if err != nil {
+		return nil, "", 0, err
+	}
+
+	// Stream from source to both temp file and hasher
+	hasher := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tempFile, hasher), src)
+	if err != nil {
+		tempFile.Close()
+		os.Remove(tempFile.Name())
+		return nil, "", 0, fmt.Errorf("failed to stream file: %w", err)
+	}
+
+	return tempFile, hex.EncodeToString(hasher.Sum(nil)), size, nil
+}
+
+// hashStagedObject streams an object of the pending bucket through SHA-256 and the checksum
+// verifier without keeping it, so it can be stored by a server-side copy. It also returns the
+// first 512 bytes, to sniff the content type.
+func (ctrl *Controller) hashStagedObject(ctx context.Context, key string, verifier *checksumVerifier) (string, int64, []byte, error) {
+	stream, _, err := ctrl.Infrastructure.MinioClient.GetObjectStream(ctx, repository.PendingBucket, key)
+	if err != nil {
+		return "", 0, nil, err
+	}
+	defer stream.Close()
+
+	hasher := sha256.New()
+	head := &headBuffer{limit: 512}
+	size, err := io.Copy(io.MultiWriter(hasher, head), verifier.wrap(stream))
+	if err != nil {
+		return "", 0, nil, fmt.Errorf("failed to stream file: %w", err)
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), size, head.data, nil
+}
+
+// headBuffer keeps the first limit bytes written to it
+type headBuffer struct {
+	data  []byte
+	limit int
+}
+
+func (b *headBuffer) Write(p []byte) (int, error) {
+	if room := b.limit - len(b.data); room > 0 {
+		b.data = append(b.data, p[:min(room, len(p))]...)
+	}
+	return len(p), nil
+}
+
+// createTempFile creates an empty file in the configured temp dir
+func (ctrl *Controller) createTempFile() (*os.File, error) {
+	tempDir := ctrl.Config.EnvConfig.ChunkConfig.TempDir
+	if tempDir == "" {
+		tempDir = os.TempDir()
+	}
+	// Ensure temp dir exists
+	if err := os.MkdirAll(tempDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create temp dir: %w", err)
+	}
+
+	tempFile, err := os.CreateTemp(tempDir, "upload-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temp file: %w", err)
+	}
+	return tempFile, nil
+}
+
+// removeTempFile closes and deletes a file created by stageToTempFile
+func removeTempFile(file *os.File) {
+	file.Close()
+	os.Remove(file.Name()) // Clean up temp file
+}
+
+// preparedUpload is a staged file whose content is stored but whose reference is not recorded yet.
+// ref is nil when the path already references the same content and nothing has to be recorded.
+type preparedUpload struct {
+	response     gin.H
+	ref          *repository.PendingReference
+	sourcePath   string // another path already referencing the content, if any
+	variants     []repository.UploadVariant
+	variantNames []string               // names of the variants listed in the response
+	claim        *repository.PathClaim  // reserves the path until the reference is committed
+	skipped      bool                   // on_conflict=skip kept the file already at the path
+	usage        repository.UsageChange // what the reference changes in the usage counters
+}
+
+// storeUpload checks a staged file against its bucket policy, names it, creates its folders and
+// stores it with deduplication. Policy violations are returned as *policyViolation.
+// It returns the response body shared by every upload endpoint.
+func (ctrl *Controller) storeUpload(ctx context.Context, upload stagedUpload) (gin.H, error) {
+	prepared, err := ctrl.prepareUpload(ctx, upload)
+	if err != nil {
+		return nil, err
+	}
+
+	defer prepared.claim.Release(ctx)
+
+	if prepared.ref != nil {
+		ctrl.publishUploadCreated(ctx, prepared)
+		if err := ctrl.Repository.Blobs.Commit(ctx, []*repository.PendingReference{prepared.ref}); err != nil {
+			return nil, fmt.Errorf("failed to upload file: %w", err)
+		}
+	}
+	return ctrl.uploadResponse(ctx, prepared), nil
+}
+
+// prepareUpload does everything storeUpload does except recording the reference, so callers
+// storing several files can commit them together. Callers release prepared.claim once the
+// reference is committed or dropped.
+func (ctrl *Controller) prepareUpload(ctx context.Context, upload stagedUpload) (*preparedUpload, error) {
+	contentType, err := ctrl.detectContentType(ctx, &upload)
+	if err != nil {
+		return nil, err
+	}
+	upload.ContentType = contentType
+
+	if err := ctrl.applyUploadPolicy(ctx, &upload); err != nil {
+		return nil, err
+	}
+
+	fullPath := uploadPath(upload)
+	if upload.IsHash || upload.OnConflict == "" || upload.OnConflict == repository.ConflictOverwrite {
+		return ctrl.prepareUploadAt(ctx, upload, fullPath)
+	}
+
+	// Without hash naming, a path may hold other content that on_conflict protects
+	requestedPath := fullPath
+	fullPath, claim, existing, err := ctrl.claimUploadPath(ctx, upload, fullPath)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		ctrl.Provider.LoggerProvider.InfoWithContextf(ctx, "[Upload File] Skipped upload to existing path: %s", fullPath)
+		return skippedUpload(upload, fullPath, existing), nil
+	}
+
+	prepared, err := ctrl.prepareUploadAt(ctx, upload, fullPath)
+	if err != nil {
+		claim.Release(ctx)
+		return nil, err
+	}
+	prepared.claim = claim
+	if fullPath != requestedPath {
+		prepared.response["renamed_from"] = requestedPath
+	}
+	return prepared, nil
+}
+
+// skippedUpload is the result of an upload kept out by the file already stored at fullPath
+func skippedUpload(upload stagedUpload, fullPath string, existing *repository.ExistingFile) *preparedUpload {
+	response := gin.H{
+		"file_path": fullPath,
+		"bucket":    upload.Bucket,
+	}
+	if existing.Hash != "" {
+		response["file_hash"] = existing.Hash
+		response["content_type"] = existing.ContentType
+		response["size"] = existing.Size
+	}
+	return &preparedUpload{response: response, skipped: true}
+}
+
+// prepareUploadAt is prepareUpload once the path of the upload is settled
+func (ctrl *Controller) prepareUploadAt(ctx context.Context, upload stagedUpload, fullPath string) (*preparedUpload, error) {
+	contentType := upload.ContentType
+	if upload.CustomPath != "" {
+		ctrl.Provider.LoggerProvider.InfoWithContextf(ctx, "[Upload File] Upload to path: %s", fullPath)
+	} else {
+		ctrl.Provider.LoggerProvider.InfoWithContextf(ctx, "[Upload File] Upload to root: %s", fullPath)
+	}
+
+	// If custom path provided, ensure folders exist in MinIO FIRST
+	// Skipped when the bucket policy disables folder markers, e.g. for the "pending" bucket
+	if upload.CustomPath != "" && ctrl.Config.Policy.For(upload.Bucket).CreatesFolderMarkers() {
+		segments := strings.Split(upload.CustomPath, "/")
+		for i := 0; i < len(segments); i++ {
+			folder := strings.Join(segments[:i+1], "/")
+			if err := ctrl.Infrastructure.MinioClient.CreateFolderIfNotExist(ctx, upload.Bucket, folder); err != nil {
+				// Don't fail hard on folder creation if it might exist
+				ctrl.Provider.LoggerProvider.WarningWithContextf(ctx, "[Upload File] Warning: Failed to create folder %s: %v", folder, err)
+			}
+		}
+	}
+
+	prepared := &preparedUpload{
+		response: gin.H{
+			"file_path":    fullPath,
+			"file_hash":    upload.Hash,
+			"bucket":       upload.Bucket,
+			"content_type": contentType,
+			"size":         upload.Size,
+		},
+	}
+
+	// A path already referencing this content needs no work
+	current, found, err := ctrl.Repository.Metadata.GetFileByPath(ctx, upload.Bucket, fullPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check file existence: %w", err)
+	}
+	// Variants dropped because their event couldn't be published are recorded again below
+	variants := ctrl.imageVariants(upload.Hash, contentType, upload.Size)
+	if found && current.FileHash == upload.Hash && (current.Variants != "" || len(variants) == 0) {
+		prepared.variantNames = current.VariantNames()
+		if len(prepared.variantNames) > 0 {
+			ctrl.republishMissingVariants(ctx, current)
+		}
+		return prepared, nil
+	}
+
+	// Check if the content is already referenced by another path in the metadata store
+	existingFile, exists, err := ctrl.Repository.Metadata.CheckFileByHash(ctx, upload.Bucket, upload.Hash)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check file existence: %w", err)
+	}
+	if exists && existingFile != fullPath {
+		prepared.sourcePath = existingFile
+	}
+
+	metadata := map[string]string{
+		"file-hash":     upload.Hash,
+		"original-name": upload.OriginalName,
+		"content-type":  contentType,
+	}
+	for key, value := range upload.Checksums {
+		metadata[key] = value
+	}
+
+	fileMetadata := infra.FileMetadata{
+		FileHash:     upload.Hash,
+		FilePath:     fullPath,
+		BucketName:   upload.Bucket,
+		OriginalName: upload.OriginalName,
+		ContentType:  contentType,
+		FileSize:     upload.Size,
+		UploadedAt:   time.Now(),
+		UserID:       upload.UserID,
+	}
+
+	// Quotas count the entry this upload adds, or how much it grows the one it replaces
+	prepared.usage = repository.UsageChange{Next: fileMetadata}
+	if found {
+		prepared.usage.Previous = &current
+	}
+	if err := ctrl.Repository.Usage.Check(ctx, ctrl.Config.Policy, prepared.usage); err != nil {
+		return nil, err
+	}
+
+	// Image variants are generated by the consumer under predictable keys
+	prepared.variants = variants
+	if len(prepared.variants) > 0 {
+		fileMetadata.Variants = joinVariantNames(prepared.variants)
+		prepared.variantNames = fileMetadata.VariantNames()
+	}
+
+	// Content is stored once per hash; the path becomes a reference to it
+	if upload.Content != nil {
+		prepared.ref, err = ctrl.Repository.Blobs.Prepare(ctx, fileMetadata, upload.Content, metadata)
+	} else {
+		prepared.ref, err = ctrl.Repository.Blobs.PrepareCopy(ctx, fileMetadata, repository.PendingBucket, upload.StagedKey, metadata)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to upload file: %w", err)
+	}
+	return prepared, nil
+}
+
+// uploadResponse completes the response of a stored upload once its reference is recorded
+func (ctrl *Controller) uploadResponse(ctx context.Context, prepared *preparedUpload) gin.H {
+	response := prepared.response
+	fullPath, hash := response["file_path"], response["file_hash"]
+
+	if len(prepared.variantNames) > 0 {
+		response["variants"] = variantsJSON(hash.(string), prepared.variantNames)
+	}
+
+	switch {
+	case prepared.skipped:
+		ctrl.Provider.LoggerProvider.InfoWithContextf(ctx, "[Upload File] Kept existing file at %s (on_conflict=skip)", fullPath)
+		response["message"] = "File already exists (skipped)"
+		response["skipped"] = true
+		response["duplicated"] = false
+	case prepared.ref == nil:
+		// Same file at same path - true duplicate
+		ctrl.Provider.LoggerProvider.InfoWithContextf(ctx, "[Upload File] File already exists at exact path: %s (hash: %s)", fullPath, hash)
+		response["message"] = "File already exists (deduplicated)"
+		response["duplicated"] = true
+	case prepared.ref.Reused:
+		ctrl.Provider.LoggerProvider.InfoWithContextf(ctx, "[Upload File] Path %s now references existing content (hash: %s)", fullPath, hash)
+		response["message"] = "File linked to existing content"
+		response["duplicated"] = true
+		if prepared.sourcePath != "" {
+			response["source_path"] = prepared.sourcePath
+		}
+	default:
+		ctrl.Provider.LoggerProvider.InfoWithContextf(ctx, "[Upload File] File uploaded successfully: %s (hash: %s)", fullPath, hash)
+		response["message"] = "File uploaded successfully"
+		response["duplicated"] = false
+	}
+	return response
+}
+
+// detectContentType returns the declared content type, or the one sniffed from the content
+func (ctrl *Controller) detectContentType(ctx context.Context, upload *stagedUpload) (string, error) {
+	if upload.ContentType != "" {
+		return upload.ContentType, nil
+	}
+	return ctrl.sniffContentType(ctx, upload)
+}
+
+// sniffContentType detects the content type from the first 512 bytes of the content, reading
+// them from the temp file or the staging object unless the caller already set SniffedType
+func (ctrl *Controller) sniffContentType(ctx context.Context, upload *stagedUpload) (string, error) {
+	if upload.SniffedType != "" {
+		return upload.SniffedType, nil
+	}
+
+	head, err := ctrl.readHead(ctx, upload, 512)
+	if err != nil {
+		return "", err
+	}
+	upload.SniffedType = http.DetectContentType(head)
+	return upload.SniffedType, nil
+}
+
+// readHead returns up to the first n bytes of the content, from the temp file or the staging object
+func (ctrl *Controller) readHead(ctx context.Context, upload *stagedUpload, n int) ([]byte, error) {
+	if upload.Content != nil {
+		buffer := make([]byte, n)
+		read, err := upload.Content.ReadAt(buffer, 0)
+		if err != nil && err != io.EOF {
+			return nil, fmt.Errorf("failed to read file: %w", err)
+		}
+		return buffer[:read], nil
+	}
+
+	stream, _, err := ctrl.Infrastructure.MinioClient.GetObjectStream(ctx, repository.PendingBucket, upload.StagedKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read staged file: %w", err)
+	}
+	defer stream.Close()
+	head, err := io.ReadAll(io.LimitReader(stream, int64(n)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read staged file: %w", err)
+	}
+	return head, nil
+}
+
+// uploadPath returns the path a staged file is stored at: its templated name, hash or original
+// name, inside its folder. upload.ContentType must already be detected.
+func uploadPath(upload stagedUpload) string {
+	// Construct file name based on name_template and is_hash parameters
+	var fileName string
+	switch {
+	case upload.FileName != "":
+		// Rendered from a name template
+		fileName = upload.FileName
+	case upload.IsHash:
+		// Use hash as filename
+		fileName = upload.Hash + uploadExt(upload)
+	default:
+		// Use original filename directly (preserve spaces and Unicode characters)
+		fileName = upload.OriginalName
+	}
+
+	// Path will be: path/filename (e.g., "abc/def/file.jpg" or "abc/def/abc123.jpg")
+	if upload.CustomPath != "" {
+		return fmt.Sprintf("%s/%s", upload.CustomPath, fileName)
+	}
+	// No path specified, save to root: filename
+	return fileName
+}
+
+// uploadExt returns the extension of the original name, or one matching the content type
+func uploadExt(upload stagedUpload) string {
+	return utils.FileExtension(upload.OriginalName, upload.ContentType)
+}
+
+// applyNameTemplate renders the name template of an upload, or the one of its bucket, once its
+// hash is final. Names keep the first rendering, so {uuid} and dates don't change between calls.
+func applyNameTemplate(upload *stagedUpload, policy config.BucketPolicy) error {
+	template := upload.NameTemplate
+	if template == "" {
+		template = policy.NameTemplate
+	}
+	if template == "" || upload.FileName != "" {
+		return nil
+	}
+
+	if err := utils.CheckHashNaming(template, policy.HashNaming()); err != nil {
+		return &policyViolation{
+			status:  http.StatusBadRequest,
+			message: fmt.Sprintf("Bucket %s names files by hash: %s", upload.Bucket, err.Error()),
+		}
+	}
+
+	upload.FileName = utils.RenderNameTemplate(template, utils.NameTemplateValues{
+		Hash:         upload.Hash,
+		OriginalName: upload.OriginalName,
+		Ext:          uploadExt(*upload),
+		Time:         time.Now(),
+	})
+	if upload.FileName == "" {
+		return &policyViolation{
+			status:  http.StatusBadRequest,
+			message: fmt.Sprintf("name_template %q produced an empty name", template),
+		}
+	}
+	if repository.IsReservedKey(path.Join(upload.CustomPath, upload.FileName)) {
+		return &policyViolation{
+			status:  http.StatusBadRequest,
+			message: fmt.Sprintf("name_template %q produced a name inside _blobs/ or _variants/", template),
+		}
+	}
+
+	// A name holding the whole hash can only reference that content, like is_hash names
+	upload.IsHash = utils.NamesByHash(template)
+	return nil
+}
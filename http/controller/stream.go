@@ -0,0 +1,253 @@
+package controller
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tnqbao/gau-upload-service/shared/repository"
+	"github.com/tnqbao/gau-upload-service/shared/utils"
+)
+
+// maxStreamFieldSize bounds the text fields read alongside a streamed file
+const maxStreamFieldSize = 64 * 1024
+
+// sizeLimitReader fails once more than limit bytes have been read
+type sizeLimitReader struct {
+	r        io.Reader
+	limit    int64
+	read     int64
+	exceeded bool
+}
+
+func (l *sizeLimitReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.read += int64(n)
+	if l.read > l.limit {
+		l.exceeded = true
+		return n, fmt.Errorf("file size exceeds %d bytes limit", l.limit)
+	}
+	return n, err
+}
+
+// disklessUpload reports whether UploadFile streams the request to a staging object. The diskless
+// query parameter overrides UPLOAD_DISKLESS.
+func (ctrl *Controller) disklessUpload(c *gin.Context) bool {
+	value := strings.ToLower(strings.TrimSpace(c.Query("diskless")))
+	if value == "" {
+		return ctrl.Config.EnvConfig.Upload.Diskless
+	}
+	return value == "true" || value == "1"
+}
+
+// uploadFileDiskless is UploadFile in a single pass: the multipart stream is hashed while it is
+// piped to a staging object, then the staging object is copied server-side into the blob area,
+// or deleted when the content is already stored. Nothing is written under TEMP_DIR.
+// Form fields may come before or after the file.
+func (ctrl *Controller) uploadFileDiskless(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	reader, err := c.Request.MultipartReader()
+	if err != nil {
+		ctrl.Provider.LoggerProvider.ErrorWithContextf(ctx, err, "[Upload File] Failed to read multipart stream")
+		utils.JSON400(c, "Failed to get file: "+err.Error())
+		return
+	}
+
+	var (
+		fields      = make(map[string]string)
+		stagedKey   string
+		filename    string
+		contentType string
+		sniffedType string
+		fileHash    string
+		size        int64
+	)
+	verifier := streamVerifier()
+
+	// The staging object is only needed until the upload is stored
+	defer func() {
+		if stagedKey != "" {
+			if err := ctrl.Repository.Streams.Delete(context.WithoutCancel(ctx), stagedKey); err != nil {
+				ctrl.Provider.LoggerProvider.WarningWithContextf(ctx, "[Upload File] Failed to delete staging object %s: %v", stagedKey, err)
+			}
+		}
+	}()
+
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			ctrl.Provider.LoggerProvider.ErrorWithContextf(ctx, err, "[Upload File] Failed to read multipart stream")
+			utils.JSON400(c, "Failed to read form data: "+err.Error())
+			return
+		}
+
+		if part.FileName() == "" {
+			value, err := io.ReadAll(io.LimitReader(part, maxStreamFieldSize+1))
+			part.Close()
+			if err != nil {
+				utils.JSON400(c, "Failed to read form data: "+err.Error())
+				return
+			}
+			if len(value) > maxStreamFieldSize {
+				utils.JSON400(c, fmt.Sprintf("Form field %s is too large", part.FormName()))
+				return
+			}
+			if _, ok := fields[part.FormName()]; !ok {
+				fields[part.FormName()] = string(value)
+			}
+			continue
+		}
+
+		if part.FormName() != "file" {
+			part.Close()
+			continue
+		}
+		if stagedKey != "" {
+			part.Close()
+			utils.JSON400(c, "Only one file can be uploaded, use /files/batch for several")
+			return
+		}
+
+		if filename, err = normalizeFileName(part.FileName()); err != nil {
+			part.Close()
+			utils.JSON400(c, "Invalid filename: filename cannot contain '..'")
+			return
+		}
+		contentType = part.Header.Get("Content-Type")
+
+		// Sniff the content type from the head of the stream, like sniffContentType
+		buffered := bufio.NewReaderSize(part, 512)
+		head, err := buffered.Peek(512)
+		if err != nil && err != io.EOF {
+			part.Close()
+			utils.JSON400(c, "Failed to read file: "+err.Error())
+			return
+		}
+		sniffedType = http.DetectContentType(head)
+		if contentType == "" {
+			contentType = sniffedType
+		}
+
+		// The bucket policy sets the limit when the bucket field came first; otherwise no bucket
+		// may accept more, and the exact policy is checked once the file is staged
+		limit := ctrl.Config.Policy.LargestMaxSize(ctrl.Config.EnvConfig.Limit.FileMaxSize)
+		if bucket := strings.TrimSpace(fields["bucket"]); bucket != "" {
+			limit = ctrl.maxUploadSize(bucket)
+		}
+		limited := &sizeLimitReader{r: buffered, limit: limit}
+		hasher := sha256.New()
+		stagedKey, err = ctrl.Repository.Streams.Stage(ctx, verifier.wrap(io.TeeReader(limited, hasher)), contentType)
+		part.Close()
+		if err != nil {
+			if limited.exceeded {
+				ctrl.Provider.LoggerProvider.WarningWithContextf(ctx, "[Upload File] File size exceeds limit: more than %d bytes", limited.limit)
+				utils.JSON400(c, fmt.Sprintf("File size exceeds %d bytes limit", limited.limit))
+				return
+			}
+			ctrl.Provider.LoggerProvider.ErrorWithContextf(ctx, err, "[Upload File] Failed to stream file to staging object")
+			utils.JSON500(c, "Failed to stream file: "+err.Error())
+			return
+		}
+		fileHash = hex.EncodeToString(hasher.Sum(nil))
+		size = limited.read
+	}
+
+	if stagedKey == "" {
+		ctrl.Provider.LoggerProvider.WarningWithContextf(ctx, "[Upload File] file is required")
+		utils.JSON400(c, "Failed to get file: "+http.ErrMissingFile.Error())
+		return
+	}
+
+	bucketName := strings.TrimSpace(fields["bucket"])
+	if bucketName == "" {
+		ctrl.Provider.LoggerProvider.WarningWithContextf(ctx, "[Upload File] bucket is required")
+		utils.JSON400(c, "bucket parameter is required")
+		return
+	}
+
+	if maxSize := ctrl.maxUploadSize(bucketName); size > maxSize {
+		ctrl.Provider.LoggerProvider.WarningWithContextf(ctx, "[Upload File] File size exceeds limit: %d bytes", size)
+		utils.JSON400(c, fmt.Sprintf("File size exceeds %d bytes limit", maxSize))
+		return
+	}
+
+	customPath, err := normalizeCustomPath(fields["path"])
+	if err != nil {
+		ctrl.Provider.LoggerProvider.WarningWithContextf(ctx, "[Upload File] Invalid path: %v", err)
+		utils.JSON400(c, invalidPathMessage(err))
+		return
+	}
+
+	onConflict, err := repository.ParseOnConflict(fields["on_conflict"])
+	if err != nil {
+		utils.JSON400(c, err.Error())
+		return
+	}
+	nameTemplate, err := parseNameTemplate(fields["name_template"])
+	if err != nil {
+		utils.JSON400(c, err.Error())
+		return
+	}
+
+	// Checksum fields may follow the file, so every digest was computed while streaming
+	verifier.expected, err = parseChecksumValues(c, func(name string) string { return fields[name] })
+	if err != nil {
+		utils.JSON400(c, err.Error())
+		return
+	}
+	checksums, mismatch := verifier.verify(fileHash)
+	if mismatch != nil {
+		ctrl.Provider.LoggerProvider.WarningWithContextf(ctx, "[Upload File] Rejected upload: %v", mismatch)
+		writeChecksumMismatch(c, mismatch)
+		return
+	}
+
+	isHash := parseIsHash(fields["is_hash"])
+	stripMetadata := parseStripMetadata(fields["strip_metadata"])
+	userID := strings.TrimSpace(fields["user_id"])
+
+	// Same fingerprint as UploadFile, so a retry may switch modes
+	idempotent, proceed := ctrl.beginIdempotentRequest(c, idempotencyFingerprint(
+		http.MethodPost, "file", bucketName, customPath, strconv.FormatBool(isHash), onConflict,
+		nameTemplate, strconv.FormatBool(stripMetadata), userID, filename, fileHash,
+	))
+	if !proceed {
+		return
+	}
+	defer idempotent.finish(c)
+
+	response, err := ctrl.storeUpload(ctx, stagedUpload{
+		Bucket:        bucketName,
+		CustomPath:    customPath,
+		IsHash:        isHash,
+		OriginalName:  filename,
+		ContentType:   contentType,
+		SniffedType:   sniffedType,
+		Hash:          fileHash,
+		Size:          size,
+		StagedKey:     stagedKey,
+		Checksums:     checksums,
+		StripMetadata: stripMetadata,
+		OnConflict:    onConflict,
+		NameTemplate:  nameTemplate,
+		UserID:        userID,
+	})
+	if err != nil {
+		ctrl.Provider.LoggerProvider.ErrorWithContextf(ctx, err, "[Upload File] Failed to store file")
+		writeStoreError(c, err)
+		return
+	}
+
+	utils.JSON200(c, response)
+}
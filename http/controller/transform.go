@@ -0,0 +1,215 @@
+package controller
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tnqbao/gau-upload-service/shared/repository"
+	"github.com/tnqbao/gau-upload-service/shared/utils"
+)
+
+const (
+	// maxTransformDimension bounds the width and height a transform can request
+	maxTransformDimension = 4096
+	// maxTransformSourcePixels bounds the decoded size of a source image (about 200MB as RGBA)
+	maxTransformSourcePixels = 50_000_000
+)
+
+// imageTransform is a resize and/or re-encode requested on GetFile
+type imageTransform struct {
+	width   int // 0 keeps the aspect ratio from height, or the source width
+	height  int
+	fit     string
+	quality int
+	format  string // empty keeps the source format
+}
+
+// parseImageTransform reads the width, height, fit, quality and format query parameters.
+// It returns nil when none is set.
+func parseImageTransform(c *gin.Context) (*imageTransform, error) {
+	requested := false
+	for _, name := range []string{"width", "height", "fit", "quality", "format"} {
+		if strings.TrimSpace(c.Query(name)) != "" {
+			requested = true
+		}
+	}
+	if !requested {
+		return nil, nil
+	}
+
+	t := &imageTransform{fit: utils.FitContain, quality: utils.DefaultImageQuality}
+	var err error
+	if t.width, err = parseTransformDimension(c.Query("width"), "width"); err != nil {
+		return nil, err
+	}
+	if t.height, err = parseTransformDimension(c.Query("height"), "height"); err != nil {
+		return nil, err
+	}
+
+	if fit := strings.ToLower(strings.TrimSpace(c.Query("fit"))); fit != "" {
+		switch fit {
+		case utils.FitContain, utils.FitCover, utils.FitFill:
+			t.fit = fit
+		default:
+			return nil, fmt.Errorf("fit must be one of contain, cover or fill")
+		}
+	}
+
+	if value := strings.TrimSpace(c.Query("quality")); value != "" {
+		t.quality, err = strconv.Atoi(value)
+		if err != nil || t.quality < 1 || t.quality > 100 {
+			return nil, fmt.Errorf("quality must be between 1 and 100")
+		}
+	}
+
+	if format := strings.ToLower(strings.TrimSpace(c.Query("format"))); format != "" {
+		switch format {
+		case "jpeg", "jpg":
+			t.format = "jpeg"
+		case "png", "gif":
+			t.format = format
+		default:
+			return nil, fmt.Errorf("format must be one of jpeg, png or gif")
+		}
+	}
+	return t, nil
+}
+
+func parseTransformDimension(value, name string) (int, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, nil
+	}
+	dimension, err := strconv.Atoi(value)
+	if err != nil || dimension < 1 || dimension > maxTransformDimension {
+		return 0, fmt.Errorf("%s must be between 1 and %d", name, maxTransformDimension)
+	}
+	return dimension, nil
+}
+
+// derivativeName names the cached result of the transform in format, e.g. w256_h0_contain_q85.jpg.
+// Parameters that don't change the output are normalized so equivalent requests share a derivative.
+func (t *imageTransform) derivativeName(format string) string {
+	fit := t.fit
+	if t.width == 0 || t.height == 0 {
+		fit = utils.FitContain
+	}
+	quality := t.quality
+	ext := ".jpg"
+	if format != "jpeg" {
+		quality = 0
+		ext = "." + format
+	}
+	return fmt.Sprintf("w%d_h%d_%s_q%d%s", t.width, t.height, fit, quality, ext)
+}
+
+// serveTransformed answers GetFile with a transformed copy of the image at objectKey. Results are
+// cached in the derivatives bucket by source hash and parameters.
+func (ctrl *Controller) serveTransformed(c *gin.Context, bucketName, filePath, objectKey string, transform *imageTransform) {
+	ctx := c.Request.Context()
+
+	// Paths without a metadata entry fall back to the object's own metadata
+	hash, contentType, size := "", "", int64(0)
+	if meta, found, err := ctrl.Repository.Metadata.GetFileByPath(ctx, bucketName, filePath); err == nil && found {
+		hash, contentType, size = meta.FileHash, meta.ContentType, meta.FileSize
+	} else {
+		objectType, userMetadata, err := ctrl.Infrastructure.MinioClient.GetObjectMetadata(ctx, bucketName, objectKey)
+		if err != nil {
+			ctrl.Provider.LoggerProvider.ErrorWithContextf(ctx, err, "[Get File] Failed to get file from MinIO - Bucket: %s, Path: %s, Error: %v", bucketName, filePath, err)
+			utils.JSON404(c, "File not found: "+err.Error())
+			return
+		}
+		hash, contentType = userMetadata["file-hash"], objectType
+	}
+
+	if !utils.IsResizableImage(contentType) {
+		utils.JSON400(c, "Transforms only apply to JPEG, PNG and GIF images")
+		return
+	}
+	if maxSize := ctrl.Config.EnvConfig.Limit.ImageMaxSize; size > maxSize {
+		utils.JSON400(c, fmt.Sprintf("Image exceeds %d bytes limit for transforms", maxSize))
+		return
+	}
+
+	format := transform.format
+	if format == "" {
+		format = strings.TrimPrefix(contentType, "image/")
+	}
+
+	derivativeKey := ""
+	if hash != "" {
+		derivativeKey = repository.DerivativeKey(hash, transform.derivativeName(format))
+		data, cachedType, found, err := ctrl.Repository.Derivatives.Get(ctx, derivativeKey)
+		if err != nil {
+			ctrl.Provider.LoggerProvider.WarningWithContextf(ctx, "[Get File] Failed to read derivative %s: %v", derivativeKey, err)
+		} else if found {
+			c.Header("X-Derivative-Cache", "HIT")
+			c.Data(http.StatusOK, cachedType, data)
+			return
+		}
+	}
+
+	// Cache misses wait for a transform slot before the source is downloaded and decoded
+	select {
+	case ctrl.transforms <- struct{}{}:
+		defer func() { <-ctrl.transforms }()
+	case <-ctx.Done():
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"error":  "Request cancelled while waiting for an image transform slot",
+			"status": http.StatusServiceUnavailable,
+		})
+		return
+	}
+
+	source, _, err := ctrl.Infrastructure.MinioClient.GetObjectFromBucket(ctx, bucketName, objectKey)
+	if err != nil {
+		ctrl.Provider.LoggerProvider.ErrorWithContextf(ctx, err, "[Get File] Failed to get file from MinIO - Bucket: %s, Path: %s, Error: %v", bucketName, filePath, err)
+		utils.JSON404(c, "File not found: "+err.Error())
+		return
+	}
+	if maxSize := ctrl.Config.EnvConfig.Limit.ImageMaxSize; int64(len(source)) > maxSize {
+		utils.JSON400(c, fmt.Sprintf("Image exceeds %d bytes limit for transforms", maxSize))
+		return
+	}
+
+	config, _, err := image.DecodeConfig(bytes.NewReader(source))
+	if err != nil {
+		utils.JSON400(c, "Failed to decode image: "+err.Error())
+		return
+	}
+	if config.Width*config.Height > maxTransformSourcePixels {
+		utils.JSON400(c, fmt.Sprintf("Image of %dx%d pixels is too large to transform", config.Width, config.Height))
+		return
+	}
+	img, _, err := image.Decode(bytes.NewReader(source))
+	if err != nil {
+		utils.JSON400(c, "Failed to decode image: "+err.Error())
+		return
+	}
+
+	if transform.width > 0 || transform.height > 0 {
+		img = utils.TransformImage(img, transform.width, transform.height, transform.fit)
+	}
+	var output bytes.Buffer
+	if err := utils.EncodeImage(&output, img, format, transform.quality); err != nil {
+		ctrl.Provider.LoggerProvider.ErrorWithContextf(ctx, err, "[Get File] Failed to encode transformed image")
+		utils.JSON500(c, "Failed to encode image: "+err.Error())
+		return
+	}
+	outputType := utils.ImageContentType(format)
+
+	if derivativeKey != "" {
+		if err := ctrl.Repository.Derivatives.Put(ctx, derivativeKey, output.Bytes(), outputType, hash); err != nil {
+			ctrl.Provider.LoggerProvider.WarningWithContextf(ctx, "[Get File] Failed to cache derivative %s: %v", derivativeKey, err)
+		}
+	}
+
+	ctrl.Provider.LoggerProvider.InfoWithContextf(ctx, "[Get File] Transformed %s/%s to %s (%d bytes)", bucketName, filePath, transform.derivativeName(format), output.Len())
+	c.Header("X-Derivative-Cache", "MISS")
+	c.Data(http.StatusOK, outputType, output.Bytes())
+}
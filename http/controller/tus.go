@@ -0,0 +1,340 @@
+package controller
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tnqbao/gau-upload-service/shared/repository"
+	"github.com/tnqbao/gau-upload-service/shared/utils"
+)
+
+const (
+	tusVersion       = "1.0.0"
+	tusExtensions    = "creation,termination"
+	tusOffsetContent = "application/offset+octet-stream"
+	tusBasePath      = "/api/v2/upload/tus/"
+)
+
+// TusOptions advertises the supported tus protocol version and extensions
+func (ctrl *Controller) TusOptions(c *gin.Context) {
+	c.Header("Tus-Resumable", tusVersion)
+	c.Header("Tus-Version", tusVersion)
+	c.Header("Tus-Extension", tusExtensions)
+	c.Header("Tus-Max-Size", strconv.FormatInt(ctrl.Config.EnvConfig.Limit.ResumableMaxSize, 10))
+	c.Status(http.StatusNoContent)
+}
+
+// TusCreate starts a resumable upload (creation extension). Upload-Metadata carries the same
+// fields as UploadFile: bucket (required), filename, filetype, path and is_hash.
+func (ctrl *Controller) TusCreate(c *gin.Context) {
+	ctx := c.Request.Context()
+	if !checkTusResumable(c) {
+		return
+	}
+
+	length, err := strconv.ParseInt(c.GetHeader("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		tusError(c, http.StatusBadRequest, "Upload-Length header must be a non-negative integer")
+		return
+	}
+	maxSize := ctrl.Config.EnvConfig.Limit.ResumableMaxSize
+	if length > maxSize {
+		ctrl.Provider.LoggerProvider.WarningWithContextf(ctx, "[Tus Upload] Upload length exceeds limit: %d bytes", length)
+		tusError(c, http.StatusRequestEntityTooLarge, fmt.Sprintf("File size exceeds %d bytes limit", maxSize))
+		return
+	}
+
+	rawMetadata := c.GetHeader("Upload-Metadata")
+	metadata, err := parseTusMetadata(rawMetadata)
+	if err != nil {
+		tusError(c, http.StatusBadRequest, "Invalid Upload-Metadata: "+err.Error())
+		return
+	}
+	if strings.TrimSpace(metadata["bucket"]) == "" {
+		tusError(c, http.StatusBadRequest, "bucket is required in Upload-Metadata")
+		return
+	}
+	if _, err := normalizeCustomPath(metadata["path"]); err != nil {
+		tusError(c, http.StatusBadRequest, invalidPathMessage(err))
+		return
+	}
+	if _, err := normalizeFileName(metadata["filename"]); err != nil {
+		tusError(c, http.StatusBadRequest, "Invalid filename: filename cannot contain '..'")
+		return
+	}
+
+	upload, etag, err := ctrl.Repository.Tus.Create(ctx, length, rawMetadata, metadata)
+	if err != nil {
+		ctrl.Provider.LoggerProvider.ErrorWithContextf(ctx, err, "[Tus Upload] Failed to create upload")
+		utils.JSON500(c, "Failed to create upload: "+err.Error())
+		return
+	}
+
+	ctrl.Provider.LoggerProvider.InfoWithContextf(ctx, "[Tus Upload] Created upload %s (%d bytes) for bucket %s", upload.ID, length, metadata["bucket"])
+	c.Header("Location", tusBasePath+upload.ID)
+	c.Header("Upload-Offset", "0")
+
+	// An empty file is complete as soon as it is created
+	if upload.Completed() {
+		if !ctrl.finishTusUpload(c, upload, etag) {
+			return
+		}
+		setTusResultHeaders(c, upload.Result)
+	}
+	c.Status(http.StatusCreated)
+}
+
+// TusHead reports how many bytes of an upload have been received
+func (ctrl *Controller) TusHead(c *gin.Context) {
+	if !checkTusResumable(c) {
+		return
+	}
+
+	upload, _, ok := ctrl.loadTusUpload(c, c.Param("id"))
+	if !ok {
+		return
+	}
+
+	c.Header("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	c.Header("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	if upload.RawMetadata != "" {
+		c.Header("Upload-Metadata", upload.RawMetadata)
+	}
+	c.Header("Cache-Control", "no-store")
+	setTusResultHeaders(c, upload.Result)
+	c.Status(http.StatusOK)
+}
+
+// TusPatch appends data at the current offset. Whatever arrived before a dropped connection is
+// kept, so the client can resume from the offset reported by HEAD. The file is hashed,
+// deduplicated and registered like UploadFile once the last byte is received.
+func (ctrl *Controller) TusPatch(c *gin.Context) {
+	ctx := c.Request.Context()
+	if !checkTusResumable(c) {
+		return
+	}
+
+	if c.ContentType() != tusOffsetContent {
+		tusError(c, http.StatusUnsupportedMediaType, "Content-Type must be "+tusOffsetContent)
+		return
+	}
+
+	offset, err := strconv.ParseInt(c.GetHeader("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		tusError(c, http.StatusBadRequest, "Upload-Offset header must be a non-negative integer")
+		return
+	}
+
+	upload, etag, ok := ctrl.loadTusUpload(c, c.Param("id"))
+	if !ok {
+		return
+	}
+	if offset != upload.Offset {
+		tusError(c, http.StatusConflict, fmt.Sprintf("Upload-Offset %d does not match current offset %d", offset, upload.Offset))
+		return
+	}
+
+	if upload.Result == nil && !upload.Completed() {
+		// Spool the body locally so a partial request still yields a part of known size
+		remaining := upload.Length - upload.Offset
+		tempFile, received, readErr := ctrl.spoolTusBody(c.Request.Body, remaining)
+		if tempFile == nil {
+			ctrl.Provider.LoggerProvider.ErrorWithContextf(ctx, readErr, "[Tus Upload] Failed to buffer upload data")
+			utils.JSON500(c, "Failed to read upload data: "+readErr.Error())
+			return
+		}
+		defer removeTempFile(tempFile)
+
+		if readErr != nil {
+			ctrl.Provider.LoggerProvider.WarningWithContextf(ctx, "[Tus Upload] Request for %s interrupted after %d bytes: %v", upload.ID, received, readErr)
+			// The client is gone; keep what arrived without tying it to the request lifetime
+			ctx = context.WithoutCancel(ctx)
+		}
+
+		if received > 0 {
+			etag, err = ctrl.Repository.Tus.AppendPart(ctx, upload, etag, tempFile, received)
+			if err != nil {
+				if errors.Is(err, repository.ErrTusConflict) {
+					tusError(c, http.StatusConflict, "Upload was modified by another request")
+					return
+				}
+				ctrl.Provider.LoggerProvider.ErrorWithContextf(ctx, err, "[Tus Upload] Failed to store upload data")
+				utils.JSON500(c, "Failed to store upload data: "+err.Error())
+				return
+			}
+		}
+		if readErr != nil {
+			return
+		}
+	}
+
+	// A completed upload whose storing failed earlier is retried by a PATCH at the final offset
+	if upload.Completed() && upload.Result == nil {
+		if !ctrl.finishTusUpload(c, upload, etag) {
+			return
+		}
+	}
+
+	c.Header("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	setTusResultHeaders(c, upload.Result)
+	c.Status(http.StatusNoContent)
+}
+
+// TusDelete terminates an upload and discards its staged data (termination extension)
+func (ctrl *Controller) TusDelete(c *gin.Context) {
+	ctx := c.Request.Context()
+	if !checkTusResumable(c) {
+		return
+	}
+
+	id := c.Param("id")
+	if err := ctrl.Repository.Tus.Terminate(ctx, id); err != nil {
+		if errors.Is(err, repository.ErrTusNotFound) {
+			tusError(c, http.StatusNotFound, "Upload not found")
+			return
+		}
+		ctrl.Provider.LoggerProvider.ErrorWithContextf(ctx, err, "[Tus Upload] Failed to terminate upload %s", id)
+		utils.JSON500(c, "Failed to terminate upload: "+err.Error())
+		return
+	}
+
+	ctrl.Provider.LoggerProvider.InfoWithContextf(ctx, "[Tus Upload] Terminated upload %s", id)
+	c.Status(http.StatusNoContent)
+}
+
+// finishTusUpload hashes the received parts, stores the file with deduplication and
+// records the response so HEAD can report it. The parts are kept if storing fails.
+func (ctrl *Controller) finishTusUpload(c *gin.Context, upload *repository.TusUpload, etag string) bool {
+	ctx := c.Request.Context()
+
+	stream := ctrl.Repository.Tus.Open(ctx, upload)
+	tempFile, fileHash, size, err := ctrl.stageToTempFile(stream)
+	stream.Close()
+	if err != nil {
+		ctrl.Provider.LoggerProvider.ErrorWithContextf(ctx, err, "[Tus Upload] Failed to assemble upload %s", upload.ID)
+		utils.JSON500(c, "Failed to assemble upload: "+err.Error())
+		return false
+	}
+	defer removeTempFile(tempFile)
+
+	if size != upload.Length {
+		ctrl.Provider.LoggerProvider.ErrorWithContextf(ctx, nil, "[Tus Upload] Upload %s assembled to %d bytes, expected %d", upload.ID, size, upload.Length)
+		utils.JSON500(c, fmt.Sprintf("Assembled upload has %d bytes, expected %d", size, upload.Length))
+		return false
+	}
+
+	customPath, _ := normalizeCustomPath(upload.Metadata["path"])
+	filename, _ := normalizeFileName(upload.Metadata["filename"])
+	response, err := ctrl.storeUpload(ctx, stagedUpload{
+		Bucket:       strings.TrimSpace(upload.Metadata["bucket"]),
+		CustomPath:   customPath,
+		IsHash:       parseIsHash(upload.Metadata["is_hash"]),
+		OriginalName: filename,
+		ContentType:  upload.Metadata["filetype"],
+		Hash:         fileHash,
+		Size:         size,
+		Content:      tempFile,
+		UserID:       strings.TrimSpace(upload.Metadata["user_id"]),
+	})
+	if err != nil {
+		ctrl.Provider.LoggerProvider.ErrorWithContextf(ctx, err, "[Tus Upload] Failed to store upload %s", upload.ID)
+		writeStoreError(c, err)
+		return false
+	}
+
+	if err := ctrl.Repository.Tus.Complete(ctx, upload, etag, response); err != nil {
+		// The file is stored; a concurrent request finishing the same upload is harmless
+		ctrl.Provider.LoggerProvider.WarningWithContextf(ctx, "[Tus Upload] Failed to record result of upload %s: %v", upload.ID, err)
+		upload.Result = response
+	}
+
+	ctrl.Provider.LoggerProvider.InfoWithContextf(ctx, "[Tus Upload] Upload %s completed: %v", upload.ID, response["file_path"])
+	return true
+}
+
+// loadTusUpload loads an upload and writes the error response when it fails
+func (ctrl *Controller) loadTusUpload(c *gin.Context, uploadID string) (*repository.TusUpload, string, bool) {
+
+	upload, etag, err := ctrl.Repository.Tus.Get(c.Request.Context(), uploadID)
+	if err != nil {
+		if errors.Is(err, repository.ErrTusNotFound) {
+			tusError(c, http.StatusNotFound, "Upload not found")
+			return nil, "", false
+		}
+		ctrl.Provider.LoggerProvider.ErrorWithContextf(c.Request.Context(), err, "[Tus Upload] Failed to load upload %s", uploadID)
+		utils.JSON500(c, "Failed to load upload: "+err.Error())
+		return nil, "", false
+	}
+	return upload, etag, true
+}
+
+// spoolTusBody copies at most limit bytes of body into a temp file rewound to its start.
+// The file is returned with the bytes received even when reading fails part way.
+func (ctrl *Controller) spoolTusBody(body io.Reader, limit int64) (*os.File, int64, error) {
+	tempFile, err := ctrl.createTempFile()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	received, readErr := io.Copy(tempFile, io.LimitReader(body, limit))
+	if _, err := tempFile.Seek(0, io.SeekStart); err != nil {
+		removeTempFile(tempFile)
+		return nil, 0, err
+	}
+	return tempFile, received, readErr
+}
+
+// checkTusResumable rejects requests for an unsupported protocol version
+func checkTusResumable(c *gin.Context) bool {
+	c.Header("Tus-Resumable", tusVersion)
+	if c.GetHeader("Tus-Resumable") != tusVersion {
+		c.Header("Tus-Version", tusVersion)
+		tusError(c, http.StatusPreconditionFailed, "Unsupported Tus-Resumable version")
+		return false
+	}
+	return true
+}
+
+// parseTusMetadata decodes "key base64value,key2 base64value2"; values may be omitted
+func parseTusMetadata(header string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		key, encoded, _ := strings.Cut(pair, " ")
+		value, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil {
+			return nil, fmt.Errorf("value of %q is not base64", key)
+		}
+		metadata[key] = string(value)
+	}
+	return metadata, nil
+}
+
+// setTusResultHeaders exposes where a completed upload was stored
+func setTusResultHeaders(c *gin.Context, result map[string]interface{}) {
+	if result == nil {
+		return
+	}
+	c.Header("X-File-Path", fmt.Sprint(result["file_path"]))
+	c.Header("X-File-Hash", fmt.Sprint(result["file_hash"]))
+	c.Header("X-File-Bucket", fmt.Sprint(result["bucket"]))
+	c.Header("X-File-Duplicated", fmt.Sprint(result["duplicated"]))
+}
+
+func tusError(c *gin.Context, status int, err string) {
+	c.JSON(status, gin.H{
+		"error":  err,
+		"status": status,
+	})
+}
@@ -0,0 +1,77 @@
+package controller
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tnqbao/gau-upload-service/shared/config"
+	"github.com/tnqbao/gau-upload-service/shared/repository"
+	"github.com/tnqbao/gau-upload-service/shared/utils"
+)
+
+// quotaExceededCode identifies uploads refused because their bucket or user is full
+const quotaExceededCode = "QUOTA_EXCEEDED"
+
+// writeQuotaExceeded answers an upload that would take a bucket or a user over its quota
+func writeQuotaExceeded(c *gin.Context, err *repository.QuotaExceededError) {
+	c.JSON(http.StatusInsufficientStorage, gin.H{
+		"error":      "Quota exceeded: " + err.Error(),
+		"error_code": quotaExceededCode,
+		"status":     http.StatusInsufficientStorage,
+		"scope":      err.Scope,
+		"name":       err.Name,
+		"limit":      err.Limit,
+		"max":        err.Max,
+		"used":       err.Used,
+		"requested":  err.Requested,
+	})
+}
+
+// GetUsage reports what a bucket and/or a user stores against each of its quota limits
+func (ctrl *Controller) GetUsage(c *gin.Context) {
+	ctx := c.Request.Context()
+	bucketName := strings.TrimSpace(c.Query("bucket"))
+	userID := strings.TrimSpace(c.Query("user_id"))
+	if bucketName == "" && userID == "" {
+		utils.JSON400(c, "bucket or user_id parameter is required")
+		return
+	}
+
+	response := gin.H{}
+	if bucketName != "" {
+		usage, err := ctrl.Repository.Usage.Bucket(ctx, bucketName)
+		if err != nil {
+			ctrl.Provider.LoggerProvider.ErrorWithContextf(ctx, err, "[Usage] Failed to read usage of bucket %s", bucketName)
+			utils.JSON500(c, "Failed to read usage: "+err.Error())
+			return
+		}
+		response["bucket"] = usageJSON(bucketName, usage, ctrl.Config.Policy.For(bucketName).Quota)
+	}
+	if userID != "" {
+		usage, err := ctrl.Repository.Usage.User(ctx, userID)
+		if err != nil {
+			ctrl.Provider.LoggerProvider.ErrorWithContextf(ctx, err, "[Usage] Failed to read usage of user %s", userID)
+			utils.JSON500(c, "Failed to read usage: "+err.Error())
+			return
+		}
+		response["user"] = usageJSON(userID, usage, ctrl.Config.Policy.QuotaForUser(userID))
+	}
+	utils.JSON200(c, response)
+}
+
+// usageJSON reports usage against each limit of a quota; unlimited limits are null
+func usageJSON(name string, usage repository.Usage, quota config.Quota) gin.H {
+	return gin.H{
+		"name":  name,
+		"files": limitJSON(usage.Files, quota.MaxFiles),
+		"bytes": limitJSON(usage.Bytes, quota.MaxBytes()),
+	}
+}
+
+func limitJSON(used, limit int64) gin.H {
+	if limit <= 0 {
+		return gin.H{"used": used, "limit": nil, "remaining": nil}
+	}
+	return gin.H{"used": used, "limit": limit, "remaining": max(limit-used, 0)}
+}
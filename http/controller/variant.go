@@ -0,0 +1,103 @@
+package controller
+
+import (
+	"context"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tnqbao/gau-upload-service/shared/infra"
+	"github.com/tnqbao/gau-upload-service/shared/repository"
+	"github.com/tnqbao/gau-upload-service/shared/utils"
+)
+
+// imageVariants returns the variants generated for content, none unless it is a resizable image
+// within IMAGE_MAX_SIZE
+func (ctrl *Controller) imageVariants(hash, contentType string, size int64) []repository.UploadVariant {
+	if !utils.IsResizableImage(contentType) || size > ctrl.Config.EnvConfig.Limit.ImageMaxSize {
+		return nil
+	}
+
+	variants := make([]repository.UploadVariant, 0, len(ctrl.Config.EnvConfig.Image.Variants))
+	for _, variant := range ctrl.Config.EnvConfig.Image.Variants {
+		variants = append(variants, repository.UploadVariant{
+			Key:    repository.VariantKey(hash, variant.Name()),
+			Size:   variant.Size,
+			Format: variant.Format,
+		})
+	}
+	return variants
+}
+
+// joinVariantNames joins the names of variants as stored in FileMetadata.Variants
+func joinVariantNames(variants []repository.UploadVariant) string {
+	names := make([]string, 0, len(variants))
+	for _, variant := range variants {
+		names = append(names, variant.Key[strings.LastIndex(variant.Key, "/")+1:])
+	}
+	return strings.Join(names, ",")
+}
+
+// variantsJSON lists variants by name and key for responses
+func variantsJSON(hash string, names []string) []gin.H {
+	entries := make([]gin.H, 0, len(names))
+	for _, name := range names {
+		entries = append(entries, gin.H{
+			"name": name,
+			"key":  repository.VariantKey(hash, name),
+		})
+	}
+	return entries
+}
+
+// publishUploadCreated announces a prepared upload, before its reference is committed, so the
+// consumer generates its variants. Variants are only recorded and returned once the event is
+// published: when publishing fails they are dropped, and the next upload of the content at the
+// path records and announces them again.
+func (ctrl *Controller) publishUploadCreated(ctx context.Context, prepared *preparedUpload) {
+	if prepared.ref == nil || len(prepared.variants) == 0 {
+		return
+	}
+
+	meta := prepared.ref.Meta
+	if err := ctrl.Repository.Events.PublishUploadCreated(uploadCreatedEvent(meta, prepared.variants)); err != nil {
+		ctrl.Provider.LoggerProvider.WarningWithContextf(ctx, "[Upload File] Failed to publish upload.created for %s, its variants are not recorded: %v", meta.FilePath, err)
+		prepared.ref.Meta.Variants = ""
+		prepared.variants = nil
+		prepared.variantNames = nil
+	}
+}
+
+// republishMissingVariants announces a path already referencing its content again when some of
+// the variants recorded for it don't exist, e.g. because generating them failed
+func (ctrl *Controller) republishMissingVariants(ctx context.Context, meta infra.FileMetadata) {
+	variants := ctrl.imageVariants(meta.FileHash, meta.ContentType, meta.FileSize)
+	missing := false
+	for _, variant := range variants {
+		exists, err := ctrl.Infrastructure.MinioClient.ObjectExists(ctx, meta.BucketName, variant.Key)
+		if err != nil {
+			return
+		}
+		missing = missing || !exists
+	}
+	if !missing {
+		return
+	}
+
+	if err := ctrl.Repository.Events.PublishUploadCreated(uploadCreatedEvent(meta, variants)); err != nil {
+		ctrl.Provider.LoggerProvider.WarningWithContextf(ctx, "[Upload File] Failed to publish upload.created for %s: %v", meta.FilePath, err)
+		return
+	}
+	ctrl.Provider.LoggerProvider.InfoWithContextf(ctx, "[Upload File] Requested missing variants of %s", meta.FilePath)
+}
+
+func uploadCreatedEvent(meta infra.FileMetadata, variants []repository.UploadVariant) repository.UploadCreatedEvent {
+	return repository.UploadCreatedEvent{
+		Bucket:      meta.BucketName,
+		FilePath:    meta.FilePath,
+		FileHash:    meta.FileHash,
+		BlobKey:     meta.ObjectKey(),
+		ContentType: meta.ContentType,
+		FileSize:    meta.FileSize,
+		Variants:    variants,
+	}
+}
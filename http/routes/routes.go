@@ -13,15 +13,50 @@ func SetupRouter(ctrl *controller.Controller) *gin.Engine {
 		panic(err)
 	}
 
+	// tus clients discover the server with an unauthenticated OPTIONS request, so it stays outside the private group
+	r.OPTIONS("/api/v2/upload/tus", ctrl.TusOptions)
+
 	apiRoutes := r.Group("/api/v2/upload")
 	{
 		apiRoutes.Use(middles.PrivateMiddlewares)
 
 		// Generic file upload endpoints
 		apiRoutes.POST("/file", ctrl.UploadFile)
+		apiRoutes.POST("/files/batch", ctrl.UploadFiles)
 		apiRoutes.GET("/file", ctrl.GetFile)
 		apiRoutes.DELETE("/file", ctrl.DeleteFile)
 		apiRoutes.GET("/files/list", ctrl.ListFiles)
+
+		// Resumable upload endpoints (tus 1.0)
+		apiRoutes.POST("/tus", ctrl.TusCreate)
+		apiRoutes.HEAD("/tus/:id", ctrl.TusHead)
+		apiRoutes.PATCH("/tus/:id", ctrl.TusPatch)
+		apiRoutes.DELETE("/tus/:id", ctrl.TusDelete)
+
+		// Multipart upload session endpoints
+		apiRoutes.POST("/multipart", ctrl.InitiateMultipartUpload)
+		apiRoutes.PUT("/multipart/:id/parts/:part_number", ctrl.UploadMultipartPart)
+		apiRoutes.GET("/multipart/:id/parts", ctrl.ListMultipartParts)
+		apiRoutes.POST("/multipart/:id/complete", ctrl.CompleteMultipartUpload)
+		apiRoutes.DELETE("/multipart/:id", ctrl.AbortMultipartUpload)
+
+		// Presigned direct-to-storage endpoints
+		apiRoutes.POST("/presign/upload", ctrl.CreatePresignedUpload)
+		apiRoutes.POST("/presign/upload/:id/finalize", ctrl.FinalizePresignedUpload)
+		apiRoutes.GET("/presign/download", ctrl.CreatePresignedDownload)
+
+		// Metadata query endpoints
+		apiRoutes.GET("/files/stats", ctrl.GetFileStatistics)
+		apiRoutes.GET("/files/hash/:hash", ctrl.SearchFilesByHash)
+		apiRoutes.GET("/files/search", ctrl.SearchFiles)
+		apiRoutes.GET("/usage", ctrl.GetUsage)
+
+		// Metadata maintenance endpoints
+		apiRoutes.POST("/admin/metadata/compact", ctrl.CompactMetadata)
+		apiRoutes.POST("/admin/metadata/reconcile", ctrl.ReconcileMetadata)
+		apiRoutes.GET("/admin/metadata/reconcile/:id", ctrl.GetReconcileJob)
+		apiRoutes.POST("/admin/metadata/migrate", ctrl.MigrateMetadataSchema)
+		apiRoutes.POST("/admin/usage/recalculate", ctrl.RecalculateUsage)
 	}
 	apiRoutes.GET("/health", ctrl.CheckHealth)
 	return r
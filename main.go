@@ -19,8 +19,8 @@ func main() {
 
 	// Initialize configuration and infrastructure
 	cfg := config.NewConfig()
-	repo := repository.NewRepository(cfg)
 	infra := infra.InitInfra(cfg)
+	repo := repository.NewRepository(cfg, infra)
 
 	// Initialize controller with the new configuration and infrastructure
 	ctrl := controller.NewController(cfg, repo, infra)
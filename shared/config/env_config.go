@@ -4,6 +4,7 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type EnvConfig struct {
@@ -28,11 +29,39 @@ type EnvConfig struct {
 		TempDir          string
 	}
 
+	Metadata struct {
+		Backend            string
+		BoltPath           string
+		CompactionInterval time.Duration
+		CacheEnabled       bool
+		CacheRefresh       time.Duration
+		CacheMaxStaleness  time.Duration
+	}
+
 	PrivateKey string
 
 	Limit struct {
-		ImageMaxSize int64
-		FileMaxSize  int64
+		ImageMaxSize     int64
+		FileMaxSize      int64
+		ResumableMaxSize int64 // largest file accepted by resumable (tus), multipart and presigned uploads
+		BatchMaxFiles    int   // most files accepted by one batch upload
+		BatchConcurrency int   // files of a batch processed in parallel
+
+		TransformConcurrency int // image transforms decoded and encoded in parallel
+	}
+
+	Image struct {
+		Variants []ImageVariant // generated for image uploads up to ImageMaxSize
+	}
+
+	Upload struct {
+		Diskless   bool   // UploadFile streams to a staging object instead of a temp file under TEMP_DIR
+		PolicyFile string // JSON file with per-bucket upload policies, built-in defaults when empty
+
+		IdempotencyTTL time.Duration // how long responses to requests with an Idempotency-Key are replayed
+
+		PendingIdleTTL       time.Duration // how long an unfinished upload may sit idle in the pending bucket
+		PendingSweepInterval time.Duration // how often the consumer sweeps the pending bucket, 0 disables it
 	}
 
 	Grafana struct {
@@ -104,6 +133,48 @@ func LoadEnvConfig() *EnvConfig {
 		config.ChunkConfig.TempDir = "/tmp/gau-upload"
 	}
 
+	// Metadata store: "parquet" (object storage) or "bolt" (embedded on-disk)
+	config.Metadata.Backend = strings.ToLower(os.Getenv("METADATA_BACKEND"))
+	if config.Metadata.Backend == "" {
+		config.Metadata.Backend = "parquet"
+	}
+	config.Metadata.BoltPath = os.Getenv("METADATA_BOLT_PATH")
+	if config.Metadata.BoltPath == "" {
+		config.Metadata.BoltPath = "/gau_upload/metadata.db"
+	}
+	// Parquet compaction interval for the consumer, "0" disables the background loop
+	if intervalStr := os.Getenv("METADATA_COMPACTION_INTERVAL"); intervalStr != "" {
+		if interval, err := time.ParseDuration(intervalStr); err == nil {
+			config.Metadata.CompactionInterval = interval
+		} else {
+			config.Metadata.CompactionInterval = 15 * time.Minute // Default to 15 minutes if invalid
+		}
+	} else {
+		config.Metadata.CompactionInterval = 15 * time.Minute // Default to 15 minutes if not set
+	}
+
+	// In-process hash index in front of the Parquet store
+	cacheEnabled := os.Getenv("METADATA_CACHE_ENABLED")
+	config.Metadata.CacheEnabled = cacheEnabled == "" || cacheEnabled == "true" || cacheEnabled == "1"
+	if refreshStr := os.Getenv("METADATA_CACHE_REFRESH_INTERVAL"); refreshStr != "" {
+		if refresh, err := time.ParseDuration(refreshStr); err == nil && refresh > 0 {
+			config.Metadata.CacheRefresh = refresh
+		} else {
+			config.Metadata.CacheRefresh = 10 * time.Second // Default to 10 seconds if invalid
+		}
+	} else {
+		config.Metadata.CacheRefresh = 10 * time.Second // Default to 10 seconds if not set
+	}
+	if stalenessStr := os.Getenv("METADATA_CACHE_MAX_STALENESS"); stalenessStr != "" {
+		if staleness, err := time.ParseDuration(stalenessStr); err == nil && staleness > 0 {
+			config.Metadata.CacheMaxStaleness = staleness
+		} else {
+			config.Metadata.CacheMaxStaleness = time.Minute // Default to 1 minute if invalid
+		}
+	} else {
+		config.Metadata.CacheMaxStaleness = time.Minute // Default to 1 minute if not set
+	}
+
 	config.PrivateKey = os.Getenv("PRIVATE_KEY")
 
 	if imageSizeStr := os.Getenv("IMAGE_MAX_SIZE"); imageSizeStr != "" {
@@ -126,6 +197,95 @@ func LoadEnvConfig() *EnvConfig {
 		config.Limit.FileMaxSize = 10485760 // Default to 10MB in bytes if not set
 	}
 
+	if resumableSizeStr := os.Getenv("RESUMABLE_MAX_SIZE"); resumableSizeStr != "" {
+		if resumableSize, err := strconv.ParseInt(resumableSizeStr, 10, 64); err == nil && resumableSize > 0 {
+			config.Limit.ResumableMaxSize = resumableSize
+		} else {
+			config.Limit.ResumableMaxSize = 5368709120 // Default to 5GB in bytes if invalid
+		}
+	} else {
+		config.Limit.ResumableMaxSize = 5368709120 // Default to 5GB in bytes if not set
+	}
+
+	if batchMaxFilesStr := os.Getenv("BATCH_UPLOAD_MAX_FILES"); batchMaxFilesStr != "" {
+		if batchMaxFiles, err := strconv.Atoi(batchMaxFilesStr); err == nil && batchMaxFiles > 0 {
+			config.Limit.BatchMaxFiles = batchMaxFiles
+		} else {
+			config.Limit.BatchMaxFiles = 100 // Default to 100 files if invalid
+		}
+	} else {
+		config.Limit.BatchMaxFiles = 100 // Default to 100 files if not set
+	}
+
+	if batchConcurrencyStr := os.Getenv("BATCH_UPLOAD_CONCURRENCY"); batchConcurrencyStr != "" {
+		if batchConcurrency, err := strconv.Atoi(batchConcurrencyStr); err == nil && batchConcurrency > 0 {
+			config.Limit.BatchConcurrency = batchConcurrency
+		} else {
+			config.Limit.BatchConcurrency = 4 // Default to 4 files at a time if invalid
+		}
+	} else {
+		config.Limit.BatchConcurrency = 4 // Default to 4 files at a time if not set
+	}
+
+	if transformConcurrencyStr := os.Getenv("IMAGE_TRANSFORM_CONCURRENCY"); transformConcurrencyStr != "" {
+		if transformConcurrency, err := strconv.Atoi(transformConcurrencyStr); err == nil && transformConcurrency > 0 {
+			config.Limit.TransformConcurrency = transformConcurrency
+		} else {
+			config.Limit.TransformConcurrency = 4 // Default to 4 transforms at a time if invalid
+		}
+	} else {
+		config.Limit.TransformConcurrency = 4 // Default to 4 transforms at a time if not set
+	}
+
+	// Image variants, e.g. "128:jpeg,512:png"; "none" disables them
+	if variantsStr := os.Getenv("IMAGE_VARIANTS"); variantsStr != "" {
+		if variants, err := parseImageVariants(variantsStr); err == nil {
+			config.Image.Variants = variants
+		} else {
+			config.Image.Variants = defaultImageVariants() // Default to 128px and 512px JPEG if invalid
+		}
+	} else {
+		config.Image.Variants = defaultImageVariants() // Default to 128px and 512px JPEG if not set
+	}
+
+	// Single-pass uploads: hash while piping to a staging object, no local temp file
+	diskless := os.Getenv("UPLOAD_DISKLESS")
+	config.Upload.Diskless = diskless == "true" || diskless == "1"
+
+	// Per-bucket upload policies, see UploadPolicy
+	config.Upload.PolicyFile = os.Getenv("UPLOAD_POLICY_FILE")
+
+	// Responses of requests made with an Idempotency-Key
+	if ttlStr := os.Getenv("IDEMPOTENCY_TTL"); ttlStr != "" {
+		if ttl, err := time.ParseDuration(ttlStr); err == nil && ttl > 0 {
+			config.Upload.IdempotencyTTL = ttl
+		} else {
+			config.Upload.IdempotencyTTL = 24 * time.Hour // Default to 24 hours if invalid
+		}
+	} else {
+		config.Upload.IdempotencyTTL = 24 * time.Hour // Default to 24 hours if not set
+	}
+
+	// Abandoned uploads and expired records are deleted from the pending bucket by the consumer
+	if ttlStr := os.Getenv("PENDING_IDLE_TTL"); ttlStr != "" {
+		if ttl, err := time.ParseDuration(ttlStr); err == nil && ttl > 0 {
+			config.Upload.PendingIdleTTL = ttl
+		} else {
+			config.Upload.PendingIdleTTL = 24 * time.Hour // Default to 24 hours if invalid
+		}
+	} else {
+		config.Upload.PendingIdleTTL = 24 * time.Hour // Default to 24 hours if not set
+	}
+	if intervalStr := os.Getenv("PENDING_SWEEP_INTERVAL"); intervalStr != "" {
+		if interval, err := time.ParseDuration(intervalStr); err == nil {
+			config.Upload.PendingSweepInterval = interval
+		} else {
+			config.Upload.PendingSweepInterval = time.Hour // Default to 1 hour if invalid
+		}
+	} else {
+		config.Upload.PendingSweepInterval = time.Hour // Default to 1 hour if not set
+	}
+
 	// Grafana/OpenTelemetry
 	grafanaEndpoint := os.Getenv("GRAFANA_OTLP_ENDPOINT")
 	if grafanaEndpoint == "" {
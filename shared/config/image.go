@@ -0,0 +1,67 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ImageVariant is a resized copy generated for image uploads: the image is scaled to fit a
+// Size x Size box, never enlarged, and encoded as Format
+type ImageVariant struct {
+	Size   int
+	Format string // "jpeg" or "png"
+}
+
+// Name is the variant's file name, e.g. 128.jpg
+func (v ImageVariant) Name() string {
+	ext := ".jpg"
+	if v.Format == "png" {
+		ext = ".png"
+	}
+	return strconv.Itoa(v.Size) + ext
+}
+
+func defaultImageVariants() []ImageVariant {
+	return []ImageVariant{
+		{Size: 128, Format: "jpeg"},
+		{Size: 512, Format: "jpeg"},
+	}
+}
+
+// parseImageVariants reads a comma-separated list of size:format entries; the format defaults to jpeg
+func parseImageVariants(value string) ([]ImageVariant, error) {
+	if strings.EqualFold(strings.TrimSpace(value), "none") {
+		return nil, nil
+	}
+
+	var variants []ImageVariant
+	seen := make(map[string]bool)
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		sizeStr, format, _ := strings.Cut(entry, ":")
+		size, err := strconv.Atoi(strings.TrimSpace(sizeStr))
+		if err != nil || size < 1 || size > 4096 {
+			return nil, fmt.Errorf("invalid image variant size %q", sizeStr)
+		}
+		format = strings.ToLower(strings.TrimSpace(format))
+		switch format {
+		case "", "jpg", "jpeg":
+			format = "jpeg"
+		case "png":
+		default:
+			return nil, fmt.Errorf("unsupported image variant format %q", format)
+		}
+
+		variant := ImageVariant{Size: size, Format: format}
+		if !seen[variant.Name()] {
+			seen[variant.Name()] = true
+			variants = append(variants, variant)
+		}
+	}
+	return variants, nil
+}
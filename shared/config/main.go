@@ -2,11 +2,19 @@ package config
 
 type Config struct {
 	EnvConfig *EnvConfig
+
+	// Policy holds the per-bucket upload rules loaded from UPLOAD_POLICY_FILE
+	Policy *UploadPolicy
 }
 
 func NewConfig() *Config {
 	EnvConfig := LoadEnvConfig()
+	policy, err := LoadUploadPolicy(EnvConfig.Upload.PolicyFile)
+	if err != nil {
+		panic("Failed to load upload policy: " + err.Error())
+	}
 	return &Config{
 		EnvConfig: EnvConfig,
+		Policy:    policy,
 	}
-}
\ No newline at end of file
+}
@@ -0,0 +1,224 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/tnqbao/gau-upload-service/shared/utils"
+)
+
+// BucketPolicy controls how uploads to a bucket are accepted and stored. Unset fields inherit
+// the default policy of the policy file.
+type BucketPolicy struct {
+	AllowedTypes  []string `json:"allowed_types,omitempty"` // MIME types accepted, "image/*" style wildcards allowed; empty accepts all
+	DeniedTypes   []string `json:"denied_types,omitempty"`  // MIME types always rejected, checked before AllowedTypes
+	MaxSizeMB     int64    `json:"max_size_mb,omitempty"`   // largest file accepted, 0 keeps FILE_MAX_SIZE
+	ForceHash     *bool    `json:"force_hash,omitempty"`    // files are named by hash whatever is_hash says
+	FolderMarkers *bool    `json:"folder_markers,omitempty"`
+	AutoCreate    *bool    `json:"auto_create,omitempty"`    // a missing bucket is created by the first upload
+	StripMetadata *bool    `json:"strip_metadata,omitempty"` // EXIF/XMP are removed from JPEG and PNG uploads
+	NameTemplate  string   `json:"name_template,omitempty"`  // names uploads, e.g. "{yyyy}/{mm}/{hash}{ext}", instead of is_hash
+	Quota         Quota    `json:"quota"`                    // limits the files stored in the bucket
+}
+
+// Quota limits the files stored in a bucket or for a user. A zero limit is unlimited.
+type Quota struct {
+	MaxMB    int64 `json:"max_mb,omitempty"`    // total size of the files
+	MaxFiles int64 `json:"max_files,omitempty"` // number of files
+}
+
+// UploadPolicy is the policy file: a default policy plus overrides by bucket name, and the
+// quotas of the users uploads are made for
+type UploadPolicy struct {
+	Default BucketPolicy            `json:"default"`
+	Buckets map[string]BucketPolicy `json:"buckets"`
+
+	// UserQuota applies to every user_id, across buckets; Users overrides it by user_id
+	UserQuota Quota            `json:"user_quota"`
+	Users     map[string]Quota `json:"users"`
+}
+
+// defaultUploadPolicy keeps the behavior of deployments without a policy file
+func defaultUploadPolicy() *UploadPolicy {
+	disabled := false
+	return &UploadPolicy{
+		Buckets: map[string]BucketPolicy{
+			// The pending bucket only stores temporary upload data
+			"pending": {FolderMarkers: &disabled},
+		},
+	}
+}
+
+// LoadUploadPolicy reads a JSON policy file; an empty path returns the built-in policy
+func LoadUploadPolicy(path string) (*UploadPolicy, error) {
+	if path == "" {
+		return defaultUploadPolicy(), nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read upload policy: %w", err)
+	}
+
+	policy := defaultUploadPolicy()
+	var file UploadPolicy
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse upload policy %s: %w", path, err)
+	}
+	policy.Default = file.Default
+	for bucket, bucketPolicy := range file.Buckets {
+		if bucketPolicy.MaxSizeMB < 0 {
+			return nil, fmt.Errorf("upload policy for bucket %s: max_size_mb cannot be negative", bucket)
+		}
+		if bucketPolicy.NameTemplate != "" {
+			if err := utils.ValidateNameTemplate(bucketPolicy.NameTemplate); err != nil {
+				return nil, fmt.Errorf("upload policy for bucket %s: %w", bucket, err)
+			}
+		}
+		if err := bucketPolicy.Quota.validate(); err != nil {
+			return nil, fmt.Errorf("upload policy for bucket %s: %w", bucket, err)
+		}
+		// Entries refine the built-in ones instead of replacing them
+		policy.Buckets[bucket] = overlayPolicy(policy.Buckets[bucket], bucketPolicy)
+	}
+	if policy.Default.MaxSizeMB < 0 {
+		return nil, fmt.Errorf("upload policy default: max_size_mb cannot be negative")
+	}
+	if policy.Default.NameTemplate != "" {
+		if err := utils.ValidateNameTemplate(policy.Default.NameTemplate); err != nil {
+			return nil, fmt.Errorf("upload policy default: %w", err)
+		}
+	}
+	if err := policy.Default.Quota.validate(); err != nil {
+		return nil, fmt.Errorf("upload policy default: %w", err)
+	}
+
+	policy.UserQuota = file.UserQuota
+	if err := policy.UserQuota.validate(); err != nil {
+		return nil, fmt.Errorf("upload policy user_quota: %w", err)
+	}
+	policy.Users = file.Users
+	for userID, quota := range policy.Users {
+		if err := quota.validate(); err != nil {
+			return nil, fmt.Errorf("upload policy for user %s: %w", userID, err)
+		}
+	}
+	return policy, nil
+}
+
+// For returns the effective policy of a bucket: its own fields over the default ones
+func (p *UploadPolicy) For(bucket string) BucketPolicy {
+	override, ok := p.Buckets[bucket]
+	if !ok {
+		return p.Default
+	}
+	return overlayPolicy(p.Default, override)
+}
+
+// overlayPolicy returns base with every field set in override replaced
+func overlayPolicy(base, override BucketPolicy) BucketPolicy {
+	effective := base
+	if override.AllowedTypes != nil {
+		effective.AllowedTypes = override.AllowedTypes
+	}
+	if override.DeniedTypes != nil {
+		effective.DeniedTypes = override.DeniedTypes
+	}
+	if override.MaxSizeMB > 0 {
+		effective.MaxSizeMB = override.MaxSizeMB
+	}
+	if override.ForceHash != nil {
+		effective.ForceHash = override.ForceHash
+	}
+	if override.FolderMarkers != nil {
+		effective.FolderMarkers = override.FolderMarkers
+	}
+	if override.AutoCreate != nil {
+		effective.AutoCreate = override.AutoCreate
+	}
+	if override.StripMetadata != nil {
+		effective.StripMetadata = override.StripMetadata
+	}
+	if override.NameTemplate != "" {
+		effective.NameTemplate = override.NameTemplate
+	}
+	effective.Quota = overlayQuota(effective.Quota, override.Quota)
+	return effective
+}
+
+// QuotaForUser returns the quota of a user_id: its own limits over UserQuota
+func (p *UploadPolicy) QuotaForUser(userID string) Quota {
+	override, ok := p.Users[userID]
+	if !ok {
+		return p.UserQuota
+	}
+	return overlayQuota(p.UserQuota, override)
+}
+
+// overlayQuota returns base with every limit set in override replaced
+func overlayQuota(base, override Quota) Quota {
+	effective := base
+	if override.MaxMB > 0 {
+		effective.MaxMB = override.MaxMB
+	}
+	if override.MaxFiles > 0 {
+		effective.MaxFiles = override.MaxFiles
+	}
+	return effective
+}
+
+// LargestMaxSize returns the largest file any bucket accepts, in bytes; fallback applies to
+// policies without a size
+func (p *UploadPolicy) LargestMaxSize(fallback int64) int64 {
+	largest := fallback
+	if p.Default.MaxSizeMB > 0 {
+		largest = p.Default.MaxSizeMB * 1024 * 1024
+	}
+	for _, bucketPolicy := range p.Buckets {
+		if size := bucketPolicy.MaxSizeMB * 1024 * 1024; size > largest {
+			largest = size
+		}
+	}
+	return largest
+}
+
+// MaxSize returns the largest file accepted by the bucket in bytes, fallback when unset
+func (bp BucketPolicy) MaxSize(fallback int64) int64 {
+	if bp.MaxSizeMB > 0 {
+		return bp.MaxSizeMB * 1024 * 1024
+	}
+	return fallback
+}
+
+// HashNaming reports whether files must be named by hash
+func (bp BucketPolicy) HashNaming() bool {
+	return bp.ForceHash != nil && *bp.ForceHash
+}
+
+// CreatesFolderMarkers reports whether folder markers are created for upload paths, the default
+func (bp BucketPolicy) CreatesFolderMarkers() bool {
+	return bp.FolderMarkers == nil || *bp.FolderMarkers
+}
+
+// CreatesBucket reports whether an upload may create a missing bucket, the default
+func (bp BucketPolicy) CreatesBucket() bool {
+	return bp.AutoCreate == nil || *bp.AutoCreate
+}
+
+// StripsMetadata reports whether image metadata is removed from every upload
+func (bp BucketPolicy) StripsMetadata() bool {
+	return bp.StripMetadata != nil && *bp.StripMetadata
+}
+
+// MaxBytes returns the total size allowed in bytes, 0 when unlimited
+func (q Quota) MaxBytes() int64 {
+	return q.MaxMB * 1024 * 1024
+}
+
+func (q Quota) validate() error {
+	if q.MaxMB < 0 || q.MaxFiles < 0 {
+		return fmt.Errorf("quota limits cannot be negative")
+	}
+	return nil
+}
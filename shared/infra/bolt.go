@@ -0,0 +1,312 @@
+package infra
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	// boltReferencesBucket stores FileMetadata as JSON keyed by "<bucket>\x00<path>"
+	boltReferencesBucket = []byte("references")
+	// boltHashesBucket indexes "<bucket>\x00<hash>\x00<path>" so references to a hash can be counted
+	boltHashesBucket = []byte("hashes")
+)
+
+// BoltMetadataStore keeps file metadata in an embedded bbolt database on local disk.
+// Lookups are indexed, so nothing has to be downloaded or decoded on each request.
+// The database belongs to one process: it suits single-replica deployments only.
+type BoltMetadataStore struct {
+	db *bolt.DB
+}
+
+func NewBoltMetadataStore(path string) (*BoltMetadataStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create metadata directory: %w", err)
+	}
+
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open bolt database: %w", err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(boltReferencesBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(boltHashesBucket)
+		return err
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("failed to initialize bolt buckets: %w", err)
+	}
+
+	return &BoltMetadataStore{db: db}, nil
+}
+
+// Close releases the underlying database file
+func (bs *BoltMetadataStore) Close() error {
+	return bs.db.Close()
+}
+
+// CheckFileByHash checks if a file with the given hash exists in the bucket
+// A blob-backed reference is preferred so callers can reuse the stored content
+func (bs *BoltMetadataStore) CheckFileByHash(ctx context.Context, bucket, hash string) (string, bool, error) {
+	references, err := bs.referencesTo(bucket, hash)
+	if err != nil || len(references) == 0 {
+		return "", false, err
+	}
+
+	for _, meta := range references {
+		if meta.BlobKey != "" {
+			return meta.FilePath, true, nil
+		}
+	}
+	return references[0].FilePath, true, nil
+}
+
+// GetFileByPath returns the entry registered for a bucket/path
+func (bs *BoltMetadataStore) GetFileByPath(ctx context.Context, bucket, filePath string) (FileMetadata, bool, error) {
+	var meta FileMetadata
+	found := false
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(boltReferencesBucket).Get(boltKey(bucket, filePath))
+		if data == nil {
+			return nil
+		}
+		found = true
+		return decodeBoltMetadata(data, &meta)
+	})
+	if err != nil {
+		return FileMetadata{}, false, err
+	}
+	return meta, found, nil
+}
+
+// CountReferences returns how many paths in the bucket reference the given hash
+func (bs *BoltMetadataStore) CountReferences(ctx context.Context, bucket, hash string) (int, error) {
+	count := 0
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		prefix := boltKey(bucket, hash+"\x00")
+		cursor := tx.Bucket(boltHashesBucket).Cursor()
+		for k, _ := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = cursor.Next() {
+			count++
+		}
+		return nil
+	})
+	return count, err
+}
+
+// ListFiles returns the entries of a bucket whose path starts with prefix
+func (bs *BoltMetadataStore) ListFiles(ctx context.Context, bucket, prefix string) ([]FileMetadata, error) {
+	var results []FileMetadata
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		start := boltKey(bucket, prefix)
+		cursor := tx.Bucket(boltReferencesBucket).Cursor()
+		for k, data := cursor.Seek(start); k != nil && bytes.HasPrefix(k, start); k, data = cursor.Next() {
+			var meta FileMetadata
+			if err := decodeBoltMetadata(data, &meta); err != nil {
+				return err
+			}
+			results = append(results, meta)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// QueryFiles filters, sorts and paginates entries, scanning a single bucket when one is given
+func (bs *BoltMetadataStore) QueryFiles(ctx context.Context, query FileQuery) (*FileQueryResult, error) {
+	if query.Bucket != "" {
+		entries, err := bs.ListFiles(ctx, query.Bucket, query.PathPrefix)
+		if err != nil {
+			return nil, err
+		}
+		return applyFileQuery(entries, query)
+	}
+
+	var entries []FileMetadata
+	if err := bs.forEach(func(meta FileMetadata) {
+		entries = append(entries, meta)
+	}); err != nil {
+		return nil, err
+	}
+	return applyFileQuery(entries, query)
+}
+
+// AddFileMetadata adds a new file metadata entry, replacing any entry at the same path in the bucket
+func (bs *BoltMetadataStore) AddFileMetadata(ctx context.Context, meta FileMetadata) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		return putBoltMetadata(tx, meta)
+	})
+}
+
+// AddFileMetadataBatch adds several entries in a single transaction
+func (bs *BoltMetadataStore) AddFileMetadataBatch(ctx context.Context, metas []FileMetadata) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		for _, meta := range metas {
+			if err := putBoltMetadata(tx, meta); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// RemoveFileMetadata removes a file metadata entry by path
+func (bs *BoltMetadataStore) RemoveFileMetadata(ctx context.Context, bucket, filePath string) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		references := tx.Bucket(boltReferencesBucket)
+		key := boltKey(bucket, filePath)
+
+		data := references.Get(key)
+		if data == nil {
+			return nil
+		}
+
+		var meta FileMetadata
+		if err := decodeBoltMetadata(data, &meta); err != nil {
+			return err
+		}
+		if err := tx.Bucket(boltHashesBucket).Delete(boltHashKey(meta)); err != nil {
+			return err
+		}
+		return references.Delete(key)
+	})
+}
+
+// SearchByHash searches for all files with a specific hash across all buckets
+func (bs *BoltMetadataStore) SearchByHash(ctx context.Context, hash string) ([]FileMetadata, error) {
+	var results []FileMetadata
+	err := bs.forEach(func(meta FileMetadata) {
+		if meta.FileHash == hash {
+			results = append(results, meta)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// GetStatistics returns statistics about stored files
+func (bs *BoltMetadataStore) GetStatistics(ctx context.Context) (map[string]interface{}, error) {
+	totalFiles := 0
+	totalSize := int64(0)
+	byBucket := make(map[string]int)
+	byType := make(map[string]int)
+
+	err := bs.forEach(func(meta FileMetadata) {
+		totalFiles++
+		totalSize += meta.FileSize
+		byBucket[meta.BucketName]++
+		byType[meta.ContentType]++
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{
+		"total_files": totalFiles,
+		"total_size":  totalSize,
+		"by_bucket":   byBucket,
+		"by_type":     byType,
+	}, nil
+}
+
+// referencesTo returns every entry of the bucket referencing the given hash
+func (bs *BoltMetadataStore) referencesTo(bucket, hash string) ([]FileMetadata, error) {
+	var results []FileMetadata
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		references := tx.Bucket(boltReferencesBucket)
+		prefix := boltKey(bucket, hash+"\x00")
+		cursor := tx.Bucket(boltHashesBucket).Cursor()
+		for k, _ := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = cursor.Next() {
+			filePath := strings.TrimPrefix(string(k), string(prefix))
+			data := references.Get(boltKey(bucket, filePath))
+			if data == nil {
+				continue
+			}
+			var meta FileMetadata
+			if err := decodeBoltMetadata(data, &meta); err != nil {
+				return err
+			}
+			results = append(results, meta)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// forEach decodes every stored entry and passes it to fn
+func (bs *BoltMetadataStore) forEach(fn func(meta FileMetadata)) error {
+	return bs.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltReferencesBucket).ForEach(func(_, data []byte) error {
+			var meta FileMetadata
+			if err := decodeBoltMetadata(data, &meta); err != nil {
+				return err
+			}
+			fn(meta)
+			return nil
+		})
+	})
+}
+
+// putBoltMetadata stores an entry and its hash index, dropping the index of the entry it replaces
+func putBoltMetadata(tx *bolt.Tx, meta FileMetadata) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return fmt.Errorf("failed to encode metadata: %w", err)
+	}
+
+	references := tx.Bucket(boltReferencesBucket)
+	hashes := tx.Bucket(boltHashesBucket)
+	key := boltKey(meta.BucketName, meta.FilePath)
+
+	// Drop the hash index of the entry being replaced
+	if existing := references.Get(key); existing != nil {
+		var old FileMetadata
+		if err := decodeBoltMetadata(existing, &old); err != nil {
+			return err
+		}
+		if err := hashes.Delete(boltHashKey(old)); err != nil {
+			return err
+		}
+	}
+
+	if err := references.Put(key, data); err != nil {
+		return err
+	}
+	return hashes.Put(boltHashKey(meta), nil)
+}
+
+func decodeBoltMetadata(data []byte, meta *FileMetadata) error {
+	if err := json.Unmarshal(data, meta); err != nil {
+		return fmt.Errorf("failed to decode metadata: %w", err)
+	}
+	return nil
+}
+
+// boltKey builds a composite key; NUL cannot appear in bucket names or object keys
+func boltKey(bucket, value string) []byte {
+	return []byte(bucket + "\x00" + value)
+}
+
+// boltHashKey builds the hash index key of an entry
+func boltHashKey(meta FileMetadata) []byte {
+	return boltKey(meta.BucketName, meta.FileHash+"\x00"+meta.FilePath)
+}
@@ -0,0 +1,147 @@
+package infra
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func newTestBoltStore(t *testing.T) *BoltMetadataStore {
+	t.Helper()
+	store, err := NewBoltMetadataStore(filepath.Join(t.TempDir(), "metadata.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = store.Close() })
+	return store
+}
+
+// boltHashKeys returns every key of the hash index
+func boltHashKeys(t *testing.T, store *BoltMetadataStore) []string {
+	t.Helper()
+	var keys []string
+	err := store.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltHashesBucket).ForEach(func(k, _ []byte) error {
+			keys = append(keys, string(k))
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+func TestBoltMetadataStoreIndex(t *testing.T) {
+	ctx := context.Background()
+	meta := func(bucket, filePath, hash string) FileMetadata {
+		return FileMetadata{BucketName: bucket, FilePath: filePath, FileHash: hash}
+	}
+
+	tests := []struct {
+		name   string
+		writes []FileMetadata
+		remove string         // path removed from the photos bucket after the writes
+		counts map[string]int // references per hash in the photos bucket
+		index  int            // keys left in the hash index
+	}{
+		{
+			name:   "shared content",
+			writes: []FileMetadata{meta("photos", "a.png", "h1"), meta("photos", "b.png", "h1")},
+			counts: map[string]int{"h1": 2},
+			index:  2,
+		},
+		{
+			name:   "replaced content drops the old index key",
+			writes: []FileMetadata{meta("photos", "a.png", "h1"), meta("photos", "a.png", "h2")},
+			counts: map[string]int{"h1": 0, "h2": 1},
+			index:  1,
+		},
+		{
+			name:   "same content written twice",
+			writes: []FileMetadata{meta("photos", "a.png", "h1"), meta("photos", "a.png", "h1")},
+			counts: map[string]int{"h1": 1},
+			index:  1,
+		},
+		{
+			name:   "removed path",
+			writes: []FileMetadata{meta("photos", "a.png", "h1"), meta("photos", "b.png", "h1")},
+			remove: "a.png",
+			counts: map[string]int{"h1": 1},
+			index:  1,
+		},
+		{
+			name:   "other buckets are counted apart",
+			writes: []FileMetadata{meta("photos", "a.png", "h1"), meta("photos-old", "a.png", "h1")},
+			counts: map[string]int{"h1": 1},
+			index:  2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newTestBoltStore(t)
+			if err := store.AddFileMetadataBatch(ctx, tt.writes); err != nil {
+				t.Fatal(err)
+			}
+			if tt.remove != "" {
+				if err := store.RemoveFileMetadata(ctx, "photos", tt.remove); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			for hash, want := range tt.counts {
+				if got, err := store.CountReferences(ctx, "photos", hash); err != nil || got != want {
+					t.Errorf("CountReferences(%s) = %d, %v; want %d", hash, got, err, want)
+				}
+			}
+			if keys := boltHashKeys(t, store); len(keys) != tt.index {
+				t.Errorf("hash index %q, want %d keys", keys, tt.index)
+			}
+		})
+	}
+}
+
+func TestBoltMetadataStoreLookups(t *testing.T) {
+	ctx := context.Background()
+	store := newTestBoltStore(t)
+
+	err := store.AddFileMetadataBatch(ctx, []FileMetadata{
+		{BucketName: "photos", FilePath: "docs/a.png", FileHash: "h1"},
+		{BucketName: "photos", FilePath: "docs/b.png", FileHash: "h1", BlobKey: "_blobs/h1"},
+		{BucketName: "photos", FilePath: "misc/c.png", FileHash: "h2"},
+		{BucketName: "photos-old", FilePath: "docs/d.png", FileHash: "h3"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A blob-backed reference is preferred so its content can be reused
+	if filePath, found, err := store.CheckFileByHash(ctx, "photos", "h1"); err != nil || !found || filePath != "docs/b.png" {
+		t.Errorf("CheckFileByHash(h1) = %q, %v, %v; want docs/b.png", filePath, found, err)
+	}
+	if _, found, err := store.CheckFileByHash(ctx, "photos", "h3"); err != nil || found {
+		t.Errorf("CheckFileByHash(h3) found=%v err=%v; want a miss in another bucket", found, err)
+	}
+
+	if meta, found, err := store.GetFileByPath(ctx, "photos", "misc/c.png"); err != nil || !found || meta.FileHash != "h2" {
+		t.Errorf("GetFileByPath = %q, %v, %v; want h2", meta.FileHash, found, err)
+	}
+
+	prefixes := []struct {
+		bucket, prefix string
+		want           int
+	}{
+		{"photos", "", 3},
+		{"photos", "docs/", 2},
+		{"photos", "none/", 0},
+		{"photos-old", "", 1},
+	}
+	for _, p := range prefixes {
+		entries, err := store.ListFiles(ctx, p.bucket, p.prefix)
+		if err != nil || len(entries) != p.want {
+			t.Errorf("ListFiles(%s, %q) = %d entries, %v; want %d", p.bucket, p.prefix, len(entries), err, p.want)
+		}
+	}
+}
@@ -18,13 +18,13 @@ func InitInfra(config *config.Config) *Infra {
 		panic("Failed to create MinIO client: " + err.Error())
 	}
 
-	parquetService := NewParquetService(minioClient)
-
 	loggerClient := InitLoggerClient(config.EnvConfig)
 	if loggerClient == nil {
 		panic("Failed to create Logger client")
 	}
 
+	parquetService := NewParquetService(minioClient, loggerClient)
+
 	// RabbitMQ is optional for HTTP service
 	rabbitMQ := InitRabbitMQClient(config.EnvConfig)
 	// Don't panic if RabbitMQ is not available - it's only needed for consumer
@@ -46,13 +46,13 @@ func InitInfraForConsumer(config *config.Config) *Infra {
 		panic("Failed to create MinIO client: " + err.Error())
 	}
 
-	parquetService := NewParquetService(minioClient)
-
 	loggerClient := InitLoggerClient(config.EnvConfig)
 	if loggerClient == nil {
 		panic("Failed to create Logger client")
 	}
 
+	parquetService := NewParquetService(minioClient, loggerClient)
+
 	rabbitMQ := InitRabbitMQClient(config.EnvConfig)
 	if rabbitMQ == nil {
 		panic("Failed to initialize RabbitMQ - required for consumer service")
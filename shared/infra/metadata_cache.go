@@ -0,0 +1,400 @@
+package infra
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"maps"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// MetadataCache is an in-process index over ParquetService keyed by (bucket, hash) and
+// (bucket, path). Dedup lookups (CheckFileByHash) and path lookups (GetFileByPath) are answered
+// from memory. The index may lag behind writes made by other replicas: a dedup lookup tolerates
+// it, since the blob store checks the content it is pointed at and uploads the bytes when that
+// content is gone, and a path missing from the index is looked up in Parquet, so only an entry
+// replaced elsewhere within maxStaleness can be returned. The writes themselves look up the
+// entries they replace in Parquet, and so do reference counts and the endpoints listing what was
+// just written. A background loop re-lists segment ETags and
+// reloads only the partitions that changed. When the index has not been synced within
+// maxStaleness, lookups fall back to reading Parquet directly.
+type MetadataCache struct {
+	parquet         *ParquetService
+	logger          *LoggerClient
+	refreshInterval time.Duration
+	maxStaleness    time.Duration
+
+	mu           sync.RWMutex
+	fingerprints map[string]string                  // partition prefix -> fingerprint of its segment ETags
+	partitions   map[string][]FileMetadata          // partition prefix -> live entries
+	byHash       map[string]map[string]FileMetadata // "<bucket>\x00<hash>" -> path -> entry
+	byPath       map[string]map[string]FileMetadata // "<bucket>\x00<path>" -> hash -> entry
+	syncedAt     time.Time
+}
+
+// legacyFingerprintKey tracks the pre-partitioning metadata file alongside partition fingerprints
+const legacyFingerprintKey = "legacy"
+
+func NewMetadataCache(parquet *ParquetService, logger *LoggerClient, refreshInterval, maxStaleness time.Duration) *MetadataCache {
+	return &MetadataCache{
+		parquet:         parquet,
+		logger:          logger,
+		refreshInterval: refreshInterval,
+		maxStaleness:    maxStaleness,
+		fingerprints:    make(map[string]string),
+		partitions:      make(map[string][]FileMetadata),
+		byHash:          make(map[string]map[string]FileMetadata),
+		byPath:          make(map[string]map[string]FileMetadata),
+	}
+}
+
+// Start refreshes the index every refreshInterval until ctx is cancelled
+func (mc *MetadataCache) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(mc.refreshInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := mc.Refresh(ctx); err != nil {
+					mc.logger.Warning("[Metadata Cache] Refresh failed", map[string]interface{}{
+						"error": err.Error(),
+					})
+				}
+			}
+		}
+	}()
+}
+
+// Refresh compares segment ETags with the last sync and reloads the partitions that changed.
+// The first call (warm-up) loads everything. A write landing while a partition is reloaded may be
+// missed from the index until the next refresh picks up its delta segment.
+func (mc *MetadataCache) Refresh(ctx context.Context) error {
+	objects, err := mc.parquet.minioClient.ListObjectsWithInfo(ctx, mc.parquet.metadataBucket, partitionRoot)
+	if err != nil && !IsNotFound(err) {
+		return err
+	}
+
+	fingerprints := make(map[string]string)
+	for prefix, partition := range groupSegments(objects) {
+		fingerprints[prefix] = partitionFingerprint(partition)
+	}
+
+	legacyETag, err := mc.legacyETag(ctx)
+	if err != nil {
+		return err
+	}
+	if legacyETag != "" {
+		fingerprints[legacyFingerprintKey] = legacyETag
+	}
+
+	mc.mu.RLock()
+	previous, syncedAt := mc.fingerprints, mc.syncedAt
+	mc.mu.RUnlock()
+
+	// Warm-up loads everything in one pass. Legacy rows span every partition, so any change
+	// while the legacy file exists reloads everything too
+	if syncedAt.IsZero() || legacyETag != "" || previous[legacyFingerprintKey] != "" {
+		if maps.Equal(previous, fingerprints) {
+			mc.markSynced()
+			return nil
+		}
+		metadata, err := mc.parquet.LoadMetadata(ctx)
+		if err != nil {
+			return err
+		}
+		mc.replaceAll(fingerprints, metadata)
+		return nil
+	}
+
+	changed := make(map[string][]FileMetadata)
+	for prefix, fingerprint := range fingerprints {
+		if previous[prefix] == fingerprint {
+			continue
+		}
+		metadata, err := mc.parquet.readPartitions(ctx, prefix)
+		if err != nil {
+			return err
+		}
+		changed[prefix] = metadata
+	}
+	for prefix := range previous {
+		if _, ok := fingerprints[prefix]; !ok {
+			changed[prefix] = nil
+		}
+	}
+
+	mc.applyPartitions(fingerprints, changed)
+	if len(changed) > 0 {
+		mc.logger.Debug("[Metadata Cache] Reloaded changed partitions", map[string]interface{}{
+			"partitions": len(changed),
+		})
+	}
+	return nil
+}
+
+// CheckFileByHash answers from the index while it is fresh enough
+func (mc *MetadataCache) CheckFileByHash(ctx context.Context, bucket, hash string) (string, bool, error) {
+	if !mc.fresh() {
+		return mc.parquet.CheckFileByHash(ctx, bucket, hash)
+	}
+
+	mc.mu.RLock()
+	defer mc.mu.RUnlock()
+	references := mc.byHash[bucket+"\x00"+hash]
+	for _, meta := range references {
+		if meta.BlobKey != "" {
+			return meta.FilePath, true, nil
+		}
+	}
+	for _, meta := range references {
+		return meta.FilePath, true, nil
+	}
+	return "", false, nil
+}
+
+// GetFileByPath answers from the index while it is fresh enough and knows the path; a path it
+// doesn't know may have been written by another replica since the last refresh, so it is looked
+// up in Parquet. A path holds several entries only after concurrent writes of different content;
+// the latest one is returned.
+func (mc *MetadataCache) GetFileByPath(ctx context.Context, bucket, filePath string) (FileMetadata, bool, error) {
+	if mc.fresh() {
+		if meta, found := mc.latestAtPath(bucket, filePath); found {
+			return meta, true, nil
+		}
+	}
+	return mc.parquet.GetFileByPath(ctx, bucket, filePath)
+}
+
+func (mc *MetadataCache) latestAtPath(bucket, filePath string) (FileMetadata, bool) {
+	mc.mu.RLock()
+	defer mc.mu.RUnlock()
+
+	var latest FileMetadata
+	found := false
+	for _, meta := range mc.byPath[bucket+"\x00"+filePath] {
+		if !found || newerThan(meta, latest) {
+			latest, found = meta, true
+		}
+	}
+	return latest, found
+}
+
+// CountReferences always reads Parquet: a stale count could delete content that is still referenced
+func (mc *MetadataCache) CountReferences(ctx context.Context, bucket, hash string) (int, error) {
+	return mc.parquet.CountReferences(ctx, bucket, hash)
+}
+
+// ListFiles always reads Parquet so a listing shows what was just written on any replica
+func (mc *MetadataCache) ListFiles(ctx context.Context, bucket, prefix string) ([]FileMetadata, error) {
+	return mc.parquet.ListFiles(ctx, bucket, prefix)
+}
+
+// QueryFiles always reads Parquet so a search shows what was just written on any replica
+func (mc *MetadataCache) QueryFiles(ctx context.Context, query FileQuery) (*FileQueryResult, error) {
+	return mc.parquet.QueryFiles(ctx, query)
+}
+
+// AddFileMetadata writes through to Parquet and updates the index immediately
+func (mc *MetadataCache) AddFileMetadata(ctx context.Context, meta FileMetadata) error {
+	return mc.AddFileMetadataBatch(ctx, []FileMetadata{meta})
+}
+
+// AddFileMetadataBatch writes every entry through to Parquet in one append and updates the index.
+// The entries being replaced are looked up in Parquet, so they are tombstoned even when the index
+// hasn't seen them yet.
+func (mc *MetadataCache) AddFileMetadataBatch(ctx context.Context, metas []FileMetadata) error {
+	metas = dedupeByPath(metas)
+	replacements := make([]replacement, 0, len(metas))
+	for _, meta := range metas {
+		previous, found, err := mc.parquet.GetFileByPath(ctx, meta.BucketName, meta.FilePath)
+		if err != nil {
+			return err
+		}
+		item := replacement{meta: meta}
+		if found {
+			item.previous = &previous
+		}
+		replacements = append(replacements, item)
+	}
+	if err := mc.parquet.addReplacing(ctx, replacements...); err != nil {
+		return err
+	}
+
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	for _, item := range replacements {
+		if item.previous != nil {
+			mc.dropEntry(*item.previous)
+		}
+		mc.dropEntry(item.meta)
+		prefix := partitionFor(item.meta.BucketName, item.meta.FileHash)
+		mc.partitions[prefix] = append(mc.partitions[prefix], item.meta)
+		mc.index(item.meta)
+	}
+	return nil
+}
+
+// RemoveFileMetadata writes through to Parquet and drops the entry from the index
+func (mc *MetadataCache) RemoveFileMetadata(ctx context.Context, bucket, filePath string) error {
+	meta, found, err := mc.parquet.GetFileByPath(ctx, bucket, filePath)
+	if err != nil || !found {
+		return err
+	}
+	if err := mc.parquet.removeEntries(ctx, []FileMetadata{meta}); err != nil {
+		return err
+	}
+
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	mc.dropEntry(meta)
+	return nil
+}
+
+// SearchByHash always reads Parquet; hash lookups across buckets report what is stored now
+func (mc *MetadataCache) SearchByHash(ctx context.Context, hash string) ([]FileMetadata, error) {
+	return mc.parquet.SearchByHash(ctx, hash)
+}
+
+// GetStatistics is computed by the Parquet service so it always reflects stored data
+func (mc *MetadataCache) GetStatistics(ctx context.Context) (map[string]interface{}, error) {
+	return mc.parquet.GetStatistics(ctx)
+}
+
+// fresh reports whether the index was synced with storage within maxStaleness
+func (mc *MetadataCache) fresh() bool {
+	mc.mu.RLock()
+	defer mc.mu.RUnlock()
+	return !mc.syncedAt.IsZero() && time.Since(mc.syncedAt) <= mc.maxStaleness
+}
+
+func (mc *MetadataCache) markSynced() {
+	mc.mu.Lock()
+	mc.syncedAt = time.Now()
+	mc.mu.Unlock()
+}
+
+// replaceAll swaps the whole index for freshly loaded metadata
+func (mc *MetadataCache) replaceAll(fingerprints map[string]string, metadata []FileMetadata) {
+	partitions := make(map[string][]FileMetadata)
+	for _, meta := range metadata {
+		prefix := partitionFor(meta.BucketName, meta.FileHash)
+		partitions[prefix] = append(partitions[prefix], meta)
+	}
+
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	mc.fingerprints = fingerprints
+	mc.partitions = partitions
+	mc.byHash = make(map[string]map[string]FileMetadata, len(metadata))
+	mc.byPath = make(map[string]map[string]FileMetadata, len(metadata))
+	for _, meta := range metadata {
+		mc.index(meta)
+	}
+	mc.syncedAt = time.Now()
+}
+
+// applyPartitions replaces the entries of changed partitions; a nil slice removes the partition
+func (mc *MetadataCache) applyPartitions(fingerprints map[string]string, changed map[string][]FileMetadata) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	for prefix, metadata := range changed {
+		for _, meta := range mc.partitions[prefix] {
+			mc.unindex(meta)
+		}
+		if metadata == nil {
+			delete(mc.partitions, prefix)
+			continue
+		}
+		mc.partitions[prefix] = metadata
+		for _, meta := range metadata {
+			mc.index(meta)
+		}
+	}
+	mc.fingerprints = fingerprints
+	mc.syncedAt = time.Now()
+}
+
+// dropEntry, index and unindex must be called with mc.mu held for writing
+func (mc *MetadataCache) dropEntry(meta FileMetadata) {
+	prefix := partitionFor(meta.BucketName, meta.FileHash)
+	entries := mc.partitions[prefix]
+	for i, item := range entries {
+		if item.BucketName == meta.BucketName && item.FileHash == meta.FileHash && item.FilePath == meta.FilePath {
+			mc.partitions[prefix] = append(entries[:i:i], entries[i+1:]...)
+			break
+		}
+	}
+	mc.unindex(meta)
+}
+
+func (mc *MetadataCache) index(meta FileMetadata) {
+	hashKey := meta.BucketName + "\x00" + meta.FileHash
+	if mc.byHash[hashKey] == nil {
+		mc.byHash[hashKey] = make(map[string]FileMetadata)
+	}
+	mc.byHash[hashKey][meta.FilePath] = meta
+
+	pathKey := meta.BucketName + "\x00" + meta.FilePath
+	if mc.byPath[pathKey] == nil {
+		mc.byPath[pathKey] = make(map[string]FileMetadata)
+	}
+	mc.byPath[pathKey][meta.FileHash] = meta
+}
+
+func (mc *MetadataCache) unindex(meta FileMetadata) {
+	hashKey := meta.BucketName + "\x00" + meta.FileHash
+	if references, ok := mc.byHash[hashKey]; ok {
+		delete(references, meta.FilePath)
+		if len(references) == 0 {
+			delete(mc.byHash, hashKey)
+		}
+	}
+
+	pathKey := meta.BucketName + "\x00" + meta.FilePath
+	if entries, ok := mc.byPath[pathKey]; ok {
+		delete(entries, meta.FileHash)
+		if len(entries) == 0 {
+			delete(mc.byPath, pathKey)
+		}
+	}
+}
+
+// legacyETag returns the ETag of the legacy metadata file, or "" once it is gone
+func (mc *MetadataCache) legacyETag(ctx context.Context) (string, error) {
+	if mc.parquet.legacyMigrated.Load() {
+		return "", nil
+	}
+
+	resp, err := mc.parquet.minioClient.Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(mc.parquet.metadataBucket),
+		Key:    aws.String(mc.parquet.metadataFile),
+	})
+	if err != nil {
+		if IsNotFound(err) {
+			mc.parquet.legacyMigrated.Store(true)
+			return "", nil
+		}
+		return "", err
+	}
+	return aws.ToString(resp.ETag), nil
+}
+
+// partitionFingerprint identifies the exact set of segments in a partition
+func partitionFingerprint(partition *partitionSegments) string {
+	hasher := sha256.New()
+	if partition.base != nil {
+		hasher.Write([]byte(partition.base.Key + ":" + partition.base.ETag + ";"))
+	}
+	for _, delta := range partition.deltas {
+		hasher.Write([]byte(delta.Key + ":" + delta.ETag + ";"))
+	}
+	return hex.EncodeToString(hasher.Sum(nil))
+}
@@ -0,0 +1,55 @@
+package infra
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestMetadataCacheGetFileByPath(t *testing.T) {
+	ctx := context.Background()
+	_, ps := newTestParquetService(t)
+	cache := NewMetadataCache(ps, ps.logger, time.Minute, time.Minute)
+	if err := cache.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	first := FileMetadata{BucketName: "photos", FilePath: "a.png", FileHash: "aa11", UploadedAt: time.Now()}
+	second := first
+	second.FileHash = "bb22"
+	// Written by another replica: the index hasn't seen it
+	other := FileMetadata{BucketName: "photos", FilePath: "b.png", FileHash: "cc33", UploadedAt: time.Now()}
+	if err := ps.AddFileMetadata(ctx, other); err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		name     string
+		write    func() error
+		path     string
+		wantHash string // "" when the path must not be found
+	}{
+		{"added", func() error { return cache.AddFileMetadata(ctx, first) }, "a.png", "aa11"},
+		{"replaced", func() error { return cache.AddFileMetadata(ctx, second) }, "a.png", "bb22"},
+		{"removed", func() error { return cache.RemoveFileMetadata(ctx, "photos", "a.png") }, "a.png", ""},
+		{"written elsewhere", nil, "b.png", "cc33"},
+	}
+	for _, step := range steps {
+		if step.write != nil {
+			if err := step.write(); err != nil {
+				t.Fatalf("%s: %v", step.name, err)
+			}
+		}
+		meta, found, err := cache.GetFileByPath(ctx, "photos", step.path)
+		if err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		if found != (step.wantHash != "") || meta.FileHash != step.wantHash {
+			t.Errorf("%s: GetFileByPath = %q, found=%v; want %q", step.name, meta.FileHash, found, step.wantHash)
+		}
+	}
+
+	if _, found := cache.latestAtPath("photos", "a.png"); found {
+		t.Error("removed path still indexed")
+	}
+}
@@ -0,0 +1,290 @@
+package infra
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+// Sort fields accepted by FileQuery
+const (
+	SortByUploadedAt = "uploaded_at"
+	SortBySize       = "size"
+	SortByPath       = "path"
+	SortByName       = "name"
+)
+
+// ErrInvalidCursor is returned when a pagination cursor is malformed or was issued for another sort order
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// FileQuery filters, sorts and paginates metadata entries. Zero values disable a filter.
+type FileQuery struct {
+	Bucket         string
+	PathPrefix     string
+	ContentType    string // exact match, or a "type/*" wildcard
+	NameContains   string // case-insensitive substring of the original name
+	MinSize        int64
+	MaxSize        int64 // 0 means unbounded
+	UploadedAfter  time.Time
+	UploadedBefore time.Time
+
+	SortBy     string // one of the SortBy constants, default SortByUploadedAt
+	Descending bool
+	Limit      int
+	Cursor     string
+}
+
+// FileQueryResult is one page of matching entries; NextCursor is empty on the last page
+type FileQueryResult struct {
+	Files      []FileMetadata
+	NextCursor string
+}
+
+// queryCursor identifies the last entry of a page in the query's sort order
+type queryCursor struct {
+	SortBy     string    `json:"s"`
+	Descending bool      `json:"d"`
+	UploadedAt time.Time `json:"t"`
+	FileSize   int64     `json:"z"`
+	Name       string    `json:"n"`
+	Bucket     string    `json:"b"`
+	Path       string    `json:"p"`
+}
+
+// Matches reports whether an entry passes every filter of the query
+func (q FileQuery) Matches(meta FileMetadata) bool {
+	if q.Bucket != "" && meta.BucketName != q.Bucket {
+		return false
+	}
+	if !strings.HasPrefix(meta.FilePath, q.PathPrefix) {
+		return false
+	}
+	if q.ContentType != "" && !q.matchesContentType(meta.ContentType) {
+		return false
+	}
+	if q.NameContains != "" && !strings.Contains(strings.ToLower(meta.OriginalName), strings.ToLower(q.NameContains)) {
+		return false
+	}
+	if meta.FileSize < q.MinSize || (q.MaxSize > 0 && meta.FileSize > q.MaxSize) {
+		return false
+	}
+	if !q.UploadedAfter.IsZero() && meta.UploadedAt.Before(q.UploadedAfter) {
+		return false
+	}
+	if !q.UploadedBefore.IsZero() && meta.UploadedAt.After(q.UploadedBefore) {
+		return false
+	}
+	return true
+}
+
+func (q FileQuery) matchesContentType(contentType string) bool {
+	if prefix, ok := q.contentTypePrefix(); ok {
+		return strings.HasPrefix(contentType, prefix)
+	}
+	return contentType == q.ContentType
+}
+
+// contentTypePrefix returns "image/" for an "image/*" wildcard
+func (q FileQuery) contentTypePrefix() (string, bool) {
+	if strings.HasSuffix(q.ContentType, "/*") {
+		return strings.TrimSuffix(q.ContentType, "*"), true
+	}
+	return "", false
+}
+
+// applyFileQuery filters, sorts and paginates entries already loaded by a store
+func applyFileQuery(entries []FileMetadata, q FileQuery) (*FileQueryResult, error) {
+	if q.SortBy == "" {
+		q.SortBy = SortByUploadedAt
+	}
+
+	var after *queryCursor
+	if q.Cursor != "" {
+		cursor, err := decodeQueryCursor(q.Cursor)
+		if err != nil || cursor.SortBy != q.SortBy || cursor.Descending != q.Descending {
+			return nil, ErrInvalidCursor
+		}
+		after = cursor
+	}
+
+	matched := make([]FileMetadata, 0)
+	for _, meta := range entries {
+		if !q.Matches(meta) {
+			continue
+		}
+		if after != nil && compareForQuery(cursorOf(meta, q), *after) <= 0 {
+			continue
+		}
+		matched = append(matched, meta)
+	}
+
+	sort.Slice(matched, func(i, j int) bool {
+		return compareForQuery(cursorOf(matched[i], q), cursorOf(matched[j], q)) < 0
+	})
+
+	result := &FileQueryResult{Files: matched}
+	if q.Limit > 0 && len(matched) > q.Limit {
+		result.Files = matched[:q.Limit]
+		result.NextCursor = encodeQueryCursor(cursorOf(result.Files[q.Limit-1], q))
+	}
+	return result, nil
+}
+
+// cursorOf returns the sort position of an entry
+func cursorOf(meta FileMetadata, q FileQuery) queryCursor {
+	return queryCursor{
+		SortBy:     q.SortBy,
+		Descending: q.Descending,
+		UploadedAt: meta.UploadedAt,
+		FileSize:   meta.FileSize,
+		Name:       meta.OriginalName,
+		Bucket:     meta.BucketName,
+		Path:       meta.FilePath,
+	}
+}
+
+// compareForQuery orders two positions by the sort field, then bucket and path so the order is total
+func compareForQuery(a, b queryCursor) int {
+	order := 0
+	switch a.SortBy {
+	case SortBySize:
+		order = compareInt64(a.FileSize, b.FileSize)
+	case SortByName:
+		order = strings.Compare(a.Name, b.Name)
+	case SortByPath:
+		order = strings.Compare(a.Path, b.Path)
+	default:
+		order = a.UploadedAt.Compare(b.UploadedAt)
+	}
+	if order == 0 {
+		order = strings.Compare(a.Bucket, b.Bucket)
+	}
+	if order == 0 {
+		order = strings.Compare(a.Path, b.Path)
+	}
+	if a.Descending {
+		return -order
+	}
+	return order
+}
+
+func compareInt64(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
+
+func encodeQueryCursor(cursor queryCursor) string {
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeQueryCursor(value string) (*queryCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	var cursor queryCursor
+	if err := json.Unmarshal(data, &cursor); err != nil {
+		return nil, err
+	}
+	return &cursor, nil
+}
+
+// rowGroupMatcher returns a predicate skipping row groups whose column statistics prove that no
+// row can match the query. Row groups without statistics are always read.
+func rowGroupMatcher(q FileQuery) func(rowGroup parquet.RowGroup) bool {
+	return func(rowGroup parquet.RowGroup) bool {
+		if q.Bucket != "" && !boundsMayContain(rowGroup, "bucket_name", q.Bucket, false) {
+			return false
+		}
+		if q.PathPrefix != "" && !boundsMayContain(rowGroup, "file_path", q.PathPrefix, true) {
+			return false
+		}
+		if q.ContentType != "" {
+			prefix, wildcard := q.contentTypePrefix()
+			if !wildcard {
+				prefix = q.ContentType
+			}
+			if !boundsMayContain(rowGroup, "content_type", prefix, wildcard) {
+				return false
+			}
+		}
+
+		if min, max, ok := columnBounds(rowGroup, "file_size"); ok {
+			if max.Int64() < q.MinSize || (q.MaxSize > 0 && min.Int64() > q.MaxSize) {
+				return false
+			}
+		}
+		if min, max, ok := columnBounds(rowGroup, "uploaded_at"); ok {
+			unit := timestampUnit(rowGroup, "uploaded_at")
+			if !q.UploadedAfter.IsZero() && max.Int64() < q.UploadedAfter.UnixNano()/unit {
+				return false
+			}
+			if !q.UploadedBefore.IsZero() && min.Int64() > q.UploadedBefore.UnixNano()/unit {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// boundsMayContain checks a string value, or any value with the given prefix, against a column's min/max
+func boundsMayContain(rowGroup parquet.RowGroup, column, value string, prefix bool) bool {
+	min, max, ok := columnBounds(rowGroup, column)
+	if !ok {
+		return true
+	}
+	lower, upper := min.ByteArray(), max.ByteArray()
+	if bytes.Compare(upper, []byte(value)) < 0 && !(prefix && bytes.HasPrefix(upper, []byte(value))) {
+		return false
+	}
+	if bytes.Compare(lower, []byte(value)) > 0 && !(prefix && bytes.HasPrefix(lower, []byte(value))) {
+		return false
+	}
+	return true
+}
+
+// columnBounds returns the min/max statistics of a column in a row group
+func columnBounds(rowGroup parquet.RowGroup, column string) (parquet.Value, parquet.Value, bool) {
+	leaf, ok := rowGroup.Schema().Lookup(column)
+	if !ok {
+		return parquet.Value{}, parquet.Value{}, false
+	}
+	chunk, ok := rowGroup.ColumnChunks()[leaf.ColumnIndex].(*parquet.FileColumnChunk)
+	if !ok {
+		return parquet.Value{}, parquet.Value{}, false
+	}
+	return chunk.Bounds()
+}
+
+// timestampUnit returns the number of nanoseconds per stored unit of a timestamp column
+func timestampUnit(rowGroup parquet.RowGroup, column string) int64 {
+	leaf, ok := rowGroup.Schema().Lookup(column)
+	if !ok {
+		return 1
+	}
+	logical := leaf.Node.Type().LogicalType()
+	if logical == nil || logical.Timestamp == nil {
+		return 1
+	}
+	switch {
+	case logical.Timestamp.Unit.Millis != nil:
+		return int64(time.Millisecond)
+	case logical.Timestamp.Unit.Micros != nil:
+		return int64(time.Microsecond)
+	default:
+		return 1
+	}
+}
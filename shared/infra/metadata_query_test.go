@@ -0,0 +1,105 @@
+package infra
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestApplyFileQueryPagination(t *testing.T) {
+	base := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	// Sizes and upload times tie, so pages rely on the bucket/path tie-break
+	entries := []FileMetadata{
+		{BucketName: "photos", FilePath: "c.png", OriginalName: "Cat.png", FileSize: 20, UploadedAt: base},
+		{BucketName: "photos", FilePath: "a.png", OriginalName: "bird.png", FileSize: 10, UploadedAt: base.Add(time.Hour)},
+		{BucketName: "photos", FilePath: "b.png", OriginalName: "ant.png", FileSize: 10, UploadedAt: base},
+		{BucketName: "docs", FilePath: "b.png", OriginalName: "dog.png", FileSize: 30, UploadedAt: base.Add(2 * time.Hour)},
+		{BucketName: "docs", FilePath: "a.txt", OriginalName: "notes.txt", FileSize: 5, UploadedAt: base.Add(time.Hour), ContentType: "text/plain"},
+	}
+
+	tests := []struct {
+		name  string
+		query FileQuery
+		want  []string // bucket/path in page order
+	}{
+		{
+			name:  "uploaded_at by default",
+			query: FileQuery{},
+			want:  []string{"photos/b.png", "photos/c.png", "docs/a.txt", "photos/a.png", "docs/b.png"},
+		},
+		{
+			name:  "size descending",
+			query: FileQuery{SortBy: SortBySize, Descending: true},
+			want:  []string{"docs/b.png", "photos/c.png", "photos/b.png", "photos/a.png", "docs/a.txt"},
+		},
+		{
+			name:  "path within a bucket",
+			query: FileQuery{Bucket: "photos", SortBy: SortByPath},
+			want:  []string{"photos/a.png", "photos/b.png", "photos/c.png"},
+		},
+		{
+			name:  "name is case-sensitive",
+			query: FileQuery{SortBy: SortByName},
+			want:  []string{"photos/c.png", "photos/b.png", "photos/a.png", "docs/b.png", "docs/a.txt"},
+		},
+		{
+			name:  "filtered",
+			query: FileQuery{ContentType: "text/*"},
+			want:  []string{"docs/a.txt"},
+		},
+	}
+	for _, tt := range tests {
+		for _, limit := range []int{0, 1, 2} {
+			query := tt.query
+			query.Limit = limit
+
+			var got []string
+			for page := 0; page <= len(entries); page++ {
+				result, err := applyFileQuery(entries, query)
+				if err != nil {
+					t.Fatalf("%s, limit %d: %v", tt.name, limit, err)
+				}
+				if limit > 0 && len(result.Files) > limit {
+					t.Fatalf("%s, limit %d: page of %d entries", tt.name, limit, len(result.Files))
+				}
+				for _, meta := range result.Files {
+					got = append(got, meta.BucketName+"/"+meta.FilePath)
+				}
+				if result.NextCursor == "" {
+					break
+				}
+				query.Cursor = result.NextCursor
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("%s, limit %d: %v, want %v", tt.name, limit, got, tt.want)
+			}
+		}
+	}
+}
+
+func TestApplyFileQueryInvalidCursor(t *testing.T) {
+	entries := []FileMetadata{
+		{BucketName: "photos", FilePath: "a.png", FileSize: 1},
+		{BucketName: "photos", FilePath: "b.png", FileSize: 2},
+	}
+	first, err := applyFileQuery(entries, FileQuery{SortBy: SortBySize, Limit: 1})
+	if err != nil || first.NextCursor == "" {
+		t.Fatalf("first page: %v, cursor %q", err, first.NextCursor)
+	}
+
+	tests := []struct {
+		name  string
+		query FileQuery
+	}{
+		{"not base64", FileQuery{Cursor: "!!"}},
+		{"not a cursor", FileQuery{Cursor: encodeQueryCursor(queryCursor{})[:3]}},
+		{"other sort field", FileQuery{SortBy: SortByPath, Cursor: first.NextCursor}},
+		{"other direction", FileQuery{SortBy: SortBySize, Descending: true, Cursor: first.NextCursor}},
+	}
+	for _, tt := range tests {
+		if _, err := applyFileQuery(entries, tt.query); !errors.Is(err, ErrInvalidCursor) {
+			t.Errorf("%s: err = %v, want ErrInvalidCursor", tt.name, err)
+		}
+	}
+}
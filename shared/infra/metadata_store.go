@@ -0,0 +1,50 @@
+package infra
+
+import (
+	"context"
+)
+
+// MetadataStore is the contract used by the upload flow to look up and register file metadata.
+// Entries are references: each bucket/path points at content identified by its hash, and several
+// paths may share the same hash. ParquetService (object storage backed) and BoltMetadataStore (embedded on-disk) both implement it,
+// MetadataCache adds an in-process index in front of ParquetService.
+type MetadataStore interface {
+	// CheckFileByHash returns the path of a file with the given hash in the bucket, if any
+	CheckFileByHash(ctx context.Context, bucket, hash string) (string, bool, error)
+
+	// GetFileByPath returns the entry registered for a bucket/path, if any
+	GetFileByPath(ctx context.Context, bucket, filePath string) (FileMetadata, bool, error)
+
+	// CountReferences returns how many paths in the bucket reference the given hash.
+	// It always reads the backing store so it can be trusted before deleting content.
+	CountReferences(ctx context.Context, bucket, hash string) (int, error)
+
+	// ListFiles returns the entries of a bucket whose path starts with prefix
+	ListFiles(ctx context.Context, bucket, prefix string) ([]FileMetadata, error)
+
+	// QueryFiles returns one page of the entries matching a query, in the query's sort order
+	QueryFiles(ctx context.Context, query FileQuery) (*FileQueryResult, error)
+
+	// AddFileMetadata adds or replaces the metadata entry for a bucket/path
+	AddFileMetadata(ctx context.Context, meta FileMetadata) error
+
+	// AddFileMetadataBatch adds or replaces several entries with a single write to the backing store.
+	// When an entry appears more than once for the same bucket/path, the last one wins.
+	AddFileMetadataBatch(ctx context.Context, metas []FileMetadata) error
+
+	// RemoveFileMetadata removes the metadata entry stored for a bucket/path
+	RemoveFileMetadata(ctx context.Context, bucket, filePath string) error
+
+	// SearchByHash returns every entry with the given hash across all buckets
+	SearchByHash(ctx context.Context, hash string) ([]FileMetadata, error)
+
+	// GetStatistics returns total files, total size and per bucket / content type counts
+	GetStatistics(ctx context.Context) (map[string]interface{}, error)
+}
+
+// Compile-time checks that every store satisfies MetadataStore
+var (
+	_ MetadataStore = (*ParquetService)(nil)
+	_ MetadataStore = (*BoltMetadataStore)(nil)
+	_ MetadataStore = (*MetadataCache)(nil)
+)
@@ -3,15 +3,20 @@ package infra
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"net/http"
+	"net/url"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	awsconfig "github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 	appconfig "github.com/tnqbao/gau-upload-service/shared/config"
 )
 
@@ -81,6 +86,29 @@ func (m *MinioClient) PutObjectWithMetadata(ctx context.Context, bucket, key str
 	return nil
 }
 
+// PutObjectIfMatch uploads data only if the object still has the given ETag.
+// An empty ETag means the object must not exist yet. It returns the new ETag of the object;
+// check failures with IsPreconditionFailed.
+func (m *MinioClient) PutObjectIfMatch(ctx context.Context, bucket, key string, data []byte, contentType, etag string) (string, error) {
+	input := &s3.PutObjectInput{
+		Bucket:      aws.String(bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(data),
+		ContentType: aws.String(contentType),
+	}
+	if etag != "" {
+		input.IfMatch = aws.String(etag)
+	} else {
+		input.IfNoneMatch = aws.String("*")
+	}
+
+	output, err := m.Client.PutObject(ctx, input)
+	if err != nil {
+		return "", fmt.Errorf("failed to put object conditionally: %w", err)
+	}
+	return aws.ToString(output.ETag), nil
+}
+
 // PutObjectStreamWithMetadata uploads an object from a stream with custom metadata
 // Uses S3 Upload Manager which automatically handles multipart uploads for large files
 func (m *MinioClient) PutObjectStreamWithMetadata(ctx context.Context, bucket, key string, reader io.Reader, size int64, contentType string, metadata map[string]string) error {
@@ -139,6 +167,51 @@ func (m *MinioClient) CheckFileExistsByHash(ctx context.Context, bucket, hash st
 	return "", false, nil
 }
 
+// ObjectExists reports whether an object exists, using a HEAD request
+func (m *MinioClient) ObjectExists(ctx context.Context, bucket, key string) (bool, error) {
+	_, err := m.Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		if IsNotFound(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to head object: %w", err)
+	}
+	return true, nil
+}
+
+// StatObject returns the size, ETag, modification time and content type of an object
+func (m *MinioClient) StatObject(ctx context.Context, bucket, key string) (ObjectInfo, error) {
+	resp, err := m.Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return ObjectInfo{}, fmt.Errorf("failed to head object: %w", err)
+	}
+	return ObjectInfo{
+		Key:          key,
+		ETag:         aws.ToString(resp.ETag),
+		Size:         aws.ToInt64(resp.ContentLength),
+		LastModified: aws.ToTime(resp.LastModified),
+		ContentType:  aws.ToString(resp.ContentType),
+	}, nil
+}
+
+// GetObjectMetadata returns the content type and user metadata of an object
+func (m *MinioClient) GetObjectMetadata(ctx context.Context, bucket, key string) (string, map[string]string, error) {
+	resp, err := m.Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to head object: %w", err)
+	}
+	return aws.ToString(resp.ContentType), resp.Metadata, nil
+}
+
 // GetObjectFromBucket retrieves an object from a specific bucket
 func (m *MinioClient) GetObjectFromBucket(ctx context.Context, bucket, key string) ([]byte, string, error) {
 	resp, err := m.Client.GetObject(ctx, &s3.GetObjectInput{
@@ -161,12 +234,51 @@ func (m *MinioClient) GetObjectFromBucket(ctx context.Context, bucket, key strin
 	return buf.Bytes(), contentType, nil
 }
 
-// GetObjectStream gets an object as a stream (io.ReadCloser) without loading into memory
-func (m *MinioClient) GetObjectStream(ctx context.Context, bucket, key string) (io.ReadCloser, int64, error) {
+// GetObjectWithETag retrieves an object together with its ETag, used for conditional rewrites
+func (m *MinioClient) GetObjectWithETag(ctx context.Context, bucket, key string) ([]byte, string, error) {
 	resp, err := m.Client.GetObject(ctx, &s3.GetObjectInput{
 		Bucket: aws.String(bucket),
 		Key:    aws.String(key),
 	})
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to get object: %w", err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	buf := new(bytes.Buffer)
+	if _, err := io.Copy(buf, resp.Body); err != nil {
+		return nil, "", err
+	}
+
+	return buf.Bytes(), aws.ToString(resp.ETag), nil
+}
+
+// GetObjectStream gets an object as a stream (io.ReadCloser) without loading into memory
+func (m *MinioClient) GetObjectStream(ctx context.Context, bucket, key string) (io.ReadCloser, int64, error) {
+	return m.GetObjectStreamFrom(ctx, bucket, key, 0, 0, "")
+}
+
+// GetObjectStreamFrom is GetObjectStream reading length bytes from offset, or the rest of the
+// object when length is 0; the returned size is what the stream holds. A non-empty etag makes
+// the read fail with IsPreconditionFailed if the object was replaced.
+func (m *MinioClient) GetObjectStreamFrom(ctx context.Context, bucket, key string, offset, length int64, etag string) (io.ReadCloser, int64, error) {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	}
+	switch {
+	case length > 0:
+		input.Range = aws.String(fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	case offset > 0:
+		input.Range = aws.String(fmt.Sprintf("bytes=%d-", offset))
+	}
+	if etag != "" {
+		input.IfMatch = aws.String(etag)
+	}
+
+	resp, err := m.Client.GetObject(ctx, input)
 	if err != nil {
 		return nil, 0, fmt.Errorf("failed to get object stream: %w", err)
 	}
@@ -191,6 +303,20 @@ func (m *MinioClient) DeleteObject(ctx context.Context, bucket, key string) erro
 	return nil
 }
 
+// DeleteObjectIfMatch deletes an object only if it still has the given ETag;
+// check failures with IsPreconditionFailed
+func (m *MinioClient) DeleteObjectIfMatch(ctx context.Context, bucket, key, etag string) error {
+	_, err := m.Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket:  aws.String(bucket),
+		Key:     aws.String(key),
+		IfMatch: aws.String(etag),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete object conditionally: %w", err)
+	}
+	return nil
+}
+
 // CopyObject copies an object from source to destination within the same or different bucket
 func (m *MinioClient) CopyObject(ctx context.Context, srcBucket, srcKey, dstBucket, dstKey string) error {
 	copySource := fmt.Sprintf("%s/%s", srcBucket, srcKey)
@@ -206,6 +332,36 @@ func (m *MinioClient) CopyObject(ctx context.Context, srcBucket, srcKey, dstBuck
 	return nil
 }
 
+// CopyObjectWithMetadata copies an object of the given size server-side, replacing its content
+// type and user metadata. Objects above the 5GB limit of a single copy are copied in parts.
+func (m *MinioClient) CopyObjectWithMetadata(ctx context.Context, srcBucket, srcKey, dstBucket, dstKey string, size int64, contentType string, metadata map[string]string) error {
+	if size > maxCopyObjectSize {
+		return m.copyObjectInParts(ctx, srcBucket, srcKey, dstBucket, dstKey, size, contentType, metadata)
+	}
+
+	_, err := m.Client.CopyObject(ctx, &s3.CopyObjectInput{
+		Bucket:            aws.String(dstBucket),
+		Key:               aws.String(dstKey),
+		CopySource:        aws.String(copySource(srcBucket, srcKey)),
+		ContentType:       aws.String(contentType),
+		Metadata:          metadata,
+		MetadataDirective: types.MetadataDirectiveReplace,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to copy object: %w", err)
+	}
+	return nil
+}
+
+// copySource builds the URL-encoded x-amz-copy-source value for a bucket/key
+func copySource(bucket, key string) string {
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return bucket + "/" + strings.Join(segments, "/")
+}
+
 // DeleteObjectFromBucket deletes an object from a specific bucket
 func (m *MinioClient) DeleteObjectFromBucket(ctx context.Context, bucket, key string) error {
 	_, err := m.Client.DeleteObject(ctx, &s3.DeleteObjectInput{
@@ -235,6 +391,75 @@ func (m *MinioClient) ListObjectsFromBucket(ctx context.Context, bucket, prefix
 	return keys, nil
 }
 
+// ObjectInfo describes a listed object
+type ObjectInfo struct {
+	Key          string
+	ETag         string
+	Size         int64
+	LastModified time.Time
+	ContentType  string // only set by StatObject; listings don't report it
+}
+
+// ListObjectsWithInfo lists every object under a prefix, following pagination, with ETag and size
+func (m *MinioClient) ListObjectsWithInfo(ctx context.Context, bucket, prefix string) ([]ObjectInfo, error) {
+	paginator := s3.NewListObjectsV2Paginator(m.Client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(prefix),
+	})
+
+	var objects []ObjectInfo
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list objects: %w", err)
+		}
+		for _, item := range page.Contents {
+			objects = append(objects, ObjectInfo{
+				Key:          aws.ToString(item.Key),
+				ETag:         aws.ToString(item.ETag),
+				Size:         aws.ToInt64(item.Size),
+				LastModified: aws.ToTime(item.LastModified),
+			})
+		}
+	}
+	return objects, nil
+}
+
+// ListFolders lists the immediate sub-folders (common prefixes) under a prefix
+func (m *MinioClient) ListFolders(ctx context.Context, bucket, prefix string) ([]string, error) {
+	paginator := s3.NewListObjectsV2Paginator(m.Client, &s3.ListObjectsV2Input{
+		Bucket:    aws.String(bucket),
+		Prefix:    aws.String(prefix),
+		Delimiter: aws.String("/"),
+	})
+
+	var folders []string
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list folders: %w", err)
+		}
+		for _, item := range page.CommonPrefixes {
+			folders = append(folders, aws.ToString(item.Prefix))
+		}
+	}
+	return folders, nil
+}
+
+// ListBuckets returns the names of all buckets
+func (m *MinioClient) ListBuckets(ctx context.Context) ([]string, error) {
+	resp, err := m.Client.ListBuckets(ctx, &s3.ListBucketsInput{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list buckets: %w", err)
+	}
+
+	names := make([]string, 0, len(resp.Buckets))
+	for _, bucket := range resp.Buckets {
+		names = append(names, aws.ToString(bucket.Name))
+	}
+	return names, nil
+}
+
 // EnsureBucketByName creates a bucket by name if it doesn't exist
 func (m *MinioClient) EnsureBucketByName(ctx context.Context, bucket string) error {
 	_, err := m.Client.HeadBucket(ctx, &s3.HeadBucketInput{
@@ -252,6 +477,20 @@ func (m *MinioClient) EnsureBucketByName(ctx context.Context, bucket string) err
 	return nil
 }
 
+// BucketExists reports whether a bucket exists
+func (m *MinioClient) BucketExists(ctx context.Context, bucket string) (bool, error) {
+	_, err := m.Client.HeadBucket(ctx, &s3.HeadBucketInput{
+		Bucket: aws.String(bucket),
+	})
+	if err != nil {
+		if IsNotFound(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to check bucket: %w", err)
+	}
+	return true, nil
+}
+
 // CreateFolderIfNotExist creates a folder (directory marker) in MinIO if it doesn't exist
 // In S3/MinIO, folders are virtual and created by adding a trailing slash to the key
 func (m *MinioClient) CreateFolderIfNotExist(ctx context.Context, bucket, folderPath string) error {
@@ -289,3 +528,36 @@ func (m *MinioClient) CreateFolderIfNotExist(ctx context.Context, bucket, folder
 
 	return nil
 }
+
+// IsNotFound reports whether an S3 error means the object or bucket does not exist
+func IsNotFound(err error) bool {
+	return httpStatusCode(err) == http.StatusNotFound
+}
+
+// IsPreconditionFailed reports whether a conditional request (If-Match / If-None-Match) was rejected
+// MinIO answers concurrent conditional writes with 409, so both codes are treated as a lost race
+func IsPreconditionFailed(err error) bool {
+	code := httpStatusCode(err)
+	return code == http.StatusPreconditionFailed || code == http.StatusConflict
+}
+
+// IsNotImplemented reports whether the storage does not support a request, such as conditional
+// writes on older S3-compatible backends
+func IsNotImplemented(err error) bool {
+	return httpStatusCode(err) == http.StatusNotImplemented
+}
+
+// IsBadRequest reports whether the storage rejected a request as invalid, such as a multipart
+// upload with a part below the minimum size
+func IsBadRequest(err error) bool {
+	return httpStatusCode(err) == http.StatusBadRequest
+}
+
+// httpStatusCode extracts the HTTP status code from an SDK error, or 0 if there is none
+func httpStatusCode(err error) int {
+	var respErr interface{ HTTPStatusCode() int }
+	if errors.As(err, &respErr) {
+		return respErr.HTTPStatusCode()
+	}
+	return 0
+}
@@ -0,0 +1,175 @@
+package infra
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+const (
+	// maxCopyObjectSize is the largest object a single CopyObject can copy
+	maxCopyObjectSize = 5 << 30
+	// copyPartSize is the size of each part of a copy above maxCopyObjectSize; 10000 parts cover 5TB
+	copyPartSize = 512 << 20
+)
+
+// MultipartPart describes a part of a multipart upload. ChecksumSHA256 is base64 encoded, as S3 reports it.
+type MultipartPart struct {
+	PartNumber     int32
+	ETag           string
+	ChecksumSHA256 string
+	Size           int64
+	LastModified   time.Time
+}
+
+// CreateMultipartUpload starts a multipart upload whose parts carry SHA-256 checksums
+func (m *MinioClient) CreateMultipartUpload(ctx context.Context, bucket, key, contentType string) (string, error) {
+	if err := m.EnsureBucketByName(ctx, bucket); err != nil {
+		return "", err
+	}
+
+	resp, err := m.Client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:            aws.String(bucket),
+		Key:               aws.String(key),
+		ContentType:       aws.String(contentType),
+		ChecksumAlgorithm: types.ChecksumAlgorithmSha256,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to create multipart upload: %w", err)
+	}
+	return aws.ToString(resp.UploadId), nil
+}
+
+// UploadPart uploads one part; the storage rejects it if the content doesn't match checksumSHA256 (base64)
+func (m *MinioClient) UploadPart(ctx context.Context, bucket, key, uploadID string, partNumber int32, body io.ReadSeeker, size int64, checksumSHA256 string) (string, error) {
+	resp, err := m.Client.UploadPart(ctx, &s3.UploadPartInput{
+		Bucket:            aws.String(bucket),
+		Key:               aws.String(key),
+		UploadId:          aws.String(uploadID),
+		PartNumber:        aws.Int32(partNumber),
+		Body:              body,
+		ContentLength:     aws.Int64(size),
+		ChecksumAlgorithm: types.ChecksumAlgorithmSha256,
+		ChecksumSHA256:    aws.String(checksumSHA256),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to upload part %d: %w", partNumber, err)
+	}
+	return aws.ToString(resp.ETag), nil
+}
+
+// ListParts returns every uploaded part of a multipart upload, following pagination
+func (m *MinioClient) ListParts(ctx context.Context, bucket, key, uploadID string) ([]MultipartPart, error) {
+	paginator := s3.NewListPartsPaginator(m.Client, &s3.ListPartsInput{
+		Bucket:   aws.String(bucket),
+		Key:      aws.String(key),
+		UploadId: aws.String(uploadID),
+	})
+
+	var parts []MultipartPart
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list parts: %w", err)
+		}
+		for _, part := range page.Parts {
+			parts = append(parts, MultipartPart{
+				PartNumber:     aws.ToInt32(part.PartNumber),
+				ETag:           aws.ToString(part.ETag),
+				ChecksumSHA256: aws.ToString(part.ChecksumSHA256),
+				Size:           aws.ToInt64(part.Size),
+				LastModified:   aws.ToTime(part.LastModified),
+			})
+		}
+	}
+	return parts, nil
+}
+
+// CompleteMultipartUpload assembles the given parts, in ascending part number order, into the object
+func (m *MinioClient) CompleteMultipartUpload(ctx context.Context, bucket, key, uploadID string, parts []MultipartPart) error {
+	completed := make([]types.CompletedPart, 0, len(parts))
+	for _, part := range parts {
+		completed = append(completed, types.CompletedPart{
+			PartNumber:     aws.Int32(part.PartNumber),
+			ETag:           aws.String(part.ETag),
+			ChecksumSHA256: aws.String(part.ChecksumSHA256),
+		})
+	}
+
+	_, err := m.Client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(bucket),
+		Key:             aws.String(key),
+		UploadId:        aws.String(uploadID),
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: completed},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to complete multipart upload: %w", err)
+	}
+	return nil
+}
+
+// AbortMultipartUpload discards a multipart upload and its uploaded parts
+func (m *MinioClient) AbortMultipartUpload(ctx context.Context, bucket, key, uploadID string) error {
+	_, err := m.Client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(bucket),
+		Key:      aws.String(key),
+		UploadId: aws.String(uploadID),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to abort multipart upload: %w", err)
+	}
+	return nil
+}
+
+// copyObjectInParts copies an object larger than maxCopyObjectSize with UploadPartCopy, replacing
+// its content type and user metadata. The multipart upload is aborted when a part fails.
+func (m *MinioClient) copyObjectInParts(ctx context.Context, srcBucket, srcKey, dstBucket, dstKey string, size int64, contentType string, metadata map[string]string) error {
+	created, err := m.Client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:      aws.String(dstBucket),
+		Key:         aws.String(dstKey),
+		ContentType: aws.String(contentType),
+		Metadata:    metadata,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create multipart copy: %w", err)
+	}
+	uploadID := aws.ToString(created.UploadId)
+
+	var completed []types.CompletedPart
+	for offset, partNumber := int64(0), int32(1); offset < size; offset, partNumber = offset+copyPartSize, partNumber+1 {
+		end := min(offset+copyPartSize, size) - 1
+		resp, err := m.Client.UploadPartCopy(ctx, &s3.UploadPartCopyInput{
+			Bucket:          aws.String(dstBucket),
+			Key:             aws.String(dstKey),
+			UploadId:        aws.String(uploadID),
+			PartNumber:      aws.Int32(partNumber),
+			CopySource:      aws.String(copySource(srcBucket, srcKey)),
+			CopySourceRange: aws.String(fmt.Sprintf("bytes=%d-%d", offset, end)),
+		})
+		if err != nil {
+			_ = m.AbortMultipartUpload(context.WithoutCancel(ctx), dstBucket, dstKey, uploadID)
+			return fmt.Errorf("failed to copy part %d: %w", partNumber, err)
+		}
+		completed = append(completed, types.CompletedPart{
+			PartNumber: aws.Int32(partNumber),
+			ETag:       resp.CopyPartResult.ETag,
+		})
+	}
+
+	_, err = m.Client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(dstBucket),
+		Key:             aws.String(dstKey),
+		UploadId:        aws.String(uploadID),
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: completed},
+	})
+	if err != nil {
+		_ = m.AbortMultipartUpload(context.WithoutCancel(ctx), dstBucket, dstKey, uploadID)
+		return fmt.Errorf("failed to complete multipart copy: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package infra
+
+import (
+	"context"
+	"fmt"
+	"mime"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// PresignedRequest is a signed URL with the headers the client has to send along with it
+type PresignedRequest struct {
+	URL     string
+	Method  string
+	Headers http.Header
+}
+
+// PresignPutObject signs an upload of key. The content type and, when size > 0, the exact content
+// length are part of the signature, so the storage rejects uploads that don't match them.
+func (m *MinioClient) PresignPutObject(ctx context.Context, bucket, key, contentType string, size int64, expiry time.Duration) (*PresignedRequest, error) {
+	input := &s3.PutObjectInput{
+		Bucket:      aws.String(bucket),
+		Key:         aws.String(key),
+		ContentType: aws.String(contentType),
+	}
+	if size > 0 {
+		input.ContentLength = aws.Int64(size)
+	}
+
+	request, err := s3.NewPresignClient(m.Client).PresignPutObject(ctx, input, s3.WithPresignExpires(expiry))
+	if err != nil {
+		return nil, fmt.Errorf("failed to presign upload: %w", err)
+	}
+	return presignedRequest(request.URL, request.Method, request.SignedHeader), nil
+}
+
+// PresignGetObject signs a download of key. A non-empty contentType or filename overrides the
+// Content-Type and Content-Disposition headers of the response.
+func (m *MinioClient) PresignGetObject(ctx context.Context, bucket, key, contentType, filename string, expiry time.Duration) (*PresignedRequest, error) {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	}
+	if contentType != "" {
+		input.ResponseContentType = aws.String(contentType)
+	}
+	if filename != "" {
+		input.ResponseContentDisposition = aws.String(mime.FormatMediaType("inline", map[string]string{"filename": filename}))
+	}
+
+	request, err := s3.NewPresignClient(m.Client).PresignGetObject(ctx, input, s3.WithPresignExpires(expiry))
+	if err != nil {
+		return nil, fmt.Errorf("failed to presign download: %w", err)
+	}
+	return presignedRequest(request.URL, request.Method, request.SignedHeader), nil
+}
+
+// presignedRequest drops the Host header, which HTTP clients set from the URL themselves
+func presignedRequest(url, method string, signed http.Header) *PresignedRequest {
+	headers := signed.Clone()
+	headers.Del("Host")
+	return &PresignedRequest{URL: url, Method: method, Headers: headers}
+}
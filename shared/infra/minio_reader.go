@@ -0,0 +1,168 @@
+package infra
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// ObjectReader reads an object as an io.ReadSeeker without loading it into memory, e.g. for
+// http.ServeContent. Reads stream from a request for a bounded range starting at the current
+// offset; a seek that moves the offset drops that request and the next read opens one at the
+// new offset. Requests end with the expected range holding the offset, or the object.
+// Requests are pinned to the object's ETag, so a replaced object fails the read instead of
+// mixing contents.
+type ObjectReader struct {
+	ctx     context.Context
+	client  *MinioClient
+	bucket  string
+	info    ObjectInfo
+	offset  int64
+	body    io.ReadCloser
+	bodyEnd int64         // offset the current request ends at
+	ranges  []objectRange // ranges expected to be read, see ExpectRanges
+}
+
+// objectRange is a byte range [start, end) of an object
+type objectRange struct {
+	start, end int64
+}
+
+// NewObjectReader returns a reader of the object described by info, as returned by StatObject.
+// The caller must close it.
+func (m *MinioClient) NewObjectReader(ctx context.Context, bucket string, info ObjectInfo) *ObjectReader {
+	return &ObjectReader{
+		ctx:    ctx,
+		client: m,
+		bucket: bucket,
+		info:   info,
+	}
+}
+
+// ExpectRanges tells the reader the byte ranges a Range header such as "bytes=0-99,-500" asks
+// for, so that requests stop at the end of the range being read instead of the object's.
+// Reads outside of them still work; an invalid header is ignored.
+func (r *ObjectReader) ExpectRanges(header string) {
+	r.ranges = nil
+	specs, found := strings.CutPrefix(strings.TrimSpace(header), "bytes=")
+	if !found {
+		return
+	}
+
+	var ranges []objectRange
+	for _, spec := range strings.Split(specs, ",") {
+		first, last, found := strings.Cut(strings.TrimSpace(spec), "-")
+		if !found {
+			return
+		}
+		var rng objectRange
+		if first == "" {
+			// The last bytes of the object
+			suffix, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || suffix <= 0 {
+				return
+			}
+			rng = objectRange{start: max(r.info.Size-suffix, 0), end: r.info.Size}
+		} else {
+			start, err := strconv.ParseInt(first, 10, 64)
+			if err != nil || start < 0 {
+				return
+			}
+			rng = objectRange{start: start, end: r.info.Size}
+			if last != "" {
+				end, err := strconv.ParseInt(last, 10, 64)
+				if err != nil || end < start {
+					return
+				}
+				rng.end = min(end+1, r.info.Size)
+			}
+		}
+		if rng.start < rng.end {
+			ranges = append(ranges, rng)
+		}
+	}
+	r.ranges = ranges
+}
+
+func (r *ObjectReader) Read(p []byte) (int, error) {
+	if r.offset >= r.info.Size {
+		return 0, io.EOF
+	}
+	if r.body == nil {
+		end := r.requestEnd()
+		body, _, err := r.client.GetObjectStreamFrom(r.ctx, r.bucket, r.info.Key, r.offset, end-r.offset, r.info.ETag)
+		if err != nil {
+			return 0, err
+		}
+		r.body = body
+		r.bodyEnd = end
+	}
+
+	n, err := r.body.Read(p)
+	r.offset += int64(n)
+	if err == io.EOF {
+		switch {
+		case r.offset < r.bodyEnd:
+			err = io.ErrUnexpectedEOF
+		case r.offset < r.info.Size:
+			// The expected range is read, yet reading goes on with a new request
+			_ = r.Close()
+			if n == 0 {
+				return r.Read(p)
+			}
+			err = nil
+		}
+	}
+	return n, err
+}
+
+// requestEnd returns where a request starting at the current offset ends: with the furthest
+// expected range holding the offset, or else the object
+func (r *ObjectReader) requestEnd() int64 {
+	end := int64(0)
+	for _, rng := range r.ranges {
+		if rng.start <= r.offset && r.offset < rng.end {
+			end = max(end, rng.end)
+		}
+	}
+	if end == 0 {
+		return r.info.Size
+	}
+	return end
+}
+
+func (r *ObjectReader) Seek(offset int64, whence int) (int64, error) {
+	var position int64
+	switch whence {
+	case io.SeekStart:
+		position = offset
+	case io.SeekCurrent:
+		position = r.offset + offset
+	case io.SeekEnd:
+		position = r.info.Size + offset
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if position < 0 {
+		return 0, fmt.Errorf("invalid seek to negative offset %d", position)
+	}
+
+	if position != r.offset {
+		_ = r.Close()
+		r.offset = position
+	}
+	return position, nil
+}
+
+// Close ends the current request, if any
+func (r *ObjectReader) Close() error {
+	if r.body == nil {
+		return nil
+	}
+	err := r.body.Close()
+	r.body = nil
+	return err
+}
@@ -3,16 +3,57 @@ package infra
 import (
 	"bytes"
 	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	mathrand "math/rand"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/parquet-go/parquet-go"
+	"go.opentelemetry.io/otel/attribute"
+	metricwrap "go.opentelemetry.io/otel/metric"
 )
 
+const (
+	// metadataMaxRetries bounds how often a conflicting metadata write is reloaded and re-applied
+	metadataMaxRetries = 8
+	// metadataRetryBaseDelay is the initial backoff between conflicting writes, doubled on every attempt
+	metadataRetryBaseDelay = 50 * time.Millisecond
+
+	// Metadata is partitioned as partitions/<bucket>/<hash prefix>/ in the metadata bucket.
+	// Each partition holds one compacted base segment plus small append-only delta segments.
+	partitionRoot      = "partitions/"
+	partitionPrefixLen = 2
+	baseSegmentName    = "base.parquet"
+	deltaSegmentPrefix = "delta-"
+
+	// compactedDeltasKey is the Parquet key-value metadata entry on a base segment listing, one
+	// name per line, the deltas merged into it. Delta names carry their writer's clock, so which
+	// deltas a base covers is recorded by name rather than by a time cutoff.
+	compactedDeltasKey = "gau.compacted_deltas"
+	// compactionRowGroupSize is the number of rows per row group in compacted base segments
+	compactionRowGroupSize = 10000
+	// tombstoneRetention keeps tombstones in compacted bases long enough to win over a write to
+	// the same path that took an older version but whose delta landed late
+	tombstoneRetention = time.Hour
+)
+
+// errMetadataConflict is returned when the metadata object changed between load and save
+var errMetadataConflict = errors.New("metadata object was modified concurrently")
+
 // FileMetadata represents file metadata stored in Parquet
+// Each entry is a reference from a user-visible bucket/path to content identified by FileHash.
+// BlobKey is the object holding the content; it is empty for files stored directly at FilePath.
 type FileMetadata struct {
 	FileHash     string    `parquet:"file_hash,snappy"`
 	FilePath     string    `parquet:"file_path,snappy"`
@@ -21,148 +62,262 @@ type FileMetadata struct {
 	ContentType  string    `parquet:"content_type,snappy"`
 	FileSize     int64     `parquet:"file_size"`
 	UploadedAt   time.Time `parquet:"uploaded_at"`
+	BlobKey      string    `parquet:"blob_key,snappy"`
+	Variants     string    `parquet:"variants,snappy"` // comma-separated names of the image variants of the content
+	UserID       string    `parquet:"user_id,snappy"`  // tenant the file was uploaded for, counted against its quota
+
+	// version orders the writes to the path in the Parquet store, see nextPathVersion
+	version int64
+}
+
+// ObjectKey returns the key of the object holding the file's content
+func (m FileMetadata) ObjectKey() string {
+	if m.BlobKey != "" {
+		return m.BlobKey
+	}
+	return m.FilePath
+}
+
+// VariantNames returns the names of the image variants generated for the content, e.g. 128.jpg
+func (m FileMetadata) VariantNames() []string {
+	if m.Variants == "" {
+		return nil
+	}
+	return strings.Split(m.Variants, ",")
+}
+
+// segmentRow is a row of a partition segment. A Deleted row is a tombstone: it removes the
+// entry stored for the same bucket, hash and path. Rows replay by Version, the write counter of
+// their path, so the order segments are read in doesn't matter. On a tombstone, UploadedAt is
+// when the entry was deleted, which expires the tombstone from compacted bases.
+type segmentRow struct {
+	FileHash     string    `parquet:"file_hash,snappy"`
+	FilePath     string    `parquet:"file_path,snappy"`
+	BucketName   string    `parquet:"bucket_name,snappy"`
+	OriginalName string    `parquet:"original_name,snappy"`
+	ContentType  string    `parquet:"content_type,snappy"`
+	FileSize     int64     `parquet:"file_size"`
+	UploadedAt   time.Time `parquet:"uploaded_at"`
+	BlobKey      string    `parquet:"blob_key,snappy"`
+	Variants     string    `parquet:"variants,snappy"`
+	UserID       string    `parquet:"user_id,snappy"`
+	Version      int64     `parquet:"version"`
+	Deleted      bool      `parquet:"deleted"`
+}
+
+// CompactionResult summarizes a compaction run
+type CompactionResult struct {
+	Partitions     int  `json:"partitions"`
+	DeltasMerged   int  `json:"deltas_merged"`
+	Rows           int  `json:"rows"`
+	LegacyMigrated bool `json:"legacy_migrated"`
 }
 
 type ParquetService struct {
 	minioClient    *MinioClient
+	logger         *LoggerClient
+	conflicts      metricwrap.Int64Counter
 	metadataBucket string
+	// metadataFile is the pre-partitioning single metadata object, migrated by Compact
 	metadataFile   string
+	legacyMigrated atomic.Bool
+
+	// pathIndexed holds the buckets whose entries are all in the path index
+	pathIndexed sync.Map
+	pathIndexMu sync.Mutex
 }
 
-func NewParquetService(minioClient *MinioClient) *ParquetService {
+func NewParquetService(minioClient *MinioClient, logger *LoggerClient) *ParquetService {
+	conflicts, err := logger.Meter.Int64Counter(
+		"upload.metadata.write_conflicts",
+		metricwrap.WithDescription("Concurrent Parquet metadata writes resolved by reload and merge"),
+	)
+	if err != nil {
+		logger.ErrorSimple("Failed to create metadata conflict counter", err)
+	}
+
 	return &ParquetService{
 		minioClient:    minioClient,
+		logger:         logger,
+		conflicts:      conflicts,
 		metadataBucket: "metadata",
 		metadataFile:   "files-metadata.parquet",
 	}
 }
 
-// LoadMetadata loads all file metadata from Parquet file
+// LoadMetadata loads all file metadata from every partition
 func (ps *ParquetService) LoadMetadata(ctx context.Context) ([]FileMetadata, error) {
-	// Ensure metadata bucket exists
-	if err := ps.minioClient.EnsureBucketByName(ctx, ps.metadataBucket); err != nil {
-		return nil, fmt.Errorf("failed to ensure metadata bucket: %w", err)
-	}
+	return ps.readPartitions(ctx, partitionRoot)
+}
 
-	// Try to download existing metadata file
-	data, _, err := ps.minioClient.GetObjectFromBucket(ctx, ps.metadataBucket, ps.metadataFile)
-	if err != nil {
-		// If file doesn't exist, return empty slice
-		return []FileMetadata{}, nil
-	}
+// LoadBucketMetadata loads file metadata from the partitions of a single bucket
+func (ps *ParquetService) LoadBucketMetadata(ctx context.Context, bucket string) ([]FileMetadata, error) {
+	return ps.readPartitions(ctx, partitionRoot+bucket+"/")
+}
 
-	// Read Parquet file
-	reader := bytes.NewReader(data)
-	parquetReader := parquet.NewGenericReader[FileMetadata](reader)
-	defer parquetReader.Close()
+// CheckFileByHash checks if a file with the given hash exists using Parquet metadata
+// Only the partition owning the hash is read
+func (ps *ParquetService) CheckFileByHash(ctx context.Context, bucket, hash string) (string, bool, error) {
+	metadata, err := ps.referencesTo(ctx, bucket, hash)
+	if err != nil || len(metadata) == 0 {
+		return "", false, err
+	}
 
-	var metadata []FileMetadata
-	rows := make([]FileMetadata, 1000) // Read in batches
-	for {
-		n, err := parquetReader.Read(rows)
-		if n > 0 {
-			metadata = append(metadata, rows[:n]...)
-		}
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			return nil, fmt.Errorf("failed to read parquet: %w", err)
+	// Prefer a blob-backed reference so callers can reuse the stored content
+	for _, item := range metadata {
+		if item.BlobKey != "" {
+			return item.FilePath, true, nil
 		}
 	}
-
-	return metadata, nil
+	return metadata[0].FilePath, true, nil
 }
 
-// SaveMetadata saves all file metadata to Parquet file
-func (ps *ParquetService) SaveMetadata(ctx context.Context, metadata []FileMetadata) error {
-	// Ensure metadata bucket exists
-	if err := ps.minioClient.EnsureBucketByName(ctx, ps.metadataBucket); err != nil {
-		return fmt.Errorf("failed to ensure metadata bucket: %w", err)
+// GetFileByPath returns the entry registered for a bucket/path
+// Only the partitions of the hashes the path index lists for the path are read
+func (ps *ParquetService) GetFileByPath(ctx context.Context, bucket, filePath string) (FileMetadata, bool, error) {
+	entries, err := ps.entriesAtPath(ctx, bucket, filePath)
+	if err != nil {
+		return FileMetadata{}, false, err
 	}
+	return latestAtPath(entries, bucket, filePath)
+}
 
-	// Write to Parquet buffer
-	buf := new(bytes.Buffer)
-	parquetWriter := parquet.NewGenericWriter[FileMetadata](buf, parquet.Compression(&parquet.Snappy))
+// CountReferences returns how many paths in the bucket reference the given hash
+func (ps *ParquetService) CountReferences(ctx context.Context, bucket, hash string) (int, error) {
+	metadata, err := ps.referencesTo(ctx, bucket, hash)
+	return len(metadata), err
+}
 
-	_, err := parquetWriter.Write(metadata)
+// ListFiles returns the entries of a bucket whose path starts with prefix
+func (ps *ParquetService) ListFiles(ctx context.Context, bucket, prefix string) ([]FileMetadata, error) {
+	metadata, err := ps.LoadBucketMetadata(ctx, bucket)
 	if err != nil {
-		return fmt.Errorf("failed to write parquet: %w", err)
+		return nil, err
 	}
+	return filterByPrefix(metadata, prefix), nil
+}
 
-	if err := parquetWriter.Close(); err != nil {
-		return fmt.Errorf("failed to close parquet writer: %w", err)
+// QueryFiles filters, sorts and paginates entries. Only the partitions of the queried bucket are
+// read, and base segment row groups whose statistics exclude every match are not decoded.
+func (ps *ParquetService) QueryFiles(ctx context.Context, query FileQuery) (*FileQueryResult, error) {
+	prefix := partitionRoot
+	if query.Bucket != "" {
+		prefix = partitionRoot + query.Bucket + "/"
 	}
 
-	// Upload to MinIO
-	_, err = ps.minioClient.Client.PutObject(ctx, &s3.PutObjectInput{
-		Bucket:      aws.String(ps.metadataBucket),
-		Key:         aws.String(ps.metadataFile),
-		Body:        bytes.NewReader(buf.Bytes()),
-		ContentType: aws.String("application/octet-stream"),
-	})
+	metadata, err := ps.readPartitionsMatching(ctx, prefix, rowGroupMatcher(query))
 	if err != nil {
-		return fmt.Errorf("failed to upload metadata: %w", err)
+		return nil, err
 	}
-
-	return nil
+	return applyFileQuery(metadata, query)
 }
 
-// CheckFileByHash checks if a file with the given hash exists using Parquet metadata
-func (ps *ParquetService) CheckFileByHash(ctx context.Context, bucket, hash string) (string, bool, error) {
-	metadata, err := ps.LoadMetadata(ctx)
+// AddFileMetadata registers a path, replacing the entry previously registered at the same path
+func (ps *ParquetService) AddFileMetadata(ctx context.Context, meta FileMetadata) error {
+	previous, found, err := ps.GetFileByPath(ctx, meta.BucketName, meta.FilePath)
 	if err != nil {
-		return "", false, err
+		return err
+	}
+	if !found {
+		return ps.addReplacing(ctx, replacement{meta: meta})
 	}
+	return ps.addReplacing(ctx, replacement{meta: meta, previous: &previous})
+}
 
-	// Search for matching hash in the same bucket
-	for _, item := range metadata {
-		if item.FileHash == hash && item.BucketName == bucket {
-			return item.FilePath, true, nil
+// AddFileMetadataBatch registers several paths with a single append
+func (ps *ParquetService) AddFileMetadataBatch(ctx context.Context, metas []FileMetadata) error {
+	metas = dedupeByPath(metas)
+	replacements := make([]replacement, 0, len(metas))
+	for _, meta := range metas {
+		previous, found, err := ps.GetFileByPath(ctx, meta.BucketName, meta.FilePath)
+		if err != nil {
+			return err
+		}
+		item := replacement{meta: meta}
+		if found {
+			item.previous = &previous
 		}
+		replacements = append(replacements, item)
 	}
-
-	return "", false, nil
+	return ps.addReplacing(ctx, replacements...)
 }
 
-// AddFileMetadata adds a new file metadata entry
-func (ps *ParquetService) AddFileMetadata(ctx context.Context, meta FileMetadata) error {
-	// Load existing metadata
-	metadata, err := ps.LoadMetadata(ctx)
+// RemoveFileMetadata removes a file metadata entry by path by appending a tombstone
+func (ps *ParquetService) RemoveFileMetadata(ctx context.Context, bucket, filePath string) error {
+	entries, err := ps.entriesAtPath(ctx, bucket, filePath)
 	if err != nil {
 		return err
 	}
+	return ps.removeEntries(ctx, entries)
+}
+
+// replacement is an entry to add and the entry registered at the same path before it, if any
+type replacement struct {
+	meta     FileMetadata
+	previous *FileMetadata
+}
 
-	// Check if hash already exists (to avoid duplicates in metadata)
-	for i, item := range metadata {
-		if item.FileHash == meta.FileHash && item.BucketName == meta.BucketName {
-			// Update existing entry
-			metadata[i] = meta
-			return ps.SaveMetadata(ctx, metadata)
+// addReplacing appends entries in one write, tombstoning each previous entry at the same path
+// when its content differs. The paths are indexed first, and each entry gets the next version
+// of its path.
+func (ps *ParquetService) addReplacing(ctx context.Context, replacements ...replacement) error {
+	metas := make([]FileMetadata, 0, len(replacements))
+	for _, item := range replacements {
+		metas = append(metas, item.meta)
+	}
+	if err := ps.indexPaths(ctx, metas); err != nil {
+		return err
+	}
+
+	rows := make([]segmentRow, 0, len(replacements))
+	for i := range replacements {
+		item := &replacements[i]
+		version, err := ps.nextPathVersion(ctx, item.meta.BucketName, item.meta.FilePath)
+		if err != nil {
+			return err
+		}
+		item.meta.version = version
+		rows = append(rows, rowFromMetadata(item.meta, false))
+		if item.previous != nil && item.previous.FileHash != item.meta.FileHash {
+			rows = append(rows, tombstoneFor(*item.previous, version))
 		}
 	}
+	return ps.appendDeltas(ctx, rows)
+}
 
-	// Add new entry
-	metadata = append(metadata, meta)
-	return ps.SaveMetadata(ctx, metadata)
+// removeEntries appends tombstones for already known entries, at the next version of their path
+func (ps *ParquetService) removeEntries(ctx context.Context, entries []FileMetadata) error {
+	versions := make(map[string]int64)
+	tombstones := make([]segmentRow, 0, len(entries))
+	for _, item := range entries {
+		id := item.BucketName + "\x00" + item.FilePath
+		version, ok := versions[id]
+		if !ok {
+			var err error
+			if version, err = ps.nextPathVersion(ctx, item.BucketName, item.FilePath); err != nil {
+				return err
+			}
+			versions[id] = version
+		}
+		tombstones = append(tombstones, tombstoneFor(item, version))
+	}
+	return ps.appendDeltas(ctx, tombstones)
 }
 
-// RemoveFileMetadata removes a file metadata entry by path
-func (ps *ParquetService) RemoveFileMetadata(ctx context.Context, bucket, filePath string) error {
-	metadata, err := ps.LoadMetadata(ctx)
+// referencesTo reads the partition owning a hash and returns every path referencing it
+func (ps *ParquetService) referencesTo(ctx context.Context, bucket, hash string) ([]FileMetadata, error) {
+	metadata, err := ps.readPartitions(ctx, partitionFor(bucket, hash))
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	// Filter out the file
-	var newMetadata []FileMetadata
+	var references []FileMetadata
 	for _, item := range metadata {
-		if !(item.FilePath == filePath && item.BucketName == bucket) {
-			newMetadata = append(newMetadata, item)
+		if item.FileHash == hash && item.BucketName == bucket {
+			references = append(references, item)
 		}
 	}
-
-	return ps.SaveMetadata(ctx, newMetadata)
+	return references, nil
 }
 
 // GetStatistics returns statistics about stored files
@@ -197,16 +352,41 @@ func (ps *ParquetService) GetStatistics(ctx context.Context) (map[string]interfa
 }
 
 // SearchByHash searches for all files with a specific hash across all buckets
+// Only the partition owning the hash is read in each bucket
 func (ps *ParquetService) SearchByHash(ctx context.Context, hash string) ([]FileMetadata, error) {
-	metadata, err := ps.LoadMetadata(ctx)
-	if err != nil {
+	bucketPrefixes, err := ps.minioClient.ListFolders(ctx, ps.metadataBucket, partitionRoot)
+	if err != nil && !IsNotFound(err) {
 		return nil, err
 	}
 
 	var results []FileMetadata
-	for _, item := range metadata {
-		if item.FileHash == hash {
-			results = append(results, item)
+	partitioned := make(map[string]bool, len(bucketPrefixes))
+	for _, bucketPrefix := range bucketPrefixes {
+		bucket := strings.TrimSuffix(strings.TrimPrefix(bucketPrefix, partitionRoot), "/")
+		partitioned[bucket] = true
+
+		// readPartitions also replays legacy rows belonging to this partition
+		metadata, err := ps.readPartitions(ctx, partitionFor(bucket, hash))
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range metadata {
+			if item.FileHash == hash {
+				results = append(results, item)
+			}
+		}
+	}
+
+	// Entries only present in the legacy file live in buckets without partitions yet
+	if !ps.legacyMigrated.Load() {
+		legacy, err := ps.loadLegacyMetadata(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range legacy {
+			if item.FileHash == hash && !partitioned[item.BucketName] {
+				results = append(results, item)
+			}
 		}
 	}
 
@@ -220,29 +400,756 @@ func (ps *ParquetService) OptimizeMetadata(ctx context.Context) (int, error) {
 		return 0, err
 	}
 
-	var validMetadata []FileMetadata
-	removedCount := 0
-
+	var orphaned []FileMetadata
 	for _, item := range metadata {
 		// Check if file still exists
 		_, err := ps.minioClient.Client.HeadObject(ctx, &s3.HeadObjectInput{
 			Bucket: aws.String(item.BucketName),
-			Key:    aws.String(item.FilePath),
+			Key:    aws.String(item.ObjectKey()),
 		})
-		if err == nil {
-			// File exists, keep metadata
-			validMetadata = append(validMetadata, item)
-		} else {
+		if err != nil {
 			// File doesn't exist, remove from metadata
-			removedCount++
+			orphaned = append(orphaned, item)
+		}
+	}
+
+	if err := ps.removeEntries(ctx, orphaned); err != nil {
+		return 0, err
+	}
+
+	return len(orphaned), nil
+}
+
+// Compact migrates the legacy single metadata file into partitions, then merges the delta
+// segments of every partition into a new row-grouped base segment.
+// Safe to run from several replicas: base segments are replaced with conditional writes.
+func (ps *ParquetService) Compact(ctx context.Context) (CompactionResult, error) {
+	var result CompactionResult
+
+	migrated, err := ps.migrateLegacy(ctx)
+	if err != nil {
+		return result, err
+	}
+	result.LegacyMigrated = migrated
+
+	objects, err := ps.minioClient.ListObjectsWithInfo(ctx, ps.metadataBucket, partitionRoot)
+	if err != nil {
+		if IsNotFound(err) {
+			return result, nil
+		}
+		return result, err
+	}
+
+	for _, partition := range groupSegments(objects) {
+		if len(partition.deltas) == 0 {
+			continue
+		}
+
+		merged, rows, err := ps.compactPartition(ctx, partition.prefix)
+		if err != nil {
+			return result, fmt.Errorf("failed to compact %s: %w", partition.prefix, err)
+		}
+		if merged > 0 {
+			result.Partitions++
+			result.DeltasMerged += merged
+			result.Rows += rows
+		}
+	}
+
+	ps.logger.Info("[Parquet] Metadata compaction finished", map[string]interface{}{
+		"partitions":      result.Partitions,
+		"deltas_merged":   result.DeltasMerged,
+		"rows":            result.Rows,
+		"legacy_migrated": result.LegacyMigrated,
+	})
+
+	return result, nil
+}
+
+// compactPartition merges the deltas of one partition into its base segment
+// Returns the number of deltas merged and the number of rows in the new base
+func (ps *ParquetService) compactPartition(ctx context.Context, prefix string) (int, int, error) {
+	merged, rows := 0, 0
+
+	err := ps.withConflictRetry(ctx, "compact", func() error {
+		objects, err := ps.minioClient.ListObjectsWithInfo(ctx, ps.metadataBucket, prefix)
+		if err != nil {
+			return err
+		}
+		partition := groupSegments(objects)[prefix]
+		if partition == nil {
+			return nil
+		}
+
+		state := newPartitionState()
+		var compacted compactedDeltas
+		baseETag := ""
+		if partition.base != nil {
+			baseRows, baseCompacted, etag, err := ps.readSegment(ctx, partition.base.Key)
+			if err != nil {
+				return err
+			}
+			state.apply(baseRows)
+			compacted, baseETag = baseCompacted, etag
+		}
+
+		// Only deltas present in this listing are merged, whatever the clock of their writer:
+		// a delta still being written is not listed and stays for the next run
+		var stale, fresh []string
+		for _, delta := range partition.deltas {
+			if compacted.contains(delta.Key) {
+				stale = append(stale, delta.Key)
+			} else {
+				fresh = append(fresh, delta.Key)
+			}
+		}
+
+		if len(fresh) > 0 {
+			for _, key := range fresh {
+				deltaRows, _, _, err := ps.readSegment(ctx, key)
+				if err != nil {
+					return err
+				}
+				state.apply(deltaRows)
+			}
+
+			// Stale deltas not deleted yet stay listed, so readers keep skipping them
+			entries := state.rows()
+			if err := ps.writeBase(ctx, prefix, entries, append(stale, fresh...), baseETag); err != nil {
+				return err
+			}
+			merged, rows = len(fresh), len(entries)
+		}
+
+		// Every listed delta is in the base now; a crash here only leaves garbage that readers
+		// skip and the next run deletes
+		for _, key := range append(stale, fresh...) {
+			if err := ps.minioClient.DeleteObject(ctx, ps.metadataBucket, key); err != nil {
+				ps.logger.Warning("[Parquet] Failed to delete compacted delta", map[string]interface{}{
+					"key":   key,
+					"error": err.Error(),
+				})
+			}
+		}
+		return nil
+	})
+
+	return merged, rows, err
+}
+
+// writeBase replaces a partition's base segment if it still has the given ETag, recording the
+// deltas merged into it. An empty ETag means the base must not exist yet.
+// Returns errMetadataConflict if the condition fails
+func (ps *ParquetService) writeBase(ctx context.Context, prefix string, rows []segmentRow, deltaKeys []string, etag string) error {
+	// A partition holds one bucket; sorting by path keeps each row group to a narrow path range,
+	// so path_prefix searches skip the row groups outside the prefix
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].FilePath != rows[j].FilePath {
+			return rows[i].FilePath < rows[j].FilePath
+		}
+		return rows[i].FileHash < rows[j].FileHash
+	})
+
+	data, err := encodeSegment(rows,
+		parquet.MaxRowsPerRowGroup(compactionRowGroupSize),
+		parquet.KeyValueMetadata(compactedDeltasKey, encodeCompactedDeltas(deltaKeys)),
+	)
+	if err != nil {
+		return err
+	}
+
+	input := &s3.PutObjectInput{
+		Bucket:      aws.String(ps.metadataBucket),
+		Key:         aws.String(prefix + baseSegmentName),
+		Body:        bytes.NewReader(data),
+		ContentType: aws.String("application/octet-stream"),
+	}
+	if etag != "" {
+		input.IfMatch = aws.String(etag)
+	} else {
+		input.IfNoneMatch = aws.String("*")
+	}
+
+	if _, err := ps.minioClient.Client.PutObject(ctx, input); err != nil {
+		if IsPreconditionFailed(err) {
+			return errMetadataConflict
 		}
+		return fmt.Errorf("failed to upload base segment: %w", err)
 	}
+	return nil
+}
+
+// appendDeltas writes rows as new delta segments, one per partition touched
+// Delta keys are unique, so appends never conflict with other writers
+func (ps *ParquetService) appendDeltas(ctx context.Context, rows []segmentRow) error {
+	if len(rows) == 0 {
+		return nil
+	}
+
+	// Ensure metadata bucket exists
+	if err := ps.minioClient.EnsureBucketByName(ctx, ps.metadataBucket); err != nil {
+		return fmt.Errorf("failed to ensure metadata bucket: %w", err)
+	}
+
+	byPartition := make(map[string][]segmentRow)
+	for _, row := range rows {
+		prefix := partitionFor(row.BucketName, row.FileHash)
+		byPartition[prefix] = append(byPartition[prefix], row)
+	}
+
+	for prefix, partitionRows := range byPartition {
+		if err := ps.writeDelta(ctx, prefix+deltaSegmentName(time.Now(), randomSuffix()), partitionRows); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeDelta uploads a delta segment; an existing object with the same key is left untouched
+func (ps *ParquetService) writeDelta(ctx context.Context, key string, rows []segmentRow) error {
+	data, err := encodeSegment(rows)
+	if err != nil {
+		return err
+	}
+
+	_, err = ps.minioClient.Client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(ps.metadataBucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(data),
+		ContentType: aws.String("application/octet-stream"),
+		IfNoneMatch: aws.String("*"),
+	})
+	if err != nil && !IsPreconditionFailed(err) {
+		return fmt.Errorf("failed to upload delta segment: %w", err)
+	}
+	return nil
+}
 
-	if removedCount > 0 {
-		if err := ps.SaveMetadata(ctx, validMetadata); err != nil {
-			return 0, err
+// readPartitions merges the segments of every partition under prefix into live entries
+func (ps *ParquetService) readPartitions(ctx context.Context, prefix string) ([]FileMetadata, error) {
+	return ps.readPartitionsMatching(ctx, prefix, nil)
+}
+
+// readPartitionsMatching is readPartitions skipping base segment row groups rejected by keep.
+// Only base row groups are skipped: delta rows may replace or delete base rows, so they are always
+// read. The result is a superset of the entries keep accepts and must still be filtered.
+func (ps *ParquetService) readPartitionsMatching(ctx context.Context, prefix string, keep func(parquet.RowGroup) bool) ([]FileMetadata, error) {
+	state := newPartitionState()
+
+	// Rows of the legacy single file predate every partition segment
+	if !ps.legacyMigrated.Load() {
+		legacy, err := ps.loadLegacyMetadata(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range legacy {
+			if strings.HasPrefix(partitionFor(item.BucketName, item.FileHash), prefix) {
+				state.apply([]segmentRow{rowFromMetadata(item, false)})
+			}
+		}
+	}
+
+	objects, err := ps.minioClient.ListObjectsWithInfo(ctx, ps.metadataBucket, prefix)
+	if err != nil {
+		if IsNotFound(err) {
+			return state.metadata(), nil
+		}
+		return nil, err
+	}
+
+	for prefix, partition := range groupSegments(objects) {
+		rows, err := ps.readPartitionRows(ctx, prefix, partition, keep)
+		if err != nil {
+			return nil, err
+		}
+		state.apply(rows)
+	}
+
+	return state.metadata(), nil
+}
+
+// readPartitionRows returns the base rows followed by the unmerged delta rows of a partition.
+// A delta vanishing mid-read means a compaction replaced the base, so the partition is re-listed.
+func (ps *ParquetService) readPartitionRows(ctx context.Context, prefix string, partition *partitionSegments, keep func(parquet.RowGroup) bool) ([]segmentRow, error) {
+	for attempt := 1; ; attempt++ {
+		rows, err := ps.readSegments(ctx, partition, keep)
+		if err == nil || !IsNotFound(err) || attempt == metadataMaxRetries {
+			return rows, err
+		}
+
+		objects, err := ps.minioClient.ListObjectsWithInfo(ctx, ps.metadataBucket, prefix)
+		if err != nil {
+			return nil, err
+		}
+		partition = groupSegments(objects)[prefix]
+		if partition == nil {
+			return nil, nil
+		}
+	}
+}
+
+// readSegments reads a partition's base followed by the deltas not yet merged into it
+func (ps *ParquetService) readSegments(ctx context.Context, partition *partitionSegments, keep func(parquet.RowGroup) bool) ([]segmentRow, error) {
+	var rows []segmentRow
+	var compacted compactedDeltas
+	if partition.base != nil {
+		baseRows, baseCompacted, _, err := ps.readSegmentMatching(ctx, partition.base.Key, keep)
+		if err != nil {
+			return nil, err
+		}
+		rows = append(rows, baseRows...)
+		compacted = baseCompacted
+	}
+
+	for _, delta := range partition.deltas {
+		if compacted.contains(delta.Key) {
+			continue
+		}
+		deltaRows, _, _, err := ps.readSegment(ctx, delta.Key)
+		if err != nil {
+			return nil, err
+		}
+		rows = append(rows, deltaRows...)
+	}
+	return rows, nil
+}
+
+// readSegment downloads and decodes a segment, returning its rows, the deltas merged into it and its ETag
+func (ps *ParquetService) readSegment(ctx context.Context, key string) ([]segmentRow, compactedDeltas, string, error) {
+	return ps.readSegmentMatching(ctx, key, nil)
+}
+
+// readSegmentMatching is readSegment decoding only the row groups accepted by keep (all when nil)
+func (ps *ParquetService) readSegmentMatching(ctx context.Context, key string, keep func(parquet.RowGroup) bool) ([]segmentRow, compactedDeltas, string, error) {
+	data, etag, err := ps.minioClient.GetObjectWithETag(ctx, ps.metadataBucket, key)
+	if err != nil {
+		return nil, nil, "", fmt.Errorf("failed to download segment %s: %w", key, err)
+	}
+
+	file, err := parquet.OpenFile(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, nil, "", fmt.Errorf("failed to open segment %s: %w", key, err)
+	}
+
+	rows, err := decodeRowGroups(file, keep)
+	if err != nil {
+		return nil, nil, "", fmt.Errorf("failed to read segment %s: %w", key, err)
+	}
+	return rows, readCompactedDeltas(file), etag, nil
+}
+
+// loadLegacyMetadata reads the pre-partitioning metadata file, remembering once it is gone
+func (ps *ParquetService) loadLegacyMetadata(ctx context.Context) ([]FileMetadata, error) {
+	data, _, err := ps.minioClient.GetObjectWithETag(ctx, ps.metadataBucket, ps.metadataFile)
+	if err != nil {
+		if IsNotFound(err) {
+			ps.legacyMigrated.Store(true)
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to download metadata: %w", err)
+	}
+
+	file, err := parquet.OpenFile(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open parquet: %w", err)
+	}
+
+	rows, err := decodeRows(file)
+	if err != nil {
+		return nil, err
+	}
+	metadata := make([]FileMetadata, 0, len(rows))
+	for _, row := range rows {
+		metadata = append(metadata, row.metadata())
+	}
+	return metadata, nil
+}
+
+// migrateLegacy splits the legacy single metadata file into partition deltas and deletes it.
+// Legacy rows keep version 0, older than every write made since.
+func (ps *ParquetService) migrateLegacy(ctx context.Context) (bool, error) {
+	if ps.legacyMigrated.Load() {
+		return false, nil
+	}
+
+	legacy, err := ps.loadLegacyMetadata(ctx)
+	if err != nil {
+		return false, err
+	}
+	if ps.legacyMigrated.Load() {
+		return false, nil
+	}
+
+	byPartition := make(map[string][]segmentRow)
+	for _, item := range legacy {
+		prefix := partitionFor(item.BucketName, item.FileHash)
+		byPartition[prefix] = append(byPartition[prefix], rowFromMetadata(item, false))
+	}
+	for prefix, rows := range byPartition {
+		if err := ps.writeDelta(ctx, prefix+deltaSegmentName(time.Unix(0, 0), "legacy"), rows); err != nil {
+			return false, err
+		}
+	}
+
+	if err := ps.minioClient.DeleteObject(ctx, ps.metadataBucket, ps.metadataFile); err != nil {
+		return false, err
+	}
+	ps.legacyMigrated.Store(true)
+
+	ps.logger.Info("[Parquet] Migrated legacy metadata file into partitions", map[string]interface{}{
+		"rows":       len(legacy),
+		"partitions": len(byPartition),
+	})
+	return true, nil
+}
+
+// withConflictRetry runs fn until it succeeds, fails with a non-conflict error, or retries run out.
+// fn must reload whatever it writes on every call so a retry merges the other writer's changes.
+func (ps *ParquetService) withConflictRetry(ctx context.Context, op string, fn func() error) error {
+	delay := metadataRetryBaseDelay
+
+	for attempt := 1; attempt <= metadataMaxRetries; attempt++ {
+		err := fn()
+		if err == nil {
+			if attempt > 1 {
+				ps.recordConflict(ctx, op, attempt, true)
+			}
+			return nil
+		}
+		if !errors.Is(err, errMetadataConflict) {
+			return err
+		}
+
+		ps.logger.WarningWithContextf(ctx, "[Parquet] Metadata changed during %s (attempt %d/%d), reloading and merging", op, attempt, metadataMaxRetries)
+
+		// Back off with jitter so competing replicas don't retry in lockstep
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay + time.Duration(mathrand.Int63n(int64(delay)))):
+		}
+		delay *= 2
+	}
+
+	ps.recordConflict(ctx, op, metadataMaxRetries, false)
+	return fmt.Errorf("%s: %w after %d attempts", op, errMetadataConflict, metadataMaxRetries)
+}
+
+// recordConflict logs and counts a metadata write that had to be retried because of a concurrent writer
+func (ps *ParquetService) recordConflict(ctx context.Context, op string, attempts int, resolved bool) {
+	if ps.conflicts != nil {
+		ps.conflicts.Add(ctx, 1, metricwrap.WithAttributes(
+			attribute.String("operation", op),
+			attribute.Bool("resolved", resolved),
+		))
+	}
+
+	if resolved {
+		ps.logger.InfoWithContext(ctx, "[Parquet] Metadata write conflict resolved", map[string]interface{}{
+			"operation": op,
+			"attempts":  attempts,
+		})
+	} else {
+		ps.logger.ErrorWithContext(ctx, "[Parquet] Metadata write conflict not resolved", errMetadataConflict, map[string]interface{}{
+			"operation": op,
+			"attempts":  attempts,
+		})
+	}
+}
+
+// partitionSegments lists the segment objects of one partition
+type partitionSegments struct {
+	prefix string
+	base   *ObjectInfo
+	deltas []ObjectInfo // sorted by key; rows replay by version, whatever the order
+}
+
+// groupSegments groups listed segment objects by partition prefix
+func groupSegments(objects []ObjectInfo) map[string]*partitionSegments {
+	partitions := make(map[string]*partitionSegments)
+	for i := range objects {
+		obj := objects[i]
+		prefix, name := path.Split(obj.Key)
+
+		partition := partitions[prefix]
+		if partition == nil {
+			partition = &partitionSegments{prefix: prefix}
+			partitions[prefix] = partition
+		}
+
+		switch {
+		case name == baseSegmentName:
+			partition.base = &obj
+		case strings.HasPrefix(name, deltaSegmentPrefix):
+			partition.deltas = append(partition.deltas, obj)
+		}
+	}
+
+	for _, partition := range partitions {
+		sort.Slice(partition.deltas, func(i, j int) bool {
+			return partition.deltas[i].Key < partition.deltas[j].Key
+		})
+	}
+	return partitions
+}
+
+// compactedDeltas holds the names of the deltas a base segment already contains
+type compactedDeltas map[string]bool
+
+// readCompactedDeltas reads the deltas recorded on a base segment; other segments record none
+func readCompactedDeltas(file *parquet.File) compactedDeltas {
+	compacted := make(compactedDeltas)
+	if list, ok := file.Lookup(compactedDeltasKey); ok {
+		for _, name := range strings.Split(list, "\n") {
+			if name != "" {
+				compacted[name] = true
+			}
+		}
+	}
+	return compacted
+}
+
+// contains reports whether the delta stored at key is merged into the base
+func (c compactedDeltas) contains(key string) bool {
+	return c[path.Base(key)]
+}
+
+// encodeCompactedDeltas lists the names of the delta keys, one per line
+func encodeCompactedDeltas(keys []string) string {
+	names := make([]string, len(keys))
+	for i, key := range keys {
+		names[i] = path.Base(key)
+	}
+	return strings.Join(names, "\n")
+}
+
+// partitionState replays segment rows, keeping the highest version per bucket/hash/path. Rows of
+// the same version replay in order. Tombstones are kept, so a write older than the delete that
+// is read after it can't bring the entry back.
+type partitionState struct {
+	entries map[string]segmentRow
+}
+
+func newPartitionState() *partitionState {
+	return &partitionState{entries: make(map[string]segmentRow)}
+}
+
+func (s *partitionState) apply(rows []segmentRow) {
+	for _, row := range rows {
+		key := row.BucketName + "\x00" + row.FileHash + "\x00" + row.FilePath
+		if current, ok := s.entries[key]; ok && current.Version > row.Version {
+			continue
+		}
+		s.entries[key] = row
+	}
+}
+
+// rows returns the entries to keep in a compacted base: live entries, and tombstones younger
+// than tombstoneRetention
+func (s *partitionState) rows() []segmentRow {
+	rows := make([]segmentRow, 0, len(s.entries))
+	for _, row := range s.entries {
+		if row.Deleted && time.Since(row.UploadedAt) >= tombstoneRetention {
+			continue
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+// metadata returns the live entries sorted by bucket and path. Of several entries at one path,
+// left by concurrent writes with different content, only the latest is returned.
+func (s *partitionState) metadata() []FileMetadata {
+	latest := make(map[string]FileMetadata, len(s.entries))
+	for _, row := range s.entries {
+		if row.Deleted {
+			continue
+		}
+		id := row.BucketName + "\x00" + row.FilePath
+		if current, ok := latest[id]; !ok || newerThan(row.metadata(), current) {
+			latest[id] = row.metadata()
+		}
+	}
+
+	metadata := make([]FileMetadata, 0, len(latest))
+	for _, meta := range latest {
+		metadata = append(metadata, meta)
+	}
+	sort.Slice(metadata, func(i, j int) bool {
+		if metadata[i].BucketName != metadata[j].BucketName {
+			return metadata[i].BucketName < metadata[j].BucketName
+		}
+		return metadata[i].FilePath < metadata[j].FilePath
+	})
+	return metadata
+}
+
+func rowFromMetadata(meta FileMetadata, deleted bool) segmentRow {
+	return segmentRow{
+		FileHash:     meta.FileHash,
+		FilePath:     meta.FilePath,
+		BucketName:   meta.BucketName,
+		OriginalName: meta.OriginalName,
+		ContentType:  meta.ContentType,
+		FileSize:     meta.FileSize,
+		UploadedAt:   meta.UploadedAt,
+		BlobKey:      meta.BlobKey,
+		Variants:     meta.Variants,
+		UserID:       meta.UserID,
+		Version:      meta.version,
+		Deleted:      deleted,
+	}
+}
+
+// tombstoneFor returns the tombstone deleting an entry at the given version of its path
+func tombstoneFor(meta FileMetadata, version int64) segmentRow {
+	row := rowFromMetadata(meta, true)
+	row.Version = version
+	row.UploadedAt = time.Now()
+	return row
+}
+
+func (r segmentRow) metadata() FileMetadata {
+	return FileMetadata{
+		FileHash:     r.FileHash,
+		FilePath:     r.FilePath,
+		BucketName:   r.BucketName,
+		OriginalName: r.OriginalName,
+		ContentType:  r.ContentType,
+		FileSize:     r.FileSize,
+		UploadedAt:   r.UploadedAt,
+		BlobKey:      r.BlobKey,
+		Variants:     r.Variants,
+		UserID:       r.UserID,
+		version:      r.Version,
+	}
+}
+
+// latestAtPath picks the most recent entry registered at a bucket/path
+func latestAtPath(metadata []FileMetadata, bucket, filePath string) (FileMetadata, bool, error) {
+	var latest FileMetadata
+	found := false
+	for _, item := range metadata {
+		if item.BucketName != bucket || item.FilePath != filePath {
+			continue
+		}
+		if !found || newerThan(item, latest) {
+			latest, found = item, true
+		}
+	}
+	return latest, found, nil
+}
+
+// newerThan reports whether a was written to its path after b. Versions order writes to a path;
+// the upload time only separates legacy entries, which have none.
+func newerThan(a, b FileMetadata) bool {
+	if a.version != b.version {
+		return a.version > b.version
+	}
+	return a.UploadedAt.After(b.UploadedAt)
+}
+
+// dedupeByPath keeps the last of several entries registered at the same bucket/path
+func dedupeByPath(metas []FileMetadata) []FileMetadata {
+	last := make(map[string]int, len(metas))
+	for i, meta := range metas {
+		last[meta.BucketName+"\x00"+meta.FilePath] = i
+	}
+
+	results := make([]FileMetadata, 0, len(last))
+	for i, meta := range metas {
+		if last[meta.BucketName+"\x00"+meta.FilePath] == i {
+			results = append(results, meta)
+		}
+	}
+	return results
+}
+
+// filterByPrefix keeps the entries whose path starts with prefix
+func filterByPrefix(metadata []FileMetadata, prefix string) []FileMetadata {
+	var results []FileMetadata
+	for _, item := range metadata {
+		if strings.HasPrefix(item.FilePath, prefix) {
+			results = append(results, item)
+		}
+	}
+	return results
+}
+
+// partitionFor returns the partition prefix owning a bucket/hash pair
+func partitionFor(bucket, hash string) string {
+	prefix := strings.ToLower(hash)
+	if len(prefix) > partitionPrefixLen {
+		prefix = prefix[:partitionPrefixLen]
+	}
+	if prefix == "" {
+		prefix = "_"
+	}
+	return partitionRoot + bucket + "/" + prefix + "/"
+}
+
+// deltaSegmentName builds a unique delta name. The write time only helps reading listings: rows
+// replay by version, so writers with skewed clocks can't reorder them.
+func deltaSegmentName(at time.Time, suffix string) string {
+	return fmt.Sprintf("%s%020d-%s.parquet", deltaSegmentPrefix, at.UnixNano(), suffix)
+}
+
+// randomSuffix disambiguates deltas written in the same nanosecond by different replicas
+func randomSuffix() string {
+	b := make([]byte, 6)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// encodeSegment writes rows into a Snappy-compressed Parquet file tagged with the current schema version
+func encodeSegment(rows []segmentRow, options ...parquet.WriterOption) ([]byte, error) {
+	// Write to Parquet buffer
+	buf := new(bytes.Buffer)
+	options = append([]parquet.WriterOption{
+		parquet.Compression(&parquet.Snappy),
+		parquet.KeyValueMetadata(schemaVersionKey, strconv.Itoa(CurrentSchemaVersion)),
+	}, options...)
+	parquetWriter := parquet.NewGenericWriter[segmentRow](buf, options...)
+
+	_, err := parquetWriter.Write(rows)
+	if err != nil {
+		return nil, fmt.Errorf("failed to write parquet: %w", err)
+	}
+
+	if err := parquetWriter.Close(); err != nil {
+		return nil, fmt.Errorf("failed to close parquet writer: %w", err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// readAllRows reads every row of an opened Parquet file
+func readAllRows[T any](file *parquet.File) ([]T, error) {
+	return readRows(parquet.NewGenericReader[T](file))
+}
+
+// readRowGroupRows reads every row of a single row group
+func readRowGroupRows[T any](rowGroup parquet.RowGroup) ([]T, error) {
+	return readRows(parquet.NewGenericRowGroupReader[T](rowGroup))
+}
+
+func readRows[T any](parquetReader *parquet.GenericReader[T]) ([]T, error) {
+	defer parquetReader.Close()
+
+	var result []T
+	rows := make([]T, 1000) // Read in batches
+	for {
+		n, err := parquetReader.Read(rows)
+		if n > 0 {
+			result = append(result, rows[:n]...)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read parquet: %w", err)
 		}
 	}
 
-	return removedCount, nil
+	return result, nil
 }
@@ -0,0 +1,161 @@
+package infra
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Metadata partitions are keyed by hash, so a path alone doesn't tell which partition holds
+	// its entry. The path index keeps one empty object per path and hash it was stored with, as
+	// paths/<bucket>/<sha256 of path>/<hash> in the metadata bucket: a path lookup lists its
+	// hashes and reads only their partitions.
+	pathIndexRoot = "paths/"
+	// pathIndexMarker is written once every entry of a bucket stored before the index is indexed
+	pathIndexMarker = ".indexed"
+	// pathIndexGrace keeps index keys whose entry isn't visible in its partition yet: the key is
+	// written before the entry, and an entry may be written long after by a slow request
+	pathIndexGrace = time.Hour
+	// pathVersionSuffix names the write counter of a path, stored next to its index prefix as
+	// paths/<bucket>/<sha256 of path>.version
+	pathVersionSuffix = ".version"
+)
+
+// entriesAtPath returns the entries registered at a bucket/path, normally one, reading only the
+// partitions of the hashes the path index lists for it
+func (ps *ParquetService) entriesAtPath(ctx context.Context, bucket, filePath string) ([]FileMetadata, error) {
+	if err := ps.ensurePathIndex(ctx, bucket); err != nil {
+		return nil, err
+	}
+
+	prefix := pathIndexPrefix(bucket, filePath)
+	keys, err := ps.minioClient.ListObjectsWithInfo(ctx, ps.metadataBucket, prefix)
+	if err != nil && !IsNotFound(err) {
+		return nil, fmt.Errorf("failed to list path index: %w", err)
+	}
+
+	var entries []FileMetadata
+	for _, key := range keys {
+		hash := strings.TrimPrefix(key.Key, prefix)
+		references, err := ps.referencesTo(ctx, bucket, hash)
+		if err != nil {
+			return nil, err
+		}
+
+		found := false
+		for _, item := range references {
+			if item.FilePath == filePath {
+				entries = append(entries, item)
+				found = true
+			}
+		}
+		if !found {
+			ps.dropPathIndexKey(ctx, key)
+		}
+	}
+	return entries, nil
+}
+
+// indexPaths records the hash of each entry under its path. It runs before the entries are
+// appended, so an entry is never stored without its index key.
+func (ps *ParquetService) indexPaths(ctx context.Context, metas []FileMetadata) error {
+	for _, meta := range metas {
+		// A random body gives every write a new ETag, so dropPathIndexKey never deletes a key rewritten meanwhile
+		key := pathIndexPrefix(meta.BucketName, meta.FilePath) + meta.FileHash
+		if err := ps.minioClient.PutObjectWithMetadata(ctx, ps.metadataBucket, key, []byte(randomSuffix()), "application/octet-stream", nil); err != nil {
+			return fmt.Errorf("failed to index path %s: %w", meta.FilePath, err)
+		}
+	}
+	return nil
+}
+
+// dropPathIndexKey deletes an index key whose partition has no entry at the path anymore, once it
+// is older than pathIndexGrace. Failures only leave a key that the next lookup retries.
+func (ps *ParquetService) dropPathIndexKey(ctx context.Context, key ObjectInfo) {
+	if time.Since(key.LastModified) < pathIndexGrace {
+		return
+	}
+	_ = ps.minioClient.DeleteObjectIfMatch(ctx, ps.metadataBucket, key.Key, key.ETag)
+}
+
+// nextPathVersion increments the write counter of a path and returns the new value. The counter
+// is updated with conditional writes, so every write to the path gets a distinct version ordered
+// by when it was taken, whatever the clocks of the replicas say.
+func (ps *ParquetService) nextPathVersion(ctx context.Context, bucket, filePath string) (int64, error) {
+	key := strings.TrimSuffix(pathIndexPrefix(bucket, filePath), "/") + pathVersionSuffix
+
+	var version int64
+	err := ps.withConflictRetry(ctx, "path version", func() error {
+		data, etag, err := ps.minioClient.GetObjectWithETag(ctx, ps.metadataBucket, key)
+		switch {
+		case IsNotFound(err):
+			version, etag = 0, ""
+		case err != nil:
+			return fmt.Errorf("failed to read path version: %w", err)
+		default:
+			if version, err = strconv.ParseInt(string(data), 10, 64); err != nil {
+				return fmt.Errorf("invalid path version %q", data)
+			}
+		}
+
+		version++
+		if _, err := ps.minioClient.PutObjectIfMatch(ctx, ps.metadataBucket, key, []byte(strconv.FormatInt(version, 10)), "text/plain", etag); err != nil {
+			if IsPreconditionFailed(err) {
+				return errMetadataConflict
+			}
+			return fmt.Errorf("failed to write path version: %w", err)
+		}
+		return nil
+	})
+	return version, err
+}
+
+// ensurePathIndex indexes the entries of a bucket written before the path index existed, once
+func (ps *ParquetService) ensurePathIndex(ctx context.Context, bucket string) error {
+	if _, ok := ps.pathIndexed.Load(bucket); ok {
+		return nil
+	}
+
+	ps.pathIndexMu.Lock()
+	defer ps.pathIndexMu.Unlock()
+	if _, ok := ps.pathIndexed.Load(bucket); ok {
+		return nil
+	}
+
+	marker := pathIndexRoot + bucket + "/" + pathIndexMarker
+	indexed, err := ps.minioClient.ObjectExists(ctx, ps.metadataBucket, marker)
+	if err != nil {
+		return err
+	}
+	if !indexed {
+		// Writes made meanwhile index their own paths first, so a snapshot is enough
+		metadata, err := ps.LoadBucketMetadata(ctx, bucket)
+		if err != nil {
+			return err
+		}
+		if err := ps.indexPaths(ctx, metadata); err != nil {
+			return err
+		}
+		if err := ps.minioClient.PutObjectWithMetadata(ctx, ps.metadataBucket, marker, nil, "application/octet-stream", nil); err != nil {
+			return fmt.Errorf("failed to mark path index: %w", err)
+		}
+		ps.logger.Info("[Parquet] Built path index", map[string]interface{}{
+			"bucket":  bucket,
+			"entries": len(metadata),
+		})
+	}
+
+	ps.pathIndexed.Store(bucket, true)
+	return nil
+}
+
+// pathIndexPrefix returns the index prefix of a path; paths are hashed to keep keys short and flat
+func pathIndexPrefix(bucket, filePath string) string {
+	sum := sha256.Sum256([]byte(filePath))
+	return pathIndexRoot + bucket + "/" + hex.EncodeToString(sum[:]) + "/"
+}
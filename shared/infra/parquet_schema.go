@@ -0,0 +1,205 @@
+package infra
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/parquet-go/parquet-go"
+)
+
+// Metadata schema versions:
+//
+//	1: the columns of segmentRow
+//
+// The pre-partitioning files-metadata.parquet carries no version entry and reads as version 1:
+// it lacks the later columns, which decode as zero values meaning content stored at its path,
+// no variants and no user.
+const (
+	// schemaVersionKey is the Parquet key-value metadata entry recording the schema of a file
+	schemaVersionKey = "gau.schema_version"
+	// CurrentSchemaVersion is the schema version written by this service
+	CurrentSchemaVersion = 1
+)
+
+// schemaUpgrade converts rows decoded from a file of one schema version to the next version.
+// Rows are decoded into segmentRow first: columns missing from old files are left zero and
+// columns no longer in segmentRow are dropped, so an upgrade only fixes up values. A change that
+// can't be decoded that way (a retyped column) needs its own decoding for the older version.
+type schemaUpgrade func(rows []segmentRow) []segmentRow
+
+// schemaUpgrades maps a version to the upgrade producing the following version; a new column
+// whose zero value means what older rows meant needs no new version
+var schemaUpgrades = map[int]schemaUpgrade{}
+
+// SchemaMigrationResult summarizes a schema migration run
+type SchemaMigrationResult struct {
+	Segments       int  `json:"segments"`
+	Rewritten      int  `json:"rewritten"`
+	Rows           int  `json:"rows"`
+	LegacyMigrated bool `json:"legacy_migrated"`
+}
+
+// MigrateSchema rewrites every stored segment older than CurrentSchemaVersion. The legacy single
+// metadata file is split into partitions first. Segments are replaced with conditional writes, so
+// a segment changed or removed by a concurrent compaction is simply skipped.
+func (ps *ParquetService) MigrateSchema(ctx context.Context) (*SchemaMigrationResult, error) {
+	result := &SchemaMigrationResult{}
+
+	migrated, err := ps.migrateLegacy(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to migrate legacy metadata: %w", err)
+	}
+	result.LegacyMigrated = migrated
+
+	objects, err := ps.minioClient.ListObjectsWithInfo(ctx, ps.metadataBucket, partitionRoot)
+	if err != nil {
+		if IsNotFound(err) {
+			return result, nil
+		}
+		return nil, err
+	}
+
+	for _, object := range objects {
+		if !strings.HasSuffix(object.Key, ".parquet") {
+			continue
+		}
+		result.Segments++
+
+		rows, rewritten, err := ps.migrateSegment(ctx, object.Key)
+		if err != nil {
+			return result, err
+		}
+		if rewritten {
+			result.Rewritten++
+			result.Rows += rows
+		}
+	}
+
+	ps.logger.Info("[Parquet] Schema migration completed", map[string]interface{}{
+		"segments":  result.Segments,
+		"rewritten": result.Rewritten,
+		"rows":      result.Rows,
+		"version":   CurrentSchemaVersion,
+	})
+	return result, nil
+}
+
+// migrateSegment rewrites one segment at the current schema version if it is older,
+// keeping the record of the deltas compacted into it
+func (ps *ParquetService) migrateSegment(ctx context.Context, key string) (int, bool, error) {
+	data, etag, err := ps.minioClient.GetObjectWithETag(ctx, ps.metadataBucket, key)
+	if err != nil {
+		if IsNotFound(err) {
+			return 0, false, nil
+		}
+		return 0, false, fmt.Errorf("failed to download segment %s: %w", key, err)
+	}
+
+	file, err := parquet.OpenFile(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to open segment %s: %w", key, err)
+	}
+	version, err := schemaVersion(file)
+	if err != nil {
+		return 0, false, fmt.Errorf("segment %s: %w", key, err)
+	}
+	if version == CurrentSchemaVersion {
+		return 0, false, nil
+	}
+
+	rows, err := decodeRows(file)
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to read segment %s: %w", key, err)
+	}
+
+	var options []parquet.WriterOption
+	if value, ok := file.Lookup(compactedDeltasKey); ok {
+		options = append(options,
+			parquet.KeyValueMetadata(compactedDeltasKey, value),
+			parquet.MaxRowsPerRowGroup(compactionRowGroupSize),
+		)
+	}
+	encoded, err := encodeSegment(rows, options...)
+	if err != nil {
+		return 0, false, err
+	}
+
+	_, err = ps.minioClient.Client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(ps.metadataBucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(encoded),
+		ContentType: aws.String("application/octet-stream"),
+		IfMatch:     aws.String(etag),
+	})
+	if err != nil {
+		if IsPreconditionFailed(err) || IsNotFound(err) {
+			// Replaced by a compaction in the meantime, which already wrote the current schema
+			return 0, false, nil
+		}
+		return 0, false, fmt.Errorf("failed to rewrite segment %s: %w", key, err)
+	}
+	return len(rows), true, nil
+}
+
+// decodeRows reads every row of a metadata file and upgrades it to the current schema
+func decodeRows(file *parquet.File) ([]segmentRow, error) {
+	return decodeRowGroups(file, nil)
+}
+
+// decodeRowGroups is decodeRows reading only the row groups accepted by keep (all when nil)
+func decodeRowGroups(file *parquet.File, keep func(parquet.RowGroup) bool) ([]segmentRow, error) {
+	version, err := schemaVersion(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var rows []segmentRow
+	if keep == nil {
+		rows, err = readAllRows[segmentRow](file)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		for _, rowGroup := range file.RowGroups() {
+			if !keep(rowGroup) {
+				continue
+			}
+			groupRows, err := readRowGroupRows[segmentRow](rowGroup)
+			if err != nil {
+				return nil, err
+			}
+			rows = append(rows, groupRows...)
+		}
+	}
+
+	for ; version < CurrentSchemaVersion; version++ {
+		upgrade, ok := schemaUpgrades[version]
+		if !ok {
+			return nil, fmt.Errorf("no upgrade registered from metadata schema version %d", version)
+		}
+		rows = upgrade(rows)
+	}
+	return rows, nil
+}
+
+// schemaVersion returns the schema version recorded in a metadata file
+func schemaVersion(file *parquet.File) (int, error) {
+	value, ok := file.Lookup(schemaVersionKey)
+	if !ok {
+		return 1, nil
+	}
+
+	version, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid metadata schema version %q", value)
+	}
+	if version > CurrentSchemaVersion {
+		return 0, fmt.Errorf("metadata schema version %d is newer than supported version %d", version, CurrentSchemaVersion)
+	}
+	return version, nil
+}
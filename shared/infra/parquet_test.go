@@ -0,0 +1,166 @@
+package infra
+
+import (
+	"context"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/tnqbao/gau-upload-service/shared/infra/s3test"
+	"go.opentelemetry.io/otel/metric/noop"
+)
+
+func newTestParquetService(t *testing.T) (*s3test.Server, *ParquetService) {
+	t.Helper()
+	server, client := s3test.NewClient(t)
+	logger := &LoggerClient{Logger: slog.Default(), Meter: noop.NewMeterProvider().Meter("test")}
+	return server, NewParquetService(&MinioClient{Client: client}, logger)
+}
+
+func testRow(hash string, version int64, deleted bool) segmentRow {
+	return segmentRow{
+		BucketName: "photos",
+		FileHash:   hash,
+		FilePath:   "a.png",
+		UploadedAt: time.Now(),
+		Version:    version,
+		Deleted:    deleted,
+	}
+}
+
+func TestPartitionStateApply(t *testing.T) {
+	tests := []struct {
+		name string
+		rows []segmentRow
+		want []string // hashes of the live entries
+	}{
+		{"newer tombstone read first", []segmentRow{testRow("h1", 2, true), testRow("h1", 1, false)}, nil},
+		{"older tombstone read last", []segmentRow{testRow("h1", 2, false), testRow("h1", 1, true)}, []string{"h1"}},
+		{"rewrite after delete", []segmentRow{testRow("h1", 1, false), testRow("h1", 2, true), testRow("h1", 3, false)}, []string{"h1"}},
+		{"same version replays in order", []segmentRow{testRow("h1", 0, false), testRow("h1", 0, true)}, nil},
+		{"same version re-added", []segmentRow{testRow("h1", 0, true), testRow("h1", 0, false)}, []string{"h1"}},
+		{"latest content of a path", []segmentRow{testRow("h2", 2, false), testRow("h1", 1, false)}, []string{"h2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state := newPartitionState()
+			for _, row := range tt.rows {
+				state.apply([]segmentRow{row})
+			}
+
+			var got []string
+			for _, meta := range state.metadata() {
+				got = append(got, meta.FileHash)
+			}
+			if len(got) != len(tt.want) || (len(got) > 0 && got[0] != tt.want[0]) {
+				t.Errorf("live entries %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPartitionStateRowsExpiresTombstones(t *testing.T) {
+	expired := testRow("h1", 1, true)
+	expired.FilePath = "expired.png"
+	expired.UploadedAt = time.Now().Add(-tombstoneRetention - time.Minute)
+	recent := testRow("h1", 1, true)
+	recent.FilePath = "recent.png"
+	live := testRow("h1", 1, false)
+
+	state := newPartitionState()
+	state.apply([]segmentRow{expired, recent, live})
+
+	kept := make(map[string]bool)
+	for _, row := range state.rows() {
+		kept[row.FilePath] = true
+	}
+	if kept["expired.png"] || !kept["recent.png"] || !kept["a.png"] {
+		t.Errorf("compacted rows %v, want the live entry and the recent tombstone", kept)
+	}
+}
+
+func TestParquetLateWriteAfterDelete(t *testing.T) {
+	ctx := context.Background()
+	_, ps := newTestParquetService(t)
+
+	meta := FileMetadata{BucketName: "photos", FilePath: "a.png", FileHash: "aa11", UploadedAt: time.Now()}
+	if err := ps.AddFileMetadata(ctx, meta); err != nil {
+		t.Fatal(err)
+	}
+
+	// A slow writer takes its version before the delete but appends its delta after it
+	version, err := ps.nextPathVersion(ctx, meta.BucketName, meta.FilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ps.RemoveFileMetadata(ctx, meta.BucketName, meta.FilePath); err != nil {
+		t.Fatal(err)
+	}
+	late := meta
+	late.version = version
+	if err := ps.appendDeltas(ctx, []segmentRow{rowFromMetadata(late, false)}); err != nil {
+		t.Fatal(err)
+	}
+
+	assertDeleted := func(stage string) {
+		t.Helper()
+		if _, found, err := ps.GetFileByPath(ctx, meta.BucketName, meta.FilePath); err != nil || found {
+			t.Fatalf("%s: found=%v err=%v, want the entry to stay deleted", stage, found, err)
+		}
+	}
+	assertDeleted("before compaction")
+
+	if _, err := ps.Compact(ctx); err != nil {
+		t.Fatal(err)
+	}
+	assertDeleted("after compaction")
+
+	// The tombstone is kept in the base, so a delta landing after compaction can't revive the entry
+	if err := ps.appendDeltas(ctx, []segmentRow{rowFromMetadata(late, false)}); err != nil {
+		t.Fatal(err)
+	}
+	assertDeleted("late delta after compaction")
+}
+
+func TestParquetPathIndex(t *testing.T) {
+	ctx := context.Background()
+	server, ps := newTestParquetService(t)
+
+	first := FileMetadata{BucketName: "photos", FilePath: "a.png", FileHash: "aa11", UploadedAt: time.Now()}
+	// The replacement is stamped earlier: the version orders writes, not the clock
+	second := FileMetadata{BucketName: "photos", FilePath: "a.png", FileHash: "bb22", UploadedAt: first.UploadedAt.Add(-time.Hour)}
+	for _, meta := range []FileMetadata{first, second} {
+		if err := ps.AddFileMetadata(ctx, meta); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, found, err := ps.GetFileByPath(ctx, "photos", "a.png")
+	if err != nil || !found || got.FileHash != "bb22" {
+		t.Fatalf("GetFileByPath = %q, %v, %v; want bb22", got.FileHash, found, err)
+	}
+	if count, err := ps.CountReferences(ctx, "photos", "aa11"); err != nil || count != 0 {
+		t.Errorf("CountReferences(replaced hash) = %d, %v; want 0", count, err)
+	}
+
+	prefix := pathIndexPrefix("photos", "a.png")
+	if keys := server.Keys(ps.metadataBucket, prefix); len(keys) != 2 {
+		t.Fatalf("index keys %v, want one per hash stored at the path", keys)
+	}
+
+	// The key of the replaced hash is dropped by the next lookup once past the grace period
+	server.SetModified(ps.metadataBucket, prefix+"aa11", time.Now().Add(-pathIndexGrace-time.Minute))
+	if _, _, err := ps.GetFileByPath(ctx, "photos", "a.png"); err != nil {
+		t.Fatal(err)
+	}
+	if keys := server.Keys(ps.metadataBucket, prefix); len(keys) != 1 || keys[0] != prefix+"bb22" {
+		t.Errorf("index keys %v, want only %s", keys, prefix+"bb22")
+	}
+
+	if err := ps.RemoveFileMetadata(ctx, "photos", "a.png"); err != nil {
+		t.Fatal(err)
+	}
+	if _, found, err := ps.GetFileByPath(ctx, "photos", "a.png"); err != nil || found {
+		t.Errorf("after delete: found=%v err=%v", found, err)
+	}
+}
@@ -0,0 +1,315 @@
+// Package s3test runs an in-memory S3 server for tests. It implements the subset of the API the
+// service uses: bucket creation, listing, object reads with ranges, writes and server-side copies
+// with If-Match / If-None-Match conditions, and deletes.
+package s3test
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+type object struct {
+	data        []byte
+	etag        string
+	modified    time.Time
+	contentType string
+	metadata    map[string]string
+}
+
+// Server is an in-memory S3 server
+type Server struct {
+	mu      sync.Mutex
+	buckets map[string]map[string]*object
+}
+
+// NewClient starts a server, closed with the test, and returns it with a client using it
+func NewClient(t testing.TB) (*Server, *s3.Client) {
+	server := &Server{buckets: make(map[string]map[string]*object)}
+	httpServer := httptest.NewServer(server)
+	t.Cleanup(httpServer.Close)
+
+	client := s3.New(s3.Options{
+		BaseEndpoint: aws.String(httpServer.URL),
+		Region:       "us-east-1",
+		UsePathStyle: true,
+		Credentials:  credentials.NewStaticCredentialsProvider("test", "test", ""),
+	})
+	return server, client
+}
+
+// Keys returns the sorted keys of a bucket starting with prefix
+func (s *Server) Keys(bucket, prefix string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var keys []string
+	for key := range s.buckets[bucket] {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Object returns the content of an object
+func (s *Server) Object(bucket, key string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	obj, ok := s.buckets[bucket][key]
+	if !ok {
+		return nil, false
+	}
+	return obj.data, true
+}
+
+// Put stores an object directly, as if written by another client
+func (s *Server) Put(bucket, key string, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.buckets[bucket] == nil {
+		s.buckets[bucket] = make(map[string]*object)
+	}
+	s.buckets[bucket][key] = newObject(data, "application/octet-stream", nil)
+}
+
+// SetModified backdates an object, for code that ages objects by their modification time
+func (s *Server) SetModified(bucket, key string, modified time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if obj, ok := s.buckets[bucket][key]; ok {
+		obj.modified = modified
+	}
+}
+
+func newObject(data []byte, contentType string, metadata map[string]string) *object {
+	sum := md5.Sum(data)
+	return &object{
+		data:        data,
+		etag:        `"` + hex.EncodeToString(sum[:]) + `"`,
+		modified:    time.Now(),
+		contentType: contentType,
+		metadata:    metadata,
+	}
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if key == "" {
+		s.serveBucket(w, r, bucket)
+		return
+	}
+
+	objects, ok := s.buckets[bucket]
+	if !ok {
+		writeError(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	current := objects[key]
+
+	switch r.Method {
+	case http.MethodPut:
+		if r.URL.Query().Has("partNumber") {
+			writeError(w, http.StatusNotImplemented, "NotImplemented")
+			return
+		}
+		if !preconditionsHold(r, current) {
+			writeError(w, http.StatusPreconditionFailed, "PreconditionFailed")
+			return
+		}
+		s.putObject(w, r, objects, key)
+	case http.MethodHead, http.MethodGet:
+		if current == nil {
+			writeError(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		if match := r.Header.Get("If-Match"); match != "" && match != current.etag {
+			writeError(w, http.StatusPreconditionFailed, "PreconditionFailed")
+			return
+		}
+		serveObject(w, r, current)
+	case http.MethodDelete:
+		if match := r.Header.Get("If-Match"); match != "" && (current == nil || current.etag != match) {
+			writeError(w, http.StatusPreconditionFailed, "PreconditionFailed")
+			return
+		}
+		delete(objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+func (s *Server) serveBucket(w http.ResponseWriter, r *http.Request, bucket string) {
+	objects, ok := s.buckets[bucket]
+	switch r.Method {
+	case http.MethodPut:
+		if !ok {
+			s.buckets[bucket] = make(map[string]*object)
+		}
+	case http.MethodHead:
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	case http.MethodGet:
+		if !ok {
+			writeError(w, http.StatusNotFound, "NoSuchBucket")
+			return
+		}
+		listObjects(w, objects, r.URL.Query().Get("prefix"))
+	default:
+		writeError(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+func (s *Server) putObject(w http.ResponseWriter, r *http.Request, objects map[string]*object, key string) {
+	contentType := r.Header.Get("Content-Type")
+	metadata := make(map[string]string)
+	var data []byte
+
+	if source := r.Header.Get("X-Amz-Copy-Source"); source != "" {
+		sourceBucket, sourceKey, _ := strings.Cut(strings.TrimPrefix(source, "/"), "/")
+		sourceObject := s.buckets[sourceBucket][sourceKey]
+		if sourceObject == nil {
+			writeError(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		data = sourceObject.data
+		if r.Header.Get("X-Amz-Metadata-Directive") != "REPLACE" {
+			contentType, metadata = sourceObject.contentType, sourceObject.metadata
+		}
+	} else {
+		var err error
+		if data, err = io.ReadAll(r.Body); err != nil {
+			writeError(w, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+		if strings.Contains(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING") || r.Header.Get("Content-Encoding") == "aws-chunked" {
+			data = decodeChunked(data)
+		}
+	}
+	for name, values := range r.Header {
+		if name := strings.ToLower(name); strings.HasPrefix(name, "x-amz-meta-") {
+			metadata[strings.TrimPrefix(name, "x-amz-meta-")] = values[0]
+		}
+	}
+
+	obj := newObject(data, contentType, metadata)
+	objects[key] = obj
+	w.Header().Set("ETag", obj.etag)
+	if r.Header.Get("X-Amz-Copy-Source") != "" {
+		_, _ = fmt.Fprintf(w, "<CopyObjectResult><ETag>%s</ETag></CopyObjectResult>", obj.etag)
+	}
+}
+
+func preconditionsHold(r *http.Request, current *object) bool {
+	if r.Header.Get("If-None-Match") == "*" && current != nil {
+		return false
+	}
+	if match := r.Header.Get("If-Match"); match != "" && (current == nil || current.etag != match) {
+		return false
+	}
+	return true
+}
+
+func serveObject(w http.ResponseWriter, r *http.Request, obj *object) {
+	w.Header().Set("ETag", obj.etag)
+	w.Header().Set("Last-Modified", obj.modified.UTC().Format(http.TimeFormat))
+	w.Header().Set("Content-Type", obj.contentType)
+	for name, value := range obj.metadata {
+		w.Header().Set("X-Amz-Meta-"+name, value)
+	}
+
+	data, status := obj.data, http.StatusOK
+	if spec := strings.TrimPrefix(r.Header.Get("Range"), "bytes="); spec != "" {
+		first, last, _ := strings.Cut(spec, "-")
+		start, _ := strconv.Atoi(first)
+		end := len(data) - 1
+		if last != "" {
+			if n, _ := strconv.Atoi(last); n < end {
+				end = n
+			}
+		}
+		data, status = data[start:end+1], http.StatusPartialContent
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(obj.data)))
+	}
+
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(status)
+	if r.Method == http.MethodGet {
+		_, _ = w.Write(data)
+	}
+}
+
+func listObjects(w http.ResponseWriter, objects map[string]*object, prefix string) {
+	type content struct {
+		Key          string
+		ETag         string
+		Size         int64
+		LastModified string
+	}
+	var result struct {
+		XMLName  xml.Name `xml:"ListBucketResult"`
+		Contents []content
+	}
+
+	var keys []string
+	for key := range objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		obj := objects[key]
+		result.Contents = append(result.Contents, content{key, obj.etag, int64(len(obj.data)), obj.modified.UTC().Format(time.RFC3339)})
+	}
+	_ = xml.NewEncoder(w).Encode(result)
+}
+
+func writeError(w http.ResponseWriter, status int, code string) {
+	w.WriteHeader(status)
+	_, _ = fmt.Fprintf(w, "<Error><Code>%s</Code></Error>", code)
+}
+
+// decodeChunked strips the aws-chunked framing of a streamed upload body
+func decodeChunked(data []byte) []byte {
+	var out bytes.Buffer
+	for len(data) > 0 {
+		end := bytes.Index(data, []byte("\r\n"))
+		if end < 0 {
+			break
+		}
+		header, _, _ := strings.Cut(string(data[:end]), ";")
+		size, err := strconv.ParseInt(header, 16, 64)
+		if err != nil || size == 0 {
+			break
+		}
+		data = data[end+2:]
+		out.Write(data[:size])
+		data = data[size+2:]
+	}
+	return out.Bytes()
+}
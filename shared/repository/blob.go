@@ -0,0 +1,423 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/tnqbao/gau-upload-service/shared/infra"
+)
+
+// BlobPrefix is the key prefix of content-addressed blobs inside each bucket
+const BlobPrefix = "_blobs/"
+
+const (
+	// blobLockStripes bounds the number of mutexes used to serialize work on the same hash
+	blobLockStripes = 64
+	// blobPinPrefix holds, under <bucket>/<hash>/, one claim per prepared reference not recorded yet
+	blobPinPrefix = "pins/"
+)
+
+// BlobStore stores each distinct content once per bucket under a content-addressed key.
+// User-visible paths are references recorded in the metadata store; a blob is deleted only
+// when the last reference to its hash is removed.
+// Creating and deleting the blob of a hash happen under a lock shared by every instance, and
+// prepared references pin their blob with a claim every instance checks before deleting it, so
+// a blob reused by one instance is never deleted by another before the reference is recorded.
+// Content is uploaded to the pending bucket before taking the lock, which then only covers the
+// existence check and the server-side copy into the blob area.
+type BlobStore struct {
+	minio    *infra.MinioClient
+	metadata infra.MetadataStore
+	claims   *ClaimStore
+	locks    [blobLockStripes]sync.Mutex
+
+	// pins counts prepared references per bucket/hash that are not recorded yet; pinned blobs are
+	// never released. Their claims under blobPinPrefix tell other instances.
+	pinMu sync.Mutex
+	pins  map[string]int
+}
+
+// PendingReference is a path whose content is stored but whose reference is not recorded yet.
+// Its blob stays pinned until the reference is committed or discarded.
+type PendingReference struct {
+	Meta   infra.FileMetadata
+	Reused bool // existing content was reused instead of uploading the bytes
+
+	previous    infra.FileMetadata
+	hasPrevious bool
+	pinned      bool
+	pin         *PathClaim
+}
+
+func NewBlobStore(minio *infra.MinioClient, metadata infra.MetadataStore, claims *ClaimStore) *BlobStore {
+	return &BlobStore{
+		minio:    minio,
+		metadata: metadata,
+		claims:   claims,
+		pins:     make(map[string]int),
+	}
+}
+
+// BlobKey returns the content-addressed key of a hash, e.g. _blobs/ab/ab12...
+func BlobKey(hash string) string {
+	hash = strings.ToLower(hash)
+	if len(hash) < 2 {
+		return BlobPrefix + "_/" + hash
+	}
+	return BlobPrefix + hash[:2] + "/" + hash
+}
+
+// IsBlobKey reports whether an object key belongs to the blob area
+func IsBlobKey(key string) bool {
+	return strings.HasPrefix(key, BlobPrefix)
+}
+
+// Resolve returns the object key holding the content of a path.
+// Paths without metadata are assumed to be stored directly at their key.
+func (bs *BlobStore) Resolve(ctx context.Context, bucket, filePath string) (string, error) {
+	meta, found, err := bs.metadata.GetFileByPath(ctx, bucket, filePath)
+	if err != nil {
+		return "", err
+	}
+	if !found {
+		return filePath, nil
+	}
+	return meta.ObjectKey(), nil
+}
+
+// Store makes sure the content of meta.FileHash exists as a blob, then registers meta.FilePath
+// as a reference to it. content is only read when the blob has to be uploaded.
+// It reports whether existing content was reused instead of uploading the bytes.
+func (bs *BlobStore) Store(ctx context.Context, meta infra.FileMetadata, content io.ReadSeeker, objectMetadata map[string]string) (bool, error) {
+	ref, err := bs.Prepare(ctx, meta, content, objectMetadata)
+	if err != nil {
+		return false, err
+	}
+	return ref.Reused, bs.Commit(ctx, []*PendingReference{ref})
+}
+
+// Prepare makes sure the content of meta.FileHash exists as a blob without recording the
+// reference yet, so several references can be committed together. Every prepared reference
+// must be passed to Commit or Discard. New content is staged in the pending bucket first and
+// deleted from there once copied.
+func (bs *BlobStore) Prepare(ctx context.Context, meta infra.FileMetadata, content io.ReadSeeker, objectMetadata map[string]string) (*PendingReference, error) {
+	return bs.prepare(ctx, meta, func() (string, string, func(), error) {
+		if _, err := content.Seek(0, io.SeekStart); err != nil {
+			return "", "", nil, fmt.Errorf("failed to rewind content: %w", err)
+		}
+		if err := bs.minio.EnsureBucketByName(ctx, PendingBucket); err != nil {
+			return "", "", nil, err
+		}
+		key := streamPrefix + newUploadID()
+		if err := bs.minio.PutObjectStreamWithMetadata(ctx, PendingBucket, key, content, meta.FileSize, meta.ContentType, nil); err != nil {
+			return "", "", nil, err
+		}
+		// A staged object left behind by a failed delete is swept with the other stream uploads
+		return PendingBucket, key, func() { _ = bs.minio.DeleteObject(context.WithoutCancel(ctx), PendingBucket, key) }, nil
+	}, objectMetadata)
+}
+
+// PrepareCopy is Prepare for content already staged in another object: the blob is created by a
+// server-side copy of srcBucket/srcKey when it doesn't exist yet. The staged object is left in place.
+func (bs *BlobStore) PrepareCopy(ctx context.Context, meta infra.FileMetadata, srcBucket, srcKey string, objectMetadata map[string]string) (*PendingReference, error) {
+	return bs.prepare(ctx, meta, func() (string, string, func(), error) {
+		return srcBucket, srcKey, func() {}, nil
+	}, objectMetadata)
+}
+
+// prepare pins the blob of meta.FileHash, creating it first when the content isn't stored yet.
+// stage runs without the hash lock and returns where the content is staged, with the function
+// dropping it once it has been copied.
+func (bs *BlobStore) prepare(ctx context.Context, meta infra.FileMetadata, stage func() (string, string, func(), error), objectMetadata map[string]string) (*PendingReference, error) {
+	meta.BlobKey = BlobKey(meta.FileHash)
+
+	previous, found, err := bs.metadata.GetFileByPath(ctx, meta.BucketName, meta.FilePath)
+	if err != nil {
+		return nil, err
+	}
+	ref := &PendingReference{Meta: meta, previous: previous, hasPrevious: found}
+
+	// Existing content is reused without staging anything
+	stored, err := bs.pinIfStored(ctx, ref, "", "", objectMetadata)
+	if err != nil || stored {
+		return ref, err
+	}
+
+	stagedBucket, stagedKey, drop, err := stage()
+	if err != nil {
+		return nil, err
+	}
+	defer drop()
+
+	if _, err := bs.pinIfStored(ctx, ref, stagedBucket, stagedKey, objectMetadata); err != nil {
+		return nil, err
+	}
+	return ref, nil
+}
+
+// pinIfStored pins the blob of a prepared reference under the hash lock if it is stored, or can
+// be copied from a legacy path or from the staged object when one is given. It reports whether
+// it was pinned, and marks the reference Reused unless the blob was copied from the staged object.
+func (bs *BlobStore) pinIfStored(ctx context.Context, ref *PendingReference, stagedBucket, stagedKey string, objectMetadata map[string]string) (bool, error) {
+	meta := ref.Meta
+	unlock, err := bs.lock(ctx, meta.BucketName, meta.FileHash)
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	reused, err := bs.ensureBlob(ctx, meta, objectMetadata)
+	if err != nil {
+		return false, err
+	}
+	if !reused {
+		if stagedKey == "" {
+			return false, nil
+		}
+		if err := bs.minio.EnsureBucketByName(ctx, meta.BucketName); err != nil {
+			return false, err
+		}
+		if err := bs.minio.CopyObjectWithMetadata(ctx, stagedBucket, stagedKey, meta.BucketName, meta.BlobKey, meta.FileSize, meta.ContentType, objectMetadata); err != nil {
+			return false, err
+		}
+	}
+
+	pin, err := bs.claims.Pin(ctx, blobPinKey(meta.BucketName, meta.FileHash))
+	if err != nil {
+		return false, fmt.Errorf("failed to pin blob: %w", err)
+	}
+	bs.pin(meta.BucketName, meta.FileHash, 1)
+	ref.Reused, ref.pinned, ref.pin = reused, true, pin
+	return true, nil
+}
+
+// Commit records prepared references with a single metadata write, then releases the content
+// each path referenced before. When the write fails the references are discarded.
+func (bs *BlobStore) Commit(ctx context.Context, refs []*PendingReference) error {
+	if len(refs) == 0 {
+		return nil
+	}
+
+	metas := make([]infra.FileMetadata, 0, len(refs))
+	for _, ref := range refs {
+		metas = append(metas, ref.Meta)
+	}
+	if err := bs.metadata.AddFileMetadataBatch(ctx, metas); err != nil {
+		bs.Discard(ctx, refs)
+		return err
+	}
+	// The references are recorded now, they protect their blobs from here on
+	for _, ref := range refs {
+		bs.unpin(ref)
+	}
+
+	for _, ref := range refs {
+		if ref.hasPrevious && ref.previous.ObjectKey() != ref.Meta.ObjectKey() {
+			if _, err := bs.release(ctx, ref.previous); err != nil {
+				return fmt.Errorf("failed to release previous content: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+// Discard unpins prepared references that will not be committed, and deletes the blobs they
+// uploaded unless another path references or pins them meanwhile. A blob that fails to delete
+// is left for reconciliation.
+func (bs *BlobStore) Discard(ctx context.Context, refs []*PendingReference) {
+	ctx = context.WithoutCancel(ctx)
+	for _, ref := range refs {
+		if !ref.pinned {
+			continue
+		}
+		bs.unpin(ref)
+		if !ref.Reused {
+			_, _ = bs.release(ctx, ref.Meta)
+		}
+	}
+}
+
+// AddReference registers a path pointing at content that is already stored
+func (bs *BlobStore) AddReference(ctx context.Context, meta infra.FileMetadata) error {
+	return bs.register(ctx, meta, nil)
+}
+
+// register records meta under the hash lock, after running prepare, then releases the content
+// previously referenced by the same path. Holding the lock keeps a concurrent release from
+// deleting the blob between its creation and the new reference being recorded.
+func (bs *BlobStore) register(ctx context.Context, meta infra.FileMetadata, prepare func() error) error {
+	previous, found, err := bs.metadata.GetFileByPath(ctx, meta.BucketName, meta.FilePath)
+	if err != nil {
+		return err
+	}
+
+	unlock, err := bs.lock(ctx, meta.BucketName, meta.FileHash)
+	if err != nil {
+		return err
+	}
+	if prepare != nil {
+		err = prepare()
+	}
+	if err == nil {
+		err = bs.metadata.AddFileMetadata(ctx, meta)
+	}
+	unlock()
+	if err != nil {
+		return err
+	}
+
+	if found && previous.ObjectKey() != meta.ObjectKey() {
+		if _, err := bs.release(ctx, previous); err != nil {
+			return fmt.Errorf("failed to release previous content: %w", err)
+		}
+	}
+	return nil
+}
+
+// RemoveReference removes the reference stored at a path and deletes its content once nothing
+// references it anymore. It reports whether a reference existed and whether content was deleted.
+func (bs *BlobStore) RemoveReference(ctx context.Context, bucket, filePath string) (bool, bool, error) {
+	meta, found, err := bs.metadata.GetFileByPath(ctx, bucket, filePath)
+	if err != nil || !found {
+		return false, false, err
+	}
+
+	if err := bs.metadata.RemoveFileMetadata(ctx, bucket, filePath); err != nil {
+		return true, false, err
+	}
+
+	deleted, err := bs.release(ctx, meta)
+	return true, deleted, err
+}
+
+// ensureBlob reports whether the blob exists. Content stored before blobs were introduced is
+// copied server-side from its legacy path. Must be called with the hash lock held.
+func (bs *BlobStore) ensureBlob(ctx context.Context, meta infra.FileMetadata, objectMetadata map[string]string) (bool, error) {
+	exists, err := bs.minio.ObjectExists(ctx, meta.BucketName, meta.BlobKey)
+	if err != nil {
+		return false, err
+	}
+	if exists {
+		return true, nil
+	}
+
+	existingPath, found, err := bs.metadata.CheckFileByHash(ctx, meta.BucketName, meta.FileHash)
+	if err != nil {
+		return false, err
+	}
+	if found {
+		existing, ok, err := bs.metadata.GetFileByPath(ctx, meta.BucketName, existingPath)
+		if err == nil && ok && existing.FileHash == meta.FileHash {
+			if err := bs.minio.CopyObjectWithMetadata(ctx, meta.BucketName, existing.ObjectKey(), meta.BucketName, meta.BlobKey, meta.FileSize, meta.ContentType, objectMetadata); err == nil {
+				return true, nil
+			}
+			// The source is gone or unreadable, the content has to be uploaded
+		}
+	}
+	return false, nil
+}
+
+// release deletes the content of a removed reference, its image variants and its cached
+// derivatives, when nothing references it anymore.
+// Legacy entries own the object stored at their path, so it is deleted directly.
+func (bs *BlobStore) release(ctx context.Context, meta infra.FileMetadata) (bool, error) {
+	if meta.BlobKey == "" {
+		if err := bs.minio.DeleteObjectFromBucket(ctx, meta.BucketName, meta.FilePath); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+
+	unlock, err := bs.lock(ctx, meta.BucketName, meta.FileHash)
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	// A prepared reference, on this instance or another, is about to be recorded
+	if bs.pinned(meta.BucketName, meta.FileHash) {
+		return false, nil
+	}
+	pinned, err := bs.claims.Pinned(ctx, blobPinKey(meta.BucketName, meta.FileHash))
+	if err != nil || pinned {
+		return false, err
+	}
+
+	references, err := bs.metadata.CountReferences(ctx, meta.BucketName, meta.FileHash)
+	if err != nil {
+		return false, err
+	}
+	if references > 0 {
+		return false, nil
+	}
+
+	if err := bs.minio.DeleteObjectFromBucket(ctx, meta.BucketName, meta.BlobKey); err != nil {
+		return false, err
+	}
+	if err := bs.deleteVariants(ctx, meta.BucketName, meta.FileHash); err != nil {
+		return true, fmt.Errorf("failed to delete image variants: %w", err)
+	}
+	if err := bs.deleteDerivatives(ctx, meta.FileHash); err != nil {
+		return true, fmt.Errorf("failed to delete image derivatives: %w", err)
+	}
+	return true, nil
+}
+
+func (bs *BlobStore) pin(bucket, hash string, delta int) {
+	bs.pinMu.Lock()
+	defer bs.pinMu.Unlock()
+
+	key := bucket + "\x00" + hash
+	bs.pins[key] += delta
+	if bs.pins[key] <= 0 {
+		delete(bs.pins, key)
+	}
+}
+
+// unpin drops the pins of a prepared reference once
+func (bs *BlobStore) unpin(ref *PendingReference) {
+	if ref.pinned {
+		ref.pinned = false
+		bs.pin(ref.Meta.BucketName, ref.Meta.FileHash, -1)
+		ref.pin.Release(context.Background())
+	}
+}
+
+func (bs *BlobStore) pinned(bucket, hash string) bool {
+	bs.pinMu.Lock()
+	defer bs.pinMu.Unlock()
+	return bs.pins[bucket+"\x00"+hash] > 0
+}
+
+// lock serializes blob creation and deletion of one hash, within this process first and then
+// across instances. It returns the function releasing both locks.
+func (bs *BlobStore) lock(ctx context.Context, bucket, hash string) (func(), error) {
+	local := bs.lockFor(bucket, hash)
+	local.Lock()
+
+	shared, err := bs.claims.Lock(ctx, "blob\x00"+bucket+"\x00"+hash)
+	if err != nil {
+		local.Unlock()
+		return nil, fmt.Errorf("failed to lock blob: %w", err)
+	}
+	return func() {
+		shared.Release(ctx)
+		local.Unlock()
+	}, nil
+}
+
+// lockFor returns the mutex serializing blob creation and deletion of one hash within this process
+func (bs *BlobStore) lockFor(bucket, hash string) *sync.Mutex {
+	hasher := fnv.New32a()
+	hasher.Write([]byte(bucket + "\x00" + hash))
+	return &bs.locks[hasher.Sum32()%blobLockStripes]
+}
+
+// blobPinKey returns the prefix of the pins of a hash
+func blobPinKey(bucket, hash string) string {
+	return blobPinPrefix + bucket + "/" + hash + "/"
+}
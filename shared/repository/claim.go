@@ -0,0 +1,262 @@
+package repository
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/tnqbao/gau-upload-service/shared/infra"
+)
+
+const (
+	// claimPrefix holds one object per path being written by an upload that must not overwrite it
+	claimPrefix = "claims/"
+	// claimTTL is how long a claim protects its path without a refresh; older claims were left by a crashed instance
+	claimTTL = 2 * time.Minute
+	// claimRefreshInterval is how often a held claim is rewritten, well within claimTTL
+	claimRefreshInterval = claimTTL / 4
+
+	// lockPrefix holds one claim per lock taken with Lock
+	lockPrefix = "locks/"
+	// lockPollInterval is how often a held lock is retried
+	lockPollInterval = 100 * time.Millisecond
+)
+
+// PathClaim reserves a path for one upload until it is released. The claim object is refreshed
+// in the background while it is held, so uploads taking longer than claimTTL keep their path.
+type PathClaim struct {
+	store *ClaimStore
+	id    string
+	key   string
+	data  []byte
+
+	stop    chan struct{}
+	done    chan struct{}
+	release sync.Once
+}
+
+// ClaimStore serializes uploads that check a path before writing it. A claim is an object in the
+// pending bucket created with a conditional write, so two instances can't claim the same path.
+// The same objects back the locks and pins the blob store shares between instances.
+// Backends without conditional writes fall back to claims local to this process.
+type ClaimStore struct {
+	minio *infra.MinioClient
+
+	mu    sync.Mutex
+	local map[string]bool
+}
+
+func NewClaimStore(minio *infra.MinioClient) *ClaimStore {
+	return &ClaimStore{
+		minio: minio,
+		local: make(map[string]bool),
+	}
+}
+
+// claimState is the content of a claim object
+type claimState struct {
+	Bucket    string    `json:"bucket,omitempty"`
+	FilePath  string    `json:"file_path,omitempty"`
+	ClaimedAt time.Time `json:"claimed_at"`
+}
+
+// Claim reserves bucket/filePath. It returns nil, without error, when another upload holds it.
+func (cs *ClaimStore) Claim(ctx context.Context, bucket, filePath string) (*PathClaim, error) {
+	id := bucket + "\x00" + filePath
+	cs.mu.Lock()
+	if cs.local[id] {
+		cs.mu.Unlock()
+		return nil, nil
+	}
+	cs.local[id] = true
+	cs.mu.Unlock()
+
+	data, err := json.Marshal(claimState{Bucket: bucket, FilePath: filePath, ClaimedAt: time.Now()})
+	if err != nil {
+		cs.unlock(id)
+		return nil, fmt.Errorf("failed to encode claim: %w", err)
+	}
+	return cs.hold(ctx, id, claimKey(bucket, filePath), data)
+}
+
+// Lock takes the lock called name, waiting while another caller, in this process or another
+// instance, holds it. The lock is released with Release.
+func (cs *ClaimStore) Lock(ctx context.Context, name string) (*PathClaim, error) {
+	for {
+		claim, err := cs.claimAt(ctx, lockPrefix+hashedName(name))
+		if err != nil || claim != nil {
+			return claim, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(lockPollInterval):
+		}
+	}
+}
+
+// Pin creates a claim of its own under prefix, which Pinned reports until it is released or expires
+func (cs *ClaimStore) Pin(ctx context.Context, prefix string) (*PathClaim, error) {
+	claim, err := cs.claimAt(ctx, prefix+newUploadID())
+	if err == nil && claim == nil {
+		err = fmt.Errorf("failed to pin %s", prefix)
+	}
+	return claim, err
+}
+
+// Pinned reports whether a pin that hasn't expired exists under prefix
+func (cs *ClaimStore) Pinned(ctx context.Context, prefix string) (bool, error) {
+	objects, err := cs.minio.ListObjectsWithInfo(ctx, PendingBucket, prefix)
+	if err != nil {
+		if infra.IsNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	for _, object := range objects {
+		if time.Since(object.LastModified) < claimTTL {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// claimAt claims the object at key, returning nil when it is held
+func (cs *ClaimStore) claimAt(ctx context.Context, key string) (*PathClaim, error) {
+	cs.mu.Lock()
+	if cs.local[key] {
+		cs.mu.Unlock()
+		return nil, nil
+	}
+	cs.local[key] = true
+	cs.mu.Unlock()
+
+	data, err := json.Marshal(claimState{ClaimedAt: time.Now()})
+	if err != nil {
+		cs.unlock(key)
+		return nil, fmt.Errorf("failed to encode claim: %w", err)
+	}
+	return cs.hold(ctx, key, key, data)
+}
+
+// hold creates the claim object at key for the local claim id, which the caller has taken
+func (cs *ClaimStore) hold(ctx context.Context, id, key string, data []byte) (*PathClaim, error) {
+	claim := &PathClaim{store: cs, id: id, key: key, data: data}
+	etag, acquired, err := cs.acquire(ctx, claim.key, data)
+	if err != nil || !acquired {
+		cs.unlock(id)
+		return nil, err
+	}
+
+	// Without conditional writes there is no claim object to keep alive
+	if etag != "" {
+		claim.stop = make(chan struct{})
+		claim.done = make(chan struct{})
+		go claim.keepAlive(etag)
+	}
+	return claim, nil
+}
+
+// acquire creates the claim object, replacing it when it expired. It returns the ETag of the
+// claim object, empty when the backend has no conditional writes.
+func (cs *ClaimStore) acquire(ctx context.Context, key string, data []byte) (string, bool, error) {
+	if err := cs.minio.EnsureBucketByName(ctx, PendingBucket); err != nil {
+		return "", false, err
+	}
+
+	etag, err := cs.minio.PutObjectIfMatch(ctx, PendingBucket, key, data, "application/json", "")
+	switch {
+	case err == nil:
+		return etag, true, nil
+	case infra.IsNotImplemented(err):
+		// Only uploads of this process are serialized
+		return "", true, nil
+	case !infra.IsPreconditionFailed(err):
+		return "", false, err
+	}
+
+	existing, err := cs.minio.StatObject(ctx, PendingBucket, key)
+	if err != nil {
+		if infra.IsNotFound(err) {
+			// Released meanwhile; the caller will find the path taken or retry
+			return "", false, nil
+		}
+		return "", false, err
+	}
+	if time.Since(existing.LastModified) < claimTTL {
+		return "", false, nil
+	}
+
+	// Take over an expired claim, unless another upload just did
+	etag, err = cs.minio.PutObjectIfMatch(ctx, PendingBucket, key, data, "application/json", existing.ETag)
+	if err != nil {
+		if infra.IsPreconditionFailed(err) {
+			return "", false, nil
+		}
+		return "", false, err
+	}
+	return etag, true, nil
+}
+
+// keepAlive rewrites the claim object every claimRefreshInterval until the claim is released.
+// It stops when the object was taken over, which only happens after a missed refresh window.
+func (c *PathClaim) keepAlive(etag string) {
+	defer close(c.done)
+
+	ticker := time.NewTicker(claimRefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+			refreshed, err := c.store.minio.PutObjectIfMatch(context.Background(), PendingBucket, c.key, c.data, "application/json", etag)
+			if err != nil {
+				if infra.IsPreconditionFailed(err) {
+					return
+				}
+				// Transient failure: the claim stays valid until claimTTL after the last refresh
+				continue
+			}
+			etag = refreshed
+		}
+	}
+}
+
+// Release drops the claim. It is safe to call on a nil claim and more than once. The claim object is deleted even
+// when ctx was cancelled, so an aborted request doesn't hold the path until claimTTL.
+func (c *PathClaim) Release(ctx context.Context) {
+	if c == nil {
+		return
+	}
+	c.release.Do(func() {
+		if c.stop != nil {
+			close(c.stop)
+			<-c.done
+		}
+		_ = c.store.minio.DeleteObject(context.WithoutCancel(ctx), PendingBucket, c.key)
+		c.store.unlock(c.id)
+	})
+}
+
+func (cs *ClaimStore) unlock(id string) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	delete(cs.local, id)
+}
+
+// claimKey returns the claim object of a path; paths are hashed to keep keys short and flat
+func claimKey(bucket, filePath string) string {
+	return claimPrefix + hashedName(bucket+"\x00"+filePath)
+}
+
+func hashedName(name string) string {
+	sum := sha256.Sum256([]byte(name))
+	return hex.EncodeToString(sum[:])
+}
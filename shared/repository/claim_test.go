@@ -0,0 +1,104 @@
+package repository
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/tnqbao/gau-upload-service/shared/infra"
+	"github.com/tnqbao/gau-upload-service/shared/infra/s3test"
+)
+
+// newTestClaimStores returns the server and two claim stores sharing it, as two instances would
+func newTestClaimStores(t *testing.T) (*s3test.Server, *ClaimStore, *ClaimStore) {
+	t.Helper()
+	server, client := s3test.NewClient(t)
+	minio := &infra.MinioClient{Client: client}
+	return server, NewClaimStore(minio), NewClaimStore(minio)
+}
+
+func TestClaimStoreClaim(t *testing.T) {
+	ctx := context.Background()
+	expired := time.Now().Add(-claimTTL - time.Minute)
+
+	tests := []struct {
+		name string
+		// prepare runs after the first instance claimed the path
+		prepare   func(server *s3test.Server, first *PathClaim)
+		wantTaken bool // the second instance gets the path
+	}{
+		{"held", func(*s3test.Server, *PathClaim) {}, false},
+		{"released", func(_ *s3test.Server, first *PathClaim) { first.Release(ctx) }, true},
+		{"recently refreshed", func(server *s3test.Server, _ *PathClaim) {
+			server.SetModified(PendingBucket, claimKey("photos", "a.png"), time.Now().Add(-claimTTL/2))
+		}, false},
+		{"expired", func(server *s3test.Server, _ *PathClaim) {
+			server.SetModified(PendingBucket, claimKey("photos", "a.png"), expired)
+		}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, one, two := newTestClaimStores(t)
+
+			first, err := one.Claim(ctx, "photos", "a.png")
+			if err != nil || first == nil {
+				t.Fatalf("first claim = %v, %v", first, err)
+			}
+			defer first.Release(ctx)
+
+			// The instance holding the claim doesn't get it twice
+			if again, err := one.Claim(ctx, "photos", "a.png"); err != nil || again != nil {
+				t.Fatalf("same instance claimed the path again: %v, %v", again, err)
+			}
+
+			tt.prepare(server, first)
+			second, err := two.Claim(ctx, "photos", "a.png")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer second.Release(ctx)
+			if taken := second != nil; taken != tt.wantTaken {
+				t.Errorf("second instance got the path: %v, want %v", taken, tt.wantTaken)
+			}
+		})
+	}
+}
+
+func TestClaimStorePinned(t *testing.T) {
+	ctx := context.Background()
+	server, store, _ := newTestClaimStores(t)
+	prefix := "pins/photos/h1/"
+
+	pinned := func() bool {
+		t.Helper()
+		ok, err := store.Pinned(ctx, prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ok
+	}
+	if pinned() {
+		t.Fatal("pinned before any pin")
+	}
+
+	pin, err := store.Pin(ctx, prefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pinned() {
+		t.Error("pin not reported")
+	}
+
+	// A pin left by a crashed instance stops counting once it expired
+	for _, key := range server.Keys(PendingBucket, prefix) {
+		server.SetModified(PendingBucket, key, time.Now().Add(-claimTTL-time.Minute))
+	}
+	if pinned() {
+		t.Error("expired pin still reported")
+	}
+
+	pin.Release(ctx)
+	if keys := server.Keys(PendingBucket, prefix); len(keys) != 0 {
+		t.Errorf("pin objects %v left after release", keys)
+	}
+}
@@ -0,0 +1,138 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/tnqbao/gau-upload-service/shared/infra"
+)
+
+// Modes of on_conflict, applied when a non-hash upload targets a path that is already taken
+const (
+	ConflictOverwrite = "overwrite" // replace the existing file, the default
+	ConflictFail      = "fail"      // refuse the upload with the existing file
+	ConflictRename    = "rename"    // store under the first free "name (n).ext"
+	ConflictSkip      = "skip"      // keep the existing file and report it
+)
+
+// maxRenameAttempts bounds the suffixes tried by the rename mode
+const maxRenameAttempts = 100
+
+// ParseOnConflict reads an on_conflict value; empty keeps overwriting
+func ParseOnConflict(value string) (string, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	switch value {
+	case "":
+		return ConflictOverwrite, nil
+	case ConflictOverwrite, ConflictFail, ConflictRename, ConflictSkip:
+		return value, nil
+	}
+	return "", fmt.Errorf("on_conflict must be one of overwrite, fail, rename or skip")
+}
+
+// ExistingFile is what a path holds before an upload to it
+type ExistingFile struct {
+	Hash        string
+	Size        int64
+	ContentType string
+}
+
+// PathConflict is an upload refused by on_conflict=fail. Existing is nil when another upload
+// is writing the path at the same time.
+type PathConflict struct {
+	FilePath string
+	Existing *ExistingFile
+}
+
+func (e *PathConflict) Error() string {
+	return fmt.Sprintf("A file already exists at %s", e.FilePath)
+}
+
+// ClaimUploadPath applies an on_conflict mode to an upload of content hash to bucket/fullPath.
+// It returns the path to store the upload at and the claim reserving it until the reference is
+// committed. A path holding the same content is not a conflict. With on_conflict=skip, the file
+// kept at the path is returned instead of a claim; with on_conflict=fail, a *PathConflict error.
+// Paths are looked up in metadata, which may be nil, then in storage.
+func (cs *ClaimStore) ClaimUploadPath(ctx context.Context, metadata infra.MetadataStore, bucket, fullPath, mode, hash string) (string, *PathClaim, *ExistingFile, error) {
+	attempts := 1
+	if mode == ConflictRename {
+		attempts = maxRenameAttempts
+	}
+
+	for attempt := 0; attempt < attempts; attempt++ {
+		candidate := fullPath
+		if attempt > 0 {
+			candidate = RenamedPath(fullPath, attempt)
+		}
+
+		// The claim keeps a concurrent upload from taking the path between the check and the commit
+		claim, err := cs.Claim(ctx, bucket, candidate)
+		if err != nil {
+			return "", nil, nil, fmt.Errorf("failed to claim path: %w", err)
+		}
+
+		var existing *ExistingFile
+		if claim != nil {
+			existing, err = cs.lookupExistingFile(ctx, metadata, bucket, candidate)
+			if err != nil {
+				claim.Release(ctx)
+				return "", nil, nil, err
+			}
+			if existing == nil || existing.Hash == hash {
+				return candidate, claim, nil, nil
+			}
+			claim.Release(ctx)
+		}
+
+		switch mode {
+		case ConflictFail:
+			return "", nil, nil, &PathConflict{FilePath: candidate, Existing: existing}
+		case ConflictSkip:
+			if existing == nil {
+				existing = &ExistingFile{}
+			}
+			return candidate, nil, existing, nil
+		}
+	}
+	return "", nil, nil, &PathConflict{FilePath: fullPath}
+}
+
+// lookupExistingFile returns the file stored at a path: its metadata entry, or an object stored
+// directly at the path. It returns nil when the path is free.
+func (cs *ClaimStore) lookupExistingFile(ctx context.Context, metadata infra.MetadataStore, bucket, filePath string) (*ExistingFile, error) {
+	if metadata != nil {
+		meta, found, err := metadata.GetFileByPath(ctx, bucket, filePath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to check file existence: %w", err)
+		}
+		if found {
+			return &ExistingFile{Hash: meta.FileHash, Size: meta.FileSize, ContentType: meta.ContentType}, nil
+		}
+	}
+
+	info, err := cs.minio.StatObject(ctx, bucket, filePath)
+	if err != nil {
+		if infra.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to check file existence: %w", err)
+	}
+	existing := &ExistingFile{Size: info.Size, ContentType: info.ContentType}
+	if _, objectMetadata, err := cs.minio.GetObjectMetadata(ctx, bucket, filePath); err == nil {
+		existing.Hash = objectMetadata["file-hash"]
+	}
+	return existing, nil
+}
+
+// RenamedPath returns filePath with " (n)" before its extension, e.g. docs/report (1).pdf
+func RenamedPath(filePath string, n int) string {
+	dir, name := path.Split(filePath)
+	ext := path.Ext(name)
+	if ext == name {
+		// Names such as ".env" have no extension
+		ext = ""
+	}
+	return fmt.Sprintf("%s%s (%d)%s", dir, strings.TrimSuffix(name, ext), n, ext)
+}
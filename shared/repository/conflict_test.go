@@ -0,0 +1,89 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/tnqbao/gau-upload-service/shared/infra"
+)
+
+func TestRenamedPath(t *testing.T) {
+	tests := []struct {
+		filePath string
+		n        int
+		want     string
+	}{
+		{"report.pdf", 1, "report (1).pdf"},
+		{"docs/report.pdf", 2, "docs/report (2).pdf"},
+		{"docs/archive.tar.gz", 1, "docs/archive.tar (1).gz"},
+		{"docs/README", 3, "docs/README (3)"},
+		{"config/.env", 1, "config/.env (1)"},
+		{"v1.2/notes", 1, "v1.2/notes (1)"},
+	}
+	for _, tt := range tests {
+		if got := RenamedPath(tt.filePath, tt.n); got != tt.want {
+			t.Errorf("RenamedPath(%q, %d) = %q, want %q", tt.filePath, tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestClaimUploadPath(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name         string
+		mode         string
+		hash         string
+		wantPath     string
+		wantClaim    bool
+		wantExisting bool
+		wantConflict bool
+	}{
+		{"same content is not a conflict", ConflictFail, "h1", "docs/a.png", true, false, false},
+		{"fail", ConflictFail, "h2", "", false, false, true},
+		{"skip", ConflictSkip, "h2", "docs/a.png", false, true, false},
+		{"rename past taken suffixes", ConflictRename, "h2", "docs/a (2).png", true, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, claims, _ := newTestClaimStores(t)
+			metadata, err := infra.NewBoltMetadataStore(filepath.Join(t.TempDir(), "metadata.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer metadata.Close()
+			err = metadata.AddFileMetadataBatch(ctx, []infra.FileMetadata{
+				{BucketName: "photos", FilePath: "docs/a.png", FileHash: "h1"},
+				{BucketName: "photos", FilePath: "docs/a (1).png", FileHash: "h3"},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			path, claim, existing, err := claims.ClaimUploadPath(ctx, metadata, "photos", "docs/a.png", tt.mode, tt.hash)
+			defer claim.Release(ctx)
+
+			var conflict *PathConflict
+			if errors.As(err, &conflict) != tt.wantConflict {
+				t.Fatalf("err = %v, want a conflict: %v", err, tt.wantConflict)
+			}
+			if conflict != nil && (conflict.Existing == nil || conflict.Existing.Hash != "h1") {
+				t.Errorf("conflict reports %+v, want the existing h1 file", conflict.Existing)
+			}
+			if !tt.wantConflict && err != nil {
+				t.Fatal(err)
+			}
+			if path != tt.wantPath {
+				t.Errorf("path = %q, want %q", path, tt.wantPath)
+			}
+			if (claim != nil) != tt.wantClaim {
+				t.Errorf("claim = %v, want one: %v", claim, tt.wantClaim)
+			}
+			if (existing != nil) != tt.wantExisting || (existing != nil && existing.Hash != "h1") {
+				t.Errorf("existing = %+v, want the h1 file: %v", existing, tt.wantExisting)
+			}
+		})
+	}
+}
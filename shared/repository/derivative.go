@@ -0,0 +1,72 @@
+package repository
+
+import (
+	"context"
+	"strings"
+
+	"github.com/tnqbao/gau-upload-service/shared/infra"
+)
+
+// DerivativesBucket caches transformed images. Derivatives are keyed by the hash of their source
+// content, so every path and bucket referencing the same image shares them.
+const DerivativesBucket = "derivatives"
+
+// DerivativeStore caches the results of image transforms
+type DerivativeStore struct {
+	minio *infra.MinioClient
+}
+
+func NewDerivativeStore(minio *infra.MinioClient) *DerivativeStore {
+	return &DerivativeStore{minio: minio}
+}
+
+// DerivativeKey returns the key of a derivative of a hash, named after its transform parameters,
+// e.g. ab/ab12.../w256_h0_contain_q85.jpg
+func DerivativeKey(hash, name string) string {
+	hash = strings.ToLower(hash)
+	if len(hash) < 2 {
+		return "_/" + hash + "/" + name
+	}
+	return hash[:2] + "/" + hash + "/" + name
+}
+
+// DerivativeFolder returns the folder holding every derivative of a hash
+func DerivativeFolder(hash string) string {
+	return DerivativeKey(hash, "")
+}
+
+// Get returns a cached derivative; found is false when it hasn't been generated yet
+func (ds *DerivativeStore) Get(ctx context.Context, key string) ([]byte, string, bool, error) {
+	data, contentType, err := ds.minio.GetObjectFromBucket(ctx, DerivativesBucket, key)
+	if err != nil {
+		if infra.IsNotFound(err) {
+			return nil, "", false, nil
+		}
+		return nil, "", false, err
+	}
+	return data, contentType, true, nil
+}
+
+// Put caches a derivative
+func (ds *DerivativeStore) Put(ctx context.Context, key string, data []byte, contentType, sourceHash string) error {
+	return ds.minio.PutObjectWithMetadata(ctx, DerivativesBucket, key, data, contentType, map[string]string{
+		"file-hash": sourceHash,
+	})
+}
+
+// deleteDerivatives removes every cached derivative of a hash
+func (bs *BlobStore) deleteDerivatives(ctx context.Context, hash string) error {
+	keys, err := bs.minio.ListObjectsFromBucket(ctx, DerivativesBucket, DerivativeFolder(hash))
+	if err != nil {
+		if infra.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	for _, key := range keys {
+		if err := bs.minio.DeleteObjectFromBucket(ctx, DerivativesBucket, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/tnqbao/gau-upload-service/shared/infra"
+)
+
+const (
+	// directPrefix holds one folder per direct upload: a session.json object and the uploaded data
+	directPrefix = "direct/"
+	// directFinalizeGrace is how long after its URL expired a direct upload can still be finalized,
+	// so a file uploaded just in time isn't lost
+	directFinalizeGrace = time.Hour
+)
+
+// ErrDirectUploadNotFound is returned for unknown or already finalized direct uploads
+var ErrDirectUploadNotFound = errors.New("direct upload not found")
+
+// DirectUpload is a file the client uploads straight to storage with a presigned URL. The data
+// lands in the pending bucket and is stored under its final path when the upload is finalized.
+type DirectUpload struct {
+	ID           string `json:"id"`
+	Key          string `json:"key"` // object key in the pending bucket
+	Bucket       string `json:"bucket"`
+	CustomPath   string `json:"path"`
+	IsHash       bool   `json:"is_hash"`
+	OriginalName string `json:"original_name"`
+	ContentType  string `json:"content_type"`
+	Size         int64  `json:"size"` // exact size signed into the URL
+	// Upload options applied when the upload is finalized
+	UserID        string    `json:"user_id,omitempty"`
+	OnConflict    string    `json:"on_conflict,omitempty"`
+	NameTemplate  string    `json:"name_template,omitempty"`
+	StripMetadata bool      `json:"strip_metadata,omitempty"`
+	CreatedAt     time.Time `json:"created_at"`
+	ExpiresAt     time.Time `json:"expires_at"`
+}
+
+// Expired reports whether the upload can't be finalized anymore; the sweeper deletes it then
+func (u *DirectUpload) Expired(now time.Time) bool {
+	return now.After(u.ExpiresAt.Add(directFinalizeGrace))
+}
+
+// DirectUploadStore persists direct upload sessions and presigns their upload URLs
+type DirectUploadStore struct {
+	minio *infra.MinioClient
+}
+
+func NewDirectUploadStore(minio *infra.MinioClient) *DirectUploadStore {
+	return &DirectUploadStore{minio: minio}
+}
+
+// Create records a direct upload and returns the presigned request the client must send
+func (ds *DirectUploadStore) Create(ctx context.Context, upload DirectUpload, expiry time.Duration) (*DirectUpload, *infra.PresignedRequest, error) {
+	if err := ds.minio.EnsureBucketByName(ctx, PendingBucket); err != nil {
+		return nil, nil, err
+	}
+
+	upload.ID = newUploadID()
+	upload.Key = directPrefix + upload.ID + "/data"
+	upload.CreatedAt = time.Now()
+	upload.ExpiresAt = upload.CreatedAt.Add(expiry)
+
+	data, err := json.Marshal(upload)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to encode direct upload: %w", err)
+	}
+	if err := ds.minio.PutObjectWithMetadata(ctx, PendingBucket, directSessionKey(upload.ID), data, "application/json", nil); err != nil {
+		return nil, nil, err
+	}
+
+	request, err := ds.minio.PresignPutObject(ctx, PendingBucket, upload.Key, upload.ContentType, upload.Size, expiry)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &upload, request, nil
+}
+
+// Get loads a direct upload
+func (ds *DirectUploadStore) Get(ctx context.Context, id string) (*DirectUpload, error) {
+	data, _, err := ds.minio.GetObjectFromBucket(ctx, PendingBucket, directSessionKey(id))
+	if err != nil {
+		if infra.IsNotFound(err) {
+			return nil, ErrDirectUploadNotFound
+		}
+		return nil, err
+	}
+
+	var upload DirectUpload
+	if err := json.Unmarshal(data, &upload); err != nil {
+		return nil, fmt.Errorf("failed to decode direct upload: %w", err)
+	}
+	return &upload, nil
+}
+
+// Stat describes the uploaded data; ErrDirectUploadNotFound means nothing was uploaded yet
+func (ds *DirectUploadStore) Stat(ctx context.Context, upload *DirectUpload) (infra.ObjectInfo, error) {
+	info, err := ds.minio.StatObject(ctx, PendingBucket, upload.Key)
+	if err != nil && infra.IsNotFound(err) {
+		return infra.ObjectInfo{}, ErrDirectUploadNotFound
+	}
+	return info, err
+}
+
+// Delete removes a direct upload and its uploaded data
+func (ds *DirectUploadStore) Delete(ctx context.Context, upload *DirectUpload) error {
+	if err := ds.minio.DeleteObject(ctx, PendingBucket, directSessionKey(upload.ID)); err != nil {
+		return err
+	}
+	return ds.minio.DeleteObject(ctx, PendingBucket, upload.Key)
+}
+
+func directSessionKey(id string) string {
+	return directPrefix + id + "/session.json"
+}
@@ -0,0 +1,65 @@
+package repository
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/tnqbao/gau-upload-service/shared/infra"
+)
+
+const (
+	// UploadExchange is the topic exchange shared with the consumer and cloud-orchestrator
+	UploadExchange = "upload.exchange"
+	// UploadCreatedRoutingKey is published when new content is referenced by a path
+	UploadCreatedRoutingKey = "upload.created"
+)
+
+// ErrEventsUnavailable is returned when the service runs without RabbitMQ
+var ErrEventsUnavailable = errors.New("event publishing is unavailable: RabbitMQ is not connected")
+
+// UploadVariant is an image variant the consumer generates for an upload
+type UploadVariant struct {
+	Key    string `json:"key"`
+	Size   int    `json:"size"`
+	Format string `json:"format"`
+}
+
+// UploadCreatedEvent announces a stored upload. Variants lists the image variants to generate
+// from the content at BlobKey, empty for anything but images.
+type UploadCreatedEvent struct {
+	Bucket      string          `json:"bucket"`
+	FilePath    string          `json:"file_path"`
+	FileHash    string          `json:"file_hash"`
+	BlobKey     string          `json:"blob_key"`
+	ContentType string          `json:"content_type"`
+	FileSize    int64           `json:"file_size"`
+	Variants    []UploadVariant `json:"variants,omitempty"`
+	Timestamp   int64           `json:"timestamp"`
+}
+
+// EventPublisher publishes upload events to the upload exchange
+type EventPublisher struct {
+	rabbit *infra.RabbitMQClient
+}
+
+func NewEventPublisher(rabbit *infra.RabbitMQClient) *EventPublisher {
+	return &EventPublisher{rabbit: rabbit}
+}
+
+// PublishUploadCreated publishes an upload.created event
+func (ep *EventPublisher) PublishUploadCreated(event UploadCreatedEvent) error {
+	if ep.rabbit == nil {
+		return ErrEventsUnavailable
+	}
+	if event.Timestamp == 0 {
+		event.Timestamp = time.Now().Unix()
+	}
+
+	body, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to marshal upload.created event: %w", err)
+	}
+	return ep.rabbit.PublishToExchange(UploadExchange, UploadCreatedRoutingKey, body)
+}
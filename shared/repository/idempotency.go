@@ -0,0 +1,137 @@
+package repository
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/tnqbao/gau-upload-service/shared/infra"
+)
+
+const (
+	// idempotencyPrefix holds one record per Idempotency-Key
+	idempotencyPrefix = "idempotency/"
+	// idempotencyLeaseTTL is how long an unfinished request keeps its key; older in-progress
+	// records were left by a crashed instance
+	idempotencyLeaseTTL = 10 * time.Minute
+	// maxIdempotencyBeginAttempts bounds the retries of a record released or taken over meanwhile
+	maxIdempotencyBeginAttempts = 10
+)
+
+// IdempotencyRecord is the state of a request made with an Idempotency-Key. Fingerprint
+// identifies the payload, and the response is set once the request completed.
+type IdempotencyRecord struct {
+	Fingerprint string    `json:"fingerprint"`
+	Completed   bool      `json:"completed"`
+	Status      int       `json:"status,omitempty"`
+	ContentType string    `json:"content_type,omitempty"`
+	Body        []byte    `json:"body,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+// IdempotencyStore keeps the first response of requests made with an Idempotency-Key in the
+// pending bucket. Records are created and completed with conditional writes, so concurrent
+// requests with the same key can't both run.
+type IdempotencyStore struct {
+	minio *infra.MinioClient
+	ttl   time.Duration
+}
+
+func NewIdempotencyStore(minio *infra.MinioClient, ttl time.Duration) *IdempotencyStore {
+	return &IdempotencyStore{minio: minio, ttl: ttl}
+}
+
+// Begin reserves key for a request with the given fingerprint and returns the ETag to complete
+// it with. When the key is already in use, it returns the live record instead and no ETag.
+func (s *IdempotencyStore) Begin(ctx context.Context, key, fingerprint string) (*IdempotencyRecord, string, error) {
+	if err := s.minio.EnsureBucketByName(ctx, PendingBucket); err != nil {
+		return nil, "", err
+	}
+
+	for attempt := 0; attempt < maxIdempotencyBeginAttempts; attempt++ {
+		now := time.Now()
+		record := &IdempotencyRecord{
+			Fingerprint: fingerprint,
+			CreatedAt:   now,
+			ExpiresAt:   now.Add(idempotencyLeaseTTL),
+		}
+		etag, err := s.save(ctx, key, record, "")
+		if err == nil {
+			return nil, etag, nil
+		}
+		if !infra.IsPreconditionFailed(err) {
+			return nil, "", err
+		}
+
+		data, existingETag, err := s.minio.GetObjectWithETag(ctx, PendingBucket, idempotencyKey(key))
+		if err != nil {
+			if infra.IsNotFound(err) {
+				// Released meanwhile, e.g. after a failure: try to take it again
+				continue
+			}
+			return nil, "", err
+		}
+		var existing IdempotencyRecord
+		if err := json.Unmarshal(data, &existing); err != nil {
+			return nil, "", fmt.Errorf("failed to decode idempotency record: %w", err)
+		}
+		if now.Before(existing.ExpiresAt) {
+			return &existing, "", nil
+		}
+
+		// The key expired: it starts over, unless another request just took it or it was
+		// released, in which case the record is read again
+		etag, err = s.save(ctx, key, record, existingETag)
+		if err == nil {
+			return nil, etag, nil
+		}
+		if !infra.IsPreconditionFailed(err) && !infra.IsNotFound(err) {
+			return nil, "", err
+		}
+	}
+	return nil, "", fmt.Errorf("idempotency record %s kept changing after %d attempts", idempotencyKey(key), maxIdempotencyBeginAttempts)
+}
+
+// Complete stores the response of the request that began with etag, kept for the store's TTL
+func (s *IdempotencyStore) Complete(ctx context.Context, key, etag string, status int, contentType string, body []byte) error {
+	data, _, err := s.minio.GetObjectWithETag(ctx, PendingBucket, idempotencyKey(key))
+	if err != nil {
+		return err
+	}
+	var record IdempotencyRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return fmt.Errorf("failed to decode idempotency record: %w", err)
+	}
+
+	record.Completed = true
+	record.Status = status
+	record.ContentType = contentType
+	record.Body = body
+	record.ExpiresAt = time.Now().Add(s.ttl)
+	_, err = s.save(ctx, key, &record, etag)
+	return err
+}
+
+// Release drops the reservation of a request that failed, so the key can be retried
+func (s *IdempotencyStore) Release(ctx context.Context, key string) error {
+	return s.minio.DeleteObject(ctx, PendingBucket, idempotencyKey(key))
+}
+
+// save writes a record if it still has the given ETag, or does not exist yet when empty
+func (s *IdempotencyStore) save(ctx context.Context, key string, record *IdempotencyRecord, etag string) (string, error) {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode idempotency record: %w", err)
+	}
+	return s.minio.PutObjectIfMatch(ctx, PendingBucket, idempotencyKey(key), data, "application/json", etag)
+}
+
+// idempotencyKey returns the record object of a key; keys are hashed since clients choose them
+func idempotencyKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return idempotencyPrefix + hex.EncodeToString(sum[:])
+}
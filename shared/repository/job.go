@@ -0,0 +1,107 @@
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/tnqbao/gau-upload-service/shared/infra"
+)
+
+// jobPrefix holds one record per background job
+const jobPrefix = "jobs/"
+
+// Job states
+const (
+	JobRunning   = "running"
+	JobCompleted = "completed"
+	JobFailed    = "failed"
+)
+
+// Job is the state of a maintenance task run in the background. Progress is updated while it
+// runs; Result is set once it completed, and Error once it failed.
+type Job struct {
+	ID         string          `json:"id"`
+	Kind       string          `json:"kind"`
+	Status     string          `json:"status"`
+	Progress   any             `json:"progress,omitempty"`
+	Result     json.RawMessage `json:"result,omitempty"`
+	Error      string          `json:"error,omitempty"`
+	StartedAt  time.Time       `json:"started_at"`
+	FinishedAt *time.Time      `json:"finished_at,omitempty"`
+}
+
+// JobStore keeps the state of background jobs in the pending bucket, so any instance can report
+// on a job started by another.
+type JobStore struct {
+	minio *infra.MinioClient
+}
+
+func NewJobStore(minio *infra.MinioClient) *JobStore {
+	return &JobStore{minio: minio}
+}
+
+// Start records a new running job of the given kind
+func (s *JobStore) Start(ctx context.Context, kind string) (*Job, error) {
+	job := &Job{
+		ID:        newUploadID(),
+		Kind:      kind,
+		Status:    JobRunning,
+		StartedAt: time.Now(),
+	}
+	return job, s.save(ctx, job)
+}
+
+// Get returns a job, or nil when it doesn't exist
+func (s *JobStore) Get(ctx context.Context, id string) (*Job, error) {
+	data, _, err := s.minio.GetObjectFromBucket(ctx, PendingBucket, jobKey(id))
+	if err != nil {
+		if infra.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var job Job
+	if err := json.Unmarshal(data, &job); err != nil {
+		return nil, fmt.Errorf("failed to decode job: %w", err)
+	}
+	return &job, nil
+}
+
+// Progress records how far a running job has gone
+func (s *JobStore) Progress(ctx context.Context, job *Job, progress any) error {
+	job.Progress = progress
+	return s.save(ctx, job)
+}
+
+// Finish records the result of a job, or its failure when err is set
+func (s *JobStore) Finish(ctx context.Context, job *Job, result any, err error) error {
+	now := time.Now()
+	job.FinishedAt = &now
+	job.Status = JobCompleted
+	if err != nil {
+		job.Status = JobFailed
+		job.Error = err.Error()
+	}
+	if result != nil {
+		data, marshalErr := json.Marshal(result)
+		if marshalErr != nil {
+			return fmt.Errorf("failed to encode job result: %w", marshalErr)
+		}
+		job.Result = data
+	}
+	return s.save(ctx, job)
+}
+
+func (s *JobStore) save(ctx context.Context, job *Job) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return fmt.Errorf("failed to encode job: %w", err)
+	}
+	return s.minio.PutObjectWithMetadata(ctx, PendingBucket, jobKey(job.ID), data, "application/json", nil)
+}
+
+func jobKey(id string) string {
+	return jobPrefix + id + ".json"
+}
@@ -1,12 +1,151 @@
 package repository
 
 import (
+	"context"
+	"time"
+
 	"github.com/tnqbao/gau-upload-service/shared/config"
+	"github.com/tnqbao/gau-upload-service/shared/infra"
 )
 
+// PendingBucket stages the data of resumable, multipart, direct and streamed uploads until they
+// complete, and holds path claims and idempotency records
+const PendingBucket = "pending"
+
 type Repository struct {
+	// Metadata is the file metadata store selected by METADATA_BACKEND
+	Metadata infra.MetadataStore
+
+	// Blobs stores content once per hash and tracks the paths referencing it
+	Blobs *BlobStore
+
+	// Tus keeps the state and staged data of resumable uploads
+	Tus *TusStore
+
+	// Multipart tracks S3 multipart upload sessions
+	Multipart *MultipartStore
+
+	// Direct tracks uploads sent straight to storage with presigned URLs
+	Direct *DirectUploadStore
+
+	// Streams stages uploads piped straight from the request without a local temp file
+	Streams *StreamStore
+
+	// Events publishes upload events for the consumer; publishing fails without RabbitMQ
+	Events *EventPublisher
+
+	// Derivatives caches images transformed on the fly by GetFile
+	Derivatives *DerivativeStore
+
+	// Claims reserves paths while uploads that must not overwrite them are stored
+	Claims *ClaimStore
+
+	// Idempotency keeps the first response of requests made with an Idempotency-Key
+	Idempotency *IdempotencyStore
+
+	// Usage counts the files and bytes stored per bucket and per user, updated by Metadata writes
+	Usage *UsageStore
+
+	// Jobs keeps the state of maintenance tasks run in the background
+	Jobs *JobStore
 }
 
-func NewRepository(config *config.Config) *Repository {
-	return &Repository{}
+func NewRepository(config *config.Config, inf *infra.Infra) *Repository {
+	store := newMetadataStore(config, inf)
+	usage := NewUsageStore(inf.MinioClient, store, inf.Logger)
+	// Every metadata write goes through the usage counters
+	metadata := newUsageTrackingStore(store, usage)
+	claims := NewClaimStore(inf.MinioClient)
+	return &Repository{
+		Metadata:    metadata,
+		Blobs:       NewBlobStore(inf.MinioClient, metadata, claims),
+		Tus:         NewTusStore(inf.MinioClient),
+		Multipart:   NewMultipartStore(inf.MinioClient),
+		Direct:      NewDirectUploadStore(inf.MinioClient),
+		Streams:     NewStreamStore(inf.MinioClient),
+		Events:      NewEventPublisher(inf.RabbitMQ),
+		Derivatives: NewDerivativeStore(inf.MinioClient),
+		Claims:      claims,
+		Idempotency: NewIdempotencyStore(inf.MinioClient, config.EnvConfig.Upload.IdempotencyTTL),
+		Usage:       usage,
+		Jobs:        NewJobStore(inf.MinioClient),
+	}
+}
+
+// NewConsumerMetadata returns the metadata store and usage counters of the consumer. Parquet
+// metadata lives in storage, shared with the HTTP service, so files the consumer composes are
+// recorded through the usage counters like HTTP uploads. The bolt database belongs to the HTTP
+// service: the store is nil, and composed files count once reconciliation backfills them.
+func NewConsumerMetadata(config *config.Config, inf *infra.Infra) (infra.MetadataStore, *UsageStore) {
+	if config.EnvConfig.Metadata.Backend != "parquet" {
+		return nil, NewUsageStore(inf.MinioClient, nil, inf.Logger)
+	}
+	usage := NewUsageStore(inf.MinioClient, inf.ParquetService, inf.Logger)
+	return newUsageTrackingStore(inf.ParquetService, usage), usage
+}
+
+// newMetadataStore picks the metadata backend configured in EnvConfig
+func newMetadataStore(config *config.Config, inf *infra.Infra) infra.MetadataStore {
+	switch config.EnvConfig.Metadata.Backend {
+	case "bolt":
+		holdBoltLease(inf)
+		store, err := infra.NewBoltMetadataStore(config.EnvConfig.Metadata.BoltPath)
+		if err != nil {
+			panic("Failed to open bolt metadata store: " + err.Error())
+		}
+		return store
+	case "parquet":
+		if !config.EnvConfig.Metadata.CacheEnabled {
+			return inf.ParquetService
+		}
+		return newMetadataCache(config, inf)
+	default:
+		panic("Unknown metadata backend: " + config.EnvConfig.Metadata.Backend)
+	}
+}
+
+// boltLeaseBucket and boltLeasePath name the claim held by the instance owning the bolt database
+const (
+	boltLeaseBucket = "metadata"
+	boltLeasePath   = "bolt"
+)
+
+// holdBoltLease claims the bolt backend for this process, which refreshes the claim until it exits.
+// The database lives on local disk, so a second replica would serve different metadata: startup
+// waits for the lease of a crashed predecessor to expire and panics while another instance holds it.
+func holdBoltLease(inf *infra.Infra) {
+	ctx := context.Background()
+	claims := NewClaimStore(inf.MinioClient)
+	deadline := time.Now().Add(claimTTL + claimRefreshInterval)
+	for {
+		claim, err := claims.Claim(ctx, boltLeaseBucket, boltLeasePath)
+		if err != nil {
+			panic("Failed to acquire the bolt metadata lease: " + err.Error())
+		}
+		if claim != nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			panic("The bolt metadata backend is single-replica only and another instance is running it")
+		}
+		time.Sleep(claimRefreshInterval)
+	}
+}
+
+// newMetadataCache warms the in-process index over Parquet and keeps it refreshed in the background
+// A failed warm-up is not fatal: lookups fall back to Parquet until a refresh succeeds
+func newMetadataCache(config *config.Config, inf *infra.Infra) *infra.MetadataCache {
+	cache := infra.NewMetadataCache(
+		inf.ParquetService,
+		inf.Logger,
+		config.EnvConfig.Metadata.CacheRefresh,
+		config.EnvConfig.Metadata.CacheMaxStaleness,
+	)
+
+	if err := cache.Refresh(context.Background()); err != nil {
+		inf.Logger.Error("[Metadata Cache] Warm-up failed, falling back to Parquet reads", err, nil)
+	}
+	cache.Start(context.Background())
+
+	return cache
 }
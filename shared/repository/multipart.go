@@ -0,0 +1,128 @@
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/tnqbao/gau-upload-service/shared/infra"
+)
+
+// multipartPrefix holds one folder per session: a session.json object and the key being assembled
+const multipartPrefix = "multipart/"
+
+// ErrMultipartNotFound is returned for unknown, completed or aborted sessions
+var ErrMultipartNotFound = errors.New("multipart session not found")
+
+// MultipartSession is an S3 multipart upload assembled in the pending bucket, with the upload
+// parameters to apply once it completes
+type MultipartSession struct {
+	ID           string `json:"id"`
+	UploadID     string `json:"upload_id"` // S3 multipart upload ID
+	Key          string `json:"key"`       // object key in the pending bucket
+	Bucket       string `json:"bucket"`
+	CustomPath   string `json:"path"`
+	IsHash       bool   `json:"is_hash"`
+	OriginalName string `json:"original_name"`
+	ContentType  string `json:"content_type"`
+	// Upload options applied when the session is completed
+	UserID        string    `json:"user_id,omitempty"`
+	OnConflict    string    `json:"on_conflict,omitempty"`
+	NameTemplate  string    `json:"name_template,omitempty"`
+	StripMetadata bool      `json:"strip_metadata,omitempty"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// MultipartStore persists multipart sessions. Parts are tracked by S3 itself, so a session never
+// changes after it is created.
+type MultipartStore struct {
+	minio *infra.MinioClient
+}
+
+func NewMultipartStore(minio *infra.MinioClient) *MultipartStore {
+	return &MultipartStore{minio: minio}
+}
+
+// Create starts the S3 multipart upload and records the session
+func (ms *MultipartStore) Create(ctx context.Context, session MultipartSession) (*MultipartSession, error) {
+	session.ID = newUploadID()
+	session.Key = multipartPrefix + session.ID + "/data"
+	session.CreatedAt = time.Now()
+
+	contentType := session.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	uploadID, err := ms.minio.CreateMultipartUpload(ctx, PendingBucket, session.Key, contentType)
+	if err != nil {
+		return nil, err
+	}
+	session.UploadID = uploadID
+
+	data, err := json.Marshal(session)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode multipart session: %w", err)
+	}
+	if err := ms.minio.PutObjectWithMetadata(ctx, PendingBucket, sessionKey(session.ID), data, "application/json", nil); err != nil {
+		_ = ms.minio.AbortMultipartUpload(ctx, PendingBucket, session.Key, uploadID)
+		return nil, err
+	}
+	return &session, nil
+}
+
+// Get loads a session
+func (ms *MultipartStore) Get(ctx context.Context, id string) (*MultipartSession, error) {
+	data, _, err := ms.minio.GetObjectFromBucket(ctx, PendingBucket, sessionKey(id))
+	if err != nil {
+		if infra.IsNotFound(err) {
+			return nil, ErrMultipartNotFound
+		}
+		return nil, err
+	}
+
+	var session MultipartSession
+	if err := json.Unmarshal(data, &session); err != nil {
+		return nil, fmt.Errorf("failed to decode multipart session: %w", err)
+	}
+	return &session, nil
+}
+
+// Parts lists the parts uploaded so far, in part number order
+func (ms *MultipartStore) Parts(ctx context.Context, session *MultipartSession) ([]infra.MultipartPart, error) {
+	parts, err := ms.minio.ListParts(ctx, PendingBucket, session.Key, session.UploadID)
+	if err != nil && infra.IsNotFound(err) {
+		return nil, ErrMultipartNotFound
+	}
+	return parts, err
+}
+
+// Assemble completes the S3 multipart upload; the assembled object is at session.Key
+func (ms *MultipartStore) Assemble(ctx context.Context, session *MultipartSession, parts []infra.MultipartPart) error {
+	err := ms.minio.CompleteMultipartUpload(ctx, PendingBucket, session.Key, session.UploadID, parts)
+	if err != nil && infra.IsNotFound(err) {
+		return ErrMultipartNotFound
+	}
+	return err
+}
+
+// Finish removes a completed session and its assembled object
+func (ms *MultipartStore) Finish(ctx context.Context, session *MultipartSession) error {
+	if err := ms.minio.DeleteObject(ctx, PendingBucket, sessionKey(session.ID)); err != nil {
+		return err
+	}
+	return ms.minio.DeleteObject(ctx, PendingBucket, session.Key)
+}
+
+// Abort discards the S3 multipart upload, its parts and the session
+func (ms *MultipartStore) Abort(ctx context.Context, session *MultipartSession) error {
+	if err := ms.minio.AbortMultipartUpload(ctx, PendingBucket, session.Key, session.UploadID); err != nil && !infra.IsNotFound(err) {
+		return err
+	}
+	return ms.minio.DeleteObject(ctx, PendingBucket, sessionKey(session.ID))
+}
+
+func sessionKey(id string) string {
+	return multipartPrefix + id + "/session.json"
+}
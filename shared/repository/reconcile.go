@@ -0,0 +1,311 @@
+package repository
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/tnqbao/gau-upload-service/shared/infra"
+)
+
+// reconcileProgressEvery controls how often progress is reported while scanning a bucket
+const reconcileProgressEvery = 100
+
+// reconcileSkippedBuckets hold service data rather than user files
+var reconcileSkippedBuckets = map[string]bool{
+	"metadata":        true,
+	"pending":         true,
+	DerivativesBucket: true,
+}
+
+// sha256Pattern matches a hex encoded SHA-256 digest
+var sha256Pattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// ReconcileOptions selects what the reconciler scans and whether it applies changes
+type ReconcileOptions struct {
+	// Bucket limits reconciliation to one bucket; empty means every user bucket
+	Bucket string
+	// DryRun only reports what would change
+	DryRun bool
+	// Progress, when set, is called periodically while a bucket is scanned
+	Progress func(progress ReconcileProgress)
+}
+
+// ReconcileProgress describes how far the scan of a bucket has gone
+type ReconcileProgress struct {
+	Bucket string `json:"bucket"`
+	Phase  string `json:"phase"` // "prune", "backfill" or "collect"
+	Done   int    `json:"done"`
+	Total  int    `json:"total"`
+}
+
+// ReconcileItem is a metadata entry pruned or backfilled by the reconciler, or a blob it collected
+type ReconcileItem struct {
+	Bucket   string `json:"bucket"`
+	FilePath string `json:"file_path"` // the blob key of a collected blob
+	FileHash string `json:"file_hash"`
+	Source   string `json:"source,omitempty"` // how the hash of a backfilled entry was obtained
+}
+
+// ReconcileReport summarizes a reconciliation run
+type ReconcileReport struct {
+	DryRun         bool            `json:"dry_run"`
+	Buckets        []string        `json:"buckets"`
+	ObjectsScanned int             `json:"objects_scanned"`
+	EntriesScanned int             `json:"entries_scanned"`
+	Pruned         []ReconcileItem `json:"pruned"`
+	Backfilled     []ReconcileItem `json:"backfilled"`
+	Collected      []ReconcileItem `json:"collected"`
+	Errors         []string        `json:"errors"`
+}
+
+// Reconciler brings the metadata store and stored objects back in sync in both directions:
+// entries whose object is gone are pruned, and objects without an entry are backfilled. Blobs no
+// entry references anymore, left by a crash between a metadata write and the release of the
+// content it replaced, are collected with their variants.
+type Reconciler struct {
+	minio    *infra.MinioClient
+	metadata infra.MetadataStore
+	blobs    *BlobStore
+}
+
+func NewReconciler(minio *infra.MinioClient, metadata infra.MetadataStore, blobs *BlobStore) *Reconciler {
+	return &Reconciler{
+		minio:    minio,
+		metadata: metadata,
+		blobs:    blobs,
+	}
+}
+
+// Reconcile scans the selected buckets. Failures on single entries or objects are collected in
+// the report instead of aborting the run; only listing failures are returned as errors.
+func (r *Reconciler) Reconcile(ctx context.Context, opts ReconcileOptions) (*ReconcileReport, error) {
+	buckets := []string{opts.Bucket}
+	if opts.Bucket == "" {
+		all, err := r.minio.ListBuckets(ctx)
+		if err != nil {
+			return nil, err
+		}
+		buckets = buckets[:0]
+		for _, bucket := range all {
+			if !reconcileSkippedBuckets[bucket] {
+				buckets = append(buckets, bucket)
+			}
+		}
+	}
+
+	report := &ReconcileReport{
+		DryRun:     opts.DryRun,
+		Buckets:    buckets,
+		Pruned:     []ReconcileItem{},
+		Backfilled: []ReconcileItem{},
+		Collected:  []ReconcileItem{},
+		Errors:     []string{},
+	}
+	for _, bucket := range buckets {
+		if err := r.reconcileBucket(ctx, bucket, opts, report); err != nil {
+			return report, fmt.Errorf("failed to reconcile bucket %s: %w", bucket, err)
+		}
+	}
+	return report, nil
+}
+
+// reconcileBucket prunes orphaned entries, backfills objects that have no entry, then collects
+// unreferenced blobs
+func (r *Reconciler) reconcileBucket(ctx context.Context, bucket string, opts ReconcileOptions, report *ReconcileReport) error {
+	objects, err := r.minio.ListObjectsWithInfo(ctx, bucket, "")
+	if err != nil {
+		return err
+	}
+	entries, err := r.metadata.ListFiles(ctx, bucket, "")
+	if err != nil {
+		return err
+	}
+	report.ObjectsScanned += len(objects)
+	report.EntriesScanned += len(entries)
+
+	stored := make(map[string]bool, len(objects))
+	for _, object := range objects {
+		stored[object.Key] = true
+	}
+
+	// Entries whose content is gone
+	referenced := make(map[string]bool, len(entries))
+	for i, entry := range entries {
+		r.progress(opts, bucket, "prune", i, len(entries))
+		if stored[entry.ObjectKey()] {
+			referenced[entry.FilePath] = true
+			continue
+		}
+
+		// The listing predates the entries, so the object may have been stored since
+		orphaned, err := r.orphaned(ctx, entry)
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("prune %s/%s: %v", bucket, entry.FilePath, err))
+			continue
+		}
+		if !orphaned {
+			referenced[entry.FilePath] = true
+			continue
+		}
+
+		report.Pruned = append(report.Pruned, ReconcileItem{Bucket: bucket, FilePath: entry.FilePath, FileHash: entry.FileHash})
+		if opts.DryRun {
+			continue
+		}
+		if err := r.metadata.RemoveFileMetadata(ctx, bucket, entry.FilePath); err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("prune %s/%s: %v", bucket, entry.FilePath, err))
+		}
+	}
+	r.progress(opts, bucket, "prune", len(entries), len(entries))
+
+	// Objects stored directly at a path without an entry
+	for i, object := range objects {
+		r.progress(opts, bucket, "backfill", i, len(objects))
+		if referenced[object.Key] || !isUserObject(object.Key) {
+			continue
+		}
+
+		meta, source, err := r.describeObject(ctx, bucket, object)
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("backfill %s/%s: %v", bucket, object.Key, err))
+			continue
+		}
+
+		report.Backfilled = append(report.Backfilled, ReconcileItem{Bucket: bucket, FilePath: meta.FilePath, FileHash: meta.FileHash, Source: source})
+		if opts.DryRun {
+			continue
+		}
+		if err := r.metadata.AddFileMetadata(ctx, meta); err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("backfill %s/%s: %v", bucket, object.Key, err))
+		}
+	}
+	r.progress(opts, bucket, "backfill", len(objects), len(objects))
+
+	// Blobs whose hash no entry of the listing references
+	hashes := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		hashes[strings.ToLower(entry.FileHash)] = true
+	}
+	var blobs []infra.ObjectInfo
+	for _, object := range objects {
+		if IsBlobKey(object.Key) && !hashes[path.Base(object.Key)] {
+			blobs = append(blobs, object)
+		}
+	}
+	for i, object := range blobs {
+		r.progress(opts, bucket, "collect", i, len(blobs))
+		hash := path.Base(object.Key)
+
+		collected, err := r.collectBlob(ctx, bucket, hash, opts.DryRun)
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("collect %s/%s: %v", bucket, object.Key, err))
+		}
+		if collected {
+			report.Collected = append(report.Collected, ReconcileItem{Bucket: bucket, FilePath: object.Key, FileHash: hash})
+		}
+	}
+	r.progress(opts, bucket, "collect", len(blobs), len(blobs))
+
+	return nil
+}
+
+// collectBlob deletes the blob of a hash, with its variants and derivatives, unless an entry
+// references it or a prepared upload pins it by now. A dry run only checks the references.
+func (r *Reconciler) collectBlob(ctx context.Context, bucket, hash string, dryRun bool) (bool, error) {
+	if dryRun {
+		references, err := r.metadata.CountReferences(ctx, bucket, hash)
+		return err == nil && references == 0, err
+	}
+	return r.blobs.release(ctx, infra.FileMetadata{BucketName: bucket, FileHash: hash, BlobKey: BlobKey(hash)})
+}
+
+// orphaned re-checks an entry missing from the object listing: it is orphaned only if it is still
+// the entry at its path and its object doesn't exist now
+func (r *Reconciler) orphaned(ctx context.Context, entry infra.FileMetadata) (bool, error) {
+	current, found, err := r.metadata.GetFileByPath(ctx, entry.BucketName, entry.FilePath)
+	if err != nil {
+		return false, err
+	}
+	if !found || current.ObjectKey() != entry.ObjectKey() {
+		return false, nil
+	}
+
+	exists, err := r.minio.ObjectExists(ctx, entry.BucketName, entry.ObjectKey())
+	if err != nil {
+		return false, err
+	}
+	return !exists, nil
+}
+
+// describeObject builds the entry of an object from its user metadata, re-hashing the content
+// when the object carries no usable file-hash
+func (r *Reconciler) describeObject(ctx context.Context, bucket string, object infra.ObjectInfo) (infra.FileMetadata, string, error) {
+	contentType, userMetadata, err := r.minio.GetObjectMetadata(ctx, bucket, object.Key)
+	if err != nil {
+		return infra.FileMetadata{}, "", err
+	}
+
+	hash := strings.ToLower(userMetadata["file-hash"])
+	source := "user-metadata"
+	if !sha256Pattern.MatchString(hash) {
+		hash, err = r.hashObject(ctx, bucket, object.Key)
+		if err != nil {
+			return infra.FileMetadata{}, "", err
+		}
+		source = "rehash"
+	}
+
+	originalName := userMetadata["original-name"]
+	if originalName == "" {
+		originalName = path.Base(object.Key)
+	}
+	if contentType == "" {
+		contentType = userMetadata["content-type"]
+	}
+
+	return infra.FileMetadata{
+		FileHash:     hash,
+		FilePath:     object.Key,
+		BucketName:   bucket,
+		OriginalName: originalName,
+		ContentType:  contentType,
+		FileSize:     object.Size,
+		UploadedAt:   object.LastModified,
+	}, source, nil
+}
+
+// hashObject streams an object through SHA-256
+func (r *Reconciler) hashObject(ctx context.Context, bucket, key string) (string, error) {
+	stream, _, err := r.minio.GetObjectStream(ctx, bucket, key)
+	if err != nil {
+		return "", err
+	}
+	defer stream.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, stream); err != nil {
+		return "", fmt.Errorf("failed to hash object: %w", err)
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+func (r *Reconciler) progress(opts ReconcileOptions, bucket, phase string, done, total int) {
+	if opts.Progress == nil || (done%reconcileProgressEvery != 0 && done != total) {
+		return
+	}
+	opts.Progress(ReconcileProgress{Bucket: bucket, Phase: phase, Done: done, Total: total})
+}
+
+// isUserObject excludes folder markers, blobs, image variants and temporary compose objects
+func isUserObject(key string) bool {
+	return !strings.HasSuffix(key, "/") &&
+		!IsBlobKey(key) &&
+		!IsVariantKey(key) &&
+		!strings.HasPrefix(key, "_temp_compose/")
+}
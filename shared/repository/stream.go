@@ -0,0 +1,41 @@
+package repository
+
+import (
+	"context"
+	"io"
+
+	"github.com/tnqbao/gau-upload-service/shared/infra"
+)
+
+// streamPrefix holds content piped straight from a request while it is hashed, before its
+// final bucket and blob key are known, and new content uploaded before its blob is created
+const streamPrefix = "stream/"
+
+// StreamStore stages streamed uploads in the pending bucket. A staged object only lives until
+// its upload is stored: it is copied server-side into the blob area or dropped as a duplicate.
+type StreamStore struct {
+	minio *infra.MinioClient
+}
+
+func NewStreamStore(minio *infra.MinioClient) *StreamStore {
+	return &StreamStore{minio: minio}
+}
+
+// Stage uploads content of unknown size to a new key in the pending bucket and returns that key
+func (ss *StreamStore) Stage(ctx context.Context, content io.Reader, contentType string) (string, error) {
+	key := streamPrefix + newUploadID()
+	if err := ss.minio.PutObjectStreamWithMetadata(ctx, PendingBucket, key, content, -1, contentType, nil); err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+// Replace overwrites the content of a staged object, e.g. once it has been sanitized
+func (ss *StreamStore) Replace(ctx context.Context, key string, content io.Reader, contentType string) error {
+	return ss.minio.PutObjectStreamWithMetadata(ctx, PendingBucket, key, content, -1, contentType, nil)
+}
+
+// Delete removes a staged object
+func (ss *StreamStore) Delete(ctx context.Context, key string) error {
+	return ss.minio.DeleteObject(ctx, PendingBucket, key)
+}
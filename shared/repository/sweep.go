@@ -0,0 +1,249 @@
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/tnqbao/gau-upload-service/shared/infra"
+)
+
+// jobRetention is how long job records are kept for GET /admin/metadata/reconcile/:id
+const jobRetention = 7 * 24 * time.Hour
+
+// SweepResult counts what a sweep deleted, per prefix of the pending bucket
+type SweepResult struct {
+	Deleted map[string]int `json:"deleted"`
+}
+
+// PendingSweeper deletes what abandoned uploads and crashed instances leave in the pending bucket:
+// uploads idle for longer than idleTTL, expired direct uploads and idempotency records, claims
+// past claimTTL and old job records. Objects still in use are never older than their TTL, so any
+// instance may sweep concurrently with uploads.
+type PendingSweeper struct {
+	minio   *infra.MinioClient
+	idleTTL time.Duration
+}
+
+func NewPendingSweeper(minio *infra.MinioClient, idleTTL time.Duration) *PendingSweeper {
+	return &PendingSweeper{minio: minio, idleTTL: idleTTL}
+}
+
+// Sweep runs every rule once. A failing rule doesn't stop the others; the first error is returned.
+func (s *PendingSweeper) Sweep(ctx context.Context) (SweepResult, error) {
+	result := SweepResult{Deleted: make(map[string]int)}
+	rules := []struct {
+		prefix string
+		sweep  func(context.Context, string) (int, error)
+	}{
+		{tusPrefix, s.sweepIdleFolders},
+		{multipartPrefix, s.sweepMultipart},
+		{directPrefix, s.sweepDirect},
+		{streamPrefix, s.sweepOlderThan(s.idleTTL)},
+		{idempotencyPrefix, s.sweepIdempotency},
+		{claimPrefix, s.sweepOlderThan(claimTTL)},
+		{lockPrefix, s.sweepOlderThan(claimTTL)},
+		{blobPinPrefix, s.sweepOlderThan(claimTTL)},
+		{jobPrefix, s.sweepOlderThan(jobRetention)},
+	}
+
+	var firstErr error
+	for _, rule := range rules {
+		deleted, err := rule.sweep(ctx, rule.prefix)
+		if deleted > 0 {
+			result.Deleted[rule.prefix] = deleted
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return result, firstErr
+}
+
+// sweepOlderThan deletes objects last written before ttl. Deletes are conditional on the listed
+// ETag, so an object rewritten meanwhile, such as a refreshed claim, is kept.
+func (s *PendingSweeper) sweepOlderThan(ttl time.Duration) func(context.Context, string) (int, error) {
+	return func(ctx context.Context, prefix string) (int, error) {
+		objects, err := s.list(ctx, prefix)
+		if err != nil {
+			return 0, err
+		}
+		deleted := 0
+		for _, object := range objects {
+			if time.Since(object.LastModified) < ttl {
+				continue
+			}
+			if s.deleteIfMatch(ctx, object) {
+				deleted++
+			}
+		}
+		return deleted, nil
+	}
+}
+
+// sweepIdleFolders deletes the upload folders, like tus/<id>/, none of whose objects was written
+// within idleTTL
+func (s *PendingSweeper) sweepIdleFolders(ctx context.Context, prefix string) (int, error) {
+	folders, err := s.listFolders(ctx, prefix)
+	if err != nil {
+		return 0, err
+	}
+	deleted := 0
+	for _, objects := range folders {
+		if !idleSince(objects, s.idleTTL) {
+			continue
+		}
+		deleted += s.deleteAll(ctx, objects)
+	}
+	return deleted, nil
+}
+
+// sweepMultipart aborts the S3 multipart upload of sessions idle for idleTTL, then deletes them.
+// Parts don't show in listings, so their own upload times count as activity too.
+func (s *PendingSweeper) sweepMultipart(ctx context.Context, prefix string) (int, error) {
+	folders, err := s.listFolders(ctx, prefix)
+	if err != nil {
+		return 0, err
+	}
+	deleted := 0
+	for id, objects := range folders {
+		if !idleSince(objects, s.idleTTL) {
+			continue
+		}
+
+		data, _, err := s.minio.GetObjectFromBucket(ctx, PendingBucket, sessionKey(id))
+		if err == nil {
+			var session MultipartSession
+			if json.Unmarshal(data, &session) == nil && session.UploadID != "" {
+				parts, err := s.minio.ListParts(ctx, PendingBucket, session.Key, session.UploadID)
+				if err != nil && !infra.IsNotFound(err) {
+					continue
+				}
+				active := false
+				for _, part := range parts {
+					active = active || time.Since(part.LastModified) < s.idleTTL
+				}
+				if active {
+					continue
+				}
+				if err := s.minio.AbortMultipartUpload(ctx, PendingBucket, session.Key, session.UploadID); err != nil && !infra.IsNotFound(err) {
+					continue
+				}
+			}
+		}
+		deleted += s.deleteAll(ctx, objects)
+	}
+	return deleted, nil
+}
+
+// sweepDirect deletes direct uploads that can't be finalized anymore, and data left without a session
+func (s *PendingSweeper) sweepDirect(ctx context.Context, prefix string) (int, error) {
+	folders, err := s.listFolders(ctx, prefix)
+	if err != nil {
+		return 0, err
+	}
+	deleted := 0
+	for id, objects := range folders {
+		data, _, err := s.minio.GetObjectFromBucket(ctx, PendingBucket, directSessionKey(id))
+		switch {
+		case err == nil:
+			var upload DirectUpload
+			if json.Unmarshal(data, &upload) != nil || !upload.Expired(time.Now()) {
+				continue
+			}
+		case infra.IsNotFound(err):
+			if !idleSince(objects, s.idleTTL) {
+				continue
+			}
+		default:
+			continue
+		}
+		deleted += s.deleteAll(ctx, objects)
+	}
+	return deleted, nil
+}
+
+// sweepIdempotency deletes idempotency records past their expiry. Records are rewritten when a
+// request completes, so only those older than the lease can have expired.
+func (s *PendingSweeper) sweepIdempotency(ctx context.Context, prefix string) (int, error) {
+	objects, err := s.list(ctx, prefix)
+	if err != nil {
+		return 0, err
+	}
+	deleted := 0
+	for _, object := range objects {
+		if time.Since(object.LastModified) < idempotencyLeaseTTL {
+			continue
+		}
+		data, etag, err := s.minio.GetObjectWithETag(ctx, PendingBucket, object.Key)
+		if err != nil {
+			continue
+		}
+		var record IdempotencyRecord
+		if json.Unmarshal(data, &record) == nil && time.Now().Before(record.ExpiresAt) {
+			continue
+		}
+		object.ETag = etag
+		if s.deleteIfMatch(ctx, object) {
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+func (s *PendingSweeper) list(ctx context.Context, prefix string) ([]infra.ObjectInfo, error) {
+	objects, err := s.minio.ListObjectsWithInfo(ctx, PendingBucket, prefix)
+	if err != nil && !infra.IsNotFound(err) {
+		return nil, err
+	}
+	return objects, nil
+}
+
+// listFolders groups the objects under prefix by the folder, an upload ID, they belong to
+func (s *PendingSweeper) listFolders(ctx context.Context, prefix string) (map[string][]infra.ObjectInfo, error) {
+	objects, err := s.list(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	folders := make(map[string][]infra.ObjectInfo)
+	for _, object := range objects {
+		id, _, found := strings.Cut(strings.TrimPrefix(object.Key, prefix), "/")
+		if !found || id == "" {
+			continue
+		}
+		folders[id] = append(folders[id], object)
+	}
+	return folders, nil
+}
+
+// deleteAll deletes a folder's objects and returns how many are gone
+func (s *PendingSweeper) deleteAll(ctx context.Context, objects []infra.ObjectInfo) int {
+	deleted := 0
+	for _, object := range objects {
+		if err := s.minio.DeleteObject(ctx, PendingBucket, object.Key); err == nil {
+			deleted++
+		}
+	}
+	return deleted
+}
+
+// deleteIfMatch deletes an object unless it changed since it was listed. Backends without
+// conditional deletes delete it anyway.
+func (s *PendingSweeper) deleteIfMatch(ctx context.Context, object infra.ObjectInfo) bool {
+	err := s.minio.DeleteObjectIfMatch(ctx, PendingBucket, object.Key, object.ETag)
+	if infra.IsNotImplemented(err) {
+		err = s.minio.DeleteObject(ctx, PendingBucket, object.Key)
+	}
+	return err == nil
+}
+
+// idleSince reports whether none of the objects was written within ttl
+func idleSince(objects []infra.ObjectInfo, ttl time.Duration) bool {
+	for _, object := range objects {
+		if time.Since(object.LastModified) < ttl {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,227 @@
+package repository
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/tnqbao/gau-upload-service/shared/infra"
+)
+
+// tusPrefix holds one folder per upload: an info.json state object and its data parts
+const tusPrefix = "tus/"
+
+var (
+	// ErrTusNotFound is returned for unknown or terminated uploads
+	ErrTusNotFound = errors.New("upload not found")
+	// ErrTusConflict is returned when another request changed the upload concurrently
+	ErrTusConflict = errors.New("upload was modified concurrently")
+)
+
+// TusUpload is the persisted state of a resumable upload
+type TusUpload struct {
+	ID          string            `json:"id"`
+	Length      int64             `json:"length"`
+	Offset      int64             `json:"offset"`
+	RawMetadata string            `json:"raw_metadata"` // Upload-Metadata header as sent by the client
+	Metadata    map[string]string `json:"metadata"`
+	Parts       []TusPart         `json:"parts"`
+	CreatedAt   time.Time         `json:"created_at"`
+	// Result is the upload response once the file has been stored
+	Result map[string]interface{} `json:"result,omitempty"`
+}
+
+// TusPart is a chunk of data received by one PATCH request
+type TusPart struct {
+	Key  string `json:"key"`
+	Size int64  `json:"size"`
+}
+
+// Completed reports whether every byte has been received
+func (u *TusUpload) Completed() bool {
+	return u.Offset >= u.Length
+}
+
+// TusStore persists resumable uploads in the pending bucket. The info.json object is the single
+// source of truth: parts are written under unique keys first and only count once info.json lists
+// them, and info.json is replaced with conditional writes so concurrent requests can't both win.
+type TusStore struct {
+	minio *infra.MinioClient
+}
+
+func NewTusStore(minio *infra.MinioClient) *TusStore {
+	return &TusStore{minio: minio}
+}
+
+// Create registers a new upload of length bytes and returns it with its ETag
+func (ts *TusStore) Create(ctx context.Context, length int64, rawMetadata string, metadata map[string]string) (*TusUpload, string, error) {
+	if err := ts.minio.EnsureBucketByName(ctx, PendingBucket); err != nil {
+		return nil, "", err
+	}
+
+	upload := &TusUpload{
+		ID:          newUploadID(),
+		Length:      length,
+		RawMetadata: rawMetadata,
+		Metadata:    metadata,
+		Parts:       []TusPart{},
+		CreatedAt:   time.Now(),
+	}
+	etag, err := ts.save(ctx, upload, "")
+	if err != nil {
+		return nil, "", err
+	}
+	return upload, etag, nil
+}
+
+// Get loads an upload and the ETag to pass back when saving it
+func (ts *TusStore) Get(ctx context.Context, id string) (*TusUpload, string, error) {
+	data, etag, err := ts.minio.GetObjectWithETag(ctx, PendingBucket, infoKey(id))
+	if err != nil {
+		if infra.IsNotFound(err) {
+			return nil, "", ErrTusNotFound
+		}
+		return nil, "", err
+	}
+
+	var upload TusUpload
+	if err := json.Unmarshal(data, &upload); err != nil {
+		return nil, "", fmt.Errorf("failed to decode upload state: %w", err)
+	}
+	return &upload, etag, nil
+}
+
+// AppendPart stores size bytes from content at the upload's current offset and advances it
+func (ts *TusStore) AppendPart(ctx context.Context, upload *TusUpload, etag string, content io.Reader, size int64) (string, error) {
+	key := fmt.Sprintf("%s%s/part-%020d-%s", tusPrefix, upload.ID, upload.Offset, newUploadID()[:8])
+	if err := ts.minio.PutObjectStreamWithMetadata(ctx, PendingBucket, key, content, size, "application/octet-stream", nil); err != nil {
+		return "", err
+	}
+
+	upload.Parts = append(upload.Parts, TusPart{Key: key, Size: size})
+	upload.Offset += size
+	newETag, err := ts.save(ctx, upload, etag)
+	if err != nil {
+		// The part is not referenced by the stored state, drop it
+		_ = ts.minio.DeleteObject(ctx, PendingBucket, key)
+		return "", err
+	}
+	return newETag, nil
+}
+
+// Complete records the result of a stored upload and drops its data parts
+func (ts *TusStore) Complete(ctx context.Context, upload *TusUpload, etag string, result map[string]interface{}) error {
+	parts := upload.Parts
+	upload.Result = result
+	upload.Parts = []TusPart{}
+	if _, err := ts.save(ctx, upload, etag); err != nil {
+		return err
+	}
+
+	for _, part := range parts {
+		_ = ts.minio.DeleteObject(ctx, PendingBucket, part.Key)
+	}
+	return nil
+}
+
+// Open returns the received data as one stream, reading parts in order
+func (ts *TusStore) Open(ctx context.Context, upload *TusUpload) io.ReadCloser {
+	return &partsReader{ctx: ctx, minio: ts.minio, parts: upload.Parts}
+}
+
+// Terminate deletes an upload and everything staged for it
+func (ts *TusStore) Terminate(ctx context.Context, id string) error {
+	objects, err := ts.minio.ListObjectsWithInfo(ctx, PendingBucket, tusPrefix+id+"/")
+	if err != nil {
+		return err
+	}
+	if len(objects) == 0 {
+		return ErrTusNotFound
+	}
+
+	// Delete the state first so the upload stops being resumable even if a part delete fails
+	if err := ts.minio.DeleteObject(ctx, PendingBucket, infoKey(id)); err != nil {
+		return err
+	}
+	for _, object := range objects {
+		if object.Key != infoKey(id) {
+			_ = ts.minio.DeleteObject(ctx, PendingBucket, object.Key)
+		}
+	}
+	return nil
+}
+
+// save writes the upload state if it still has the given ETag (or does not exist yet when empty)
+func (ts *TusStore) save(ctx context.Context, upload *TusUpload, etag string) (string, error) {
+	data, err := json.Marshal(upload)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode upload state: %w", err)
+	}
+
+	newETag, err := ts.minio.PutObjectIfMatch(ctx, PendingBucket, infoKey(upload.ID), data, "application/json", etag)
+	if err != nil {
+		if infra.IsPreconditionFailed(err) {
+			return "", ErrTusConflict
+		}
+		return "", err
+	}
+	return newETag, nil
+}
+
+func infoKey(id string) string {
+	return tusPrefix + id + "/info.json"
+}
+
+// newUploadID returns a random 128-bit hex identifier
+func newUploadID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// partsReader streams upload parts one after another, opening each only when reached
+type partsReader struct {
+	ctx     context.Context
+	minio   *infra.MinioClient
+	parts   []TusPart
+	current io.ReadCloser
+}
+
+func (r *partsReader) Read(p []byte) (int, error) {
+	for {
+		if r.current == nil {
+			if len(r.parts) == 0 {
+				return 0, io.EOF
+			}
+			stream, _, err := r.minio.GetObjectStream(r.ctx, PendingBucket, r.parts[0].Key)
+			if err != nil {
+				return 0, err
+			}
+			r.current = stream
+			r.parts = r.parts[1:]
+		}
+
+		n, err := r.current.Read(p)
+		if err == io.EOF {
+			r.current.Close()
+			r.current = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+func (r *partsReader) Close() error {
+	if r.current != nil {
+		return r.current.Close()
+	}
+	return nil
+}
@@ -0,0 +1,506 @@
+package repository
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/tnqbao/gau-upload-service/shared/config"
+	"github.com/tnqbao/gau-upload-service/shared/infra"
+)
+
+const (
+	// usageBucket keeps the usage counters next to the metadata they are derived from
+	usageBucket = "metadata"
+	// usagePrefix holds one counter object per bucket and per user
+	usagePrefix = "usage/"
+	// maxUsageUpdateAttempts bounds the retries of a counter changed concurrently
+	maxUsageUpdateAttempts = 10
+)
+
+// Scopes of usage counters and quotas
+const (
+	QuotaScopeBucket = "bucket"
+	QuotaScopeUser   = "user"
+)
+
+// Usage is what a bucket or a user stores: every metadata entry counts as a file of its size,
+// even when its content is shared with other paths
+type Usage struct {
+	Files int64 `json:"files"`
+	Bytes int64 `json:"bytes"`
+}
+
+// usageCounter identifies the counter of a bucket or a user
+type usageCounter struct {
+	scope string
+	name  string
+}
+
+// key returns the counter object; user ids are hashed since clients choose them
+func (c usageCounter) key() string {
+	if c.scope == QuotaScopeUser {
+		sum := sha256.Sum256([]byte(c.name))
+		return usagePrefix + "users/" + hex.EncodeToString(sum[:]) + ".json"
+	}
+	return usagePrefix + "buckets/" + c.name + ".json"
+}
+
+// usageRecord is the content of a counter object
+type usageRecord struct {
+	Scope     string    `json:"scope"`
+	Name      string    `json:"name"`
+	Files     int64     `json:"files"`
+	Bytes     int64     `json:"bytes"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// QuotaExceededError is a change that would take a bucket or a user over its quota
+type QuotaExceededError struct {
+	Scope     string // QuotaScopeBucket or QuotaScopeUser
+	Name      string
+	Limit     string // "files" or "bytes"
+	Max       int64
+	Used      int64
+	Requested int64
+}
+
+func (e *QuotaExceededError) Error() string {
+	return fmt.Sprintf("%s %s would exceed its quota of %d %s (%d used, %d requested)",
+		e.Scope, e.Name, e.Max, e.Limit, e.Used, e.Requested)
+}
+
+// UsageStore keeps what each bucket and user stores in counter objects updated with every
+// metadata write, so quotas are checked without listing files. Counters are updated with
+// conditional writes after the metadata entry is written; a crash in between leaves them off
+// until Recalculate runs.
+type UsageStore struct {
+	minio    *infra.MinioClient
+	metadata infra.MetadataStore // counts the files of buckets without a counter yet; they start empty when nil
+	logger   *infra.LoggerClient
+}
+
+func NewUsageStore(minio *infra.MinioClient, metadata infra.MetadataStore, logger *infra.LoggerClient) *UsageStore {
+	return &UsageStore{
+		minio:    minio,
+		metadata: metadata,
+		logger:   logger,
+	}
+}
+
+// Bucket returns what a bucket stores
+func (s *UsageStore) Bucket(ctx context.Context, bucket string) (Usage, error) {
+	return s.get(ctx, usageCounter{scope: QuotaScopeBucket, name: bucket})
+}
+
+// User returns what a user stores across buckets
+func (s *UsageStore) User(ctx context.Context, userID string) (Usage, error) {
+	return s.get(ctx, usageCounter{scope: QuotaScopeUser, name: userID})
+}
+
+// UsageChange is a metadata entry about to be written over the entry at its path, nil for a new path
+type UsageChange struct {
+	Previous *infra.FileMetadata
+	Next     infra.FileMetadata
+}
+
+// Check returns a *QuotaExceededError when writing the changes together would take a bucket or a
+// user they write to over its quota in policy. Limits the changes don't add to always pass.
+// Nothing is reserved: quotas are soft, and concurrent writers checked against the same counters
+// may together go over a limit.
+func (s *UsageStore) Check(ctx context.Context, policy *config.UploadPolicy, changes ...UsageChange) error {
+	deltas := make(map[usageCounter]Usage)
+	var counters []usageCounter
+	for _, change := range changes {
+		mergeUsageDeltas(deltas, change.Previous, -1)
+		mergeUsageDeltas(deltas, &change.Next, 1)
+		for _, counter := range countersOf(change.Next) {
+			if !slices.Contains(counters, counter) {
+				counters = append(counters, counter)
+			}
+		}
+	}
+
+	for _, counter := range counters {
+		var quota config.Quota
+		if counter.scope == QuotaScopeUser {
+			quota = policy.QuotaForUser(counter.name)
+		} else {
+			quota = policy.For(counter.name).Quota
+		}
+		delta := deltas[counter]
+		addsFiles := quota.MaxFiles > 0 && delta.Files > 0
+		addsBytes := quota.MaxBytes() > 0 && delta.Bytes > 0
+		if !addsFiles && !addsBytes {
+			continue
+		}
+
+		used, err := s.get(ctx, counter)
+		if err != nil {
+			return fmt.Errorf("failed to read %s usage: %w", counter.scope, err)
+		}
+		if addsFiles && used.Files+delta.Files > quota.MaxFiles {
+			return &QuotaExceededError{
+				Scope: counter.scope, Name: counter.name, Limit: "files",
+				Max: quota.MaxFiles, Used: used.Files, Requested: delta.Files,
+			}
+		}
+		if addsBytes && used.Bytes+delta.Bytes > quota.MaxBytes() {
+			return &QuotaExceededError{
+				Scope: counter.scope, Name: counter.name, Limit: "bytes",
+				Max: quota.MaxBytes(), Used: used.Bytes, Requested: delta.Bytes,
+			}
+		}
+	}
+	return nil
+}
+
+// UsageRecalculation summarizes a recount of the usage counters
+type UsageRecalculation struct {
+	Buckets map[string]Usage `json:"buckets"`
+	Users   int              `json:"users"`
+}
+
+// Recalculate recounts the counters of every user bucket and user from the metadata store,
+// fixing counters left off by failed updates. Writes landing during the recount may be missed
+// until the next one.
+func (s *UsageStore) Recalculate(ctx context.Context) (*UsageRecalculation, error) {
+	if s.metadata == nil {
+		return nil, fmt.Errorf("usage can't be recalculated without a metadata store")
+	}
+	buckets, err := s.minio.ListBuckets(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &UsageRecalculation{Buckets: make(map[string]Usage)}
+	users := make(map[string]Usage)
+	for _, bucket := range buckets {
+		if reconcileSkippedBuckets[bucket] {
+			continue
+		}
+		entries, err := s.metadata.ListFiles(ctx, bucket, "")
+		if err != nil {
+			return nil, fmt.Errorf("failed to list files of bucket %s: %w", bucket, err)
+		}
+		var total Usage
+		for _, entry := range entries {
+			total.add(entry, 1)
+			if entry.UserID != "" {
+				usage := users[entry.UserID]
+				usage.add(entry, 1)
+				users[entry.UserID] = usage
+			}
+		}
+		result.Buckets[bucket] = total
+	}
+
+	live := make(map[string]bool)
+	for bucket, usage := range result.Buckets {
+		counter := usageCounter{scope: QuotaScopeBucket, name: bucket}
+		if err := s.set(ctx, counter, usage); err != nil {
+			return nil, err
+		}
+		live[counter.key()] = true
+	}
+	for userID, usage := range users {
+		counter := usageCounter{scope: QuotaScopeUser, name: userID}
+		if err := s.set(ctx, counter, usage); err != nil {
+			return nil, err
+		}
+		live[counter.key()] = true
+	}
+	result.Users = len(users)
+
+	// Counters of deleted buckets and of users without files left; a missing counter is empty
+	objects, err := s.minio.ListObjectsWithInfo(ctx, usageBucket, usagePrefix)
+	if err != nil && !infra.IsNotFound(err) {
+		return nil, err
+	}
+	for _, object := range objects {
+		if !live[object.Key] && strings.HasSuffix(object.Key, ".json") {
+			if err := s.minio.DeleteObject(ctx, usageBucket, object.Key); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return result, nil
+}
+
+// get returns the usage of a counter. A missing bucket counter is counted from the metadata store
+// without being created; a missing user counter is empty, since older entries have no user.
+func (s *UsageStore) get(ctx context.Context, counter usageCounter) (Usage, error) {
+	record, _, err := s.read(ctx, counter)
+	if err == nil {
+		return Usage{Files: record.Files, Bytes: record.Bytes}, nil
+	}
+	if !infra.IsNotFound(err) {
+		return Usage{}, err
+	}
+	return s.initial(ctx, counter)
+}
+
+// initial returns the usage of a counter that does not exist yet
+func (s *UsageStore) initial(ctx context.Context, counter usageCounter) (Usage, error) {
+	var usage Usage
+	if counter.scope != QuotaScopeBucket || s.metadata == nil {
+		return usage, nil
+	}
+	entries, err := s.metadata.ListFiles(ctx, counter.name, "")
+	if err != nil {
+		return usage, fmt.Errorf("failed to count files of bucket %s: %w", counter.name, err)
+	}
+	for _, entry := range entries {
+		usage.add(entry, 1)
+	}
+	return usage, nil
+}
+
+// prime creates the counters of buckets that have none from their files, so the deltas of the
+// metadata write about to happen apply on top of them
+func (s *UsageStore) prime(ctx context.Context, buckets []string) error {
+	for _, bucket := range buckets {
+		counter := usageCounter{scope: QuotaScopeBucket, name: bucket}
+		_, _, err := s.read(ctx, counter)
+		if err == nil {
+			continue
+		}
+		if !infra.IsNotFound(err) {
+			return err
+		}
+
+		usage, err := s.initial(ctx, counter)
+		if err != nil {
+			return err
+		}
+		record := &usageRecord{Scope: counter.scope, Name: counter.name, Files: usage.Files, Bytes: usage.Bytes}
+		// Another instance creating it first counted the same files
+		if _, err := s.save(ctx, counter, record, ""); err != nil && !infra.IsPreconditionFailed(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// record applies the deltas of a metadata write that already happened. The write stands if the
+// counters can't be updated, so failures are only logged.
+func (s *UsageStore) record(ctx context.Context, deltas map[usageCounter]Usage) {
+	ctx = context.WithoutCancel(ctx)
+	for counter, delta := range deltas {
+		if delta == (Usage{}) {
+			continue
+		}
+		if err := s.update(ctx, counter, delta); err != nil {
+			s.logger.Warning("[Usage] Failed to update usage counter", map[string]interface{}{
+				"scope": counter.scope,
+				"name":  counter.name,
+				"error": err.Error(),
+			})
+		}
+	}
+}
+
+// update adds delta to a counter, retrying while other writers change it
+func (s *UsageStore) update(ctx context.Context, counter usageCounter, delta Usage) error {
+	for attempt := 0; attempt < maxUsageUpdateAttempts; attempt++ {
+		record, etag, err := s.read(ctx, counter)
+		if err != nil {
+			if !infra.IsNotFound(err) {
+				return err
+			}
+			record = &usageRecord{Scope: counter.scope, Name: counter.name}
+		}
+
+		// Removing entries counted before the counter existed must not go below zero
+		record.Files = max(record.Files+delta.Files, 0)
+		record.Bytes = max(record.Bytes+delta.Bytes, 0)
+		_, err = s.save(ctx, counter, record, etag)
+		if err == nil || !infra.IsPreconditionFailed(err) {
+			return err
+		}
+	}
+	return fmt.Errorf("usage counter %s kept changing after %d attempts", counter.key(), maxUsageUpdateAttempts)
+}
+
+// set overwrites a counter
+func (s *UsageStore) set(ctx context.Context, counter usageCounter, usage Usage) error {
+	data, err := json.Marshal(usageRecord{
+		Scope:     counter.scope,
+		Name:      counter.name,
+		Files:     usage.Files,
+		Bytes:     usage.Bytes,
+		UpdatedAt: time.Now(),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode usage counter: %w", err)
+	}
+	return s.minio.PutObjectWithMetadata(ctx, usageBucket, counter.key(), data, "application/json", nil)
+}
+
+// read returns a counter and its ETag
+func (s *UsageStore) read(ctx context.Context, counter usageCounter) (*usageRecord, string, error) {
+	data, etag, err := s.minio.GetObjectWithETag(ctx, usageBucket, counter.key())
+	if err != nil {
+		return nil, "", err
+	}
+	var record usageRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, "", fmt.Errorf("failed to decode usage counter: %w", err)
+	}
+	return &record, etag, nil
+}
+
+// save writes a counter if it still has the given ETag, or does not exist yet when empty.
+// Backends without conditional writes get a plain write.
+func (s *UsageStore) save(ctx context.Context, counter usageCounter, record *usageRecord, etag string) (string, error) {
+	record.UpdatedAt = time.Now()
+	data, err := json.Marshal(record)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode usage counter: %w", err)
+	}
+	if err := s.minio.EnsureBucketByName(ctx, usageBucket); err != nil {
+		return "", err
+	}
+
+	etag, err = s.minio.PutObjectIfMatch(ctx, usageBucket, counter.key(), data, "application/json", etag)
+	if infra.IsNotImplemented(err) {
+		return "", s.minio.PutObjectWithMetadata(ctx, usageBucket, counter.key(), data, "application/json", nil)
+	}
+	return etag, err
+}
+
+// add counts entry sign times
+func (u *Usage) add(entry infra.FileMetadata, sign int64) {
+	u.Files += sign
+	u.Bytes += sign * entry.FileSize
+}
+
+// countersOf returns the counters an entry counts in: its bucket, and its user if any
+func countersOf(entry infra.FileMetadata) []usageCounter {
+	counters := []usageCounter{{scope: QuotaScopeBucket, name: entry.BucketName}}
+	if entry.UserID != "" {
+		counters = append(counters, usageCounter{scope: QuotaScopeUser, name: entry.UserID})
+	}
+	return counters
+}
+
+// usageDeltas returns how counters change when previous is replaced by next; either may be nil
+// for an entry that is added or removed
+func usageDeltas(previous, next *infra.FileMetadata) map[usageCounter]Usage {
+	deltas := make(map[usageCounter]Usage)
+	mergeUsageDeltas(deltas, previous, -1)
+	mergeUsageDeltas(deltas, next, 1)
+	return deltas
+}
+
+func mergeUsageDeltas(deltas map[usageCounter]Usage, entry *infra.FileMetadata, sign int64) {
+	if entry == nil {
+		return
+	}
+	for _, counter := range countersOf(*entry) {
+		delta := deltas[counter]
+		delta.add(*entry, sign)
+		deltas[counter] = delta
+	}
+}
+
+// usageTrackingStore is a MetadataStore that updates the usage counters with every entry it
+// adds, replaces or removes
+type usageTrackingStore struct {
+	infra.MetadataStore
+	usage *UsageStore
+}
+
+func newUsageTrackingStore(store infra.MetadataStore, usage *UsageStore) *usageTrackingStore {
+	return &usageTrackingStore{MetadataStore: store, usage: usage}
+}
+
+func (ts *usageTrackingStore) AddFileMetadata(ctx context.Context, meta infra.FileMetadata) error {
+	deltas, err := ts.writeDeltas(ctx, []infra.FileMetadata{meta})
+	if err != nil {
+		return err
+	}
+	if err := ts.MetadataStore.AddFileMetadata(ctx, meta); err != nil {
+		return err
+	}
+	ts.usage.record(ctx, deltas)
+	return nil
+}
+
+func (ts *usageTrackingStore) AddFileMetadataBatch(ctx context.Context, metas []infra.FileMetadata) error {
+	deltas, err := ts.writeDeltas(ctx, metas)
+	if err != nil {
+		return err
+	}
+	if err := ts.MetadataStore.AddFileMetadataBatch(ctx, metas); err != nil {
+		return err
+	}
+	ts.usage.record(ctx, deltas)
+	return nil
+}
+
+func (ts *usageTrackingStore) RemoveFileMetadata(ctx context.Context, bucket, filePath string) error {
+	previous, found, err := ts.MetadataStore.GetFileByPath(ctx, bucket, filePath)
+	if err != nil {
+		return err
+	}
+	if found {
+		ts.prime(ctx, []string{bucket})
+	}
+	if err := ts.MetadataStore.RemoveFileMetadata(ctx, bucket, filePath); err != nil {
+		return err
+	}
+	if found {
+		ts.usage.record(ctx, usageDeltas(&previous, nil))
+	}
+	return nil
+}
+
+// writeDeltas returns how counters change once metas are written, each replacing the entry at
+// its path, and primes the counters of their buckets
+func (ts *usageTrackingStore) writeDeltas(ctx context.Context, metas []infra.FileMetadata) (map[usageCounter]Usage, error) {
+	deltas := make(map[usageCounter]Usage)
+	written := make(map[string]*infra.FileMetadata)
+	primed := make(map[string]bool)
+	var buckets []string
+
+	for i := range metas {
+		next := &metas[i]
+		id := next.BucketName + "\x00" + next.FilePath
+		previous, seen := written[id]
+		if !seen {
+			entry, found, err := ts.MetadataStore.GetFileByPath(ctx, next.BucketName, next.FilePath)
+			if err != nil {
+				return nil, err
+			}
+			if found {
+				previous = &entry
+			}
+		}
+		if !primed[next.BucketName] {
+			primed[next.BucketName] = true
+			buckets = append(buckets, next.BucketName)
+		}
+		mergeUsageDeltas(deltas, previous, -1)
+		mergeUsageDeltas(deltas, next, 1)
+		written[id] = next
+	}
+
+	ts.prime(ctx, buckets)
+	return deltas, nil
+}
+
+// prime creates missing bucket counters before a write; the write goes on if it fails
+func (ts *usageTrackingStore) prime(ctx context.Context, buckets []string) {
+	if err := ts.usage.prime(ctx, buckets); err != nil {
+		ts.usage.logger.Warning("[Usage] Failed to create usage counters", map[string]interface{}{
+			"buckets": buckets,
+			"error":   err.Error(),
+		})
+	}
+}
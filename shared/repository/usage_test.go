@@ -0,0 +1,146 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"testing"
+
+	"github.com/tnqbao/gau-upload-service/shared/config"
+	"github.com/tnqbao/gau-upload-service/shared/infra"
+	"github.com/tnqbao/gau-upload-service/shared/infra/s3test"
+	"go.opentelemetry.io/otel/metric/noop"
+)
+
+const mb = 1024 * 1024
+
+func testEntry(bucket, filePath string, size int64, userID string) *infra.FileMetadata {
+	return &infra.FileMetadata{BucketName: bucket, FilePath: filePath, FileSize: size, UserID: userID}
+}
+
+func TestUsageDeltas(t *testing.T) {
+	photos := usageCounter{scope: QuotaScopeBucket, name: "photos"}
+	alice := usageCounter{scope: QuotaScopeUser, name: "alice"}
+	bob := usageCounter{scope: QuotaScopeUser, name: "bob"}
+
+	tests := []struct {
+		name     string
+		previous *infra.FileMetadata
+		next     *infra.FileMetadata
+		want     map[usageCounter]Usage
+	}{
+		{
+			name: "added",
+			next: testEntry("photos", "a.png", 10, "alice"),
+			want: map[usageCounter]Usage{photos: {1, 10}, alice: {1, 10}},
+		},
+		{
+			name:     "removed",
+			previous: testEntry("photos", "a.png", 10, ""),
+			want:     map[usageCounter]Usage{photos: {-1, -10}},
+		},
+		{
+			name:     "replaced by larger content",
+			previous: testEntry("photos", "a.png", 10, "alice"),
+			next:     testEntry("photos", "a.png", 25, "alice"),
+			want:     map[usageCounter]Usage{photos: {0, 15}, alice: {0, 15}},
+		},
+		{
+			name:     "replaced for another user",
+			previous: testEntry("photos", "a.png", 10, "alice"),
+			next:     testEntry("photos", "a.png", 10, "bob"),
+			want:     map[usageCounter]Usage{photos: {0, 0}, alice: {-1, -10}, bob: {1, 10}},
+		},
+	}
+	for _, tt := range tests {
+		got := usageDeltas(tt.previous, tt.next)
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: deltas %v, want %v", tt.name, got, tt.want)
+			continue
+		}
+		for counter, want := range tt.want {
+			if got[counter] != want {
+				t.Errorf("%s: %s %s changes by %+v, want %+v", tt.name, counter.scope, counter.name, got[counter], want)
+			}
+		}
+	}
+}
+
+func TestUsageStoreCheck(t *testing.T) {
+	ctx := context.Background()
+	server, client := s3test.NewClient(t)
+	logger := &infra.LoggerClient{Logger: slog.Default(), Meter: noop.NewMeterProvider().Meter("test")}
+	store := NewUsageStore(&infra.MinioClient{Client: client}, nil, logger)
+
+	// Creates the bucket the counters are written to
+	server.Put(usageBucket, "placeholder", nil)
+	counters := map[usageCounter]Usage{
+		{scope: QuotaScopeBucket, name: "photos"}: {Files: 2, Bytes: 2 * mb},
+		{scope: QuotaScopeUser, name: "alice"}:    {Files: 1, Bytes: mb},
+	}
+	for counter, usage := range counters {
+		if err := store.set(ctx, counter, usage); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	policy := &config.UploadPolicy{
+		Buckets:   map[string]config.BucketPolicy{"photos": {Quota: config.Quota{MaxFiles: 3, MaxMB: 3}}},
+		UserQuota: config.Quota{MaxFiles: 1},
+	}
+
+	tests := []struct {
+		name      string
+		changes   []UsageChange
+		wantLimit string // "" when the changes fit
+		wantScope string
+	}{
+		{
+			name:    "fits",
+			changes: []UsageChange{{Next: *testEntry("photos", "c.png", mb/2, "")}},
+		},
+		{
+			name:      "too large",
+			changes:   []UsageChange{{Next: *testEntry("photos", "c.png", 2*mb, "")}},
+			wantLimit: "bytes", wantScope: QuotaScopeBucket,
+		},
+		{
+			name: "too many files together",
+			changes: []UsageChange{
+				{Next: *testEntry("photos", "c.png", 1, "")},
+				{Next: *testEntry("photos", "d.png", 1, "")},
+			},
+			wantLimit: "files", wantScope: QuotaScopeBucket,
+		},
+		{
+			name:    "replacement adds no file",
+			changes: []UsageChange{{Previous: testEntry("photos", "a.png", mb, ""), Next: *testEntry("photos", "a.png", 2*mb, "")}},
+		},
+		{
+			name:      "user quota",
+			changes:   []UsageChange{{Next: *testEntry("photos", "c.png", 1, "alice")}},
+			wantLimit: "files", wantScope: QuotaScopeUser,
+		},
+		{
+			name:    "moved to a user with room",
+			changes: []UsageChange{{Previous: testEntry("photos", "a.png", mb, "alice"), Next: *testEntry("photos", "a.png", mb, "bob")}},
+		},
+		{
+			name:    "bucket without quota",
+			changes: []UsageChange{{Next: *testEntry("docs", "c.pdf", 100*mb, "")}},
+		},
+	}
+	for _, tt := range tests {
+		err := store.Check(ctx, policy, tt.changes...)
+		var exceeded *QuotaExceededError
+		if !errors.As(err, &exceeded) {
+			if err != nil || tt.wantLimit != "" {
+				t.Errorf("%s: err = %v, want %s quota exceeded: %v", tt.name, err, tt.wantScope, tt.wantLimit != "")
+			}
+			continue
+		}
+		if exceeded.Limit != tt.wantLimit || exceeded.Scope != tt.wantScope {
+			t.Errorf("%s: %v, want the %s %s limit", tt.name, exceeded, tt.wantScope, tt.wantLimit)
+		}
+	}
+}
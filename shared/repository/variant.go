@@ -0,0 +1,49 @@
+package repository
+
+import (
+	"context"
+	"strings"
+)
+
+// VariantPrefix is the key prefix of image variants inside each bucket. Variants belong to
+// content, like blobs, so every path referencing an image shares them.
+const VariantPrefix = "_variants/"
+
+// VariantFolder returns the folder holding the variants of a hash, e.g. _variants/ab/ab12.../
+func VariantFolder(hash string) string {
+	hash = strings.ToLower(hash)
+	if len(hash) < 2 {
+		return VariantPrefix + "_/" + hash + "/"
+	}
+	return VariantPrefix + hash[:2] + "/" + hash + "/"
+}
+
+// VariantKey returns the key of a named variant of a hash, e.g. _variants/ab/ab12.../128.jpg
+func VariantKey(hash, name string) string {
+	return VariantFolder(hash) + name
+}
+
+// IsVariantKey reports whether an object key belongs to the variant area
+func IsVariantKey(key string) bool {
+	return strings.HasPrefix(key, VariantPrefix)
+}
+
+// IsReservedKey reports whether an object key belongs to the blob or variant areas, which hold
+// content shared by paths: clients can't store or delete files there
+func IsReservedKey(key string) bool {
+	return IsBlobKey(key) || IsVariantKey(key)
+}
+
+// deleteVariants removes every variant generated for a hash
+func (bs *BlobStore) deleteVariants(ctx context.Context, bucket, hash string) error {
+	keys, err := bs.minio.ListObjectsFromBucket(ctx, bucket, VariantFolder(hash))
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := bs.minio.DeleteObjectFromBucket(ctx, bucket, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -6,9 +6,14 @@ import (
 	"strings"
 )
 
+// CheckFileType reports whether contentType is one of allowedTypes.
+// Wildcards are supported: "image/*" matches every image type and "*/*" matches any type.
 func CheckFileType(contentType string, allowedTypes []string) bool {
 	for _, t := range allowedTypes {
-		if t == contentType {
+		if t == contentType || t == "*/*" {
+			return true
+		}
+		if prefix, ok := strings.CutSuffix(t, "/*"); ok && strings.HasPrefix(contentType, prefix+"/") {
 			return true
 		}
 	}
@@ -33,13 +33,18 @@ func JSON401(c *gin.Context, err string) {
 	})
 }
 
-func JSON409(c *gin.Context, err string) {
-
-	c.JSON(409, gin.H{
+// JSON409 answers a conflict; details, such as the conflicting resource, are added to the body
+func JSON409(c *gin.Context, err string, details ...gin.H) {
+	body := gin.H{
 		"error":  err,
 		"status": 409,
-	})
-
+	}
+	for _, detail := range details {
+		for key, value := range detail {
+			body[key] = value
+		}
+	}
+	c.JSON(409, body)
 }
 
 func JSON404(c *gin.Context, err string) {
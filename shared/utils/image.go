@@ -0,0 +1,159 @@
+package utils
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+)
+
+// DefaultImageQuality is the JPEG quality used when none is requested
+const DefaultImageQuality = 85
+
+// IsResizableImage reports whether contentType is an image format that can be decoded and resized
+func IsResizableImage(contentType string) bool {
+	switch contentType {
+	case "image/jpeg", "image/png", "image/gif":
+		return true
+	}
+	return false
+}
+
+// FitSize returns the largest size with the aspect ratio of width x height that fits inside
+// maxWidth x maxHeight, without enlarging. A zero bound is unconstrained.
+func FitSize(width, height, maxWidth, maxHeight int) (int, int) {
+	scale := 1.0
+	if maxWidth > 0 && width > maxWidth {
+		scale = float64(maxWidth) / float64(width)
+	}
+	if maxHeight > 0 && height > maxHeight {
+		if s := float64(maxHeight) / float64(height); s < scale {
+			scale = s
+		}
+	}
+	return max(1, int(float64(width)*scale+0.5)), max(1, int(float64(height)*scale+0.5))
+}
+
+// ResizeImage scales src to width x height. Each target pixel averages the source pixels it
+// covers, which keeps thumbnails smooth without an external imaging library.
+func ResizeImage(src image.Image, width, height int) *image.RGBA {
+	bounds := src.Bounds()
+	source, ok := src.(*image.RGBA)
+	if !ok || bounds.Min != (image.Point{}) {
+		source = image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+		draw.Draw(source, source.Bounds(), src, bounds.Min, draw.Src)
+	}
+	srcWidth, srcHeight := source.Bounds().Dx(), source.Bounds().Dy()
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0 := y * srcHeight / height
+		y1 := max(y0+1, (y+1)*srcHeight/height)
+		for x := 0; x < width; x++ {
+			x0 := x * srcWidth / width
+			x1 := max(x0+1, (x+1)*srcWidth/width)
+
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				row := source.Pix[sy*source.Stride:]
+				for sx := x0; sx < x1; sx++ {
+					pixel := row[sx*4 : sx*4+4]
+					r += uint64(pixel[0])
+					g += uint64(pixel[1])
+					b += uint64(pixel[2])
+					a += uint64(pixel[3])
+					n++
+				}
+			}
+
+			offset := y*dst.Stride + x*4
+			dst.Pix[offset] = uint8(r / n)
+			dst.Pix[offset+1] = uint8(g / n)
+			dst.Pix[offset+2] = uint8(b / n)
+			dst.Pix[offset+3] = uint8(a / n)
+		}
+	}
+	return dst
+}
+
+// Fit modes of TransformImage
+const (
+	FitContain = "contain" // fit inside the box, keeping the aspect ratio
+	FitCover   = "cover"   // fill the box, keeping the aspect ratio and cropping the overflow
+	FitFill    = "fill"    // stretch to the box
+)
+
+// TransformImage resizes src to a width x height box using fit. A zero width or height is derived
+// from the aspect ratio, in which case every fit mode gives the same result. Images are never
+// enlarged by contain.
+func TransformImage(src image.Image, width, height int, fit string) image.Image {
+	srcWidth, srcHeight := src.Bounds().Dx(), src.Bounds().Dy()
+	if width == 0 || height == 0 {
+		fit = FitContain
+		if width == 0 {
+			width = max(1, srcWidth*height/srcHeight)
+		}
+		if height == 0 {
+			height = max(1, srcHeight*width/srcWidth)
+		}
+	}
+
+	switch fit {
+	case FitFill:
+		return ResizeImage(src, width, height)
+	case FitCover:
+		// Scale so the box is covered, then keep the centered part
+		scale := max(float64(width)/float64(srcWidth), float64(height)/float64(srcHeight))
+		scaledWidth := max(width, int(float64(srcWidth)*scale+0.5))
+		scaledHeight := max(height, int(float64(srcHeight)*scale+0.5))
+		scaled := ResizeImage(src, scaledWidth, scaledHeight)
+		left, top := (scaledWidth-width)/2, (scaledHeight-height)/2
+		return scaled.SubImage(image.Rect(left, top, left+width, top+height))
+	default:
+		fitWidth, fitHeight := FitSize(srcWidth, srcHeight, width, height)
+		return ResizeImage(src, fitWidth, fitHeight)
+	}
+}
+
+// EncodeImage writes img as jpeg, png or gif; quality only applies to JPEG
+func EncodeImage(w io.Writer, img image.Image, format string, quality int) error {
+	switch format {
+	case "jpeg", "jpg":
+		if quality < 1 || quality > 100 {
+			quality = DefaultImageQuality
+		}
+		return jpeg.Encode(w, flattenImage(img), &jpeg.Options{Quality: quality})
+	case "png":
+		return png.Encode(w, img)
+	case "gif":
+		return gif.Encode(w, img, nil)
+	default:
+		return fmt.Errorf("unsupported image format %q", format)
+	}
+}
+
+// ImageContentType returns the MIME type of an EncodeImage format
+func ImageContentType(format string) string {
+	switch format {
+	case "png":
+		return "image/png"
+	case "gif":
+		return "image/gif"
+	default:
+		return "image/jpeg"
+	}
+}
+
+// flattenImage draws img over a white background, since JPEG has no transparency
+func flattenImage(img image.Image) image.Image {
+	if opaque, ok := img.(interface{ Opaque() bool }); ok && opaque.Opaque() {
+		return img
+	}
+	flat := image.NewRGBA(img.Bounds())
+	draw.Draw(flat, flat.Bounds(), image.White, image.Point{}, draw.Src)
+	draw.Draw(flat, flat.Bounds(), img, img.Bounds().Min, draw.Over)
+	return flat
+}
@@ -0,0 +1,297 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+)
+
+// sanitizedJPEGQuality is used when a JPEG has to be re-encoded to apply its orientation
+const sanitizedJPEGQuality = 95
+
+var (
+	// ErrImageTooLarge is returned when an image has more pixels than allowed to be decoded
+	ErrImageTooLarge = errors.New("image is too large to decode")
+	// ErrMalformedImage is returned when the structure of a JPEG or PNG can't be followed, so
+	// metadata could be left in it
+	ErrMalformedImage = errors.New("malformed image")
+)
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// IsSanitizableImage reports whether content starting with head is a JPEG or a PNG, the formats
+// SanitizeImage cleans
+func IsSanitizableImage(head []byte) bool {
+	return bytes.HasPrefix(head, []byte{0xFF, 0xD8}) || bytes.HasPrefix(head, pngSignature)
+}
+
+// SanitizeImage removes EXIF, XMP, IPTC and text metadata from a JPEG or PNG, and applies the EXIF
+// orientation to the pixels so the image displays the same without it. Data after the end of the
+// image is dropped too. Images needing rotation are decoded, and rejected with ErrImageTooLarge
+// above maxPixels. Images whose structure can't be followed fail with ErrMalformedImage.
+// It returns the data unchanged, and false, for other formats or when there is nothing to remove.
+func SanitizeImage(data []byte, maxPixels int) ([]byte, bool, error) {
+	switch {
+	case bytes.HasPrefix(data, []byte{0xFF, 0xD8}):
+		return sanitizeJPEG(data, maxPixels)
+	case bytes.HasPrefix(data, pngSignature):
+		return sanitizePNG(data, maxPixels)
+	}
+	return data, false, nil
+}
+
+// sanitizeJPEG drops the APP1 (EXIF, XMP), APP13 (IPTC) and comment segments. Other segments,
+// such as ICC profiles (APP2), are kept since decoders need them.
+func sanitizeJPEG(data []byte, maxPixels int) ([]byte, bool, error) {
+	output := make([]byte, 0, len(data))
+	output = append(output, 0xFF, 0xD8)
+	var profile [][]byte // ICC profile segments, copied into a re-encoded image
+	orientation := 1
+	changed := false
+	ended := false
+
+	pos := 2
+	for pos < len(data) && !ended {
+		// Markers may be preceded by fill bytes
+		for pos+1 < len(data) && data[pos] == 0xFF && data[pos+1] == 0xFF {
+			pos++
+		}
+		if pos+2 > len(data) || data[pos] != 0xFF {
+			return nil, false, ErrMalformedImage
+		}
+		marker := data[pos+1]
+		if marker == 0xD9 || marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7) {
+			// Markers without a length
+			output = append(output, data[pos:pos+2]...)
+			pos += 2
+			ended = marker == 0xD9
+			continue
+		}
+		if pos+4 > len(data) {
+			return nil, false, ErrMalformedImage
+		}
+		end := pos + 2 + int(binary.BigEndian.Uint16(data[pos+2:pos+4]))
+		if end > len(data) || end < pos+4 {
+			return nil, false, ErrMalformedImage
+		}
+		payload := data[pos+4 : end]
+
+		switch marker {
+		case 0xDA:
+			// Start of scan: the entropy-coded data runs until the next marker, which may start
+			// another scan of a progressive JPEG
+			end = entropyCodedEnd(data, end)
+			output = append(output, data[pos:end]...)
+		case 0xE1:
+			if bytes.HasPrefix(payload, []byte("Exif\x00\x00")) {
+				orientation = exifOrientation(payload[6:])
+			}
+			changed = true
+		case 0xED, 0xFE:
+			changed = true
+		case 0xE2:
+			profile = append(profile, data[pos:end])
+			output = append(output, data[pos:end]...)
+		default:
+			output = append(output, data[pos:end]...)
+		}
+		pos = end
+	}
+	if !ended {
+		return nil, false, ErrMalformedImage
+	}
+	if pos < len(data) {
+		// Trailing data after the end of image may hide anything
+		changed = true
+	}
+
+	if orientation == 1 {
+		return output, changed, nil
+	}
+
+	img, err := decodeLimited(output, maxPixels)
+	if err != nil {
+		return nil, false, err
+	}
+	var encoded bytes.Buffer
+	if err := jpeg.Encode(&encoded, OrientImage(img, orientation), &jpeg.Options{Quality: sanitizedJPEGQuality}); err != nil {
+		return nil, false, err
+	}
+
+	// Keep the color profile of the original right after the start of image marker
+	reencoded := encoded.Bytes()
+	result := make([]byte, 0, len(reencoded))
+	result = append(result, reencoded[:2]...)
+	for _, segment := range profile {
+		result = append(result, segment...)
+	}
+	result = append(result, reencoded[2:]...)
+	return result, true, nil
+}
+
+// entropyCodedEnd returns where the entropy-coded data starting at pos ends: at the first marker
+// other than a stuffed 0xFF00 or a restart marker, or at the end of data
+func entropyCodedEnd(data []byte, pos int) int {
+	for ; pos+1 < len(data); pos++ {
+		if data[pos] != 0xFF {
+			continue
+		}
+		next := data[pos+1]
+		if next != 0x00 && next != 0xFF && (next < 0xD0 || next > 0xD7) {
+			return pos
+		}
+	}
+	return len(data)
+}
+
+// sanitizePNG drops the eXIf, text (tEXt, zTXt, iTXt, which also carries XMP) and tIME chunks,
+// and anything after the IEND chunk
+func sanitizePNG(data []byte, maxPixels int) ([]byte, bool, error) {
+	output := make([]byte, 0, len(data))
+	output = append(output, pngSignature...)
+	orientation := 1
+	changed := false
+	ended := false
+
+	pos := len(pngSignature)
+	for pos < len(data) && !ended {
+		if pos+12 > len(data) {
+			return nil, false, ErrMalformedImage
+		}
+		length := int(binary.BigEndian.Uint32(data[pos : pos+4]))
+		end := pos + 12 + length
+		if length < 0 || end > len(data) || end < pos {
+			return nil, false, ErrMalformedImage
+		}
+		chunkType := string(data[pos+4 : pos+8])
+
+		switch chunkType {
+		case "eXIf":
+			orientation = exifOrientation(data[pos+8 : pos+8+length])
+			changed = true
+		case "tEXt", "zTXt", "iTXt", "tIME":
+			changed = true
+		default:
+			output = append(output, data[pos:end]...)
+		}
+		pos = end
+		ended = chunkType == "IEND"
+	}
+	if !ended {
+		return nil, false, ErrMalformedImage
+	}
+	if pos < len(data) {
+		changed = true
+	}
+
+	if orientation == 1 {
+		return output, changed, nil
+	}
+
+	img, err := decodeLimited(output, maxPixels)
+	if err != nil {
+		return nil, false, err
+	}
+	var encoded bytes.Buffer
+	if err := png.Encode(&encoded, OrientImage(img, orientation)); err != nil {
+		return nil, false, err
+	}
+	return encoded.Bytes(), true, nil
+}
+
+// decodeLimited decodes data after checking its dimensions against maxPixels
+func decodeLimited(data []byte, maxPixels int) (image.Image, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if config.Width*config.Height > maxPixels {
+		return nil, ErrImageTooLarge
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	return img, err
+}
+
+// exifOrientation reads the orientation tag (0x0112) of the first IFD of a TIFF-structured EXIF
+// block; 1, the default, when missing or invalid
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:4]) {
+	case "II*\x00":
+		order = binary.LittleEndian
+	case "MM\x00*":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+
+	ifd := int(order.Uint32(tiff[4:8]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 1
+	}
+	entries := int(order.Uint16(tiff[ifd : ifd+2]))
+	for i := 0; i < entries; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		// A SHORT value is stored in the first bytes of the value field
+		if order.Uint16(tiff[entry:entry+2]) == 0x0112 && order.Uint16(tiff[entry+2:entry+4]) == 3 {
+			if orientation := int(order.Uint16(tiff[entry+8 : entry+10])); orientation >= 1 && orientation <= 8 {
+				return orientation
+			}
+			return 1
+		}
+	}
+	return 1
+}
+
+// OrientImage returns src transformed as described by an EXIF orientation (1-8), so that it
+// displays upright without the tag
+func OrientImage(src image.Image, orientation int) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return src
+	}
+
+	bounds := src.Bounds()
+	source := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(source, source.Bounds(), src, bounds.Min, draw.Src)
+	width, height := bounds.Dx(), bounds.Dy()
+
+	dstWidth, dstHeight := width, height
+	if orientation >= 5 {
+		dstWidth, dstHeight = height, width
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dstWidth, dstHeight))
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2: // mirrored horizontally
+				dx, dy = width-1-x, y
+			case 3: // rotated 180°
+				dx, dy = width-1-x, height-1-y
+			case 4: // mirrored vertically
+				dx, dy = x, height-1-y
+			case 5: // transposed
+				dx, dy = y, x
+			case 6: // needs a 90° clockwise rotation
+				dx, dy = height-1-y, x
+			case 7: // transversed
+				dx, dy = height-1-y, width-1-x
+			case 8: // needs a 90° counter-clockwise rotation
+				dx, dy = y, width-1-x
+			}
+			copy(dst.Pix[dy*dst.Stride+dx*4:dy*dst.Stride+dx*4+4], source.Pix[y*source.Stride+x*4:y*source.Stride+x*4+4])
+		}
+	}
+	return dst
+}
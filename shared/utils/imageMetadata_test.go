@@ -0,0 +1,236 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+// testImage returns a 3x2 image whose pixels all have a different color
+func testImage() *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, 3, 2))
+	for y := 0; y < 2; y++ {
+		for x := 0; x < 3; x++ {
+			img.Set(x, y, pixelColor(x, y))
+		}
+	}
+	return img
+}
+
+func pixelColor(x, y int) color.RGBA {
+	return color.RGBA{R: uint8(40 + 80*x), G: uint8(60 + 120*y), B: 10, A: 255}
+}
+
+// exifBlock returns a little-endian TIFF block holding only an orientation tag
+func exifBlock(orientation int) []byte {
+	tiff := []byte("II*\x00")
+	tiff = binary.LittleEndian.AppendUint32(tiff, 8)
+	tiff = binary.LittleEndian.AppendUint16(tiff, 1)
+	tiff = binary.LittleEndian.AppendUint16(tiff, 0x0112)
+	tiff = binary.LittleEndian.AppendUint16(tiff, 3)
+	tiff = binary.LittleEndian.AppendUint32(tiff, 1)
+	tiff = binary.LittleEndian.AppendUint16(tiff, uint16(orientation))
+	tiff = append(tiff, 0, 0)
+	return binary.LittleEndian.AppendUint32(tiff, 0)
+}
+
+// jpegWithExif encodes the test image with an APP1 EXIF segment and a comment
+func jpegWithExif(t *testing.T, orientation int) []byte {
+	t.Helper()
+	var encoded bytes.Buffer
+	if err := jpeg.Encode(&encoded, testImage(), &jpeg.Options{Quality: 100}); err != nil {
+		t.Fatal(err)
+	}
+	data := encoded.Bytes()
+
+	app1 := append([]byte("Exif\x00\x00"), exifBlock(orientation)...)
+	comment := []byte("shot at home")
+	result := append([]byte{}, data[:2]...)
+	result = append(result, jpegSegment(0xE1, app1)...)
+	result = append(result, jpegSegment(0xFE, comment)...)
+	return append(result, data[2:]...)
+}
+
+func jpegSegment(marker byte, payload []byte) []byte {
+	segment := []byte{0xFF, marker}
+	segment = binary.BigEndian.AppendUint16(segment, uint16(len(payload)+2))
+	return append(segment, payload...)
+}
+
+// pngWithExif encodes the test image with eXIf and tEXt chunks right after IHDR
+func pngWithExif(t *testing.T, orientation int) []byte {
+	t.Helper()
+	var encoded bytes.Buffer
+	if err := png.Encode(&encoded, testImage()); err != nil {
+		t.Fatal(err)
+	}
+	data := encoded.Bytes()
+
+	ihdrEnd := len(pngSignature) + 12 + 13
+	result := append([]byte{}, data[:ihdrEnd]...)
+	result = append(result, pngChunk("eXIf", exifBlock(orientation))...)
+	result = append(result, pngChunk("tEXt", []byte("Author\x00someone"))...)
+	return append(result, data[ihdrEnd:]...)
+}
+
+func pngChunk(chunkType string, payload []byte) []byte {
+	chunk := binary.BigEndian.AppendUint32(nil, uint32(len(payload)))
+	chunk = append(chunk, chunkType...)
+	chunk = append(chunk, payload...)
+	return binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+}
+
+func TestSanitizeImageOrientation(t *testing.T) {
+	// The source pixels expected at the top-left and top-right corners once the image displays
+	// upright, and whether width and height are swapped
+	tests := []struct {
+		orientation int
+		topLeft     image.Point
+		topRight    image.Point
+		swapped     bool
+	}{
+		{1, image.Pt(0, 0), image.Pt(2, 0), false},
+		{2, image.Pt(2, 0), image.Pt(0, 0), false},
+		{3, image.Pt(2, 1), image.Pt(0, 1), false},
+		{4, image.Pt(0, 1), image.Pt(2, 1), false},
+		{5, image.Pt(0, 0), image.Pt(0, 1), true},
+		{6, image.Pt(0, 1), image.Pt(0, 0), true},
+		{7, image.Pt(2, 1), image.Pt(2, 0), true},
+		{8, image.Pt(2, 0), image.Pt(2, 1), true},
+	}
+
+	for _, tt := range tests {
+		wantWidth, wantHeight := 3, 2
+		if tt.swapped {
+			wantWidth, wantHeight = 2, 3
+		}
+
+		t.Run("png", func(t *testing.T) {
+			sanitized, changed, err := SanitizeImage(pngWithExif(t, tt.orientation), 1000)
+			if err != nil || !changed {
+				t.Fatalf("orientation %d: changed=%v err=%v", tt.orientation, changed, err)
+			}
+			for _, chunk := range []string{"eXIf", "tEXt"} {
+				if bytes.Contains(sanitized, []byte(chunk)) {
+					t.Errorf("orientation %d: %s chunk kept", tt.orientation, chunk)
+				}
+			}
+
+			img, err := png.Decode(bytes.NewReader(sanitized))
+			if err != nil {
+				t.Fatalf("orientation %d: %v", tt.orientation, err)
+			}
+			bounds := img.Bounds()
+			if bounds.Dx() != wantWidth || bounds.Dy() != wantHeight {
+				t.Fatalf("orientation %d: got %dx%d, want %dx%d", tt.orientation, bounds.Dx(), bounds.Dy(), wantWidth, wantHeight)
+			}
+			if got := color.RGBAModel.Convert(img.At(0, 0)); got != pixelColor(tt.topLeft.X, tt.topLeft.Y) {
+				t.Errorf("orientation %d: top-left is %v, want source pixel %v", tt.orientation, got, tt.topLeft)
+			}
+			if got := color.RGBAModel.Convert(img.At(wantWidth-1, 0)); got != pixelColor(tt.topRight.X, tt.topRight.Y) {
+				t.Errorf("orientation %d: top-right is %v, want source pixel %v", tt.orientation, got, tt.topRight)
+			}
+		})
+
+		t.Run("jpeg", func(t *testing.T) {
+			sanitized, changed, err := SanitizeImage(jpegWithExif(t, tt.orientation), 1000)
+			if err != nil || !changed {
+				t.Fatalf("orientation %d: changed=%v err=%v", tt.orientation, changed, err)
+			}
+			if bytes.Contains(sanitized, []byte("Exif\x00\x00")) || bytes.Contains(sanitized, []byte("shot at home")) {
+				t.Errorf("orientation %d: metadata kept", tt.orientation)
+			}
+
+			config, err := jpeg.DecodeConfig(bytes.NewReader(sanitized))
+			if err != nil {
+				t.Fatalf("orientation %d: %v", tt.orientation, err)
+			}
+			if config.Width != wantWidth || config.Height != wantHeight {
+				t.Fatalf("orientation %d: got %dx%d, want %dx%d", tt.orientation, config.Width, config.Height, wantWidth, wantHeight)
+			}
+		})
+	}
+}
+
+func TestSanitizeImageMalformed(t *testing.T) {
+	jpegData := jpegWithExif(t, 1)
+	pngData := pngWithExif(t, 1)
+	iend := bytes.LastIndex(pngData, []byte("IEND")) - 4
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"jpeg without end of image", jpegData[:len(jpegData)-2]},
+		{"jpeg truncated in a segment", jpegData[:10]},
+		{"jpeg segment longer than the data", append([]byte{0xFF, 0xD8, 0xFF, 0xE1, 0xFF, 0xF0}, "Exif"...)},
+		{"jpeg garbage between segments", append([]byte{0xFF, 0xD8, 0x00, 0x01}, jpegData[2:]...)},
+		{"png truncated chunk", pngData[:len(pngData)-6]},
+		{"png without IEND", pngData[:iend]},
+		{"png chunk longer than the data", append(append([]byte{}, pngSignature...), 0x7F, 0xFF, 0xFF, 0xFF, 'I', 'H', 'D', 'R', 0, 0, 0, 0)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sanitized, changed, err := SanitizeImage(tt.data, 1000)
+			if !errors.Is(err, ErrMalformedImage) {
+				t.Fatalf("got err=%v, want ErrMalformedImage", err)
+			}
+			if sanitized != nil || changed {
+				t.Errorf("got %d bytes, changed=%v for a malformed image", len(sanitized), changed)
+			}
+		})
+	}
+}
+
+func TestSanitizeImageTrailingData(t *testing.T) {
+	trailer := []byte("PK\x03\x04hidden archive")
+
+	tests := []struct {
+		name string
+		data []byte
+		end  []byte
+	}{
+		{"jpeg", jpegWithExif(t, 1), []byte{0xFF, 0xD9}},
+		{"png", pngWithExif(t, 1), pngChunk("IEND", nil)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clean, _, err := SanitizeImage(tt.data, 1000)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Once the metadata is gone, only the trailing data remains to be dropped
+			sanitized, changed, err := SanitizeImage(append(append([]byte{}, clean...), trailer...), 1000)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !changed {
+				t.Error("trailing data not reported as a change")
+			}
+			if !bytes.Equal(sanitized, clean) {
+				t.Errorf("got %d bytes, want the %d bytes up to the end of image", len(sanitized), len(clean))
+			}
+			if !bytes.HasSuffix(sanitized, tt.end) {
+				t.Error("sanitized image doesn't end with its end marker")
+			}
+
+			if _, changed, _ := SanitizeImage(clean, 1000); changed {
+				t.Error("clean image reported as changed")
+			}
+		})
+	}
+}
+
+func TestSanitizeImageOtherFormats(t *testing.T) {
+	data := []byte("GIF89a not sanitized")
+	sanitized, changed, err := SanitizeImage(data, 1000)
+	if err != nil || changed || !bytes.Equal(sanitized, data) {
+		t.Errorf("got changed=%v err=%v for a GIF", changed, err)
+	}
+}
@@ -0,0 +1,166 @@
+package utils
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// NameTemplateValues fills the placeholders of a name template
+type NameTemplateValues struct {
+	Hash         string
+	OriginalName string
+	Ext          string // with its leading dot, may be empty
+	Time         time.Time
+}
+
+// ErrHashPlaceholderRequired is returned for a name template without {hash} in a bucket that
+// names files by hash
+var ErrHashPlaceholderRequired = errors.New("name_template must contain {hash}")
+
+// nameTemplatePlaceholder matches {name} and {name:N}
+var nameTemplatePlaceholder = regexp.MustCompile(`\{([a-z_]+)(?::([0-9]+))?\}`)
+
+// ValidateNameTemplate checks that a name template only uses known placeholders:
+// {hash}, {hash:N}, {yyyy}, {mm}, {dd}, {uuid}, {ext} and {sanitized_name}
+func ValidateNameTemplate(template string) error {
+	if strings.TrimSpace(template) == "" {
+		return fmt.Errorf("name template cannot be empty")
+	}
+	if strings.Contains(template, "..") || strings.Contains(template, "\\") {
+		return fmt.Errorf("name template cannot contain '..' or '\\'")
+	}
+
+	for _, match := range nameTemplatePlaceholder.FindAllStringSubmatch(template, -1) {
+		name, length := match[1], match[2]
+		switch name {
+		case "hash":
+			if length != "" {
+				if n, err := strconv.Atoi(length); err != nil || n < 1 || n > 64 {
+					return fmt.Errorf("invalid placeholder %s: length must be between 1 and 64", match[0])
+				}
+			}
+		case "yyyy", "mm", "dd", "uuid", "ext", "sanitized_name":
+			if length != "" {
+				return fmt.Errorf("invalid placeholder %s: only {hash} takes a length", match[0])
+			}
+		default:
+			return fmt.Errorf("unknown placeholder %s", match[0])
+		}
+	}
+
+	// Braces left once the placeholders are removed are malformed placeholders
+	if rest := nameTemplatePlaceholder.ReplaceAllString(template, ""); strings.ContainsAny(rest, "{}") {
+		return fmt.Errorf("malformed placeholder in name template %q", template)
+	}
+	return nil
+}
+
+// RenderNameTemplate replaces the placeholders of a template checked by ValidateNameTemplate.
+// {sanitized_name} is SanitizeFileName of the original name, extension included, and dates are
+// in UTC. Slashes create folders; empty segments are dropped.
+func RenderNameTemplate(template string, values NameTemplateValues) string {
+	date := values.Time.UTC()
+	rendered := nameTemplatePlaceholder.ReplaceAllStringFunc(template, func(placeholder string) string {
+		match := nameTemplatePlaceholder.FindStringSubmatch(placeholder)
+		switch match[1] {
+		case "hash":
+			if n, err := strconv.Atoi(match[2]); err == nil && n < len(values.Hash) {
+				return values.Hash[:n]
+			}
+			return values.Hash
+		case "yyyy":
+			return fmt.Sprintf("%04d", date.Year())
+		case "mm":
+			return fmt.Sprintf("%02d", date.Month())
+		case "dd":
+			return fmt.Sprintf("%02d", date.Day())
+		case "uuid":
+			return newUUID()
+		case "ext":
+			return values.Ext
+		case "sanitized_name":
+			return SanitizeFileName(values.OriginalName)
+		}
+		return placeholder
+	})
+
+	segments := strings.Split(rendered, "/")
+	kept := segments[:0]
+	for _, segment := range segments {
+		if segment = strings.TrimSpace(segment); segment != "" {
+			kept = append(kept, segment)
+		}
+	}
+	return strings.Join(kept, "/")
+}
+
+// NamesByHash reports whether names rendered from a template hold the whole hash, so that a name
+// can only reference one content, like hash names
+func NamesByHash(template string) bool {
+	return strings.Contains(template, "{hash}")
+}
+
+// CheckHashNaming checks a name template against a bucket's force_hash rule: buckets naming files
+// by hash only accept templates holding the whole hash
+func CheckHashNaming(template string, forceHash bool) error {
+	if forceHash && !NamesByHash(template) {
+		return ErrHashPlaceholderRequired
+	}
+	return nil
+}
+
+// FileExtension returns the extension, with its leading dot, of a file stored by hash or {ext}:
+// the one of its original name, or else the one of its content type
+func FileExtension(originalName, contentType string) string {
+	if ext := filepath.Ext(originalName); ext != "" {
+		return ext
+	}
+	return ExtensionFromContentType(contentType)
+}
+
+// ExtensionFromContentType returns the usual extension of a content type, .bin when unknown
+func ExtensionFromContentType(contentType string) string {
+	switch contentType {
+	case "image/jpeg", "image/jpg":
+		return ".jpg"
+	case "image/png":
+		return ".png"
+	case "image/gif":
+		return ".gif"
+	case "image/webp":
+		return ".webp"
+	case "image/svg+xml":
+		return ".svg"
+	case "application/pdf":
+		return ".pdf"
+	case "application/zip":
+		return ".zip"
+	case "application/json":
+		return ".json"
+	case "text/plain":
+		return ".txt"
+	case "text/html":
+		return ".html"
+	case "video/mp4":
+		return ".mp4"
+	case "audio/mpeg":
+		return ".mp3"
+	default:
+		return ".bin"
+	}
+}
+
+// newUUID returns a random version 4 UUID
+func newUUID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
@@ -0,0 +1,113 @@
+package utils
+
+import (
+	"errors"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestValidateNameTemplate(t *testing.T) {
+	tests := []struct {
+		template string
+		valid    bool
+	}{
+		{"{hash}{ext}", true},
+		{"{yyyy}/{mm}/{dd}/{hash}{ext}", true},
+		{"{hash:2}/{hash}{ext}", true},
+		{"{hash:64}", true},
+		{"{uuid}-{sanitized_name}", true},
+		{"avatars/{hash}.png", true},
+		{"", false},
+		{"   ", false},
+		{"../{hash}", false},
+		{"a\\{hash}", false},
+		{"{hash:0}", false},
+		{"{hash:65}", false},
+		{"{uuid:8}", false},
+		{"{name}", false},
+		{"{hash", false},
+		{"hash}", false},
+		{"{Hash}", false},
+	}
+	for _, tt := range tests {
+		err := ValidateNameTemplate(tt.template)
+		if (err == nil) != tt.valid {
+			t.Errorf("ValidateNameTemplate(%q) = %v, want valid=%v", tt.template, err, tt.valid)
+		}
+	}
+}
+
+func TestRenderNameTemplate(t *testing.T) {
+	hash := "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	values := NameTemplateValues{
+		Hash:         hash,
+		OriginalName: "My Photo.JPG",
+		Ext:          ".JPG",
+		// Dates are rendered in UTC
+		Time: time.Date(2024, 3, 9, 23, 30, 0, 0, time.FixedZone("UTC-2", -2*60*60)),
+	}
+
+	tests := []struct {
+		template string
+		want     string
+	}{
+		{"{hash}{ext}", hash + ".JPG"},
+		{"{hash:2}/{hash:4}/{hash}{ext}", "01/0123/" + hash + ".JPG"},
+		{"{hash:100}", hash},
+		{"{yyyy}/{mm}/{dd}/{hash:8}", "2024/03/10/01234567"},
+		{"{sanitized_name}", SanitizeFileName("My Photo.JPG")},
+		{"//{hash:4}// /x", "0123/x"},
+		{"static.txt", "static.txt"},
+	}
+	for _, tt := range tests {
+		if got := RenderNameTemplate(tt.template, values); got != tt.want {
+			t.Errorf("RenderNameTemplate(%q) = %q, want %q", tt.template, got, tt.want)
+		}
+	}
+
+	uuid := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	first, second := RenderNameTemplate("{uuid}", values), RenderNameTemplate("{uuid}", values)
+	if !uuid.MatchString(first) || first == second {
+		t.Errorf("{uuid} rendered %q then %q, want distinct version 4 UUIDs", first, second)
+	}
+}
+
+func TestCheckHashNaming(t *testing.T) {
+	tests := []struct {
+		template  string
+		forceHash bool
+		wantErr   bool
+	}{
+		{"{yyyy}/{hash}{ext}", true, false},
+		{"{hash:8}{ext}", true, true},
+		{"{uuid}{ext}", true, true},
+		{"{uuid}{ext}", false, false},
+	}
+	for _, tt := range tests {
+		err := CheckHashNaming(tt.template, tt.forceHash)
+		if tt.wantErr != errors.Is(err, ErrHashPlaceholderRequired) {
+			t.Errorf("CheckHashNaming(%q, %v) = %v, want error=%v", tt.template, tt.forceHash, err, tt.wantErr)
+		}
+	}
+}
+
+func TestFileExtension(t *testing.T) {
+	tests := []struct {
+		originalName string
+		contentType  string
+		want         string
+	}{
+		{"photo.jpeg", "image/png", ".jpeg"},
+		{"archive.tar.gz", "", ".gz"},
+		{"photo", "image/png", ".png"},
+		{"", "image/jpeg", ".jpg"},
+		{"data", "application/x-unknown", ".bin"},
+		{"", "", ".bin"},
+	}
+	for _, tt := range tests {
+		if got := FileExtension(tt.originalName, tt.contentType); got != tt.want {
+			t.Errorf("FileExtension(%q, %q) = %q, want %q", tt.originalName, tt.contentType, got, tt.want)
+		}
+	}
+}